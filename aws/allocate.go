@@ -2,13 +2,20 @@ package aws
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
 	"sort"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
+// ErrENILimitReached is returned when the existing interfaces are full
+// and no new interface may be created
+var ErrENILimitReached = fmt.Errorf("unable to allocate - ENI limit reached and no IPs available on existing interfaces")
+
 // AllocationResult contains a net.IP / Interface pair
 type AllocationResult struct {
 	*net.IP
@@ -18,11 +25,101 @@ type AllocationResult struct {
 // AllocateClient offers IP allocation on interfaces
 type AllocateClient interface {
 	AllocateIPOn(intf Interface) (*AllocationResult, error)
-	AllocateIPFirstAvailableAtIndex(index int) (*AllocationResult, error)
+	AllocateIPFirstAvailableAtIndex(index int, ipTarget int, subnetTags map[string]string) (*AllocationResult, error)
 	AllocateIPFirstAvailable() (*AllocationResult, error)
 	DeallocateIP(ipToRelease *net.IP) error
 }
 
+// AllocateRetry bounds the full jitter backoff of IP assignments
+// throttled by EC2
+type AllocateRetry struct {
+	Retries   int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultAllocateRetry is the retry policy of IP assignments, which
+// plugins may override from their configuration
+var DefaultAllocateRetry = AllocateRetry{
+	Retries:   5,
+	BaseDelay: 100 * time.Millisecond,
+	MaxDelay:  10 * time.Second,
+}
+
+// allocateSleep is replaced by tests
+var allocateSleep = time.Sleep
+
+// backoff returns the full jitter wait before the attempt following
+// the given one
+func (r AllocateRetry) backoff(attempt int) time.Duration {
+	ceiling := math.Min(float64(r.MaxDelay), float64(r.BaseDelay)*math.Pow(2, float64(attempt)))
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// do runs fn until it succeeds, fails with an error other than
+// throttling, or the retries are exhausted. Assignments are not
+// idempotent: a request failing with a server error may still have
+// assigned IPs, which a retry would add to, so only throttled requests,
+// which EC2 rejects before acting on them, are retried.
+func (r AllocateRetry) do(fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || !throttledEC2Error(err) || attempt >= r.Retries {
+			return err
+		}
+		allocateSleep(r.backoff(attempt))
+	}
+}
+
+// IsTransient reports whether err is an EC2 throttling or server error,
+// or a failure to reach the instance metadata service, which a later
+// call may not hit
+func IsTransient(err error) bool {
+	if retryableEC2Error(err) {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "EC2MetadataRequestError", "EC2MetadataError", "RequestError":
+			return true
+		}
+	}
+	return false
+}
+
+// retryableEC2Error reports whether err is an EC2 throttling or server
+// error, which a later attempt may not hit
+func retryableEC2Error(err error) bool {
+	if throttledEC2Error(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "InternalError", "InternalFailure", "ServiceUnavailable", "Unavailable":
+			return true
+		}
+	}
+	return false
+}
+
+// throttledEC2Error reports whether err is an EC2 throttling error
+func throttledEC2Error(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "RequestLimitExceeded", "Throttling", "ThrottlingException":
+			return true
+		}
+	}
+	return false
+}
+
 type allocateClient struct {
 	aws    *awsclient
 	subnet SubnetsClient
@@ -30,6 +127,11 @@ type allocateClient struct {
 
 // AllocateIPOn allocates an IP on a specific interface.
 func (c *allocateClient) AllocateIPOn(intf Interface) (*AllocationResult, error) {
+	// EC2 rejects assignments past the limit with a confusing error
+	if c.aws.ENILimits().FreeSlots(intf) == 0 {
+		return nil, fmt.Errorf("interface %v already holds %d IPs, the limit of the instance type", intf.ID, len(intf.IPv4s))
+	}
+
 	client, err := c.aws.newEC2()
 	if err != nil {
 		return nil, err
@@ -39,7 +141,10 @@ func (c *allocateClient) AllocateIPOn(intf Interface) (*AllocationResult, error)
 	}
 	request.SetSecondaryPrivateIpAddressCount(1)
 
-	_, err = client.AssignPrivateIpAddresses(&request)
+	err = DefaultAllocateRetry.do(func() error {
+		_, err := client.AssignPrivateIpAddresses(&request)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -80,29 +185,47 @@ func (c *allocateClient) AllocateIPOn(intf Interface) (*AllocationResult, error)
 	return nil, fmt.Errorf("Can't locate new IP address from AWS")
 }
 
-// AllocateIPFirstAvailableAtIndex allocates an IP address, skipping any adapter < the given index
-// Returns a reference to the interface the IP was allocated on
-func (c *allocateClient) AllocateIPFirstAvailableAtIndex(index int) (*AllocationResult, error) {
-	interfaces, err := c.aws.GetInterfaces()
-	if err != nil {
-		return nil, err
+// allocationCandidates returns the interfaces at or above index with
+// room for another IP. An ipTarget > 0 lowers the per-interface limit
+// below the instance type maximum.
+func allocationCandidates(interfaces []Interface, index int, maxIPs int, ipTarget int) []Interface {
+	limit := maxIPs
+	if ipTarget > 0 && ipTarget < limit {
+		limit = ipTarget
 	}
-	limits := c.aws.ENILimits()
 
 	var candidates []Interface
 	for _, intf := range interfaces {
 		if intf.Number < index {
 			continue
 		}
-		if len(intf.IPv4s) < limits.IPv4 {
+		if len(intf.IPv4s) < limit {
 			candidates = append(candidates, intf)
 		}
 	}
+	return candidates
+}
+
+// AllocateIPFirstAvailableAtIndex allocates an IP address, skipping any adapter < the given index,
+// any adapter with ipTarget or more IPs when ipTarget > 0 and any adapter in a subnet
+// lacking subnetTags. Returns a reference to the interface the IP was allocated on
+func (c *allocateClient) AllocateIPFirstAvailableAtIndex(index int, ipTarget int, subnetTags map[string]string) (*AllocationResult, error) {
+	interfaces, err := c.aws.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	limits := c.aws.ENILimits()
+
+	candidates := allocationCandidates(interfaces, index, limits.IPv4, ipTarget)
 
 	subnets, err := c.subnet.GetSubnetsForInstance()
 	if err != nil {
 		return nil, err
 	}
+	subnets = FilterSubnetsByTags(subnets, subnetTags)
+	if len(subnets) == 0 && len(subnetTags) > 0 {
+		return nil, subnetTagsError(subnetTags)
+	}
 
 	sort.Sort(SubnetsByAvailableAddressCount(subnets))
 	for _, subnet := range subnets {
@@ -122,7 +245,7 @@ func (c *allocateClient) AllocateIPFirstAvailableAtIndex(index int) (*Allocation
 // AllocateIPFirstAvailable allocates an IP address on the first available IP address
 // Returns a reference to the interface the IP was allocated on
 func (c *allocateClient) AllocateIPFirstAvailable() (*AllocationResult, error) {
-	return c.AllocateIPFirstAvailableAtIndex(0)
+	return c.AllocateIPFirstAvailableAtIndex(0, 0, nil)
 }
 
 // DeallocateIP releases an IP back to AWS
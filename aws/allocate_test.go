@@ -0,0 +1,122 @@
+package aws
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestAllocationCandidatesIPTarget(t *testing.T) {
+	ips := func(n int) []net.IP {
+		var res []net.IP
+		for i := 0; i < n; i++ {
+			res = append(res, net.IPv4(10, 0, 0, byte(10+i)))
+		}
+		return res
+	}
+	interfaces := []Interface{
+		{ID: "eni-1", Number: 1, IPv4s: ips(5)},
+		{ID: "eni-2", Number: 2, IPv4s: ips(1)},
+	}
+
+	cases := []struct {
+		Interfaces []Interface
+		Target     int
+		Expected   []string
+	}{
+		// no target, fill the first interface to the hard limit
+		{Interfaces: interfaces, Target: 0, Expected: []string{"eni-1", "eni-2"}},
+		// the first interface hit the target, spill to the second
+		{Interfaces: interfaces, Target: 5, Expected: []string{"eni-2"}},
+		// every interface is at the target, a new one is needed
+		{Interfaces: interfaces[:1], Target: 5, Expected: nil},
+		// the target can't exceed the instance type limit
+		{Interfaces: interfaces[:1], Target: 50, Expected: []string{"eni-1"}},
+	}
+
+	for i, c := range cases {
+		candidates := allocationCandidates(c.Interfaces, 1, 10, c.Target)
+		var ids []string
+		for _, intf := range candidates {
+			ids = append(ids, intf.ID)
+		}
+		if len(ids) != len(c.Expected) {
+			t.Errorf("%d expected %v, got %v", i, c.Expected, ids)
+			continue
+		}
+		for j := range ids {
+			if ids[j] != c.Expected[j] {
+				t.Errorf("%d expected %v, got %v", i, c.Expected, ids)
+			}
+		}
+	}
+}
+
+func TestAllocateRetry(t *testing.T) {
+	oldSleep := allocateSleep
+	defer func() { allocateSleep = oldSleep }()
+	var slept []time.Duration
+	allocateSleep = func(d time.Duration) { slept = append(slept, d) }
+
+	retry := AllocateRetry{Retries: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: 25 * time.Millisecond}
+	throttled := awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+	unavailable := awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 503, "req-1")
+	invalid := awserr.New("InvalidParameterValue", "bad", nil)
+
+	cases := []struct {
+		Errors   []error
+		Attempts int
+		Err      error
+	}{
+		// throttling then success
+		{Errors: []error{throttled, throttled, nil}, Attempts: 3, Err: nil},
+		// non-retryable errors surface at once
+		{Errors: []error{invalid, nil}, Attempts: 1, Err: invalid},
+		// a failed assignment may have assigned IPs, so it isn't retried
+		{Errors: []error{unavailable, nil}, Attempts: 1, Err: unavailable},
+		// retries are bounded
+		{Errors: []error{throttled, throttled, throttled, throttled, nil}, Attempts: 4, Err: throttled},
+	}
+
+	for i, c := range cases {
+		slept = nil
+		attempts := 0
+		err := retry.do(func() error {
+			err := c.Errors[attempts]
+			attempts++
+			return err
+		})
+		if err != c.Err || attempts != c.Attempts {
+			t.Errorf("Case %d: got %v after %d attempts, expected %v after %d", i, err, attempts, c.Err, c.Attempts)
+		}
+		if len(slept) != attempts-1 {
+			t.Errorf("Case %d: slept %d times for %d attempts", i, len(slept), attempts)
+		}
+		for _, d := range slept {
+			if d < 0 || d >= retry.MaxDelay {
+				t.Errorf("Case %d: backoff %v out of [0, %v)", i, d, retry.MaxDelay)
+			}
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		Err       error
+		Transient bool
+	}{
+		{awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil), true},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 503, "req-1"), true},
+		{awserr.New("EC2MetadataRequestError", "failed to get EC2 instance identity document", nil), true},
+		{awserr.New("InvalidParameterValue", "bad", nil), false},
+		{fmt.Errorf("too many adapters on this instance already"), false},
+	}
+	for i, c := range cases {
+		if got := IsTransient(c.Err); got != c.Transient {
+			t.Errorf("%d expected transient %v for %v", i, c.Transient, c.Err)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package cache
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
@@ -94,24 +96,36 @@ func Store(key string, lifetime time.Duration, data interface{}) State {
 
 	key = path.Join(cachePath(), key)
 
-	file, err := os.OpenFile(key, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	var contents Cacheable
+	contents.Expires.Time = time.Now().Add(lifetime)
+	contents.Contents = data
+	encoded, err := json.Marshal(&contents)
 	if err != nil {
 		return CacheNotAvailable
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	if encoder == nil {
+	// other processes never read a partially written entry
+	if err := lib.WriteFileAtomic(key, encoded, 0600); err != nil {
 		return CacheNotAvailable
 	}
 
-	var contents Cacheable
-	contents.Expires.Time = time.Now().Add(lifetime)
-	contents.Contents = data
-	err = encoder.Encode(&contents)
+	return CacheFound
+}
+
+// Delete removes a key from the cache
+func Delete(key string) {
+	os.Remove(path.Join(cachePath(), key))
+}
+
+// DeletePrefix removes all keys starting with prefix from the cache
+func DeletePrefix(prefix string) {
+	files, err := ioutil.ReadDir(cachePath())
 	if err != nil {
-		return CacheNotAvailable
+		return
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), prefix) {
+			os.Remove(path.Join(cachePath(), file.Name()))
+		}
 	}
-
-	return CacheFound
 }
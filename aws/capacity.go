@@ -0,0 +1,80 @@
+package aws
+
+import (
+	"net"
+)
+
+// Capacity summarizes the Pod IP capacity and usage of the instance
+type Capacity struct {
+	// Capacity is the number of Pod IPs the instance can hold at most
+	Capacity int `json:"capacity"`
+	// Used is the number of IPs bound to Pods
+	Used int `json:"used"`
+	// Free is the number of IPs which can still be handed to Pods
+	Free int `json:"free"`
+	// WarmPool is the number of IPs assigned in EC2 but not bound to a Pod
+	WarmPool int `json:"warmPool"`
+}
+
+// CapacityAtIndex computes the capacity of interfaces at or above
+// index. IPs being allocated are counted as used and IPs being
+// released as free, as they are not bound (or unbound) yet.
+func CapacityAtIndex(index int, allocating []net.IP, releasing []net.IP) (*Capacity, error) {
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	free, err := FindFreeIPsAtIndex(index, false)
+	if err != nil {
+		return nil, err
+	}
+	return capacityAtIndex(interfaces, free, DefaultClient.ENILimits(), index, allocating, releasing), nil
+}
+
+// capacityAtIndex computes the capacity of the interfaces at or above
+// index holding the free IPs
+func capacityAtIndex(interfaces []Interface, free []*AllocationResult, limits ENILimit, index int, allocating []net.IP, releasing []net.IP) *Capacity {
+	adapters := limits.Adapters - index
+	if adapters < 0 {
+		adapters = 0
+	}
+
+	assigned := 0
+	for _, intf := range interfaces {
+		if intf.Number >= index {
+			assigned += len(intf.IPv4s)
+		}
+	}
+
+	warm := len(free)
+	for _, ip := range allocating {
+		if containsAllocation(free, ip) {
+			warm--
+		}
+	}
+	for _, ip := range releasing {
+		if !containsAllocation(free, ip) {
+			warm++
+		}
+	}
+
+	capacity := &Capacity{
+		Capacity: adapters * limits.IPv4,
+		Used:     assigned - warm,
+		WarmPool: warm,
+	}
+	capacity.Free = capacity.Capacity - capacity.Used
+	if capacity.Free < 0 {
+		capacity.Free = 0
+	}
+	return capacity
+}
+
+func containsAllocation(allocs []*AllocationResult, ip net.IP) bool {
+	for _, alloc := range allocs {
+		if alloc.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package aws
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func TestCapacityConcurrentAddDel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	registry := &Registry{path: dir}
+	contents := defaultRegistry()
+	if err := registry.save(&contents); err != nil {
+		t.Fatalf("Failed to create the registry: %v", err)
+	}
+
+	// the primary IP of eni-1 and ten Pod IPs
+	intf := Interface{ID: "eni-1", Number: 1, IPv4s: []net.IP{net.ParseIP("10.0.1.1")}}
+	var podIPs []net.IP
+	for i := 0; i < 10; i++ {
+		ip := net.ParseIP(fmt.Sprintf("10.0.1.%d", 10+i))
+		podIPs = append(podIPs, ip)
+		intf.IPv4s = append(intf.IPv4s, ip)
+	}
+	interfaces := []Interface{{ID: "eni-0", Number: 0, IPv4s: []net.IP{net.ParseIP("10.0.0.1")}}, intf}
+
+	// every Pod is added, and every other one deleted right away
+	var wg sync.WaitGroup
+	for i, ip := range podIPs {
+		wg.Add(1)
+		go func(i int, ip net.IP) {
+			defer wg.Done()
+			containerID := fmt.Sprintf("pod-%d", i)
+			if err := registry.AssignIP(ip, containerID); err != nil {
+				t.Errorf("Failed to assign %v: %v", ip, err)
+				return
+			}
+			if i%2 == 1 {
+				if _, err := registry.ReleaseIPs(containerID); err != nil {
+					t.Errorf("Failed to release %v: %v", ip, err)
+				}
+			}
+		}(i, ip)
+	}
+	wg.Wait()
+
+	assigned, err := registry.AssignedIPs()
+	if err != nil {
+		t.Fatalf("Failed to list assigned IPs: %v", err)
+	}
+	if len(assigned) != 5 {
+		t.Fatalf("Expected 5 assigned IPs, got %v", assigned)
+	}
+	tracked, err := registry.List()
+	if err != nil {
+		t.Fatalf("Failed to list tracked IPs: %v", err)
+	}
+	if len(tracked) != 5 {
+		t.Fatalf("Expected the 5 released IPs to be tracked, got %v", tracked)
+	}
+
+	var bound []nl.BoundIP
+	for ipString := range assigned {
+		bound = append(bound, nl.BoundIP{IPNet: &net.IPNet{IP: net.ParseIP(ipString)}})
+	}
+	free := freeIPsAtIndex(interfaces, bound, 1)
+	capacity := capacityAtIndex(interfaces, free, ENILimit{Adapters: 3, IPv4: 15}, 1, nil, nil)
+	// the primary IP of eni-1 takes a slot as well
+	expected := Capacity{Capacity: 30, Used: 6, Free: 24, WarmPool: 5}
+	if *capacity != expected {
+		t.Errorf("Expected capacity %+v, got %+v", expected, *capacity)
+	}
+}
@@ -1,6 +1,10 @@
 package aws
 
 import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -11,6 +15,10 @@ import (
 	"time"
 )
 
+// metadataEndpointEnv overrides the base URL of the instance metadata
+// service, e.g. for tests or proxies
+const metadataEndpointEnv = "AWS_EC2_METADATA_ENDPOINT"
+
 type awsclient struct {
 	sess     *session.Session
 	metaData *ec2metadata.EC2Metadata
@@ -20,6 +28,11 @@ type awsclient struct {
 
 	ec2Client ec2iface.EC2API
 	onceEc2   sync.Once
+
+	// ec2Endpoint and region override the EC2 API endpoint and the
+	// region of the instance identity document
+	ec2Endpoint string
+	region      string
 }
 
 type combinedClient struct {
@@ -64,7 +77,48 @@ func init() {
 
 	DefaultClient = defaultClient
 	defaultClient.sess = session.Must(session.NewSession())
-	defaultClient.metaData = ec2metadata.New(defaultClient.sess)
+	defaultClient.metaData = newMetadata(defaultClient.sess)
+}
+
+func newMetadata(sess *session.Session) *ec2metadata.EC2Metadata {
+	endpoint := os.Getenv(metadataEndpointEnv)
+	if endpoint == "" {
+		return ec2metadata.New(sess)
+	}
+	if err := ValidateEndpoint(endpoint); err != nil {
+		log.Printf("Ignoring %v: %v", metadataEndpointEnv, err)
+		return ec2metadata.New(sess)
+	}
+	// the client replaces the path of the endpoint with that of each
+	// request, including the /latest prefix
+	return ec2metadata.New(sess, aws.NewConfig().WithEndpoint(endpoint))
+}
+
+// ValidateEndpoint checks endpoint is an absolute http(s) URL
+func ValidateEndpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q: expected an http or https URL with a host", endpoint)
+	}
+	return nil
+}
+
+// SetEC2Endpoint overrides the EC2 API endpoint, e.g. a VPC interface
+// endpoint, and the region, for partitions such as GovCloud or China
+// where they are not resolved from the instance region. Empty values
+// keep the defaults. It must be called before the first EC2 request.
+func SetEC2Endpoint(endpoint string, region string) error {
+	if endpoint != "" {
+		if err := ValidateEndpoint(endpoint); err != nil {
+			return err
+		}
+	}
+	defaultClient.awsclient.ec2Endpoint = endpoint
+	defaultClient.awsclient.region = region
+	return nil
 }
 
 func (c *awsclient) getIDDoc() (*ec2metadata.EC2InstanceIdentityDocument, error) {
@@ -95,8 +149,20 @@ func (c *awsclient) newEC2() (ec2iface.EC2API, error) {
 			return
 		}
 		if c.ec2Client == nil {
+			region := c.region
+			if region == "" {
+				region = id.Region
+			}
+			if region == "" {
+				err = fmt.Errorf("the instance metadata has no region, set the region explicitly")
+				return
+			}
+			config := aws.NewConfig().WithRegion(region)
+			if c.ec2Endpoint != "" {
+				config = config.WithEndpoint(c.ec2Endpoint)
+			}
 			// Use the sess object already defined
-			c.ec2Client = ec2.New(c.sess, aws.NewConfig().WithRegion(id.Region))
+			c.ec2Client = ec2.New(c.sess, config)
 		}
 	})
 	return c.ec2Client, err
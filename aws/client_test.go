@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 func TestClientCreate(t *testing.T) {
@@ -30,3 +31,39 @@ func TestClientCreate(t *testing.T) {
 	}
 
 }
+
+func TestClientEndpointOverride(t *testing.T) {
+	c := &awsclient{
+		sess:        defaultClient.sess,
+		idDoc:       &ec2metadata.EC2InstanceIdentityDocument{},
+		ec2Endpoint: "https://vpce-1234.ec2.us-gov-west-1.vpce.amazonaws.com",
+		region:      "us-gov-west-1",
+	}
+	client, err := c.newEC2()
+	if err != nil {
+		t.Fatalf("Failed to create a client: %v", err)
+	}
+	svc := client.(*ec2.EC2)
+	if svc.Endpoint != c.ec2Endpoint || *svc.Config.Region != "us-gov-west-1" {
+		t.Errorf("Overrides were not applied: %v %v", svc.Endpoint, *svc.Config.Region)
+	}
+
+	// no region in the metadata and no override
+	c = &awsclient{sess: defaultClient.sess, idDoc: &ec2metadata.EC2InstanceIdentityDocument{}}
+	if _, err := c.newEC2(); err == nil {
+		t.Errorf("Client created without a region")
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"https://ec2.cn-north-1.amazonaws.com.cn", "http://169.254.169.254"} {
+		if err := ValidateEndpoint(endpoint); err != nil {
+			t.Errorf("Valid endpoint %q rejected: %v", endpoint, err)
+		}
+	}
+	for _, endpoint := range []string{"ec2.us-east-1.amazonaws.com", "ftp://ec2", "https://", "http://[::1"} {
+		if err := ValidateEndpoint(endpoint); err == nil {
+			t.Errorf("Invalid endpoint %q accepted", endpoint)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package aws
 
 import (
+	"fmt"
+	"net"
+	"time"
+
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
@@ -8,46 +12,34 @@ import (
 // from the EC2 metadata service and the currently used addresses
 // within netlink. This is inherently somewhat racey - for example
 // newly provisioned addresses may not show up immediately in metadata
-// and are subject to a few seconds of delay.
+// and are subject to a few seconds of delay. The primary IP of every
+// interface is never considered free.
 func FindFreeIPsAtIndex(index int, updateRegistry bool) ([]*AllocationResult, error) {
-	freeIps := []*AllocationResult{}
 	registry := &Registry{}
 
 	interfaces, err := DefaultClient.GetInterfaces()
 	if err != nil {
 		return nil, err
 	}
-	assigned, err := nl.GetIPs()
+	assigned, err := usedIPs(registry)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, intf := range interfaces {
-		if intf.Number < index {
-			continue
-		}
-		for _, intfIP := range intf.IPv4s {
-			found := false
-			for _, assignedIP := range assigned {
-				if assignedIP.IPNet.IP.Equal(intfIP) {
-					found = true
-					break
-				}
-			}
-			if !found {
-				intfIPCopy := intfIP
-				// No match, record as free
-				freeIps = append(freeIps, &AllocationResult{
-					&intfIPCopy,
-					intf,
-				})
+	freeIps := freeIPsAtIndex(interfaces, assigned, index)
+
+	if updateRegistry {
+		for _, intf := range interfaces {
+			if intf.Number < index {
+				continue
 			}
-			if updateRegistry {
-				if exists, err := registry.HasIP(intfIP); err == nil && !exists && !found {
+			for _, intfIP := range intf.IPv4s {
+				free := containsAllocation(freeIps, intfIP)
+				if exists, err := registry.HasIP(intfIP); err == nil && !exists && free {
 					// track IP as free if it hasn't been registered before
 					registry.TrackIP(intfIP)
-				} else if found {
-					// mark IP as in use
+				} else if !free {
+					// mark IP as in use or reserved
 					registry.ForgetIP(intfIP)
 				}
 			}
@@ -56,3 +48,131 @@ func FindFreeIPsAtIndex(index int, updateRegistry bool) ([]*AllocationResult, er
 
 	return freeIps, nil
 }
+
+// usedIPs returns the IPs bound on the host along with those the
+// registry records as assigned to a container
+func usedIPs(registry *Registry) ([]nl.BoundIP, error) {
+	used, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	// IPs handed to a container are in use before they are bound
+	if pending, err := registry.AssignedIPs(); err == nil {
+		for ipString := range pending {
+			if ip := net.ParseIP(ipString); ip != nil {
+				used = append(used, nl.BoundIP{IPNet: &net.IPNet{IP: ip}})
+			}
+		}
+	}
+	return used, nil
+}
+
+// unboundIPs returns the IPs of all interfaces which are not bound on
+// the host, without consulting the registry
+func unboundIPs() ([]*AllocationResult, error) {
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	assigned, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+	return freeIPsAtIndex(interfaces, assigned, 0), nil
+}
+
+// freeIPsAtIndex returns the IPs of interfaces at or above index which
+// are neither bound to a local interface nor the primary IP of their
+// interface
+func freeIPsAtIndex(interfaces []Interface, assigned []nl.BoundIP, index int) []*AllocationResult {
+	freeIps := []*AllocationResult{}
+	for _, intf := range interfaces {
+		if intf.Number < index {
+			continue
+		}
+		primary := intf.PrimaryIP()
+		for _, intfIP := range intf.IPv4s {
+			if intfIP.Equal(primary) || isBound(assigned, intfIP) {
+				continue
+			}
+			intfIPCopy := intfIP
+			// No match, record as free
+			freeIps = append(freeIps, &AllocationResult{
+				&intfIPCopy,
+				intf,
+			})
+		}
+	}
+	return freeIps
+}
+
+func isBound(assigned []nl.BoundIP, ip net.IP) bool {
+	for _, assignedIP := range assigned {
+		if assignedIP.IPNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LeakedIPs returns the IPs of interfaces at or above index which have
+// been neither bound in any namespace nor assigned to a container for
+// at least grace, e.g. those of Pods that died with their node before
+// DEL ran. IPs seen unbound for the first time start their grace
+// period now.
+func LeakedIPs(index int, grace time.Duration) ([]net.IP, error) {
+	free, err := FindFreeIPsAtIndex(index, true)
+	if err != nil {
+		return nil, err
+	}
+	tracked, err := (&Registry{}).TrackedBefore(time.Now().Add(-grace))
+	if err != nil {
+		return nil, err
+	}
+	return leakedIPs(free, tracked), nil
+}
+
+// leakedIPs returns the free IPs tracked for long enough
+func leakedIPs(free []*AllocationResult, tracked []net.IP) []net.IP {
+	var leaked []net.IP
+	for _, ip := range tracked {
+		if containsAllocation(free, ip) {
+			leaked = append(leaked, ip)
+		}
+	}
+	return leaked
+}
+
+// CheckIPCapacity reports whether EC2 can be reached and an IP can be
+// handed out at or above index, either from the free IPs, an interface
+// with spare capacity, or a new interface
+func CheckIPCapacity(index int) error {
+	if !DefaultClient.Available() {
+		return fmt.Errorf("EC2 metadata not available")
+	}
+
+	free, err := FindFreeIPsAtIndex(index, false)
+	if err != nil {
+		return err
+	}
+	if len(free) > 0 {
+		return nil
+	}
+
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return err
+	}
+	limits := DefaultClient.ENILimits()
+	for _, intf := range interfaces {
+		if intf.Number >= index && len(intf.IPv4s) < limits.IPv4 {
+			return nil
+		}
+	}
+	if len(interfaces) < limits.Adapters {
+		return nil
+	}
+
+	return fmt.Errorf("no IP capacity available at interface index %d", index)
+}
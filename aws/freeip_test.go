@@ -0,0 +1,48 @@
+package aws
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func TestFreeIPsAtIndexExcludesPrimaryIPs(t *testing.T) {
+	interfaces := []Interface{
+		{Number: 0, IPv4s: []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11")}},
+		// the primary IP of a secondary ENI is not bound on the host
+		{Number: 1, IPv4s: []net.IP{net.ParseIP("10.0.1.10"), net.ParseIP("10.0.1.11"), net.ParseIP("10.0.1.12")}},
+	}
+	assigned := []nl.BoundIP{
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.10"), Mask: net.CIDRMask(24, 32)}},
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.0.1.12"), Mask: net.CIDRMask(32, 32)}},
+	}
+
+	free := freeIPsAtIndex(interfaces, assigned, 0)
+	if len(free) != 2 || !free[0].IP.Equal(net.ParseIP("10.0.0.11")) || !free[1].IP.Equal(net.ParseIP("10.0.1.11")) {
+		t.Errorf("Unexpected free IPs %v", free)
+	}
+	for _, alloc := range free {
+		if alloc.IP.Equal(net.ParseIP("10.0.1.10")) {
+			t.Errorf("Primary IP %v was offered as free", alloc.IP)
+		}
+	}
+
+	if free := freeIPsAtIndex(interfaces, assigned, 1); len(free) != 1 {
+		t.Errorf("Interfaces below the index were considered: %v", free)
+	}
+}
+
+func TestLeakedIPs(t *testing.T) {
+	free := freeIPsAtIndex([]Interface{{ID: "eni-1", Number: 1, IPv4s: []net.IP{
+		net.ParseIP("10.0.1.10"), net.ParseIP("10.0.1.11"), net.ParseIP("10.0.1.12"),
+	}}}, nil, 1)
+
+	// 10.0.1.11 is free but tracked too recently, 10.0.1.20 was tracked
+	// long ago but is bound again
+	tracked := []net.IP{net.ParseIP("10.0.1.12"), net.ParseIP("10.0.1.20")}
+	leaked := leakedIPs(free, tracked)
+	if len(leaked) != 1 || !leaked[0].Equal(net.ParseIP("10.0.1.12")) {
+		t.Errorf("Unexpected leaked IPs %v", leaked)
+	}
+}
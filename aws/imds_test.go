@@ -0,0 +1,86 @@
+package aws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newTestMetadata serves instance-id, requiring a session token unless
+// the token endpoint is disabled, to the client newMetadata creates
+func newTestMetadata(t *testing.T, tokens bool, puts *int32) (*ec2metadata.EC2Metadata, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/latest/api/token":
+			atomic.AddInt32(puts, 1)
+			if !tokens || r.Method != "PUT" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("X-aws-ec2-metadata-token-ttl-seconds", "600")
+			w.Write([]byte("token"))
+		case r.URL.Path == "/latest/meta-data/instance-id":
+			if tokens && r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("i-1234"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	old, set := os.LookupEnv(metadataEndpointEnv)
+	os.Setenv(metadataEndpointEnv, server.URL)
+	md := newMetadata(session.Must(session.NewSession()))
+	if set {
+		os.Setenv(metadataEndpointEnv, old)
+	} else {
+		os.Unsetenv(metadataEndpointEnv)
+	}
+	if md.Endpoint != server.URL {
+		t.Fatalf("Unexpected metadata endpoint %q", md.Endpoint)
+	}
+	return md, server.Close
+}
+
+func TestIMDSv2Token(t *testing.T) {
+	var puts int32
+	md, done := newTestMetadata(t, true, &puts)
+	defer done()
+
+	for i := 0; i < 3; i++ {
+		id, err := md.GetMetadata("instance-id")
+		if err != nil || id != "i-1234" {
+			t.Fatalf("Failed to get metadata with a token: %v %v", id, err)
+		}
+	}
+	if puts != 1 {
+		t.Errorf("Token was requested %d times, not cached", puts)
+	}
+}
+
+func TestIMDSv1Fallback(t *testing.T) {
+	var puts int32
+	md, done := newTestMetadata(t, false, &puts)
+	defer done()
+
+	for i := 0; i < 3; i++ {
+		id, err := md.GetMetadata("instance-id")
+		if err != nil || id != "i-1234" {
+			t.Fatalf("Failed to fall back to IMDSv1: %v %v", id, err)
+		}
+	}
+	if puts != 1 {
+		t.Errorf("Token was requested %d times once IMDSv1 was chosen", puts)
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path"
 	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
@@ -21,10 +24,24 @@ var (
 	interfaceDetachAttempts       = 20 // interfaceDetachAttempts * interfaceDetachWaitTime = total wait time
 )
 
+// PrimaryIPLowestFree may be passed as a primary IP to select the
+// lowest unused address in the target subnet as the primary private
+// IP of a new interface.
+const PrimaryIPLowestFree = "lowest-free-in-subnet"
+
+// attachLockFile serializes ENI attachments on the host. EC2 rejects an
+// attachment while another is in progress and concurrent callers would
+// pick the same device index.
+const attachLockFile = "attach.lock"
+
+// subnetReservedAddrs is the count of addresses AWS reserves at the
+// start of every subnet (network, router, DNS and future use)
+const subnetReservedAddrs = 4
+
 // InterfaceClient provides methods for allocating and deallocating interfaces
 type InterfaceClient interface {
-	NewInterfaceOnSubnetAtIndex(index int, secGrps []string, subnet Subnet) (*Interface, error)
-	NewInterface(secGrps []string, requiredTags map[string]string) (*Interface, error)
+	NewInterfaceOnSubnetAtIndex(index int, secGrps []string, subnet Subnet, primaryIP string) (*Interface, error)
+	NewInterface(secGrps []string, requiredTags map[string]string, primaryIP string) (*Interface, error)
 	RemoveInterface(interfaceIDs []string) error
 }
 
@@ -33,8 +50,10 @@ type interfaceClient struct {
 	subnet SubnetsClient
 }
 
-// NewInterfaceOnSubnetAtIndex creates a new Interface with a specified subnet and index
-func (c *interfaceClient) NewInterfaceOnSubnetAtIndex(index int, secGrps []string, subnet Subnet) (*Interface, error) {
+// NewInterfaceOnSubnetAtIndex creates a new Interface with a specified subnet and index.
+// An optional primaryIP (or PrimaryIPLowestFree) selects the primary private IP of the
+// interface, otherwise EC2 assigns one.
+func (c *interfaceClient) NewInterfaceOnSubnetAtIndex(index int, secGrps []string, subnet Subnet, primaryIP string) (*Interface, error) {
 	client, err := c.aws.newEC2()
 	if err != nil {
 		return nil, err
@@ -56,6 +75,14 @@ func (c *interfaceClient) NewInterfaceOnSubnetAtIndex(index int, secGrps []strin
 	createReq.SetGroups(secGrpsPtr)
 	createReq.SetSubnetId(subnet.ID)
 
+	privateIP, err := resolvePrimaryIP(client, subnet, primaryIP)
+	if err != nil {
+		return nil, err
+	}
+	if privateIP != "" {
+		createReq.SetPrivateIpAddress(privateIP)
+	}
+
 	resp, err := client.CreateNetworkInterface(createReq)
 	if err != nil {
 		return nil, err
@@ -80,6 +107,10 @@ func (c *interfaceClient) NewInterfaceOnSubnetAtIndex(index int, secGrps []strin
 		return nil, err
 	}
 
+	if err := waitUntilInterfaceAttaches(client, *resp.NetworkInterface.NetworkInterfaceId); err != nil {
+		return nil, err
+	}
+
 	// We have an attachment ID from the last API, which lets us mark the
 	// interface as delete on termination
 	changes := &ec2.NetworkInterfaceAttachmentChanges{}
@@ -98,6 +129,8 @@ func (c *interfaceClient) NewInterfaceOnSubnetAtIndex(index int, secGrps []strin
 	}
 
 	for start := time.Now(); time.Since(start) <= interfaceSettleTime; time.Sleep(interfacePollWaitTime) {
+		// the attachment changes the interfaces listed in metadata
+		invalidateMetadataCache()
 		newInterfaces, err := c.aws.GetInterfaces()
 		if err != nil {
 			// The metadata server is inconsistent - for example, not
@@ -123,6 +156,146 @@ func (c *interfaceClient) NewInterfaceOnSubnetAtIndex(index int, secGrps []strin
 	return nil, fmt.Errorf("interface did not attach in time")
 }
 
+// waitUntilInterfaceAttaches polls the interface until EC2 reports its
+// attachment as attached, for at most interfaceSettleTime
+func waitUntilInterfaceAttaches(client ec2iface.EC2API, interfaceID string) error {
+	req := &ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: aws.StringSlice([]string{interfaceID}),
+	}
+	for start := time.Now(); ; time.Sleep(interfacePollWaitTime) {
+		resp, err := client.DescribeNetworkInterfaces(req)
+		if err == nil && len(resp.NetworkInterfaces) > 0 {
+			attachment := resp.NetworkInterfaces[0].Attachment
+			if attachment != nil && aws.StringValue(attachment.Status) == ec2.AttachmentStatusAttached {
+				return nil
+			}
+		}
+		if time.Since(start) > interfaceSettleTime {
+			return fmt.Errorf("interface %v did not reach the attached state in time", interfaceID)
+		}
+	}
+}
+
+// freeDeviceIndex returns the lowest device index not used by any of
+// the attached interfaces
+func freeDeviceIndex(attached []*ec2.NetworkInterface) int {
+	used := make(map[int64]bool)
+	for _, intf := range attached {
+		if intf.Attachment != nil && intf.Attachment.DeviceIndex != nil {
+			used[*intf.Attachment.DeviceIndex] = true
+		}
+	}
+	index := int64(0)
+	for used[index] {
+		index++
+	}
+	return int(index)
+}
+
+// nextDeviceIndex asks EC2 for the interfaces attached to the instance
+// rather than counting them, so the gap left by a detached interface is
+// reused instead of colliding with a higher index
+func nextDeviceIndex(client ec2iface.EC2API, instanceID string) (int, error) {
+	resp, err := client.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{newEc2Filter("attachment.instance-id", instanceID)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return freeDeviceIndex(resp.NetworkInterfaces), nil
+}
+
+// attachLockRun runs a function holding the host wide attach lock
+func attachLockRun(run func() error) error {
+	dir := registryPath()
+	if err := os.MkdirAll(dir, os.ModeDir|0700); err != nil {
+		return err
+	}
+	return lib.LockfileRunAt(path.Join(dir, attachLockFile), run)
+}
+
+// resolvePrimaryIP validates (or selects, for PrimaryIPLowestFree) the
+// primary private IP of a new interface on the given subnet. An empty
+// string is returned when EC2 should pick the address.
+func resolvePrimaryIP(client ec2iface.EC2API, subnet Subnet, primaryIP string) (string, error) {
+	if primaryIP == "" {
+		return "", nil
+	}
+
+	_, cidr, err := net.ParseCIDR(subnet.Cidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid CIDR %q for subnet %v: %v", subnet.Cidr, subnet.ID, err)
+	}
+
+	used, err := usedIPsInSubnet(client, subnet.ID)
+	if err != nil {
+		return "", err
+	}
+
+	if primaryIP == PrimaryIPLowestFree {
+		ip := lowestFreeIP(cidr, used)
+		if ip == nil {
+			return "", fmt.Errorf("no free addresses in subnet %v to use as a primary IP", subnet.ID)
+		}
+		return ip.String(), nil
+	}
+
+	ip := net.ParseIP(primaryIP).To4()
+	if ip == nil {
+		return "", fmt.Errorf("invalid primary IP %q", primaryIP)
+	}
+	if !cidr.Contains(ip) {
+		return "", fmt.Errorf("primary IP %v is not within subnet %v (%v)", ip, subnet.ID, cidr)
+	}
+	if used[ip.String()] {
+		return "", fmt.Errorf("primary IP %v is already in use in subnet %v", ip, subnet.ID)
+	}
+	return ip.String(), nil
+}
+
+// usedIPsInSubnet returns all private IPs assigned to any interface in a subnet
+func usedIPsInSubnet(client ec2iface.EC2API, subnetID string) (map[string]bool, error) {
+	req := &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{newEc2Filter("subnet-id", subnetID)},
+	}
+	resp, err := client.DescribeNetworkInterfaces(req)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]bool)
+	for _, intf := range resp.NetworkInterfaces {
+		for _, addr := range intf.PrivateIpAddresses {
+			if addr.PrivateIpAddress != nil {
+				used[*addr.PrivateIpAddress] = true
+			}
+		}
+	}
+	return used, nil
+}
+
+// lowestFreeIP returns the lowest address in cidr which is neither
+// reserved by AWS nor present in used. Returns nil if the subnet is full.
+func lowestFreeIP(cidr *net.IPNet, used map[string]bool) net.IP {
+	base := cidr.IP.To4()
+	if base == nil {
+		return nil
+	}
+	ones, bits := cidr.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	start := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+
+	// skip the reserved addresses at the start and the broadcast address
+	for offset := uint32(subnetReservedAddrs); offset+1 < size; offset++ {
+		n := start + offset
+		ip := net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).To4()
+		if !used[ip.String()] {
+			return ip
+		}
+	}
+	return nil
+}
+
 // Fire and forget method to configure an interface
 func configureInterface(intf *Interface) {
 	// Found a match, going to try to make sure the interface is up
@@ -141,7 +314,7 @@ func configureInterface(intf *Interface) {
 }
 
 // NewInterface creates an Interface based on specified parameters
-func (c *interfaceClient) NewInterface(secGrps []string, requiredTags map[string]string) (*Interface, error) {
+func (c *interfaceClient) NewInterface(secGrps []string, requiredTags map[string]string, primaryIP string) (*Interface, error) {
 	subnets, err := c.subnet.GetSubnetsForInstance()
 	if err != nil {
 		return nil, err
@@ -157,20 +330,30 @@ func (c *interfaceClient) NewInterface(secGrps []string, requiredTags map[string
 		return nil, fmt.Errorf("too many adapters on this instance already")
 	}
 
-	var availableSubnets []Subnet
-
-OUTER:
-	for _, newSubnet := range subnets {
-		// Match incoming tags
-		for tagKey, tagValue := range requiredTags {
-			value, ok := newSubnet.Tags[tagKey]
-			// Skip untagged subnets and ones not matching
-			// the required tag
-			if !ok || (ok && value != tagValue) {
-				continue OUTER
+	// new ENIs follow the security groups of the primary ENI by default
+	if len(secGrps) == 0 {
+		for _, intf := range existingInterfaces {
+			if intf.Number == 0 {
+				secGrps = intf.SecurityGroupIds
 			}
 		}
-		availableSubnets = append(availableSubnets, newSubnet)
+		if len(secGrps) == 0 {
+			return nil, fmt.Errorf("no secGroupIds are configured and the security groups of the primary ENI are unknown")
+		}
+	}
+	if len(existingInterfaces) > 0 {
+		client, err := c.aws.newEC2()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSecurityGroupsInVPC(client, secGrps, existingInterfaces[0].VpcID); err != nil {
+			return nil, err
+		}
+	}
+
+	availableSubnets := FilterSubnetsByTags(subnets, requiredTags)
+	if len(availableSubnets) == 0 && len(requiredTags) > 0 {
+		return nil, subnetTagsError(requiredTags)
 	}
 
 	// assign new interfaces to subnets with most available addresses
@@ -180,7 +363,27 @@ OUTER:
 		return nil, fmt.Errorf("No subnets are available which haven't already been used")
 	}
 
-	return c.NewInterfaceOnSubnetAtIndex(len(existingInterfaces), secGrps, availableSubnets[0])
+	idDoc, err := c.aws.getIDDoc()
+	if err != nil {
+		return nil, err
+	}
+	client, err := c.aws.newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	// only one attachment proceeds at a time, and the device index is
+	// chosen under the lock
+	var newIf *Interface
+	err = attachLockRun(func() error {
+		index, err := nextDeviceIndex(client, idDoc.InstanceID)
+		if err != nil {
+			return err
+		}
+		newIf, err = c.NewInterfaceOnSubnetAtIndex(index, secGrps, availableSubnets[0], primaryIP)
+		return err
+	})
+	return newIf, err
 }
 
 // RemoveInterface gracefull shutdown and removal of interfaces
@@ -218,6 +421,7 @@ func (c *awsclient) RemoveInterface(interfaceIDs []string) error {
 		if err := c.waitUtilInterfaceDetaches(interfaceID); err != nil {
 			return err
 		}
+		invalidateMetadataCache()
 
 		// Even after the interface detaches, you cannot delete right away
 		time.Sleep(interfacePostDetachSettleTime)
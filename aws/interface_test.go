@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
@@ -14,6 +15,9 @@ type ec2ClientMock struct {
 	NetworkDescribeResponse ec2.DescribeNetworkInterfacesOutput
 	NetworkDeleteResponse   ec2.DeleteNetworkInterfaceOutput
 	NetworkDetachResponse   ec2.DetachNetworkInterfaceOutput
+	NetworkCreateResponse   ec2.CreateNetworkInterfaceOutput
+	NetworkAttachResponse   ec2.AttachNetworkInterfaceOutput
+	NetworkCreateRequest    *ec2.CreateNetworkInterfaceInput
 }
 
 func (e *ec2ClientMock) DescribeNetworkInterfaces(in *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
@@ -28,10 +32,129 @@ func (e *ec2ClientMock) DetachNetworkInterface(in *ec2.DetachNetworkInterfaceInp
 	return &e.NetworkDetachResponse, nil
 }
 
-// func TestNewInterfaceOnSubnetAtIndex(t *testing.T) {}
+func (e *ec2ClientMock) CreateNetworkInterface(in *ec2.CreateNetworkInterfaceInput) (*ec2.CreateNetworkInterfaceOutput, error) {
+	e.NetworkCreateRequest = in
+	return &e.NetworkCreateResponse, nil
+}
+
+func (e *ec2ClientMock) AttachNetworkInterface(in *ec2.AttachNetworkInterfaceInput) (*ec2.AttachNetworkInterfaceOutput, error) {
+	return &e.NetworkAttachResponse, nil
+}
+
+func (e *ec2ClientMock) ModifyNetworkInterfaceAttribute(in *ec2.ModifyNetworkInterfaceAttributeInput) (*ec2.ModifyNetworkInterfaceAttributeOutput, error) {
+	return &ec2.ModifyNetworkInterfaceAttributeOutput{}, nil
+}
+
+func TestNewInterfaceOnSubnetAtIndexPrimaryIP(t *testing.T) {
+	oldIDDoc := defaultClient.idDoc
+	oldSettleTime := interfaceSettleTime
+	defer func() {
+		defaultClient.idDoc = oldIDDoc
+		interfaceSettleTime = oldSettleTime
+	}()
+	defaultClient.idDoc = &ec2metadata.EC2InstanceIdentityDocument{
+		InstanceID:       "i-lyft",
+		Region:           "us-east-1",
+		AvailabilityZone: "us-east-1a",
+	}
+	// Don't wait for the interface to show up in metadata
+	interfaceSettleTime = 0
+
+	subnet := Subnet{ID: "subnet-lyft", Cidr: "10.0.0.0/28"}
+	inUse := ec2.DescribeNetworkInterfacesOutput{
+		NetworkInterfaces: []*ec2.NetworkInterface{
+			{
+				PrivateIpAddresses: []*ec2.NetworkInterfacePrivateIpAddress{
+					{PrivateIpAddress: aws.String("10.0.0.4")},
+					{PrivateIpAddress: aws.String("10.0.0.6")},
+				},
+				Attachment: &ec2.NetworkInterfaceAttachment{
+					Status: aws.String(ec2.AttachmentStatusAttached),
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		PrimaryIP string
+		Expected  string
+		Error     string
+	}{
+		{PrimaryIP: "10.0.0.5", Expected: "10.0.0.5"},
+		{PrimaryIP: PrimaryIPLowestFree, Expected: "10.0.0.5"},
+		{PrimaryIP: "10.0.0.6", Error: "primary IP 10.0.0.6 is already in use in subnet subnet-lyft"},
+		{PrimaryIP: "10.0.1.5", Error: "primary IP 10.0.1.5 is not within subnet subnet-lyft (10.0.0.0/28)"},
+	}
+
+	for i, c := range cases {
+		mock := &ec2ClientMock{
+			NetworkDescribeResponse: inUse,
+			NetworkCreateResponse: ec2.CreateNetworkInterfaceOutput{
+				NetworkInterface: &ec2.NetworkInterface{
+					NetworkInterfaceId: aws.String("eni-lyft-1"),
+					MacAddress:         aws.String("02:00:00:00:00:01"),
+					PrivateIpAddress:   aws.String(c.Expected),
+				},
+			},
+			NetworkAttachResponse: ec2.AttachNetworkInterfaceOutput{
+				AttachmentId: aws.String("eni-lyft-1-attachmentid"),
+			},
+		}
+		defaultClient.ec2Client = mock
+
+		_, err := defaultClient.NewInterfaceOnSubnetAtIndex(1, []string{"sg-lyft"}, subnet, c.PrimaryIP)
+		if c.Error != "" {
+			if err == nil || err.Error() != c.Error {
+				t.Fatalf("%d expected error %q, got %v", i, c.Error, err)
+			}
+			if mock.NetworkCreateRequest != nil {
+				t.Fatalf("%d interface was created despite a conflicting primary IP", i)
+			}
+			continue
+		}
+
+		if mock.NetworkCreateRequest == nil {
+			t.Fatalf("%d interface was not created: %v", i, err)
+		}
+		if got := aws.StringValue(mock.NetworkCreateRequest.PrivateIpAddress); got != c.Expected {
+			t.Fatalf("%d expected primary IP %v to be requested, got %v", i, c.Expected, got)
+		}
+	}
+}
+
 // func TestConfigureInterface(t *testing.T) {}
 // func TestNewInterface(t *testing.T) {}
 
+func TestFreeDeviceIndex(t *testing.T) {
+	attached := func(indexes ...int64) []*ec2.NetworkInterface {
+		var interfaces []*ec2.NetworkInterface
+		for _, index := range indexes {
+			interfaces = append(interfaces, &ec2.NetworkInterface{
+				Attachment: &ec2.NetworkInterfaceAttachment{DeviceIndex: aws.Int64(index)},
+			})
+		}
+		return interfaces
+	}
+
+	cases := []struct {
+		Attached []*ec2.NetworkInterface
+		Expected int
+	}{
+		{attached(), 0},
+		{attached(0), 1},
+		{attached(0, 1, 2), 3},
+		// the index of a detached interface is reused
+		{attached(0, 2), 1},
+		{attached(2, 0, 3), 1},
+	}
+
+	for i, c := range cases {
+		if got := freeDeviceIndex(c.Attached); got != c.Expected {
+			t.Errorf("%d expected device index %d, got %d", i, c.Expected, got)
+		}
+	}
+}
+
 func TestRemoveInterface(t *testing.T) {
 	interfaceDetachAttempts = 1
 	interfacePostDetachSettleTime = 1
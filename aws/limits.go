@@ -7,6 +7,20 @@ type ENILimit struct {
 	IPv6     int
 }
 
+// FreeSlots returns how many more IPv4 addresses or prefixes intf can
+// be assigned before reaching the limit of the instance type, or -1 when
+// the limit of the instance type is unknown. Each delegated prefix takes
+// one slot.
+func (l ENILimit) FreeSlots(intf Interface) int {
+	if l.IPv4 <= 0 {
+		return -1
+	}
+	if free := l.IPv4 - len(intf.IPv4s) - len(intf.IPv4Prefixes); free > 0 {
+		return free
+	}
+	return 0
+}
+
 // LimitsClient provides methods for locating limits in AWS
 type LimitsClient interface {
 	ENILimits() ENILimit
@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"net"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
@@ -21,3 +22,24 @@ func TestLimitsReturn(t *testing.T) {
 		t.Fatalf("No valid limit returned for r4.xlarge %v", limits)
 	}
 }
+
+func TestFreeSlots(t *testing.T) {
+	intf := Interface{IPv4s: make([]net.IP, 10)}
+
+	cases := []struct {
+		Limit    ENILimit
+		Expected int
+	}{
+		{Limit: ENILimit{Adapters: 4, IPv4: 15}, Expected: 5},
+		{Limit: ENILimit{Adapters: 4, IPv4: 10}, Expected: 0},
+		{Limit: ENILimit{Adapters: 2, IPv4: 6}, Expected: 0},
+		// unknown instance type
+		{Limit: ENILimit{}, Expected: -1},
+	}
+
+	for i, c := range cases {
+		if free := c.Limit.FreeSlots(intf); free != c.Expected {
+			t.Errorf("Case %d: got %d free slots, expected %d", i, free, c.Expected)
+		}
+	}
+}
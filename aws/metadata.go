@@ -7,6 +7,9 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws/cache"
 )
 
 // Interface describes an interface from the metadata service
@@ -17,6 +20,9 @@ type Interface struct {
 	Number int
 	IPv4s  []net.IP
 
+	// IPv4Prefixes are the /28 prefixes delegated to the interface
+	IPv4Prefixes []*net.IPNet
+
 	SubnetID   string
 	SubnetCidr *net.IPNet
 
@@ -31,6 +37,15 @@ func (i Interface) LocalName() string {
 	return i.IfName
 }
 
+// PrimaryIP returns the primary private IP of the interface, which the
+// metadata service lists first, or nil when it has no IPs
+func (i Interface) PrimaryIP() net.IP {
+	if len(i.IPv4s) == 0 {
+		return nil
+	}
+	return i.IPv4s[0]
+}
+
 // Interfaces contains a slice of Interface
 type Interfaces []Interface
 
@@ -45,6 +60,27 @@ type MetadataClient interface {
 	InstanceType() string
 }
 
+const (
+	macsCacheKey         = "metadata_macs"
+	interfaceCachePrefix = "metadata_interface_"
+)
+
+// MetadataCacheTTL is how long the list of interfaces and their
+// subnets and VPC CIDRs are cached on disk, shared by plugin processes.
+// Zero disables the cache.
+var MetadataCacheTTL = 5 * time.Second
+
+func interfaceCacheKey(mac string) string {
+	return interfaceCachePrefix + strings.Replace(mac, ":", "", -1)
+}
+
+// invalidateMetadataCache drops the cached interface metadata, once an
+// interface is attached or detached
+func invalidateMetadataCache() {
+	cache.Delete(macsCacheKey)
+	cache.DeletePrefix(interfaceCachePrefix)
+}
+
 // EC2 generally gives the following data blocks from an interface in meta-data
 // device-number
 // interface-id
@@ -61,7 +97,70 @@ type MetadataClient interface {
 // vpc-ipv4-cidr-blocks
 // vpc-ipv6-cidr-blocks
 
+// getInterface returns the metadata of the interface mac. Its IPs are
+// always fetched, the rest is cached for MetadataCacheTTL as it only
+// changes when interfaces are attached or detached.
 func (c *awsclient) getInterface(mac string) (Interface, error) {
+	var iface Interface
+	key := interfaceCacheKey(mac)
+	if MetadataCacheTTL <= 0 || cache.Get(key, &iface) != cache.CacheFound {
+		var err error
+		iface, err = c.getInterfaceMetadata(mac)
+		if err != nil {
+			return iface, err
+		}
+		if MetadataCacheTTL > 0 {
+			cache.Store(key, MetadataCacheTTL, &iface)
+		}
+	}
+	iface.IPv4s = nil
+	iface.IPv4Prefixes = nil
+
+	value, err := c.metaData.GetMetadata(fmt.Sprintf("network/interfaces/macs/%s/local-ipv4s", mac))
+	if err != nil {
+		log.Printf("Error calling metadata service: %v", err)
+		return iface, err
+	}
+	for _, ipv4 := range strings.Split(value, "\n") {
+		parsed := net.ParseIP(ipv4)
+		if parsed != nil {
+			iface.IPv4s = append(iface.IPv4s, parsed)
+		}
+	}
+
+	// the metadata service has no entry for interfaces without
+	// delegated prefixes
+	if value, err := c.metaData.GetMetadata(fmt.Sprintf("network/interfaces/macs/%s/ipv4-prefix", mac)); err == nil {
+		for _, cidr := range strings.Split(value, "\n") {
+			if _, prefix, err := net.ParseCIDR(cidr); err == nil {
+				iface.IPv4Prefixes = append(iface.IPv4Prefixes, prefix)
+			}
+		}
+	}
+
+	// Retrieve interface name on host for this MAC address
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return iface, err
+	}
+	for _, i := range ifaces {
+		if i.HardwareAddr.String() == mac {
+			iface.IfName = i.Name
+			break
+		}
+	}
+	// Commented because the AWS metadata server can return MAC addreses from detached interfaces on c5/m5
+	// A cleaner fix would be to ignore bogus interfaces (but probably not the effort because it should get fixed soon)
+	//if iface.IfName  == "" {
+	//	return iface, fmt.Errorf("Unable to locate interface with mac %s on host", mac)
+	//}
+
+	return iface, nil
+}
+
+// getInterfaceMetadata fetches the metadata of the interface mac which
+// does not change while it is attached
+func (c *awsclient) getInterfaceMetadata(mac string) (Interface, error) {
 	var iface Interface
 	iface.Mac = mac
 
@@ -99,18 +198,6 @@ func (c *awsclient) getInterface(mac string) (Interface, error) {
 		return iface, err
 	}
 
-	if err := metadataParser("local-ipv4s", func(iface *Interface, value string) error {
-		for _, ipv4 := range strings.Split(value, "\n") {
-			parsed := net.ParseIP(ipv4)
-			if parsed != nil {
-				iface.IPv4s = append(iface.IPv4s, parsed)
-			}
-		}
-		return nil
-	}); err != nil {
-		return iface, err
-	}
-
 	if err := metadataParser("subnet-id", func(iface *Interface, value string) error {
 		iface.SubnetID = value
 		return nil
@@ -166,23 +253,6 @@ func (c *awsclient) getInterface(mac string) (Interface, error) {
 		return iface, err
 	}
 
-	// Retrieve interface name on host for this MAC address
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return iface, err
-	}
-	for _, i := range ifaces {
-		if i.HardwareAddr.String() == mac {
-			iface.IfName = i.Name
-			break
-		}
-	}
-	// Commented because the AWS metadata server can return MAC addreses from detached interfaces on c5/m5
-	// A cleaner fix would be to ignore bogus interfaces (but probably not the effort because it should get fixed soon)
-	//if iface.IfName  == "" {
-	//	return iface, fmt.Errorf("Unable to locate interface with mac %s on host", mac)
-	//}
-
 	return iface, nil
 }
 
@@ -199,9 +269,16 @@ func (c *awsclient) GetInterfaces() ([]Interface, error) {
 		return nil, fmt.Errorf("EC2 Metadata not available")
 	}
 
-	macResult, err := c.metaData.GetMetadata("network/interfaces/macs/")
-	if err != nil {
-		return nil, err
+	var macResult string
+	if MetadataCacheTTL <= 0 || cache.Get(macsCacheKey, &macResult) != cache.CacheFound {
+		var err error
+		macResult, err = c.metaData.GetMetadata("network/interfaces/macs/")
+		if err != nil {
+			return nil, err
+		}
+		if MetadataCacheTTL > 0 {
+			cache.Store(macsCacheKey, MetadataCacheTTL, &macResult)
+		}
 	}
 
 	macs := strings.Split(macResult, "\n")
@@ -0,0 +1,81 @@
+package aws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestGetInterfacesCache(t *testing.T) {
+	const mac = "0a:11:22:33:44:fe"
+	values := map[string]string{
+		"instance-id":             "i-1234",
+		"network/interfaces/macs": mac + "/",
+		"interface-id":            "eni-1234",
+		"device-number":           "1",
+		"local-ipv4s":             "10.0.1.10\n10.0.1.11",
+		"subnet-id":               "subnet-1234",
+		"subnet-ipv4-cidr-block":  "10.0.1.0/24",
+		"vpc-id":                  "vpc-1234",
+		"vpc-ipv4-cidr-block":     "10.0.0.0/16",
+		"vpc-ipv4-cidr-blocks":    "10.0.0.0/16",
+		"security-group-ids":      "sg-1234",
+	}
+	var subnetGets, ipv4Gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/latest/meta-data/")
+		p = strings.TrimPrefix(p, "network/interfaces/macs/"+mac+"/")
+		switch p {
+		case "subnet-id":
+			atomic.AddInt32(&subnetGets, 1)
+		case "local-ipv4s":
+			atomic.AddInt32(&ipv4Gets, 1)
+		}
+		value, ok := values[strings.TrimSuffix(p, "/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(value))
+	}))
+	defer server.Close()
+
+	oldTTL := MetadataCacheTTL
+	defer func() { MetadataCacheTTL = oldTTL }()
+	invalidateMetadataCache()
+	defer invalidateMetadataCache()
+
+	sess := session.Must(session.NewSession())
+	c := &awsclient{metaData: ec2metadata.New(sess, aws.NewConfig().WithEndpoint(server.URL+"/latest").WithMaxRetries(0))}
+
+	for i := 0; i < 3; i++ {
+		interfaces, err := c.GetInterfaces()
+		if err != nil {
+			t.Fatalf("Failed to get interfaces: %v", err)
+		}
+		if len(interfaces) != 1 || interfaces[0].SubnetID != "subnet-1234" || len(interfaces[0].IPv4s) != 2 {
+			t.Fatalf("Unexpected interfaces %v", interfaces)
+		}
+	}
+	if subnetGets != 1 || ipv4Gets != 3 {
+		t.Errorf("Expected 1 subnet and 3 IP lookups, got %d and %d", subnetGets, ipv4Gets)
+	}
+
+	// an attachment drops the cache
+	invalidateMetadataCache()
+	if _, err := c.GetInterfaces(); err != nil || subnetGets != 2 {
+		t.Errorf("Cache was not invalidated: %v, %d subnet lookups", err, subnetGets)
+	}
+
+	// a zero TTL disables the cache
+	MetadataCacheTTL = 0
+	if _, err := c.GetInterfaces(); err != nil || subnetGets != 3 {
+		t.Errorf("Disabled cache was used: %v, %d subnet lookups", err, subnetGets)
+	}
+}
@@ -0,0 +1,246 @@
+package aws
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+// prefixAddrs returns every address of prefix
+func prefixAddrs(prefix *net.IPNet) []net.IP {
+	ones, bits := prefix.Mask.Size()
+	base := binary.BigEndian.Uint32(prefix.IP.To4())
+	var ips []net.IP
+	for i := uint32(0); i < 1<<uint(bits-ones); i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+i)
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// PrefixIPs returns every address of the IPv4 prefixes delegated to the
+// interface, all of which can be handed to Pods
+func (i Interface) PrefixIPs() []net.IP {
+	var ips []net.IP
+	for _, prefix := range i.IPv4Prefixes {
+		ips = append(ips, prefixAddrs(prefix)...)
+	}
+	return ips
+}
+
+// freePrefixIPs returns the addresses of the prefixes of the interfaces
+// at or above index which are neither bound nor reserved
+func freePrefixIPs(interfaces []Interface, bound []nl.BoundIP, reserved map[string]bool, index int) []*AllocationResult {
+	var free []*AllocationResult
+	for _, intf := range interfaces {
+		if intf.Number < index {
+			continue
+		}
+		for _, ip := range intf.PrefixIPs() {
+			if reserved[ip.String()] || isBound(bound, ip) {
+				continue
+			}
+			ipCopy := ip
+			free = append(free, &AllocationResult{&ipCopy, intf})
+		}
+	}
+	return free
+}
+
+// prefixReservedIPs returns the prefix addresses the registry records
+// as assigned to a container or as released less than reuseWait ago
+func prefixReservedIPs(registry *Registry, reuseWait time.Duration) (map[string]bool, error) {
+	reserved := make(map[string]bool)
+	assigned, err := registry.AssignedIPs()
+	if err != nil {
+		return nil, err
+	}
+	for ipString := range assigned {
+		reserved[ipString] = true
+	}
+	tracked, err := registry.List()
+	if err != nil {
+		return nil, err
+	}
+	reusable, err := registry.TrackedBefore(time.Now().Add(-reuseWait))
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range tracked {
+		if !containsIP(reusable, ip) {
+			reserved[ip.String()] = true
+		}
+	}
+	return reserved, nil
+}
+
+// AllocatePrefixIPAtIndex carves a Pod IP out of the IPv4 prefixes
+// delegated to the interfaces at or above index, skipping the addresses
+// released less than reuseWait ago. When every address is in use, a new
+// prefix is delegated to the first interface with a free slot in a
+// subnet with subnetTags. Returns ErrENILimitReached when none has one.
+// The caller records the IP as assigned in the registry.
+func AllocatePrefixIPAtIndex(index int, reuseWait time.Duration, subnetTags map[string]string) (*AllocationResult, error) {
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	bound, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := prefixReservedIPs(&Registry{}, reuseWait)
+	if err != nil {
+		return nil, err
+	}
+	if free := freePrefixIPs(interfaces, bound, reserved, index); len(free) > 0 {
+		return free[0], nil
+	}
+
+	subnets, err := DefaultClient.GetSubnetsForInstance()
+	if err != nil {
+		return nil, err
+	}
+	subnets = FilterSubnetsByTags(subnets, subnetTags)
+	if len(subnets) == 0 && len(subnetTags) > 0 {
+		return nil, subnetTagsError(subnetTags)
+	}
+	limits := DefaultClient.ENILimits()
+	for _, intf := range interfaces {
+		if intf.Number < index || limits.FreeSlots(intf) == 0 {
+			continue
+		}
+		for _, subnet := range subnets {
+			if subnet.ID == intf.SubnetID {
+				return AllocatePrefixIPOn(intf)
+			}
+		}
+	}
+	return nil, ErrENILimitReached
+}
+
+// AllocatePrefixIPOn delegates a new IPv4 prefix to intf and returns
+// its first address
+func AllocatePrefixIPOn(intf Interface) (*AllocationResult, error) {
+	prefix, err := defaultClient.allocateClient.assignPrefixOn(intf)
+	if err != nil {
+		return nil, err
+	}
+	intf.IPv4Prefixes = append(intf.IPv4Prefixes, prefix)
+	ip := prefixAddrs(prefix)[0]
+	return &AllocationResult{&ip, intf}, nil
+}
+
+// assignPrefixOn delegates a new IPv4 prefix to intf. The prefix is
+// taken from the response, as it shows up in the metadata service with
+// a delay.
+func (c *allocateClient) assignPrefixOn(intf Interface) (*net.IPNet, error) {
+	if c.aws.ENILimits().FreeSlots(intf) == 0 {
+		return nil, fmt.Errorf("interface %v has no free slot for a prefix", intf.ID)
+	}
+	client, err := c.aws.newEC2()
+	if err != nil {
+		return nil, err
+	}
+	request := ec2.AssignPrivateIpAddressesInput{
+		NetworkInterfaceId: &intf.ID,
+	}
+	request.SetIpv4PrefixCount(1)
+
+	var output *ec2.AssignPrivateIpAddressesOutput
+	err = DefaultAllocateRetry.do(func() error {
+		var err error
+		output, err = client.AssignPrivateIpAddresses(&request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range output.AssignedIpv4Prefixes {
+		if spec.Ipv4Prefix == nil {
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(*spec.Ipv4Prefix)
+		if err == nil {
+			return prefix, nil
+		}
+	}
+	return nil, fmt.Errorf("no prefix was delegated to %v", intf.ID)
+}
+
+// emptyPrefixes returns the prefixes of the interfaces at or above
+// index none of whose addresses is bound or assigned to a container,
+// other than the released ones
+func emptyPrefixes(interfaces []Interface, bound []nl.BoundIP, assigned map[string]string, released []net.IP, index int) map[string][]*net.IPNet {
+	empty := make(map[string][]*net.IPNet)
+	for _, intf := range interfaces {
+		if intf.Number < index {
+			continue
+		}
+	PREFIXES:
+		for _, prefix := range intf.IPv4Prefixes {
+			for _, ip := range prefixAddrs(prefix) {
+				if containsIP(released, ip) {
+					continue
+				}
+				if _, ok := assigned[ip.String()]; ok || isBound(bound, ip) {
+					continue PREFIXES
+				}
+			}
+			empty[intf.ID] = append(empty[intf.ID], prefix)
+		}
+	}
+	return empty
+}
+
+// ReleaseEmptyPrefixes unassigns the prefixes of the interfaces at or
+// above index which no Pod uses any more and forgets their addresses.
+// The released IPs may still be bound and count as unused. Returns the
+// unassigned prefixes.
+func ReleaseEmptyPrefixes(index int, released []net.IP) ([]*net.IPNet, error) {
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	bound, err := nl.GetIPs()
+	if err != nil {
+		return nil, err
+	}
+	registry := &Registry{}
+	assigned, err := registry.AssignedIPs()
+	if err != nil {
+		return nil, err
+	}
+	client, err := defaultClient.newEC2()
+	if err != nil {
+		return nil, err
+	}
+
+	var unassigned []*net.IPNet
+	for id, prefixes := range emptyPrefixes(interfaces, bound, assigned, released, index) {
+		request := ec2.UnassignPrivateIpAddressesInput{}
+		request.SetNetworkInterfaceId(id)
+		var cidrs []*string
+		for _, prefix := range prefixes {
+			cidr := prefix.String()
+			cidrs = append(cidrs, &cidr)
+		}
+		request.SetIpv4Prefixes(cidrs)
+		if _, err := client.UnassignPrivateIpAddresses(&request); err != nil {
+			return unassigned, err
+		}
+		for _, prefix := range prefixes {
+			for _, ip := range prefixAddrs(prefix) {
+				_ = registry.ForgetIP(ip)
+			}
+		}
+		unassigned = append(unassigned, prefixes...)
+	}
+	return unassigned, nil
+}
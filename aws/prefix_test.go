@@ -0,0 +1,65 @@
+package aws
+
+import (
+	"net"
+	"testing"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func TestPrefixIPs(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.1.16/28")
+	intf := Interface{IPv4s: make([]net.IP, 2), IPv4Prefixes: []*net.IPNet{prefix}}
+
+	ips := intf.PrefixIPs()
+	if len(ips) != 16 || !ips[0].Equal(net.ParseIP("10.0.1.16")) || !ips[15].Equal(net.ParseIP("10.0.1.31")) {
+		t.Errorf("Unexpected prefix IPs %v", ips)
+	}
+	// the prefix takes a single slot
+	if free := (ENILimit{IPv4: 4}).FreeSlots(intf); free != 1 {
+		t.Errorf("Got %d free slots, expected 1", free)
+	}
+}
+
+func TestFreePrefixIPs(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.1.16/28")
+	interfaces := []Interface{
+		{ID: "eni-0", Number: 0},
+		{ID: "eni-1", Number: 1, IPv4s: []net.IP{net.ParseIP("10.0.1.5")}, IPv4Prefixes: []*net.IPNet{prefix}},
+	}
+	bound := []nl.BoundIP{{IPNet: &net.IPNet{IP: net.ParseIP("10.0.1.16")}}}
+	reserved := map[string]bool{"10.0.1.17": true}
+
+	free := freePrefixIPs(interfaces, bound, reserved, 1)
+	if len(free) != 14 || !free[0].IP.Equal(net.ParseIP("10.0.1.18")) || free[0].Interface.ID != "eni-1" {
+		t.Errorf("Unexpected free prefix IPs %v", free)
+	}
+	// the primary IP of the interface is never carved
+	for _, alloc := range free {
+		if alloc.IP.Equal(net.ParseIP("10.0.1.5")) {
+			t.Errorf("Secondary IP %v handed out as a prefix IP", alloc.IP)
+		}
+	}
+	if free := freePrefixIPs(interfaces, bound, reserved, 2); len(free) != 0 {
+		t.Errorf("Prefix IPs below the index were handed out: %v", free)
+	}
+}
+
+func TestEmptyPrefixes(t *testing.T) {
+	_, used, _ := net.ParseCIDR("10.0.1.16/28")
+	_, empty, _ := net.ParseCIDR("10.0.1.32/28")
+	interfaces := []Interface{{ID: "eni-1", Number: 1, IPv4Prefixes: []*net.IPNet{used, empty}}}
+	bound := []nl.BoundIP{{IPNet: &net.IPNet{IP: net.ParseIP("10.0.1.20")}}}
+	assigned := map[string]string{"10.0.1.21": "container"}
+
+	prefixes := emptyPrefixes(interfaces, bound, assigned, nil, 1)
+	if len(prefixes["eni-1"]) != 1 || prefixes["eni-1"][0].String() != "10.0.1.32/28" {
+		t.Errorf("Unexpected empty prefixes %v", prefixes)
+	}
+
+	// the IP being released may still be bound
+	prefixes = emptyPrefixes(interfaces, bound, nil, []net.IP{net.ParseIP("10.0.1.20")}, 1)
+	if len(prefixes["eni-1"]) != 2 {
+		t.Errorf("Prefix of the released IP is not empty: %v", prefixes)
+	}
+}
@@ -17,6 +17,7 @@ import (
 const (
 	registryDir           = "cni-ipvlan-vpc-k8s"
 	registryFile          = "registry.json"
+	registryLockFile      = "registry.lock"
 	registrySchemaVersion = 1
 )
 
@@ -24,6 +25,8 @@ func defaultRegistry() registryContents {
 	return registryContents{
 		SchemaVersion: registrySchemaVersion,
 		IPs:           map[string]*registryIP{},
+		Assigned:      map[string]*registryAssignment{},
+		Idle:          map[string]*registryInterface{},
 	}
 }
 
@@ -31,9 +34,23 @@ type registryIP struct {
 	ReleasedOn lib.JSONTime `json:"released_on"`
 }
 
+type registryAssignment struct {
+	ContainerID string       `json:"container_id"`
+	AssignedOn  lib.JSONTime `json:"assigned_on"`
+}
+
+type registryInterface struct {
+	IdleSince lib.JSONTime `json:"idle_since"`
+}
+
 type registryContents struct {
 	SchemaVersion int                    `json:"schema_version"`
 	IPs           map[string]*registryIP `json:"ips"`
+	// Assigned maps the IPs handed to containers to their container ID
+	Assigned map[string]*registryAssignment `json:"assigned,omitempty"`
+	// Idle maps the IDs of interfaces holding no Pod IP to when they
+	// were first seen idle
+	Idle map[string]*registryInterface `json:"idle_interfaces,omitempty"`
 }
 
 // Registry defines a re-usable IP registry which tracks IPs that are
@@ -84,10 +101,10 @@ func (r *Registry) load() (*registryContents, error) {
 		// Return an empty registry, prefilled with IPs
 		// already existing on all interfaces and timestamped
 		// at the golang epoch
-		free, err := FindFreeIPsAtIndex(0, false)
+		free, err := unboundIPs()
 		if err == nil {
 			for _, freeAlloc := range free {
-				contents.IPs[freeAlloc.IP.String()] = &registryIP{lib.JSONTime{time.Time{}}}
+				contents.IPs[freeAlloc.IP.String()] = &registryIP{ReleasedOn: lib.JSONTime{Time: time.Time{}}}
 			}
 			err = r.save(&contents)
 			return &contents, err
@@ -119,6 +136,12 @@ func (r *Registry) load() (*registryContents, error) {
 	if contents.IPs == nil {
 		contents = defaultRegistry()
 	}
+	if contents.Assigned == nil {
+		contents.Assigned = map[string]*registryAssignment{}
+	}
+	if contents.Idle == nil {
+		contents.Idle = map[string]*registryInterface{}
+	}
 	return &contents, nil
 }
 
@@ -127,50 +150,172 @@ func (r *Registry) save(rc *registryContents) error {
 	if err != nil {
 		return err
 	}
-	file, err := os.OpenFile(rpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	rc.SchemaVersion = registrySchemaVersion
+	data, err := json.Marshal(rc)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	if encoder == nil {
-		return fmt.Errorf("could not make a new encoder")
-	}
-	rc.SchemaVersion = registrySchemaVersion
-	err = encoder.Encode(rc)
-	return err
+	// readers never see a partially written registry
+	return lib.WriteFileAtomic(rpath, data, 0600)
 }
 
-// TrackIP records an IP in the free registry with the current system
-// time as the current freed-time. If an IP is freed again, the time
-// will be updated to the new current time.
-func (r *Registry) TrackIP(ip net.IP) error {
+// update runs fn on the registry contents and saves them, holding a
+// lock file so that concurrent plugin processes do not lose updates
+func (r *Registry) update(fn func(*registryContents) error) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	contents, err := r.load()
+	rpath, err := r.ensurePath()
 	if err != nil {
 		return err
 	}
+	return lib.LockfileRunAt(path.Join(path.Dir(rpath), registryLockFile), func() error {
+		contents, err := r.load()
+		if err != nil {
+			return err
+		}
+		if err := fn(contents); err != nil {
+			return err
+		}
+		return r.save(contents)
+	})
+}
+
+// TrackIP records an IP in the free registry with the current system
+// time as the current freed-time. If an IP is freed again, the time
+// will be updated to the new current time.
+func (r *Registry) TrackIP(ip net.IP) error {
+	return r.TrackIPAt(ip, time.Now())
+}
 
-	contents.IPs[ip.String()] = &registryIP{lib.JSONTime{time.Now()}}
-	return r.save(contents)
+// TrackIPAt records an IP in the free registry as freed at t. IPs that
+// were never bound to a Pod are tracked at the zero time so they are
+// reusable at once.
+func (r *Registry) TrackIPAt(ip net.IP, t time.Time) error {
+	return r.update(func(contents *registryContents) error {
+		contents.IPs[ip.String()] = &registryIP{ReleasedOn: lib.JSONTime{Time: t}}
+		return nil
+	})
 }
 
 // ForgetIP removes an IP from the registry
 func (r *Registry) ForgetIP(ip net.IP) error {
+	return r.update(func(contents *registryContents) error {
+		delete(contents.IPs, ip.String())
+		return nil
+	})
+}
+
+// AssignIP records that ip is handed to the container containerID and
+// no longer free. It fails when the IP is assigned to another
+// container, so concurrent ADDs never hand out the same IP.
+func (r *Registry) AssignIP(ip net.IP, containerID string) error {
+	return r.update(func(contents *registryContents) error {
+		if a, ok := contents.Assigned[ip.String()]; ok && a.ContainerID != containerID {
+			return fmt.Errorf("IP %v is already assigned to container %v", ip, a.ContainerID)
+		}
+		delete(contents.IPs, ip.String())
+		contents.Assigned[ip.String()] = &registryAssignment{ContainerID: containerID, AssignedOn: lib.JSONTime{Time: time.Now()}}
+		return nil
+	})
+}
+
+// ReleaseIPs removes the assignments of the container containerID and
+// tracks their IPs as free. Returns the released IPs.
+func (r *Registry) ReleaseIPs(containerID string) ([]net.IP, error) {
+	var released []net.IP
+	err := r.update(func(contents *registryContents) error {
+		for ipString, a := range contents.Assigned {
+			if a.ContainerID != containerID {
+				continue
+			}
+			delete(contents.Assigned, ipString)
+			contents.IPs[ipString] = &registryIP{ReleasedOn: lib.JSONTime{Time: time.Now()}}
+			if ip := net.ParseIP(ipString); ip != nil {
+				released = append(released, ip)
+			}
+		}
+		return nil
+	})
+	return released, err
+}
+
+// AssignedIPs returns the container ID of every assigned IP
+func (r *Registry) AssignedIPs() (map[string]string, error) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
 	contents, err := r.load()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	assigned := make(map[string]string)
+	for ipString, a := range contents.Assigned {
+		assigned[ipString] = a.ContainerID
+	}
+	return assigned, nil
+}
+
+// Reconcile heals the registry against the ENIs of the instance. IPs
+// no longer assigned to any interface, or in a prefix delegated to one,
+// are dropped, as are assignments
+// older than grace whose IP was never bound, left by an ADD which
+// failed after the IPAM plugin ran.
+func (r *Registry) Reconcile(interfaces []Interface, bound []net.IP, grace time.Duration) error {
+	if len(interfaces) == 0 {
+		// the metadata service is unavailable, nothing to compare with
+		return nil
+	}
+	onENI := make(map[string]bool)
+	for _, intf := range interfaces {
+		for _, ip := range intf.IPv4s {
+			onENI[ip.String()] = true
+		}
+		for _, ip := range intf.PrefixIPs() {
+			onENI[ip.String()] = true
+		}
+	}
+	isBound := make(map[string]bool)
+	for _, ip := range bound {
+		isBound[ip.String()] = true
 	}
 
-	delete(contents.IPs, ip.String())
+	return r.update(func(contents *registryContents) error {
+		for ipString := range contents.IPs {
+			if !onENI[ipString] {
+				delete(contents.IPs, ipString)
+			}
+		}
+		for ipString, a := range contents.Assigned {
+			stale := !isBound[ipString] && time.Since(a.AssignedOn.Time) > grace
+			if !onENI[ipString] || stale {
+				delete(contents.Assigned, ipString)
+			}
+		}
+		return nil
+	})
+}
 
-	return r.save(contents)
+// InterfacesIdleSince records the interfaces with the IDs in idle as
+// idle from now on, unless they already were, and forgets every other
+// interface. Returns when each of the idle interfaces became idle.
+func (r *Registry) InterfacesIdleSince(idle []string) (map[string]time.Time, error) {
+	since := make(map[string]time.Time)
+	err := r.update(func(contents *registryContents) error {
+		for _, id := range idle {
+			if _, ok := contents.Idle[id]; !ok {
+				contents.Idle[id] = &registryInterface{IdleSince: lib.JSONTime{Time: time.Now()}}
+			}
+			since[id] = contents.Idle[id].IdleSince.Time
+		}
+		for id := range contents.Idle {
+			if _, ok := since[id]; !ok {
+				delete(contents.Idle, id)
+			}
+		}
+		return nil
+	})
+	return since, err
 }
 
 // HasIP checks if an IP is in an registry
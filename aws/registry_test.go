@@ -1,7 +1,9 @@
 package aws
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
 	"time"
 )
@@ -119,3 +121,77 @@ func TestJitter(t *testing.T) {
 		t.Fatalf("Jitter moved more than 10pct forward %v", d1p)
 	}
 }
+
+func TestRegistry_AssignIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := &Registry{path: dir}
+
+	ip := net.ParseIP(IP1)
+	r.TrackIP(ip)
+	if err := r.AssignIP(ip, "container-1"); err != nil {
+		t.Fatalf("Failed to assign IP: %v", err)
+	}
+	if ok, _ := r.HasIP(ip); ok {
+		t.Errorf("Assigned IP is still tracked as free")
+	}
+	if err := r.AssignIP(ip, "container-2"); err == nil {
+		t.Errorf("IP was assigned to two containers")
+	}
+	if err := r.AssignIP(ip, "container-1"); err != nil {
+		t.Errorf("Assigning again to the same container failed: %v", err)
+	}
+
+	// a new process sees the assignment
+	assigned, err := (&Registry{path: dir}).AssignedIPs()
+	if err != nil || assigned[IP1] != "container-1" {
+		t.Errorf("Assignment was not persisted: %v %v", assigned, err)
+	}
+
+	released, err := r.ReleaseIPs("container-1")
+	if err != nil || len(released) != 1 || !released[0].Equal(ip) {
+		t.Fatalf("Unexpected released IPs %v %v", released, err)
+	}
+	if ok, _ := r.HasIP(ip); !ok {
+		t.Errorf("Released IP is not tracked as free")
+	}
+	if assigned, _ := r.AssignedIPs(); len(assigned) != 0 {
+		t.Errorf("Assignment was not removed: %v", assigned)
+	}
+}
+
+func TestRegistry_Reconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := &Registry{path: dir}
+
+	r.AssignIP(net.ParseIP(IP1), "container-1")
+	r.AssignIP(net.ParseIP(IP2), "container-2")
+	r.TrackIP(net.ParseIP(IP3))
+
+	// IP3 was unassigned from the ENI behind our back
+	interfaces := []Interface{{ID: "eni-1", IPv4s: []net.IP{net.ParseIP(IP1), net.ParseIP(IP2)}}}
+	if err := r.Reconcile(interfaces, nil, time.Hour); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if ok, _ := r.HasIP(net.ParseIP(IP3)); ok {
+		t.Errorf("IP gone from the ENIs is still tracked")
+	}
+	if assigned, _ := r.AssignedIPs(); len(assigned) != 2 {
+		t.Errorf("Recent assignments were dropped: %v", assigned)
+	}
+
+	// without grace, only the bound IP keeps its assignment
+	if err := r.Reconcile(interfaces, []net.IP{net.ParseIP(IP1)}, -time.Second); err != nil {
+		t.Fatalf("Failed to reconcile: %v", err)
+	}
+	if assigned, _ := r.AssignedIPs(); len(assigned) != 1 || assigned[IP1] != "container-1" {
+		t.Errorf("Unexpected assignments after reconcile %v", assigned)
+	}
+}
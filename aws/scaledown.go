@@ -0,0 +1,110 @@
+package aws
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+// idleInterfaces returns the secondary interfaces at or above index
+// whose IPs, other than their primary IP, are all free, and none of
+// whose prefix addresses is used. The primary interface is never idle.
+func idleInterfaces(interfaces []Interface, free []*AllocationResult, used []nl.BoundIP, index int) []Interface {
+	var idle []Interface
+	for _, intf := range interfaces {
+		if intf.Number == 0 || intf.Number < index {
+			continue
+		}
+		primary := intf.PrimaryIP()
+		busy := false
+		for _, ip := range intf.IPv4s {
+			if !ip.Equal(primary) && !containsAllocation(free, ip) {
+				busy = true
+				break
+			}
+		}
+		for _, ip := range intf.PrefixIPs() {
+			if isBound(used, ip) {
+				busy = true
+				break
+			}
+		}
+		if !busy {
+			idle = append(idle, intf)
+		}
+	}
+	return idle
+}
+
+// scaleDownInterfaces returns the idle interfaces idle since before
+// cutoff which can be removed while keep of the attached interfaces
+// remain, the highest device index first
+func scaleDownInterfaces(idle []Interface, since map[string]time.Time, cutoff time.Time, attached int, keep int) []Interface {
+	sorted := append([]Interface(nil), idle...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Number > sorted[j].Number })
+
+	var remove []Interface
+	for _, intf := range sorted {
+		if attached-len(remove) <= keep {
+			break
+		}
+		if t, ok := since[intf.ID]; ok && t.Before(cutoff) {
+			remove = append(remove, intf)
+		}
+	}
+	return remove
+}
+
+// IdleInterfaces returns the secondary interfaces at or above index
+// which held no bound or assigned IP for at least grace, leaving at
+// least keep interfaces, the primary one included, attached. Interfaces
+// seen idle for the first time start their grace period now.
+func IdleInterfaces(index int, grace time.Duration, keep int) ([]Interface, error) {
+	if keep < 1 {
+		keep = 1
+	}
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	free, err := FindFreeIPsAtIndex(index, false)
+	if err != nil {
+		return nil, err
+	}
+	used, err := usedIPs(&Registry{})
+	if err != nil {
+		return nil, err
+	}
+
+	idle := idleInterfaces(interfaces, free, used, index)
+	ids := make([]string, 0, len(idle))
+	for _, intf := range idle {
+		ids = append(ids, intf.ID)
+	}
+	since, err := (&Registry{}).InterfacesIdleSince(ids)
+	if err != nil {
+		return nil, err
+	}
+	return scaleDownInterfaces(idle, since, time.Now().Add(-grace), len(interfaces), keep), nil
+}
+
+// RemoveIdleInterface detaches and deletes intf, found by
+// IdleInterfaces, and drops its IPs from the registry. The free IPs it
+// held for the warm pool go with it, so the other interfaces at or
+// above index are then filled up to warmTarget free IPs again, which
+// are returned.
+func RemoveIdleInterface(intf Interface, index int, warmTarget int) ([]net.IP, error) {
+	if err := DefaultClient.RemoveInterface([]string{intf.ID}); err != nil {
+		return nil, err
+	}
+	registry := &Registry{}
+	for _, ip := range append(intf.IPv4s, intf.PrefixIPs()...) {
+		_ = registry.ForgetIP(ip)
+	}
+	if warmTarget <= 0 {
+		return nil, nil
+	}
+	return ReplenishWarmPool(index, warmTarget)
+}
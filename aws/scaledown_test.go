@@ -0,0 +1,68 @@
+package aws
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func TestIdleInterfaces(t *testing.T) {
+	ip := func(s string) net.IP { return net.ParseIP(s) }
+	free := func(intf Interface, s string) *AllocationResult {
+		addr := ip(s)
+		return &AllocationResult{&addr, intf}
+	}
+	interfaces := []Interface{
+		{ID: "eni-0", Number: 0, IPv4s: []net.IP{ip("10.0.0.1")}},
+		{ID: "eni-1", Number: 1, IPv4s: []net.IP{ip("10.0.1.1"), ip("10.0.1.2"), ip("10.0.1.3")}},
+		{ID: "eni-2", Number: 2, IPv4s: []net.IP{ip("10.0.2.1"), ip("10.0.2.2")}},
+		{ID: "eni-3", Number: 3, IPv4s: []net.IP{ip("10.0.3.1")}},
+	}
+	// 10.0.1.3 is used by a Pod
+	freeIPs := []*AllocationResult{free(interfaces[1], "10.0.1.2"), free(interfaces[2], "10.0.2.2")}
+
+	idle := idleInterfaces(interfaces, freeIPs, nil, 0)
+	if len(idle) != 2 || idle[0].ID != "eni-2" || idle[1].ID != "eni-3" {
+		t.Fatalf("Unexpected idle interfaces %v", idle)
+	}
+
+	now := time.Now()
+	since := map[string]time.Time{"eni-2": now.Add(-time.Hour), "eni-3": now.Add(-time.Hour)}
+	remove := scaleDownInterfaces(idle, since, now.Add(-time.Minute), len(interfaces), 1)
+	if len(remove) != 2 || remove[0].ID != "eni-3" || remove[1].ID != "eni-2" {
+		t.Errorf("Unexpected interfaces to remove %v", remove)
+	}
+
+	// the floor keeps three interfaces attached
+	remove = scaleDownInterfaces(idle, since, now.Add(-time.Minute), len(interfaces), 3)
+	if len(remove) != 1 || remove[0].ID != "eni-3" {
+		t.Errorf("Unexpected interfaces to remove with a floor of 3: %v", remove)
+	}
+
+	// eni-3 only just became idle
+	since["eni-3"] = now
+	remove = scaleDownInterfaces(idle, since, now.Add(-time.Minute), len(interfaces), 1)
+	if len(remove) != 1 || remove[0].ID != "eni-2" {
+		t.Errorf("Interface within its grace period was removed: %v", remove)
+	}
+}
+
+func TestIdleInterfacesPrefixes(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.2.16/28")
+	interfaces := []Interface{
+		{ID: "eni-0", Number: 0, IPv4s: []net.IP{net.ParseIP("10.0.0.1")}},
+		// delegated prefixes are not listed among the IPv4s
+		{ID: "eni-1", Number: 1, IPv4s: []net.IP{net.ParseIP("10.0.1.1")}, IPv4Prefixes: []*net.IPNet{prefix}},
+	}
+
+	// a Pod uses an address of the prefix of eni-1
+	used := []nl.BoundIP{{IPNet: &net.IPNet{IP: net.ParseIP("10.0.2.20")}}}
+	if idle := idleInterfaces(interfaces, nil, used, 0); len(idle) != 0 {
+		t.Errorf("Interface with a used prefix address is idle: %v", idle)
+	}
+	if idle := idleInterfaces(interfaces, nil, nil, 0); len(idle) != 1 || idle[0].ID != "eni-1" {
+		t.Errorf("Expected eni-1 with an unused prefix to be idle, got %v", idle)
+	}
+}
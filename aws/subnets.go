@@ -1,6 +1,8 @@
 package aws
 
 import (
+	"fmt"
+
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
@@ -28,6 +30,29 @@ func (a SubnetsByAvailableAddressCount) Less(i, j int) bool {
 	return a[i].AvailableAddressCount > a[j].AvailableAddressCount
 }
 
+// FilterSubnetsByTags returns the subnets carrying every key / value
+// pair of tags
+func FilterSubnetsByTags(subnets []Subnet, tags map[string]string) []Subnet {
+	var matching []Subnet
+OUTER:
+	for _, subnet := range subnets {
+		for tagKey, tagValue := range tags {
+			// Skip untagged subnets and ones not matching
+			// the required tag
+			if value, ok := subnet.Tags[tagKey]; !ok || value != tagValue {
+				continue OUTER
+			}
+		}
+		matching = append(matching, subnet)
+	}
+	return matching
+}
+
+// subnetTagsError reports that no subnet of the instance matches tags
+func subnetTagsError(tags map[string]string) error {
+	return fmt.Errorf("no subnet in the availability zone of the instance matches the subnet tags %v", tags)
+}
+
 // SubnetsClient provides information about VPC subnets
 type SubnetsClient interface {
 	GetSubnetsForInstance() ([]Subnet, error)
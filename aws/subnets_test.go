@@ -1,6 +1,7 @@
 package aws
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -90,3 +91,31 @@ func TestGetSubnetsForInstance(t *testing.T) {
 
 	}
 }
+
+func TestFilterSubnetsByTags(t *testing.T) {
+	subnets := []Subnet{
+		{ID: "subnet-pods", Tags: map[string]string{"kubernetes.io/role/cni": "1", "team": "infra"}},
+		{ID: "subnet-other", Tags: map[string]string{"kubernetes.io/role/cni": "0"}},
+		{ID: "subnet-untagged", Tags: map[string]string{}},
+	}
+
+	cases := []struct {
+		Tags     map[string]string
+		Expected []string
+	}{
+		{Tags: nil, Expected: []string{"subnet-pods", "subnet-other", "subnet-untagged"}},
+		{Tags: map[string]string{"kubernetes.io/role/cni": "1"}, Expected: []string{"subnet-pods"}},
+		// every pair must match
+		{Tags: map[string]string{"kubernetes.io/role/cni": "1", "team": "web"}, Expected: nil},
+	}
+
+	for i, c := range cases {
+		var ids []string
+		for _, subnet := range FilterSubnetsByTags(subnets, c.Tags) {
+			ids = append(ids, subnet.ID)
+		}
+		if !reflect.DeepEqual(ids, c.Expected) {
+			t.Errorf("Case %d: got subnets %v, expected %v", i, ids, c.Expected)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// CheckSecurityGroups ensures the security groups exist in EC2 and
+// belong to the VPC of the instance
+func CheckSecurityGroups(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	client, err := defaultClient.newEC2()
+	if err != nil {
+		return err
+	}
+	var vpcID string
+	if interfaces, err := DefaultClient.GetInterfaces(); err == nil && len(interfaces) > 0 {
+		vpcID = interfaces[0].VpcID
+	}
+	return checkSecurityGroupsInVPC(client, ids, vpcID)
+}
+
+// checkSecurityGroupsInVPC ensures the security groups exist and, when
+// vpcID is set, belong to that VPC
+func checkSecurityGroupsInVPC(client ec2iface.EC2API, ids []string, vpcID string) error {
+	resp, err := client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: aws.StringSlice(ids),
+	})
+	if err != nil {
+		return fmt.Errorf("security groups %v could not be resolved: %v", ids, err)
+	}
+	if vpcID == "" {
+		return nil
+	}
+	for _, group := range resp.SecurityGroups {
+		if aws.StringValue(group.VpcId) != vpcID {
+			return fmt.Errorf("security group %v belongs to %v, not to the VPC %v of the instance",
+				aws.StringValue(group.GroupId), aws.StringValue(group.VpcId), vpcID)
+		}
+	}
+	return nil
+}
+
+// CheckSubnetTags ensures at least one subnet available to the instance
+// carries all of the tags
+func CheckSubnetTags(tags map[string]string) error {
+	subnets, err := DefaultClient.GetSubnetsForInstance()
+	if err != nil {
+		return err
+	}
+
+OUTER:
+	for _, subnet := range subnets {
+		for key, value := range tags {
+			if subnet.Tags[key] != value {
+				continue OUTER
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no subnet available to the instance matches subnetTags %v", tags)
+}
@@ -0,0 +1,41 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+type ec2SecurityGroupsMock struct {
+	ec2iface.EC2API
+	Groups map[string]string
+}
+
+func (e *ec2SecurityGroupsMock) DescribeSecurityGroups(in *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	out := &ec2.DescribeSecurityGroupsOutput{}
+	for _, id := range in.GroupIds {
+		vpc, ok := e.Groups[*id]
+		if !ok {
+			return nil, awserr.New("InvalidGroup.NotFound", "The security group does not exist", nil)
+		}
+		out.SecurityGroups = append(out.SecurityGroups, &ec2.SecurityGroup{GroupId: id, VpcId: aws.String(vpc)})
+	}
+	return out, nil
+}
+
+func TestCheckSecurityGroupsInVPC(t *testing.T) {
+	client := &ec2SecurityGroupsMock{Groups: map[string]string{"sg-1": "vpc-1", "sg-2": "vpc-2"}}
+
+	if err := checkSecurityGroupsInVPC(client, []string{"sg-1"}, "vpc-1"); err != nil {
+		t.Errorf("Security group of the VPC rejected: %v", err)
+	}
+	if err := checkSecurityGroupsInVPC(client, []string{"sg-1", "sg-2"}, "vpc-1"); err == nil {
+		t.Errorf("Security group of another VPC accepted")
+	}
+	if err := checkSecurityGroupsInVPC(client, []string{"sg-3"}, "vpc-1"); err == nil {
+		t.Errorf("Missing security group accepted")
+	}
+}
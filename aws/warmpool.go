@@ -0,0 +1,171 @@
+package aws
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// warmPoolDeficits returns, by interface ID, how many IPs to assign so
+// that every interface at or above index holds target free IPs. The
+// deficit never takes an interface past the maxIPs the instance type
+// permits.
+func warmPoolDeficits(interfaces []Interface, free []*AllocationResult, index int, target int, maxIPs int) map[string]int {
+	deficits := make(map[string]int)
+	for _, intf := range interfaces {
+		if intf.Number < index {
+			continue
+		}
+		warm := 0
+		for _, alloc := range free {
+			if alloc.Interface.ID == intf.ID {
+				warm++
+			}
+		}
+		deficit := target - warm
+		if room := maxIPs - len(intf.IPv4s); deficit > room {
+			deficit = room
+		}
+		if deficit > 0 {
+			deficits[intf.ID] = deficit
+		}
+	}
+	return deficits
+}
+
+// ReplenishWarmPool assigns secondary IPs on the existing interfaces at
+// or above index until each holds target free IPs, up to the instance
+// type limit. The new IPs are tracked as immediately reusable, as no
+// Pod ever held them. Returns the IPs that were assigned.
+func ReplenishWarmPool(index int, target int) ([]net.IP, error) {
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	free, err := FindFreeIPsAtIndex(index, false)
+	if err != nil {
+		return nil, err
+	}
+	deficits := warmPoolDeficits(interfaces, free, index, target, DefaultClient.ENILimits().IPv4)
+
+	var assigned []net.IP
+	for _, intf := range interfaces {
+		count, ok := deficits[intf.ID]
+		if !ok {
+			continue
+		}
+		ips, err := defaultClient.allocateClient.assignIPsOn(intf, count)
+		assigned = append(assigned, ips...)
+		if err != nil {
+			return assigned, err
+		}
+	}
+	return assigned, nil
+}
+
+// WarmPoolSurplus returns the released ips which can be unassigned
+// while every interface at or above index keeps target free IPs. The
+// others stay assigned for the next Pods.
+func WarmPoolSurplus(index int, target int, released []net.IP) ([]net.IP, error) {
+	if target <= 0 {
+		return released, nil
+	}
+	interfaces, err := DefaultClient.GetInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	free, err := FindFreeIPsAtIndex(index, false)
+	if err != nil {
+		return nil, err
+	}
+	return warmPoolSurplus(interfaces, free, index, target, released), nil
+}
+
+func warmPoolSurplus(interfaces []Interface, free []*AllocationResult, index int, target int, released []net.IP) []net.IP {
+	eniOf := func(ip net.IP) string {
+		for _, intf := range interfaces {
+			if intf.Number >= index && containsIP(intf.IPv4s, ip) {
+				return intf.ID
+			}
+		}
+		return ""
+	}
+
+	// released IPs may still be bound, count them as free
+	warm := make(map[string]int)
+	for _, alloc := range free {
+		if !containsIP(released, *alloc.IP) {
+			warm[alloc.Interface.ID]++
+		}
+	}
+	for _, ip := range released {
+		if eni := eniOf(ip); eni != "" {
+			warm[eni]++
+		}
+	}
+
+	var surplus []net.IP
+	for _, ip := range released {
+		eni := eniOf(ip)
+		if eni == "" || warm[eni] > target {
+			surplus = append(surplus, ip)
+			warm[eni]--
+		}
+	}
+	return surplus
+}
+
+// assignIPsOn assigns count secondary IPs on intf in a single request
+// and waits for them to show up in the metadata service
+func (c *allocateClient) assignIPsOn(intf Interface, count int) ([]net.IP, error) {
+	client, err := c.aws.newEC2()
+	if err != nil {
+		return nil, err
+	}
+	request := ec2.AssignPrivateIpAddressesInput{
+		NetworkInterfaceId: &intf.ID,
+	}
+	request.SetSecondaryPrivateIpAddressCount(int64(count))
+
+	err = DefaultAllocateRetry.do(func() error {
+		_, err := client.AssignPrivateIpAddresses(&request)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	registry := &Registry{}
+	var assigned []net.IP
+	for attempts := 10; attempts > 0 && len(assigned) < count; attempts-- {
+		newIntf, err := c.aws.getInterface(intf.Mac)
+		if err == nil {
+			for _, newip := range newIntf.IPv4s {
+				if containsIP(intf.IPv4s, newip) || containsIP(assigned, newip) {
+					continue
+				}
+				// warm IPs were never bound, so they need not age
+				registry.TrackIPAt(newip, time.Time{})
+				assigned = append(assigned, newip)
+			}
+		}
+		if len(assigned) < count {
+			time.Sleep(1.0 * time.Second)
+		}
+	}
+	if len(assigned) < count {
+		return assigned, fmt.Errorf("only %d of %d warm IPs showed up on %v", len(assigned), count, intf.ID)
+	}
+	return assigned, nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
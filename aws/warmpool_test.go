@@ -0,0 +1,51 @@
+package aws
+
+import (
+	"net"
+	"testing"
+)
+
+func TestWarmPoolDeficits(t *testing.T) {
+	ip := func(s string) net.IP { return net.ParseIP(s) }
+	free := func(id string, s string) *AllocationResult {
+		addr := ip(s)
+		return &AllocationResult{&addr, Interface{ID: id}}
+	}
+	interfaces := []Interface{
+		{ID: "eni-0", Number: 0, IPv4s: []net.IP{ip("10.0.0.1")}},
+		{ID: "eni-1", Number: 1, IPv4s: []net.IP{ip("10.0.1.1"), ip("10.0.1.2"), ip("10.0.1.3")}},
+		{ID: "eni-2", Number: 2, IPv4s: []net.IP{ip("10.0.2.1"), ip("10.0.2.2")}},
+	}
+	freeIPs := []*AllocationResult{free("eni-1", "10.0.1.2"), free("eni-2", "10.0.2.2")}
+
+	deficits := warmPoolDeficits(interfaces, freeIPs, 1, 3, 4)
+	// eni-0 is below the index, eni-1 can only hold one more IP
+	if len(deficits) != 2 || deficits["eni-1"] != 1 || deficits["eni-2"] != 2 {
+		t.Errorf("Unexpected deficits %v", deficits)
+	}
+
+	if deficits := warmPoolDeficits(interfaces, freeIPs, 1, 1, 4); len(deficits) != 0 {
+		t.Errorf("Full warm pool has deficits %v", deficits)
+	}
+}
+
+func TestWarmPoolSurplus(t *testing.T) {
+	ip := func(s string) net.IP { return net.ParseIP(s) }
+	interfaces := []Interface{
+		{ID: "eni-1", Number: 1, IPv4s: []net.IP{ip("10.0.1.1"), ip("10.0.1.2"), ip("10.0.1.3"), ip("10.0.1.4")}},
+	}
+	addr := ip("10.0.1.2")
+	freeIPs := []*AllocationResult{{&addr, interfaces[0]}}
+
+	// one free IP and two released ones, a target of 2 keeps one of them
+	surplus := warmPoolSurplus(interfaces, freeIPs, 1, 2, []net.IP{ip("10.0.1.3"), ip("10.0.1.4")})
+	if len(surplus) != 1 || !surplus[0].Equal(ip("10.0.1.3")) {
+		t.Errorf("Unexpected surplus %v", surplus)
+	}
+
+	// IPs of unknown interfaces are always released
+	surplus = warmPoolSurplus(interfaces, freeIPs, 1, 5, []net.IP{ip("10.0.9.9")})
+	if len(surplus) != 1 {
+		t.Errorf("Unknown IP was kept in the warm pool")
+	}
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
 	"github.com/urfave/cli"
+	"github.com/vishvananda/netlink"
 
 	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
 	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/netconf"
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
@@ -55,7 +61,7 @@ func actionNewInterface(c *cli.Context) error {
 			fmt.Println("please specify security groups")
 			return fmt.Errorf("need security groups")
 		}
-		newIf, err := aws.DefaultClient.NewInterface(secGrps, filters)
+		newIf, err := aws.DefaultClient.NewInterface(secGrps, filters, c.String("primary_ip"))
 		if err != nil {
 			fmt.Println(err)
 			return err
@@ -125,7 +131,7 @@ func actionDeallocate(c *cli.Context) error {
 func actionAllocate(c *cli.Context) error {
 	return lib.LockfileRun(func() error {
 		index := c.Int("index")
-		res, err := aws.DefaultClient.AllocateIPFirstAvailableAtIndex(index)
+		res, err := aws.DefaultClient.AllocateIPFirstAvailableAtIndex(index, 0, nil)
 		if err != nil {
 			fmt.Println(err)
 			return err
@@ -214,6 +220,195 @@ func actionEniIf(c *cli.Context) error {
 	return nil
 }
 
+func actionCapacity(c *cli.Context) error {
+	interfaces, err := aws.DefaultClient.GetInterfaces()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	limits := aws.DefaultClient.ENILimits()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "iface	id	ips	limit	free_slots	")
+	for _, iface := range interfaces {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t\n", iface.LocalName(),
+			iface.ID,
+			len(iface.IPv4s),
+			limits.IPv4,
+			limits.FreeSlots(iface))
+	}
+	w.Flush()
+
+	capacity, err := aws.CapacityAtIndex(c.Int("index"), nil, nil)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	fmt.Printf("\ncapacity %d, used %d, free %d, warm pool %d, %d of %d adapters attached\n",
+		capacity.Capacity, capacity.Used, capacity.Free, capacity.WarmPool,
+		len(interfaces), limits.Adapters)
+	return nil
+}
+
+// eniStatus is the state of an ENI printed by status --json. Field
+// names are stable.
+type eniStatus struct {
+	DeviceIndex  int        `json:"deviceIndex"`
+	ID           string     `json:"id"`
+	Mac          string     `json:"mac"`
+	Interface    string     `json:"interface"`
+	SubnetID     string     `json:"subnetId"`
+	SubnetCidr   string     `json:"subnetCidr"`
+	PrimaryIP    string     `json:"primaryIp"`
+	FreeSlots    int        `json:"freeSlots"`
+	SecondaryIPs []ipStatus `json:"secondaryIps"`
+}
+
+// ipStatus is the state of a secondary IP of an ENI
+type ipStatus struct {
+	IP          string `json:"ip"`
+	InUse       bool   `json:"inUse"`
+	ContainerID string `json:"containerId,omitempty"`
+	RouteTable  int    `json:"routeTable,omitempty"`
+}
+
+// eniStatuses combines the ENIs with the IPs bound in any namespace,
+// the container assignments of the registry and the Pod route tables
+func eniStatuses(interfaces []aws.Interface, limits aws.ENILimit, bound []nl.BoundIP, assigned map[string]string, tables map[string]int) []eniStatus {
+	inUse := make(map[string]bool)
+	for _, b := range bound {
+		inUse[b.IP.String()] = true
+	}
+
+	statuses := []eniStatus{}
+	for _, intf := range interfaces {
+		status := eniStatus{
+			DeviceIndex:  intf.Number,
+			ID:           intf.ID,
+			Mac:          intf.Mac,
+			Interface:    intf.LocalName(),
+			SubnetID:     intf.SubnetID,
+			FreeSlots:    limits.FreeSlots(intf),
+			SecondaryIPs: []ipStatus{},
+		}
+		if intf.SubnetCidr != nil {
+			status.SubnetCidr = intf.SubnetCidr.String()
+		}
+		primary := intf.PrimaryIP()
+		if primary != nil {
+			status.PrimaryIP = primary.String()
+		}
+		for _, ip := range intf.IPv4s {
+			if ip.Equal(primary) {
+				continue
+			}
+			key := ip.String()
+			status.SecondaryIPs = append(status.SecondaryIPs, ipStatus{
+				IP:          key,
+				InUse:       inUse[key],
+				ContainerID: assigned[key],
+				RouteTable:  tables[key],
+			})
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func actionStatus(c *cli.Context) error {
+	interfaces, err := aws.DefaultClient.GetInterfaces()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	bound, err := nl.GetIPs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	assigned, err := (&aws.Registry{}).AssignedIPs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	tables, err := nl.PodTables(c.Int("pod-rule-priority"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+
+	statuses := eniStatuses(interfaces, aws.DefaultClient.ENILimits(), bound, assigned, tables)
+	if c.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "iface\tindex\tid\tsubnet\tfree_slots\tip\tin_use\tcontainer\ttable\t")
+	for _, status := range statuses {
+		for _, ip := range status.SecondaryIPs {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n", status.Interface,
+				status.DeviceIndex,
+				status.ID,
+				status.SubnetID,
+				status.FreeSlots,
+				ip.IP,
+				ip.InUse,
+				ip.ContainerID,
+				ip.RouteTable)
+		}
+	}
+	w.Flush()
+	return nil
+}
+
+func actionCheck(c *cli.Context) error {
+	if c.String("netns") == "" {
+		fmt.Fprintln(os.Stderr, "please specify the network namespace of the Pod with --netns")
+		return cli.NewExitError("need a network namespace", 1)
+	}
+
+	netns, err := ns.GetNS(c.String("netns"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return cli.NewExitError("failed to open the network namespace", 1)
+	}
+	defer netns.Close()
+
+	conf := nl.PodCheckConf{
+		IfName:          c.String("ifname"),
+		VethName:        c.String("container-interface"),
+		PodRulePriority: c.Int("pod-rule-priority"),
+	}
+	if c.Bool("enforce-mtu") {
+		link, err := netlink.LinkByName(c.String("host-interface"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return cli.NewExitError("failed to lookup the host interface", 1)
+		}
+		conf.MTU = link.Attrs().MTU
+	}
+	checks := nl.CheckPod(netns, conf)
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "check	result	detail	")
+	for _, check := range checks {
+		result, detail := "pass", ""
+		if check.Err != nil {
+			result, detail = "fail", check.Err.Error()
+			failed = true
+		}
+		fmt.Fprintf(w, "%v	%v	%v	\n", check.Name, result, detail)
+	}
+	w.Flush()
+
+	if failed {
+		return cli.NewExitError("datapath check failed", 1)
+	}
+	return nil
+}
+
 func actionVpcCidr(c *cli.Context) error {
 	interfaces, err := aws.DefaultClient.GetInterfaces()
 	if err != nil {
@@ -319,6 +514,13 @@ func actionRegistryGc(c *cli.Context) error {
 			return err
 		}
 
+		// keep the warm pool of each ENI assigned
+		ips, err = aws.WarmPoolSurplus(c.Int("index"), c.Int("warm-ip-target"), ips)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+
 		// grab a list of in-use IPs to sanity check
 		assigned, err := nl.GetIPs()
 		if err != nil {
@@ -346,6 +548,284 @@ func actionRegistryGc(c *cli.Context) error {
 	})
 }
 
+func actionReconcile(c *cli.Context) error {
+	return lib.LockfileRun(func() error {
+		grace := c.Duration("grace")
+		if grace <= 0 {
+			return fmt.Errorf("grace must be > 0 seconds")
+		}
+
+		leaked, err := aws.LeakedIPs(c.Int("index"), grace)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+		leaked, err = aws.WarmPoolSurplus(c.Int("index"), c.Int("warm-ip-target"), leaked)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+
+		reg := &aws.Registry{}
+		for i := range leaked {
+			fmt.Printf("leaked IP %v\n", leaked[i])
+			if c.Bool("dry-run") {
+				continue
+			}
+			if err := aws.DefaultClient.DeallocateIP(&leaked[i]); err != nil {
+				fmt.Fprintf(os.Stderr, "Can't deallocate %v due to %v\n", leaked[i], err)
+				continue
+			}
+			reg.ForgetIP(leaked[i])
+		}
+		return nil
+	})
+}
+
+func actionScaleDown(c *cli.Context) error {
+	return lib.LockfileRun(func() error {
+		grace := c.Duration("grace")
+		if grace <= 0 {
+			return fmt.Errorf("grace must be > 0 seconds")
+		}
+
+		idle, err := aws.IdleInterfaces(c.Int("index"), grace, c.Int("keep"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+		for _, intf := range idle {
+			fmt.Printf("idle interface %v (%v)\n", intf.ID, intf.IfName)
+			if c.Bool("dry-run") {
+				continue
+			}
+			assigned, err := aws.RemoveIdleInterface(intf, c.Int("index"), c.Int("warm-ip-target"))
+			for _, ip := range assigned {
+				fmt.Printf("assigned %v\n", ip)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Can't remove %v due to %v\n", intf.ID, err)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func actionWarmPool(c *cli.Context) error {
+	return lib.LockfileRun(func() error {
+		target := c.Int("warm-ip-target")
+		if target <= 0 {
+			return fmt.Errorf("warm-ip-target must be > 0")
+		}
+		ips, err := aws.ReplenishWarmPool(c.Int("index"), target)
+		for _, ip := range ips {
+			fmt.Printf("assigned %v\n", ip)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return err
+	})
+}
+
+func actionGc(c *cli.Context) error {
+	dryRun := c.Bool("dry-run")
+
+	rules, err := nl.StalePodRules(c.Int("pod-rule-priority"), c.Int("route-protocol"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	for _, rule := range rules {
+		fmt.Printf("policy rule for %q and table %d\n", rule.IifName, rule.Table)
+		if dryRun {
+			continue
+		}
+		if err := nl.RemovePodRule(rule); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+	}
+
+	if c.Bool("node-port-rules") {
+		pendingRules := 0
+		if dryRun {
+			pendingRules = len(rules)
+		}
+		if err := gcNodePortRule(c, dryRun, pendingRules); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+	}
+
+	// IP masquerade chains are only told apart by the network name
+	name := c.String("network")
+	if name == "" {
+		return nil
+	}
+	masqRules, err := nl.ListIPMasqRules(c.String("iptables-path"), name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	podIPs, err := nl.PodIPs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	for _, rule := range staleIPMasqRules(masqRules, podIPs) {
+		fmt.Printf("IP masquerade chain %v of %v for container %v\n", rule.Chain, rule.Source, rule.ID)
+		if dryRun {
+			continue
+		}
+		chain := utils.FormatChainName(name, rule.ID)
+		if err := nl.TeardownIPMasq(c.String("iptables-path"), rule.Source, chain, utils.FormatComment(name, rule.ID)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// gcNodePortRule removes the NodePort rules of the host interface and
+// restores its rp_filter once no Pod policy rule is left. pendingRules
+// are the stale rules a dry run listed without removing them.
+func gcNodePortRule(c *cli.Context, dryRun bool, pendingRules int) error {
+	rules, err := nl.PodRules(c.Int("pod-rule-priority"))
+	if err != nil || len(rules) > pendingRules {
+		return err
+	}
+
+	ifName := c.String("host-interface")
+	fmt.Printf("NodePort rules and rp_filter of %q\n", ifName)
+	if dryRun {
+		return nil
+	}
+	mask := c.Int("node-port-mark-mask")
+	if mask == 0 {
+		mask = c.Int("node-port-mark")
+	}
+	return nl.TeardownNodePortRule(c.String("iptables-path"), ifName, c.String("node-ports"), c.Int("node-port-mark"), mask, c.Int("main-table-rule-priority"), c.String("host-veth-prefix"))
+}
+
+// staleIPMasqRules returns the IP masquerade rules whose source is not
+// the IP of a running Pod
+func staleIPMasqRules(rules []nl.IPMasqRule, podIPs []net.IP) []nl.IPMasqRule {
+	var stale []nl.IPMasqRule
+OUTER:
+	for _, rule := range rules {
+		for _, podIP := range podIPs {
+			if rule.Source.IP.Equal(podIP) {
+				continue OUTER
+			}
+		}
+		stale = append(stale, rule)
+	}
+	return stale
+}
+
+func actionCordon(c *cli.Context) error {
+	if err := lib.Cordon(c.String("path")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	return nil
+}
+
+func actionUncordon(c *cli.Context) error {
+	if err := lib.Uncordon(c.String("path")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	return nil
+}
+
+func actionBootstrap(c *cli.Context) error {
+	priority := c.Int("main-table-rule-priority")
+	if err := nl.ValidateRulePriorities(nl.PodRulePriority, priority); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+
+	// rules in another backend than kube-proxy's never see its traffic,
+	// which only shows as broken NodePorts
+	iptablesPath := c.String("iptables-path")
+	if err := nl.CheckIptablesBackend(iptablesPath); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: NodePort rules may not take effect: %v\n", err)
+	}
+
+	mask := c.Int("node-port-mark-mask")
+	if mask == 0 {
+		mask = c.Int("node-port-mark")
+	}
+	err := nl.SetupNodePortRule(iptablesPath, c.String("host-interface"), c.String("node-ports"), c.Int("node-port-mark"), mask, priority, c.Bool("node-port-sctp"), c.String("host-veth-prefix"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	return nil
+}
+
+func actionValidate(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		fmt.Fprintln(os.Stderr, "please specify configuration files")
+		return cli.NewExitError("need configuration files", 1)
+	}
+
+	failed := false
+	for _, path := range c.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+
+		problems := netconf.Validate(data)
+		if plugins, err := netconf.Plugins(data); err == nil {
+			for _, plugin := range plugins {
+				if plugin.Type == netconf.IPAMPluginType {
+					problems = append(problems, validateIPAMReferences(plugin.Raw)...)
+				}
+			}
+		}
+
+		for _, problem := range problems {
+			fmt.Printf("%v: %v\n", path, problem)
+		}
+		if len(problems) > 0 {
+			failed = true
+		}
+	}
+
+	if failed {
+		return cli.NewExitError("invalid configuration", 1)
+	}
+	return nil
+}
+
+// validateIPAMReferences checks that the security groups and subnet tags
+// of an IPAM configuration resolve in AWS, without changing any state
+func validateIPAMReferences(raw []byte) []error {
+	// an invalid configuration is reported by netconf.Validate
+	conf, err := netconf.LoadIPAMConf(raw)
+	if err != nil {
+		return nil
+	}
+
+	var problems []error
+	if err := aws.CheckSecurityGroups(conf.SecGroupIds); err != nil {
+		problems = append(problems, fmt.Errorf("%s: %v", netconf.IPAMPluginType, err))
+	}
+	if len(conf.SubnetTags) > 0 {
+		if err := aws.CheckSubnetTags(conf.SubnetTags); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", netconf.IPAMPluginType, err))
+		}
+	}
+	return problems
+}
+
 func main() {
 	if !aws.DefaultClient.Available() {
 		fmt.Fprintln(os.Stderr, "This command must be run from a running ec2 instance")
@@ -363,12 +843,16 @@ func main() {
 			Name:      "new-interface",
 			Usage:     "Create a new interface",
 			Action:    actionNewInterface,
-			ArgsUsage: "[--subnet_filter=k,v] [security_group_ids...]",
+			ArgsUsage: "[--subnet_filter=k,v] [--primary_ip=ip] [security_group_ids...]",
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "subnet_filter",
 					Usage: "Comma separated key=value filters to restrict subnets",
 				},
+				cli.StringFlag{
+					Name:  "primary_ip",
+					Usage: "Primary private IP for the interface, or " + aws.PrimaryIPLowestFree,
+				},
 			},
 		},
 		{
@@ -421,6 +905,48 @@ func main() {
 			Usage:  "Return a single number specifying the maximum number of pod addresses that can be used on this instance",
 			Action: actionMaxPods,
 		},
+		{
+			Name:   "capacity",
+			Usage:  "Show the free IP slots of each ENI and the Pod IP capacity of this instance",
+			Action: actionCapacity,
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "index",
+					Usage: "Interface index at or above which Pod IPs are counted"},
+			},
+		},
+		{
+			Name:   "status",
+			Usage:  "Show the secondary IPs of each ENI, the Pods using them and their route tables",
+			Action: actionStatus,
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "json",
+					Usage: "Print the status as JSON with stable field names"},
+				cli.IntFlag{Name: "pod-rule-priority",
+					Value: nl.PodRulePriority},
+			},
+		},
+		{
+			Name:   "check",
+			Usage:  "Check the datapath of a running Pod, exiting non-zero when any check fails",
+			Action: actionCheck,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "netns",
+					Usage: "Path of the network namespace of the Pod"},
+				cli.StringFlag{Name: "ifname",
+					Value: "eth0",
+					Usage: "Interface of the Pod holding its IPs"},
+				cli.StringFlag{Name: "container-interface",
+					Value: "veth0",
+					Usage: "Pod veth of the unnumbered-ptp plugin, its containerInterface"},
+				cli.IntFlag{Name: "pod-rule-priority",
+					Value: nl.PodRulePriority},
+				cli.BoolFlag{Name: "enforce-mtu",
+					Usage: "Check the MTU of the Pod veth matches the MTU of --host-interface"},
+				cli.StringFlag{Name: "host-interface",
+					Value: "eth0",
+					Usage: "ENI interface of the Pod"},
+			},
+		},
 		{
 			Name:   "bugs",
 			Usage:  "Show any bugs associated with this instance",
@@ -448,8 +974,147 @@ func main() {
 			Flags: []cli.Flag{
 				cli.DurationFlag{Name: "free-after",
 					Value: 0 * time.Second},
+				cli.IntFlag{Name: "warm-ip-target",
+					Usage: "Keep this many free IPs assigned on each ENI, as the warmIPTarget of the IPAM plugin"},
+				cli.IntFlag{Name: "index",
+					Usage: "Interface index of the warm pool"},
+			},
+		},
+		{
+			Name:   "reconcile",
+			Usage:  "Unassign the IPs of ENIs bound to no container for a grace period",
+			Action: actionReconcile,
+			Flags: []cli.Flag{
+				cli.DurationFlag{Name: "grace",
+					Value: 15 * time.Minute},
+				cli.IntFlag{Name: "index",
+					Usage: "Interface index at or above which ENIs are reconciled"},
+				cli.IntFlag{Name: "warm-ip-target",
+					Usage: "Keep this many free IPs assigned on each ENI, as the warmIPTarget of the IPAM plugin"},
+				cli.BoolFlag{Name: "dry-run",
+					Usage: "List the leaked IPs without unassigning them"},
+			},
+		},
+		{
+			Name:   "scale-down",
+			Usage:  "Detach and delete the secondary ENIs holding no Pod IP for a grace period",
+			Action: actionScaleDown,
+			Flags: []cli.Flag{
+				cli.DurationFlag{Name: "grace",
+					Value: 30 * time.Minute},
+				cli.IntFlag{Name: "keep",
+					Value: 1,
+					Usage: "Keep at least this many ENIs attached, counting the primary ENI"},
+				cli.IntFlag{Name: "index",
+					Usage: "Interface index at or above which ENIs are removed"},
+				cli.IntFlag{Name: "warm-ip-target",
+					Usage: "Refill the remaining ENIs to this many free IPs, as the warmIPTarget of the IPAM plugin"},
+				cli.BoolFlag{Name: "dry-run",
+					Usage: "List the idle ENIs without removing them"},
+			},
+		},
+		{
+			Name:   "warm-pool",
+			Usage:  "Assign free IPs on each ENI up to a warm IP target",
+			Action: actionWarmPool,
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "warm-ip-target",
+					Usage: "Free IPs to hold on each ENI, as the warmIPTarget of the IPAM plugin"},
+				cli.IntFlag{Name: "index",
+					Usage: "Interface index at or above which ENIs are filled"},
+			},
+		},
+		{
+			Name:   "gc",
+			Usage:  "Remove the policy rules, route tables and IP masquerade chains of Pods that are gone",
+			Action: actionGc,
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "dry-run",
+					Usage: "List what would be removed without removing it"},
+				cli.IntFlag{Name: "pod-rule-priority",
+					Value: nl.PodRulePriority},
+				cli.IntFlag{Name: "route-protocol",
+					Usage: "Only collect policy rules whose table holds routes tagged with the routeProtocol of the plugin"},
+				cli.StringFlag{Name: "network",
+					Usage: "Network name, prefixed by the cluster ID when set, of the IP masquerade chains to collect"},
+				cli.BoolFlag{Name: "node-port-rules",
+					Usage: "Remove the NodePort rules and restore rp_filter of the host interface once no Pod is left"},
+				cli.StringFlag{Name: "host-interface",
+					Value: "eth0"},
+				cli.StringFlag{Name: "node-ports",
+					Value: nl.DefaultNodePorts},
+				cli.IntFlag{Name: "node-port-mark",
+					Value: nl.DefaultNodePortMark},
+				cli.IntFlag{Name: "node-port-mark-mask",
+					Usage: "Connection mark bits owned by the NodePort mark, defaults to the mark"},
+				cli.IntFlag{Name: "main-table-rule-priority",
+					Value: nl.NodePortRulePriority},
+				cli.StringFlag{Name: "host-veth-prefix",
+					Usage: "Name prefix of Pod host veths, must match the hostVethPrefix of the plugin",
+					Value: nl.DefaultHostVethPrefix},
+				cli.StringFlag{Name: "iptables-path",
+					Usage: "iptables binary to add the rules with, must match the iptablesPath of the plugin"},
 			},
 		},
+		{
+			Name:   "bootstrap",
+			Usage:  "Set up NodePort rules and rp_filter at boot, before any Pod is scheduled",
+			Action: actionBootstrap,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "host-interface",
+					Value: "eth0"},
+				cli.StringFlag{Name: "node-ports",
+					Value: nl.DefaultNodePorts},
+				cli.IntFlag{Name: "node-port-mark",
+					Value: nl.DefaultNodePortMark},
+				cli.IntFlag{Name: "node-port-mark-mask",
+					Usage: "Connection mark bits owned by the NodePort mark, defaults to the mark"},
+				cli.IntFlag{Name: "main-table-rule-priority",
+					Value: nl.NodePortRulePriority},
+				cli.StringFlag{Name: "host-veth-prefix",
+					Usage: "Name prefix of Pod host veths, must match the hostVethPrefix of the plugin",
+					Value: nl.DefaultHostVethPrefix},
+				cli.StringFlag{Name: "iptables-path",
+					Usage: "iptables binary to add the rules with, must match the iptablesPath of the plugin"},
+				cli.BoolFlag{Name: "node-port-sctp",
+					Usage: "Also mark SCTP NodePorts, requires the sctp kernel module"},
+			},
+		},
+		{
+			Name:      "validate",
+			Usage:     "Check CNI configuration files for problems without applying them",
+			Action:    actionValidate,
+			ArgsUsage: "[config_file...]",
+		},
+		{
+			Name:   "cordon",
+			Usage:  "Block new IP allocations on this node",
+			Action: actionCordon,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "path",
+					Value: lib.DefaultCordonPath},
+			},
+		},
+		{
+			Name:   "uncordon",
+			Usage:  "Allow new IP allocations on this node",
+			Action: actionUncordon,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "path",
+					Value: lib.DefaultCordonPath},
+			},
+		},
+	}
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "ec2-endpoint",
+			Usage:  "EC2 API endpoint, as the ec2Endpoint of the IPAM plugin",
+			EnvVar: "AWS_EC2_ENDPOINT"},
+		cli.StringFlag{Name: "region",
+			Usage:  "Region of the EC2 API, as the region of the IPAM plugin",
+			EnvVar: "AWS_REGION"},
+	}
+	app.Before = func(c *cli.Context) error {
+		return aws.SetEC2Endpoint(c.GlobalString("ec2-endpoint"), c.GlobalString("region"))
 	}
 	app.Version = version
 	app.Copyright = "(c) 2017-2018 Lyft Inc."
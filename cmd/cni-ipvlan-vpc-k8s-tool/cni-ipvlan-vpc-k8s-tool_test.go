@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"net"
 	"testing"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
 // TestFilterBuildNil checks the empty string input
@@ -37,3 +42,45 @@ func TestFilterBuildMulti(t *testing.T) {
 	}
 
 }
+
+// TestStaleIPMasqRules checks only rules of missing Pod IPs are stale
+func TestStaleIPMasqRules(t *testing.T) {
+	_, live, _ := net.ParseCIDR("10.0.1.20/32")
+	_, gone, _ := net.ParseCIDR("10.0.1.21/32")
+	rules := []nl.IPMasqRule{{Source: live, ID: "live"}, {Source: gone, ID: "gone"}}
+
+	stale := staleIPMasqRules(rules, []net.IP{net.ParseIP("10.0.1.20")})
+	if len(stale) != 1 || stale[0].ID != "gone" {
+		t.Errorf("Unexpected stale rules %+v", stale)
+	}
+}
+
+// TestENIStatuses checks the JSON status of ENIs and their secondary IPs
+func TestENIStatuses(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.1.0/24")
+	interfaces := []aws.Interface{{
+		ID:         "eni-1",
+		Mac:        "0a:00:00:00:00:01",
+		Number:     1,
+		SubnetID:   "subnet-1",
+		SubnetCidr: subnet,
+		IPv4s:      []net.IP{net.ParseIP("10.0.1.10"), net.ParseIP("10.0.1.11"), net.ParseIP("10.0.1.12")},
+	}}
+	_, podIP, _ := net.ParseCIDR("10.0.1.11/32")
+	bound := []nl.BoundIP{{IPNet: podIP}}
+	assigned := map[string]string{"10.0.1.11": "abc123"}
+	tables := map[string]int{"10.0.1.11": 300}
+
+	statuses := eniStatuses(interfaces, aws.ENILimit{Adapters: 4, IPv4: 15}, bound, assigned, tables)
+	data, err := json.Marshal(statuses)
+	if err != nil {
+		t.Fatalf("Failed to marshal status: %v", err)
+	}
+	expected := `[{"deviceIndex":1,"id":"eni-1","mac":"0a:00:00:00:00:01","interface":"","subnetId":"subnet-1",` +
+		`"subnetCidr":"10.0.1.0/24","primaryIp":"10.0.1.10","freeSlots":12,"secondaryIps":[` +
+		`{"ip":"10.0.1.11","inUse":true,"containerId":"abc123","routeTable":300},` +
+		`{"ip":"10.0.1.12","inUse":false}]}]`
+	if string(data) != expected {
+		t.Errorf("Unexpected status\n%s\nexpected\n%s", data, expected)
+	}
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type counts struct {
+	Used int `json:"used"`
+	Free int `json:"free"`
+}
+
+func TestWriteFileAtomicConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capacity.json")
+
+	if err := WriteFileAtomic(path, []byte(`{"used":0,"free":100}`), 0644); err != nil {
+		t.Fatalf("Failed initial write: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				data, _ := json.Marshal(&counts{Used: i + j, Free: 100 - i - j})
+				if err := WriteFileAtomic(path, data, 0644); err != nil {
+					t.Errorf("Failed to write: %v", err)
+				}
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		var c counts
+		if err := json.Unmarshal(data, &c); err != nil {
+			t.Fatalf("Read a torn value %q: %v", data, err)
+		}
+		if c.Used+c.Free != 100 {
+			t.Fatalf("Inconsistent value %v", c)
+		}
+
+		select {
+		case <-done:
+			files, _ := ioutil.ReadDir(dir)
+			if len(files) != 1 {
+				t.Fatalf("Temporary files were left behind: %v", files)
+			}
+			return
+		default:
+		}
+	}
+}
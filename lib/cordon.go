@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+)
+
+// DefaultCordonPath is the sentinel file which blocks new IP allocations
+const DefaultCordonPath = "/run/cni-ipvlan-cordon"
+
+// ErrCordoned is returned when allocations are blocked by a cordon
+var ErrCordoned = fmt.Errorf("node cordoned for CNI allocation")
+
+// IsCordoned checks whether the sentinel file at path exists
+func IsCordoned(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Cordon blocks new allocations by creating the sentinel file at path
+func Cordon(path string) error {
+	file, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Uncordon removes the sentinel file at path, allowing allocations again
+func Uncordon(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCordon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cordon")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cordon")
+
+	if IsCordoned(path) {
+		t.Fatalf("Cordoned before cordon was called")
+	}
+
+	if err := Cordon(path); err != nil {
+		t.Fatalf("Failed to cordon: %v", err)
+	}
+	if !IsCordoned(path) {
+		t.Fatalf("Not cordoned after cordon was called")
+	}
+	// cordoning twice is fine
+	if err := Cordon(path); err != nil {
+		t.Fatalf("Failed to cordon again: %v", err)
+	}
+
+	if err := Uncordon(path); err != nil {
+		t.Fatalf("Failed to uncordon: %v", err)
+	}
+	if IsCordoned(path) {
+		t.Fatalf("Still cordoned after uncordon was called")
+	}
+	if err := Uncordon(path); err != nil {
+		t.Fatalf("Uncordoning an uncordoned node should not fail: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package lib
+
+import (
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// K8sArgs are the CNI_ARGS kubelet passes to identify the Pod
+type K8sArgs struct {
+	types.CommonArgs
+	K8S_POD_NAME      types.UnmarshallableString
+	K8S_POD_NAMESPACE types.UnmarshallableString
+}
+
+// LoadK8sArgs parses the Kubernetes CNI_ARGS, which are empty when
+// the runtime is not kubelet
+func LoadK8sArgs(args string) (*K8sArgs, error) {
+	k8sArgs := &K8sArgs{}
+	if err := types.LoadArgs(args, k8sArgs); err != nil {
+		return nil, err
+	}
+	return k8sArgs, nil
+}
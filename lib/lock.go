@@ -9,9 +9,19 @@ import (
 	"github.com/nightlyone/lockfile"
 )
 
+// ErrLockfileBusy is returned when the lock file stayed held by another
+// process for all attempts
+var ErrLockfileBusy = fmt.Errorf("Lockfile not acquired, aborting")
+
 // LockfileRun wraps execution of a specified function around a file lock
 func LockfileRun(run func() error) error {
-	lock, err := lockfile.New(filepath.Join(os.TempDir(), "cni-ipvlan-vpc-k8s.lock"))
+	return LockfileRunAt(filepath.Join(os.TempDir(), "cni-ipvlan-vpc-k8s.lock"), run)
+}
+
+// LockfileRunAt runs a function holding the lock file at path. A lock
+// left behind by a process which died is taken over.
+func LockfileRunAt(path string, run func() error) error {
+	lock, err := lockfile.New(path)
 	if err != nil {
 		return err
 	}
@@ -20,7 +30,7 @@ func LockfileRun(run func() error) error {
 	for {
 		tries--
 		if tries <= 0 {
-			return fmt.Errorf("Lockfile not acquired, aborting")
+			return ErrLockfileBusy
 		}
 
 		err = lock.TryLock()
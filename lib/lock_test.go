@@ -0,0 +1,40 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockfileRunAtStaleLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lyft-lock")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// leave the lock of a process which has exited
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Fatalf("Failed to run process: %v", err)
+	}
+	path := filepath.Join(dir, "tables.lock")
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", dead.Process.Pid)), 0644); err != nil {
+		t.Fatalf("Failed to write lock: %v", err)
+	}
+
+	ran := false
+	err = LockfileRunAt(path, func() error {
+		ran = true
+		return fmt.Errorf("route add failed")
+	})
+	if !ran || err == nil || err.Error() != "route add failed" {
+		t.Errorf("Expected the function error after taking over the lock, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Lock was not released after a failure: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogFields are the structured fields of a log entry
+type LogFields map[string]interface{}
+
+// Logger writes log entries as JSON lines. A nil Logger discards
+// entries, so logging costs nothing when disabled.
+type Logger struct {
+	lock sync.Mutex
+	out  io.WriteCloser
+}
+
+// OpenLogFile returns a logger appending to the file at path
+func OpenLogFile(path string) (*Logger, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file %v: %v", path, err)
+	}
+	return &Logger{out: f}, nil
+}
+
+// Tee returns a logger writing its entries to w as well as to the
+// outputs of l, which may be nil. Close only closes the outputs of l,
+// never w.
+func (l *Logger) Tee(w io.Writer) *Logger {
+	if l == nil {
+		return &Logger{out: writeCloser{w, nil}}
+	}
+	return &Logger{out: writeCloser{io.MultiWriter(l.out, w), l.out}}
+}
+
+// writeCloser closes closer, if any, in place of its writer
+type writeCloser struct {
+	io.Writer
+	closer io.Closer
+}
+
+func (w writeCloser) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+// Log writes an entry with a timestamp, msg and fields. Failures to
+// write are ignored as logging must not fail a CNI call.
+func (l *Logger) Log(msg string, fields LogFields) {
+	if l == nil {
+		return
+	}
+	entry := LogFields{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(LogFields{"time": entry["time"], "msg": msg, "error": err.Error()})
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	_, _ = l.out.Write(append(line, '\n'))
+}
+
+// Close closes the log file
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.out.Close()
+}
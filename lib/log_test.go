@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lyft-log")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cni.log")
+	logger, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	logger.Log("route added", LogFields{"table": 256})
+	logger.Log("rule added", nil)
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Failed to close log file: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	defer f.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Log line %q is not JSON: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %v", entries)
+	}
+	if entries[0]["msg"] != "route added" || entries[0]["table"] != float64(256) || entries[0]["time"] == nil {
+		t.Errorf("Unexpected entry %v", entries[0])
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *Logger
+	logger.Log("discarded", LogFields{"table": 256})
+	if err := logger.Close(); err != nil {
+		t.Errorf("Nil logger failed to close: %v", err)
+	}
+}
+
+func TestLoggerTee(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lyft-log")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stderr bytes.Buffer
+	var logger *Logger
+	logger.Tee(&stderr).Log("traced", nil)
+	if !strings.Contains(stderr.String(), `"msg":"traced"`) {
+		t.Errorf("Tee of a nil logger wrote %q", stderr.String())
+	}
+
+	path := filepath.Join(dir, "cni.log")
+	if logger, err = OpenLogFile(path); err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	stderr.Reset()
+	logger = logger.Tee(&stderr)
+	logger.Log("route added", nil)
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Failed to close log file: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if string(data) != stderr.String() || !strings.Contains(string(data), `"msg":"route added"`) {
+		t.Errorf("Log file %q and tee %q differ", data, stderr.String())
+	}
+}
@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds in seconds of latency histograms
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics accumulates counters and histograms during a CNI call and
+// adds them to a Prometheus text file, as read by the node_exporter
+// textfile collector. A nil Metrics records nothing.
+type Metrics struct {
+	path string
+
+	lock   sync.Mutex
+	deltas map[string]float64
+	types  map[string]string
+}
+
+// NewMetrics returns metrics added to the text file at path on Flush
+func NewMetrics(path string) *Metrics {
+	return &Metrics{path: path, deltas: map[string]float64{}, types: map[string]string{}}
+}
+
+// series formats a metric name and its labels, given as name/value
+// pairs
+func series(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Inc increments the counter name with the given label name/value
+// pairs
+func (m *Metrics) Inc(name string, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.types[name] = "counter"
+	m.deltas[series(name, labels)]++
+}
+
+// Observe records value in the histogram name with DefaultBuckets
+func (m *Metrics) Observe(name string, value float64) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.types[name] = "histogram"
+	// every bucket is written, even when empty
+	for _, bound := range DefaultBuckets {
+		bucket := series(name+"_bucket", []string{"le", strconv.FormatFloat(bound, 'g', -1, 64)})
+		m.deltas[bucket] += 0
+		if value <= bound {
+			m.deltas[bucket]++
+		}
+	}
+	m.deltas[series(name+"_bucket", []string{"le", "+Inf"})]++
+	m.deltas[name+"_sum"] += value
+	m.deltas[name+"_count"]++
+}
+
+// Flush adds the recorded values to the metrics file. Concurrent
+// plugin processes are serialized by a lock file, and the file is
+// replaced atomically so the collector never reads a partial file.
+func (m *Metrics) Flush() error {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.deltas) == 0 {
+		return nil
+	}
+
+	path, err := filepath.Abs(m.path)
+	if err != nil {
+		return err
+	}
+	err = LockfileRunAt(path+".lock", func() error {
+		values, types, err := readMetrics(path)
+		if err != nil {
+			return err
+		}
+		for name, t := range m.types {
+			types[name] = t
+		}
+		for s, delta := range m.deltas {
+			values[s] += delta
+		}
+		return WriteFileAtomic(path, formatMetrics(values, types), 0644)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write metrics to %v: %v", m.path, err)
+	}
+	m.deltas = map[string]float64{}
+	return nil
+}
+
+// readMetrics parses the series and TYPE comments of a metrics file
+func readMetrics(path string) (map[string]float64, map[string]string, error) {
+	values := map[string]float64{}
+	types := map[string]string{}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return values, types, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "# TYPE ") {
+			if fields := strings.Fields(line); len(fields) == 4 {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if line == "" || strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		values[line[:i]] = value
+	}
+	return values, types, scanner.Err()
+}
+
+// formatMetrics renders series in the Prometheus text format, grouped
+// under the TYPE of their metric
+func formatMetrics(values map[string]float64, types map[string]string) []byte {
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var all []string
+	for s := range values {
+		all = append(all, s)
+	}
+	// buckets sort by their upper bound
+	sort.Slice(all, func(i, j int) bool {
+		bi, bj := seriesBase(all[i]), seriesBase(all[j])
+		if bi != bj {
+			return bi < bj
+		}
+		if li, lj := bucketBound(all[i]), bucketBound(all[j]); li != lj {
+			return li < lj
+		}
+		return all[i] < all[j]
+	})
+
+	var buf bytes.Buffer
+	written := map[string]bool{}
+	for _, name := range names {
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, types[name])
+		for _, s := range all {
+			base := seriesBase(s)
+			if base == name || (types[name] == "histogram" &&
+				(base == name+"_bucket" || base == name+"_sum" || base == name+"_count")) {
+				fmt.Fprintf(&buf, "%s %s\n", s, strconv.FormatFloat(values[s], 'g', -1, 64))
+				written[s] = true
+			}
+		}
+	}
+	for _, s := range all {
+		if !written[s] {
+			fmt.Fprintf(&buf, "%s %s\n", s, strconv.FormatFloat(values[s], 'g', -1, 64))
+		}
+	}
+	return buf.Bytes()
+}
+
+// seriesBase returns the metric name of a series
+func seriesBase(s string) string {
+	if i := strings.Index(s, "{"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// bucketBound returns the le label of a histogram bucket series, 0 for
+// other series
+func bucketBound(s string) float64 {
+	i := strings.Index(s, `le="`)
+	if i < 0 {
+		return 0
+	}
+	bound := s[i+len(`le="`):]
+	if j := strings.Index(bound, `"`); j >= 0 {
+		bound = bound[:j]
+	}
+	value, err := strconv.ParseFloat(bound, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
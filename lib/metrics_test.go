@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetricsFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lyft-metrics")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cni.prom")
+
+	// two plugin invocations adding to the same file
+	for i := 0; i < 2; i++ {
+		m := NewMetrics(path)
+		m.Inc("cni_invocations_total", "command", "ADD")
+		m.Observe("cni_duration_seconds", 0.3)
+		if err := m.Flush(); err != nil {
+			t.Fatalf("Failed to flush metrics: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	text := string(data)
+	for _, expected := range []string{
+		"# TYPE cni_invocations_total counter\ncni_invocations_total{command=\"ADD\"} 2\n",
+		"# TYPE cni_duration_seconds histogram\n",
+		"cni_duration_seconds_bucket{le=\"0.25\"} 0\n",
+		"cni_duration_seconds_bucket{le=\"0.5\"} 2\n",
+		"cni_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"cni_duration_seconds_count 2\n",
+		"cni_duration_seconds_sum 0.6\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Metrics %q do not contain %q", text, expected)
+		}
+	}
+	if strings.Index(text, `le="0.5"`) > strings.Index(text, `le="+Inf"`) {
+		t.Errorf("Buckets are not sorted by bound: %q", text)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.Inc("cni_invocations_total")
+	m.Observe("cni_duration_seconds", 1)
+	if err := m.Flush(); err != nil {
+		t.Errorf("Nil metrics failed to flush: %v", err)
+	}
+}
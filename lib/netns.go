@@ -0,0 +1,29 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// GetNSWithRetry opens the network namespace at path. During container
+// startup the namespace can briefly be absent, so failed opens are
+// retried up to retries times, waiting backoff between attempts.
+func GetNSWithRetry(path string, retries int, backoff time.Duration) (ns.NetNS, error) {
+	return getNSWithRetry(ns.GetNS, path, retries, backoff)
+}
+
+func getNSWithRetry(open func(string) (ns.NetNS, error), path string, retries int, backoff time.Duration) (ns.NetNS, error) {
+	netns, err := open(path)
+	for attempt := 0; err != nil && attempt < retries; attempt++ {
+		fmt.Fprintf(os.Stderr, "failed to open netns %q, retrying in %v: %v\n", path, backoff, err)
+		time.Sleep(backoff)
+		netns, err = open(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netns %q: %v", path, err)
+	}
+	return netns, nil
+}
@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+type mockNS struct {
+	ns.NetNS
+}
+
+func TestGetNSWithRetry(t *testing.T) {
+	calls := 0
+	flaky := func(path string) (ns.NetNS, error) {
+		calls++
+		if calls == 1 {
+			return nil, ns.NSPathNotExistErr{}
+		}
+		return &mockNS{}, nil
+	}
+
+	netns, err := getNSWithRetry(flaky, "/var/run/netns/test", 2, 0)
+	if err != nil || netns == nil {
+		t.Fatalf("Retry did not recover: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 opens, got %d", calls)
+	}
+
+	calls = 0
+	broken := func(path string) (ns.NetNS, error) {
+		calls++
+		return nil, fmt.Errorf("broken")
+	}
+	if _, err := getNSWithRetry(broken, "/var/run/netns/test", 2, 0); err == nil {
+		t.Errorf("Expected an error after exhausting retries")
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 opens, got %d", calls)
+	}
+}
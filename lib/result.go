@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+// interfaceMTU adds the MTU, which CNI spec 1.1 reports, to the
+// interfaces of the result types we build against
+type interfaceMTU struct {
+	*current.Interface
+	MTU int `json:"mtu,omitempty"`
+}
+
+// resultMTU is a result with interfaceMTU interfaces
+type resultMTU struct {
+	*current.Result
+	Interfaces []*interfaceMTU `json:"interfaces,omitempty"`
+}
+
+// marshalResult encodes result as version, with the MTU of the
+// interfaces named in mtus
+func marshalResult(result types.Result, version string, mtus map[string]int) ([]byte, error) {
+	res, err := result.GetAsVersion(ResultVersion(version))
+	if err != nil {
+		return nil, err
+	}
+	r, ok := res.(*current.Result)
+	if ok && r.CNIVersion != version {
+		// 0.4.0 and 1.0.0 results are 0.3.1 results of another version
+		converted := *r
+		converted.CNIVersion = version
+		r, res = &converted, &converted
+	}
+	if !ok || len(mtus) == 0 {
+		return json.MarshalIndent(res, "", "    ")
+	}
+
+	out := &resultMTU{Result: r}
+	for _, intf := range r.Interfaces {
+		out.Interfaces = append(out.Interfaces, &interfaceMTU{intf, mtus[intf.Name]})
+	}
+	return json.MarshalIndent(out, "", "    ")
+}
+
+// PrintResult prints result as version to stdout like
+// types.PrintResult, adding the MTU of the interfaces named in mtus so
+// that chained plugins and the runtime see the MTU a plugin chose
+func PrintResult(result types.Result, version string, mtus map[string]int) error {
+	data, err := marshalResult(result, version, mtus)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// ResultMTUs returns the MTU of the interfaces of a raw prevResult by
+// name, as added by PrintResult
+func ResultMTUs(raw map[string]interface{}) map[string]int {
+	mtus := make(map[string]int)
+	interfaces, _ := raw["interfaces"].([]interface{})
+	for _, i := range interfaces {
+		intf, _ := i.(map[string]interface{})
+		name, _ := intf["name"].(string)
+		// JSON numbers decode to float64
+		if mtu, ok := intf["mtu"].(float64); ok && name != "" && mtu > 0 {
+			mtus[name] = int(mtu)
+		}
+	}
+	return mtus
+}
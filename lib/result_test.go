@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+func TestResultMTUs(t *testing.T) {
+	result := &current.Result{
+		CNIVersion: "0.3.1",
+		Interfaces: []*current.Interface{{Name: "eth0", Sandbox: "/var/run/netns/pod"}, {Name: "veth0"}},
+	}
+	data, err := marshalResult(result, "0.3.1", map[string]int{"eth0": 1400})
+	if err != nil {
+		t.Fatalf("Failed to marshal result: %v", err)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Failed to unmarshal %s: %v", data, err)
+	}
+	mtus := ResultMTUs(raw)
+	if len(mtus) != 1 || mtus["eth0"] != 1400 {
+		t.Errorf("Expected the MTU of eth0 only, got %v", mtus)
+	}
+
+	// the remaining fields are those of the plain result
+	parsed, err := current.NewResult(data)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", data, err)
+	}
+	if r := parsed.(*current.Result); len(r.Interfaces) != 2 || r.Interfaces[0].Sandbox != "/var/run/netns/pod" || r.CNIVersion != "0.3.1" {
+		t.Errorf("Unexpected result %v", r)
+	}
+
+	// 0.2.0 results have no interfaces to add the MTU to
+	_, ipn, _ := net.ParseCIDR("10.0.0.5/32")
+	result.IPs = []*current.IPConfig{{Version: "4", Address: *ipn}}
+	if data, err = marshalResult(result, "0.2.0", map[string]int{"eth0": 1400}); err != nil || strings.Contains(string(data), "mtu") {
+		t.Errorf("Unexpected 0.2.0 result %s: %v", data, err)
+	}
+}
@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// Error codes returned to the runtime. Codes 7 and 11 were defined by
+// CNI spec 1.0; runtimes speaking the older versions the plugins
+// support treat them as any other error code.
+const (
+	ErrCodeInvalidNetworkConfig uint = 7
+	ErrCodeTryAgainLater        uint = 11
+	ErrCodePluginNotAvailable   uint = 50
+	ErrCodeInternal             uint = 100
+)
+
+// TryAgainLater marks err as transient, e.g. EC2 throttling, so the
+// runtime retries the call with backoff instead of failing the Pod
+func TryAgainLater(err error) error {
+	return typedError(ErrCodeTryAgainLater, err)
+}
+
+// InvalidConfig marks err as a configuration error no retry fixes
+func InvalidConfig(err error) error {
+	return typedError(ErrCodeInvalidNetworkConfig, err)
+}
+
+// typedError gives err a CNI error code, keeping the code of errors
+// which already have one
+func typedError(code uint, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*types.Error); ok {
+		return err
+	}
+	return &types.Error{Code: code, Msg: err.Error()}
+}
+
+// PluginFuncs contains the handlers for each CNI verb supported by a
+// plugin. Missing Check, Status and GC handlers report success.
+type PluginFuncs struct {
+	Add    func(*skel.CmdArgs) error
+	Del    func(*skel.CmdArgs) error
+	Check  func(*skel.CmdArgs) error
+	Status func(*skel.CmdArgs) error
+	GC     func(*skel.CmdArgs) error
+}
+
+// GCAttachment is an attachment the runtime still considers valid
+// during garbage collection
+type GCAttachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+}
+
+// PluginMain runs a plugin for the verb given in CNI_COMMAND. ADD, DEL
+// and VERSION are handled by skel; CHECK (CNI spec 0.4), STATUS and GC
+// (CNI spec 1.1) are dispatched here as the skel package we build
+// against predates them.
+func PluginMain(funcs PluginFuncs, versionInfo version.PluginInfo) {
+	if e := pluginMainWithError(funcs, versionInfo); e != nil {
+		exitWithError(e)
+	}
+}
+
+func pluginMainWithError(funcs PluginFuncs, versionInfo version.PluginInfo) *types.Error {
+	cmd := os.Getenv("CNI_COMMAND")
+	switch cmd {
+	case "CHECK", "STATUS", "GC":
+	default:
+		return skel.PluginMainWithError(funcs.Add, funcs.Del, versionInfo)
+	}
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return &types.Error{
+			Code: ErrCodeInternal,
+			Msg:  fmt.Sprintf("error reading from stdin: %v", err),
+		}
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Args:        os.Getenv("CNI_ARGS"),
+		Path:        os.Getenv("CNI_PATH"),
+		StdinData:   stdin,
+	}
+	if e := checkVersion(args.StdinData, versionInfo); e != nil {
+		return e
+	}
+	return runVerb(funcs, cmd, args)
+}
+
+// checkVersion rejects a configuration whose cniVersion the plugin
+// doesn't support, as skel does for ADD and DEL
+func checkVersion(stdin []byte, versionInfo version.PluginInfo) *types.Error {
+	configVersion, err := (&version.ConfigDecoder{}).Decode(stdin)
+	if err != nil {
+		return &types.Error{Code: ErrCodeInternal, Msg: err.Error()}
+	}
+	if verErr := (&version.Reconciler{}).Check(configVersion, versionInfo); verErr != nil {
+		return &types.Error{
+			Code:    types.ErrIncompatibleCNIVersion,
+			Msg:     "incompatible CNI versions",
+			Details: verErr.Details(),
+		}
+	}
+	return nil
+}
+
+func runVerb(funcs PluginFuncs, cmd string, args *skel.CmdArgs) *types.Error {
+	var fn func(*skel.CmdArgs) error
+	code := ErrCodeInternal
+	switch cmd {
+	case "CHECK":
+		fn = funcs.Check
+	case "STATUS":
+		fn = funcs.Status
+		code = ErrCodePluginNotAvailable
+	case "GC":
+		fn = funcs.GC
+	default:
+		return &types.Error{Code: ErrCodeInternal, Msg: fmt.Sprintf("unknown CNI_COMMAND: %v", cmd)}
+	}
+
+	if fn == nil {
+		return nil
+	}
+	err := fn(args)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*types.Error); ok {
+		return e
+	}
+	return &types.Error{Code: code, Msg: err.Error()}
+}
+
+func exitWithError(e *types.Error) {
+	if err := e.Print(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing error JSON to stdout: %v", err)
+	}
+	os.Exit(1)
+}
+
+// ValidAttachments returns the attachments listed as valid in the
+// configuration of a GC request
+func ValidAttachments(stdin []byte) ([]GCAttachment, error) {
+	conf := struct {
+		ValidAttachments []GCAttachment `json:"cni.dev/valid-attachments"`
+	}{}
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse valid attachments: %v", err)
+	}
+	return conf.ValidAttachments, nil
+}
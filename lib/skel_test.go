@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestRunVerbStatus(t *testing.T) {
+	args := &skel.CmdArgs{}
+
+	if e := runVerb(PluginFuncs{}, "STATUS", args); e != nil {
+		t.Errorf("Missing status handler should report available, got %v", e)
+	}
+
+	funcs := PluginFuncs{Status: func(*skel.CmdArgs) error { return fmt.Errorf("no capacity") }}
+	e := runVerb(funcs, "STATUS", args)
+	if e == nil || e.Code != ErrCodePluginNotAvailable || e.Msg != "no capacity" {
+		t.Errorf("Status failure was not reported as unavailable: %v", e)
+	}
+}
+
+func TestRunVerbCheck(t *testing.T) {
+	if e := runVerb(PluginFuncs{}, "CHECK", &skel.CmdArgs{}); e != nil {
+		t.Errorf("Missing check handler should report success, got %v", e)
+	}
+
+	funcs := PluginFuncs{Check: func(*skel.CmdArgs) error { return fmt.Errorf("veth is missing") }}
+	e := runVerb(funcs, "CHECK", &skel.CmdArgs{})
+	if e == nil || e.Code != ErrCodeInternal || e.Msg != "veth is missing" {
+		t.Errorf("Check failure was not reported: %v", e)
+	}
+}
+
+func TestRunVerbGC(t *testing.T) {
+	called := false
+	funcs := PluginFuncs{GC: func(*skel.CmdArgs) error {
+		called = true
+		return &types.Error{Code: 11, Msg: "try again"}
+	}}
+
+	e := runVerb(funcs, "GC", &skel.CmdArgs{})
+	if !called {
+		t.Fatalf("GC handler was not called")
+	}
+	if e == nil || e.Code != 11 {
+		t.Errorf("Typed GC error was not passed through: %v", e)
+	}
+
+	if e := runVerb(funcs, "BOGUS", &skel.CmdArgs{}); e == nil {
+		t.Errorf("Unknown verb did not fail")
+	}
+}
+
+func TestValidAttachments(t *testing.T) {
+	stdin := []byte(`{"cniVersion":"1.1.0","name":"test","cni.dev/valid-attachments":[{"containerID":"abc","ifname":"eth0"}]}`)
+	attachments, err := ValidAttachments(stdin)
+	if err != nil {
+		t.Fatalf("Failed to parse attachments: %v", err)
+	}
+	if len(attachments) != 1 || attachments[0].ContainerID != "abc" || attachments[0].IfName != "eth0" {
+		t.Errorf("Unexpected attachments %v", attachments)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	if e, ok := TryAgainLater(fmt.Errorf("throttled")).(*types.Error); !ok || e.Code != ErrCodeTryAgainLater || e.Msg != "throttled" {
+		t.Errorf("Unexpected transient error %v", e)
+	}
+	if e, ok := InvalidConfig(fmt.Errorf("bad mtu")).(*types.Error); !ok || e.Code != ErrCodeInvalidNetworkConfig {
+		t.Errorf("Unexpected configuration error %v", e)
+	}
+	// the code of typed errors is kept
+	if e := InvalidConfig(TryAgainLater(fmt.Errorf("throttled"))).(*types.Error); e.Code != ErrCodeTryAgainLater {
+		t.Errorf("Error code was replaced with %d", e.Code)
+	}
+	if TryAgainLater(nil) != nil {
+		t.Errorf("nil error was wrapped")
+	}
+}
+
+// runPluginMain runs pluginMainWithError as a runtime would invoke the
+// plugin for cmd with the configuration conf
+func runPluginMain(t *testing.T, funcs PluginFuncs, cmd, conf string) *types.Error {
+	env := map[string]string{
+		"CNI_COMMAND":     cmd,
+		"CNI_CONTAINERID": "container",
+		"CNI_NETNS":       "/var/run/netns/test",
+		"CNI_IFNAME":      "eth0",
+		"CNI_PATH":        "/opt/cni/bin",
+	}
+	for k, v := range env {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		if ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+	}
+
+	stdin, err := ioutil.TempFile("", "cni-conf")
+	if err != nil {
+		t.Fatalf("Failed to create stdin: %v", err)
+	}
+	defer os.Remove(stdin.Name())
+	defer stdin.Close()
+	if _, err := stdin.WriteString(conf); err != nil {
+		t.Fatalf("Failed to write stdin: %v", err)
+	}
+	if _, err := stdin.Seek(0, 0); err != nil {
+		t.Fatalf("Failed to rewind stdin: %v", err)
+	}
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = oldStdin }()
+
+	return pluginMainWithError(funcs, AllVersions)
+}
+
+func TestPluginMainVersions(t *testing.T) {
+	called := make(map[string]bool)
+	handler := func(cmd string) func(*skel.CmdArgs) error {
+		return func(*skel.CmdArgs) error {
+			called[cmd] = true
+			return nil
+		}
+	}
+	funcs := PluginFuncs{
+		Add:    handler("ADD"),
+		Del:    handler("DEL"),
+		Check:  handler("CHECK"),
+		Status: handler("STATUS"),
+		GC:     handler("GC"),
+	}
+
+	for _, cmd := range []string{"ADD", "DEL", "CHECK", "STATUS", "GC"} {
+		if e := runPluginMain(t, funcs, cmd, `{"cniVersion":"1.1.0","name":"test"}`); e != nil {
+			t.Errorf("%s of a 1.1.0 configuration failed: %v", cmd, e)
+		}
+		if !called[cmd] {
+			t.Errorf("%s handler was not called", cmd)
+		}
+	}
+
+	called = make(map[string]bool)
+	for _, cmd := range []string{"ADD", "STATUS", "GC"} {
+		e := runPluginMain(t, funcs, cmd, `{"cniVersion":"2.0.0","name":"test"}`)
+		if e == nil || e.Code != types.ErrIncompatibleCNIVersion {
+			t.Errorf("%s of an unsupported version was not rejected: %v", cmd, e)
+		}
+		if called[cmd] {
+			t.Errorf("%s handler was called for an unsupported version", cmd)
+		}
+	}
+}
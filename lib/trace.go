@@ -0,0 +1,203 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+// Span attribute keys
+const (
+	AttrContainerID = "container.id"
+	AttrENIID       = "eni.id"
+	AttrRouteTable  = "route.table"
+)
+
+// Span is a timed operation of a CNI call
+type Span struct {
+	Name       string            `json:"name"`
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentSpanId,omitempty"`
+	Start      time.Time         `json:"startTime"`
+	End        time.Time         `json:"endTime"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	tracer *Tracer
+}
+
+// SpanExporter ships finished spans to a tracing backend
+type SpanExporter interface {
+	Export(spans []*Span) error
+}
+
+// Tracer records the spans of a single CNI call. A nil Tracer is a
+// no-op, as are the spans it returns, so tracing costs nothing when
+// disabled.
+type Tracer struct {
+	exporter SpanExporter
+	traceID  string
+	root     *Span
+
+	lock  sync.Mutex
+	spans []*Span
+}
+
+// NewTracer returns a tracer exporting its spans to exporter
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter, traceID: randomID(16)}
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// StartSpan starts a span. The first span of a tracer is the parent of
+// all later ones.
+func (t *Tracer) StartSpan(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		Name:       name,
+		TraceID:    t.traceID,
+		SpanID:     randomID(8),
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+		tracer:     t,
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.root == nil {
+		t.root = span
+	} else {
+		span.ParentID = t.root.SpanID
+	}
+	return span
+}
+
+// SetAttribute records an attribute on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = fmt.Sprint(value)
+}
+
+// Finish ends the span, recording err if any
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s)
+}
+
+// Flush exports the finished spans
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.lock.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+	return t.exporter.Export(spans)
+}
+
+// HTTPExporter posts spans as JSON to a collector endpoint
+type HTTPExporter struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// Export implements SpanExporter
+func (e *HTTPExporter) Export(spans []*Span) error {
+	body, err := json.Marshal(map[string][]*Span{"spans": spans})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: e.Timeout}
+	resp, err := client.Post(e.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to export spans to %v: %v", e.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to export spans to %v: unexpected status %v", e.URL, resp.Status)
+	}
+	return nil
+}
+
+// MemoryExporter keeps exported spans in memory
+type MemoryExporter struct {
+	Spans []*Span
+}
+
+// Export implements SpanExporter
+func (e *MemoryExporter) Export(spans []*Span) error {
+	e.Spans = append(e.Spans, spans...)
+	return nil
+}
+
+// TracingConf contains the tracing options understood by every plugin
+type TracingConf struct {
+	Tracing         bool   `json:"tracing"`
+	TracingEndpoint string `json:"tracingEndpoint"`
+}
+
+// DefaultTracingTimeout bounds the export of the spans of a call
+const DefaultTracingTimeout = 2 * time.Second
+
+// TracerFromConf returns a tracer exporting to the configured endpoint
+// when tracing is enabled in the network configuration, nil otherwise
+func TracerFromConf(stdin []byte) *Tracer {
+	conf := TracingConf{}
+	if err := json.Unmarshal(stdin, &conf); err != nil || !conf.Tracing || conf.TracingEndpoint == "" {
+		return nil
+	}
+	return NewTracer(&HTTPExporter{URL: conf.TracingEndpoint, Timeout: DefaultTracingTimeout})
+}
+
+// TraceVerb wraps the handler of a CNI verb in a span named name. The
+// tracer of the call is handed to set so sub-steps can add their own
+// spans. Export failures are only logged.
+func TraceVerb(name string, set func(*Tracer), fn func(*skel.CmdArgs) error) func(*skel.CmdArgs) error {
+	return func(args *skel.CmdArgs) error {
+		tracer := TracerFromConf(args.StdinData)
+		set(tracer)
+
+		span := tracer.StartSpan(name)
+		span.SetAttribute(AttrContainerID, args.ContainerID)
+		err := fn(args)
+		span.Finish(err)
+
+		if flushErr := tracer.Flush(); flushErr != nil {
+			fmt.Fprintln(os.Stderr, flushErr)
+		}
+		return err
+	}
+}
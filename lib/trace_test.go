@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.StartSpan("noop")
+	span.SetAttribute(AttrENIID, "eni-1")
+	span.Finish(fmt.Errorf("ignored"))
+	if err := tracer.Flush(); err != nil {
+		t.Errorf("Nil tracer failed to flush: %v", err)
+	}
+}
+
+func TestTracerSpans(t *testing.T) {
+	exporter := &MemoryExporter{}
+	tracer := NewTracer(exporter)
+
+	root := tracer.StartSpan("cmdAdd")
+	child := tracer.StartSpan("route-programming")
+	child.SetAttribute(AttrRouteTable, 256)
+	child.Finish(fmt.Errorf("no free table"))
+	root.Finish(nil)
+
+	if err := tracer.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if len(exporter.Spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %v", exporter.Spans)
+	}
+	if child.ParentID != root.SpanID || root.ParentID != "" {
+		t.Errorf("Span %v is not a child of %v", child, root)
+	}
+	if child.TraceID != root.TraceID {
+		t.Errorf("Spans of a tracer do not share the trace id")
+	}
+	if child.Attributes[AttrRouteTable] != "256" || child.Error != "no free table" {
+		t.Errorf("Unexpected span %v", child)
+	}
+}
+
+func TestTraceVerb(t *testing.T) {
+	var received struct {
+		Spans []*Span `json:"spans"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	var set *Tracer
+	fn := TraceVerb("cmdAdd", func(t *Tracer) { set = t }, func(*skel.CmdArgs) error {
+		set.StartSpan("veth-setup").Finish(nil)
+		return nil
+	})
+
+	args := &skel.CmdArgs{
+		ContainerID: "abc",
+		StdinData:   []byte(fmt.Sprintf(`{"tracing": true, "tracingEndpoint": %q}`, server.URL)),
+	}
+	if err := fn(args); err != nil {
+		t.Fatalf("Traced verb failed: %v", err)
+	}
+	if len(received.Spans) != 2 {
+		t.Fatalf("Expected 2 exported spans, got %v", received.Spans)
+	}
+	root := received.Spans[1]
+	if root.Name != "cmdAdd" || root.Attributes[AttrContainerID] != "abc" {
+		t.Errorf("Unexpected root span %v", root)
+	}
+
+	args.StdinData = []byte(`{}`)
+	if err := fn(args); err != nil || set != nil {
+		t.Errorf("Tracing was not disabled by default")
+	}
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// CNI spec versions newer than the version package we build against.
+// 0.4.0 adds CHECK, 1.0.0 drops the version of result IPs and 1.1.0
+// adds STATUS and GC; their results are otherwise those of 0.3.1.
+const (
+	CNIVersion040 = "0.4.0"
+	CNIVersion100 = "1.0.0"
+	CNIVersion110 = "1.1.0"
+)
+
+// resultVersions maps the versions the result types don't know to the
+// version their results are encoded and parsed as
+var resultVersions = map[string]string{
+	CNIVersion040: "0.3.1",
+	CNIVersion100: "0.3.1",
+	CNIVersion110: "0.3.1",
+}
+
+// AllVersions are the versions of version.All along with those of
+// resultVersions
+var AllVersions = version.PluginSupports(append(version.All.SupportedVersions(), CNIVersion040, CNIVersion100, CNIVersion110)...)
+
+// ResultVersion returns the version the result types encode and parse
+// the results of cniVersion as
+func ResultVersion(cniVersion string) string {
+	if v, ok := resultVersions[cniVersion]; ok {
+		return v
+	}
+	return cniVersion
+}
+
+// DelegateConf returns the configuration stdin to pass to a delegated
+// plugin, whose result is parsed as the cniVersion of the configuration.
+// A cniVersion the result types don't know is rewritten to the one they
+// parse its results as.
+func DelegateConf(stdin []byte) ([]byte, error) {
+	conf := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(stdin))
+	// keep large integers such as route table numbers intact
+	decoder.UseNumber()
+	if err := decoder.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+	cniVersion, _ := conf["cniVersion"].(string)
+	if ResultVersion(cniVersion) == cniVersion {
+		return stdin, nil
+	}
+	conf["cniVersion"] = ResultVersion(cniVersion)
+	return json.Marshal(conf)
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+)
+
+func TestAllVersions(t *testing.T) {
+	supported := make(map[string]bool)
+	for _, v := range AllVersions.SupportedVersions() {
+		supported[v] = true
+	}
+	for _, v := range []string{"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0", "1.1.0"} {
+		if !supported[v] {
+			t.Errorf("Version %s is not supported", v)
+		}
+	}
+	if v := ResultVersion("0.4.0"); v != "0.3.1" {
+		t.Errorf("0.4.0 results are encoded as %s", v)
+	}
+	if v := ResultVersion("1.0.0"); v != "0.3.1" {
+		t.Errorf("1.0.0 results are encoded as %s", v)
+	}
+	if v := ResultVersion("1.1.0"); v != "0.3.1" {
+		t.Errorf("1.1.0 results are encoded as %s", v)
+	}
+	if v := ResultVersion("0.2.0"); v != "0.2.0" {
+		t.Errorf("0.2.0 results are encoded as %s", v)
+	}
+}
+
+func TestDelegateConf(t *testing.T) {
+	stdin := []byte(`{"cniVersion": "0.4.0", "name": "net", "routeTableEnd": 4294967295, "ipam": {"type": "cni-ipvlan-vpc-k8s-ipam"}}`)
+	delegated, err := DelegateConf(stdin)
+	if err != nil {
+		t.Fatalf("Failed to rewrite the config: %v", err)
+	}
+	var conf map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(delegated))
+	decoder.UseNumber()
+	if err := decoder.Decode(&conf); err != nil {
+		t.Fatalf("Failed to parse %s: %v", delegated, err)
+	}
+	if conf["cniVersion"] != "0.3.1" || conf["name"] != "net" || conf["routeTableEnd"] != json.Number("4294967295") {
+		t.Errorf("Unexpected delegated config %s", delegated)
+	}
+
+	if delegated, err := DelegateConf([]byte(`{"cniVersion": "1.0.0"}`)); err != nil || string(delegated) != `{"cniVersion":"0.3.1"}` {
+		t.Errorf("1.0.0 config was rewritten to %s: %v", delegated, err)
+	}
+
+	// other versions are passed as is
+	stdin = []byte(`{"cniVersion": "0.3.1", "name": "net"}`)
+	if delegated, err := DelegateConf(stdin); err != nil || string(delegated) != string(stdin) {
+		t.Errorf("Config was rewritten to %s: %v", delegated, err)
+	}
+	if _, err := DelegateConf([]byte(`{`)); err == nil {
+		t.Errorf("Unparseable config was accepted")
+	}
+}
+
+func TestMarshalResult040(t *testing.T) {
+	result := &current.Result{CNIVersion: "0.3.1", Interfaces: []*current.Interface{{Name: "eth0"}}}
+	data, err := marshalResult(result, "0.4.0", map[string]int{"eth0": 1400})
+	if err != nil {
+		t.Fatalf("Failed to marshal result: %v", err)
+	}
+	parsed, err := current.NewResult(data)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", data, err)
+	}
+	if r := parsed.(*current.Result); r.CNIVersion != "0.4.0" || len(r.Interfaces) != 1 {
+		t.Errorf("Unexpected 0.4.0 result %s", data)
+	}
+	if result.CNIVersion != "0.3.1" {
+		t.Errorf("Version of the printed result changed to %s", result.CNIVersion)
+	}
+}
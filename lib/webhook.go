@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Defaults for notifying an external IPAM system of record
+const (
+	DefaultWebhookTimeout = 2 * time.Second
+	DefaultWebhookRetries = 2
+)
+
+// IPAMLease describes the ownership of a Pod IP sent to an external
+// IPAM webhook
+type IPAMLease struct {
+	IP        string `json:"ip"`
+	PodName   string `json:"podName"`
+	Namespace string `json:"namespace"`
+	NodeName  string `json:"nodeName"`
+	ENIID     string `json:"eniId"`
+}
+
+// NotifyIPAMWebhook sends lease to url with the given HTTP method,
+// http.MethodPost on allocation and http.MethodDelete on release. Each
+// attempt is bounded by timeout and failed attempts are retried up to
+// retries times.
+func NotifyIPAMWebhook(url string, method string, lease IPAMLease, timeout time.Duration, retries int) error {
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: timeout}
+	err = postLease(client, url, method, body)
+	for attempt := 0; err != nil && attempt < retries; attempt++ {
+		fmt.Fprintf(os.Stderr, "failed to notify IPAM webhook, retrying: %v\n", err)
+		err = postLease(client, url, method, body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to notify IPAM webhook %v of %v: %v", url, lease.IP, err)
+	}
+	return nil
+}
+
+func postLease(client *http.Client, url string, method string, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotifyIPAMWebhook(t *testing.T) {
+	type request struct {
+		Method string
+		Lease  IPAMLease
+	}
+	var requests []request
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var lease IPAMLease
+		if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+			t.Errorf("Failed to decode payload: %v", err)
+		}
+		requests = append(requests, request{r.Method, lease})
+	}))
+	defer server.Close()
+
+	lease := IPAMLease{
+		IP:        "10.0.0.5",
+		PodName:   "web-1",
+		Namespace: "default",
+		NodeName:  "node-1",
+		ENIID:     "eni-lyft",
+	}
+	if err := NotifyIPAMWebhook(server.URL, http.MethodPost, lease, time.Second, 1); err != nil {
+		t.Fatalf("Failed to notify allocation: %v", err)
+	}
+	if err := NotifyIPAMWebhook(server.URL, http.MethodDelete, lease, time.Second, 0); err != nil {
+		t.Fatalf("Failed to notify release: %v", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %v", requests)
+	}
+	if requests[0].Method != http.MethodPost || requests[0].Lease != lease {
+		t.Errorf("Unexpected allocation request %v", requests[0])
+	}
+	if requests[1].Method != http.MethodDelete || requests[1].Lease != lease {
+		t.Errorf("Unexpected release request %v", requests[1])
+	}
+
+	failures = 1
+	if err := NotifyIPAMWebhook(server.URL, http.MethodPost, lease, time.Second, 0); err == nil {
+		t.Errorf("Failure without retries was not reported")
+	}
+}
@@ -0,0 +1,135 @@
+package netconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+)
+
+// IPAMConf contains the configuration parameters of the IPAM plugin
+type IPAMConf struct {
+	Name             string            `json:"name"`
+	CNIVersion       string            `json:"cniVersion"`
+	SecGroupIds      []string          `json:"secGroupIds"`
+	SubnetTags       map[string]string `json:"subnetTags"`
+	IfaceIndex       int               `json:"interfaceIndex"`
+	SkipDeallocation bool              `json:"skipDeallocation"`
+	RouteToVPCPeers  bool              `json:"routeToVpcPeers"`
+	ReuseIPWait      int               `json:"reuseIPWait"`
+	ENIPrimaryIP     string            `json:"eniPrimaryIP"`
+	CordonFile       string            `json:"cordonFile"`
+	CapacityFile     string            `json:"capacityFile"`
+	PerENIIPTarget   int               `json:"perENIIPTarget"`
+
+	// ExternalIPAMWebhook is notified of every allocated and released
+	// Pod IP. Failures only block ADD when RequireExternalIPAM is set.
+	ExternalIPAMWebhook string `json:"externalIPAMWebhook"`
+	RequireExternalIPAM bool   `json:"requireExternalIPAM"`
+
+	// AllowENICreation permits attaching new ENIs when the existing ones
+	// are full. Disable it when ENIs are provisioned out-of-band.
+	AllowENICreation bool `json:"allowENICreation"`
+
+	// AllocateRetries and AllocateRetryBaseMs bound the backoff of IP
+	// assignments throttled or failed by EC2
+	AllocateRetries     int `json:"allocateRetries"`
+	AllocateRetryBaseMs int `json:"allocateRetryBaseMs"`
+
+	// WarmIPTarget is the number of free IPs kept assigned on each ENI,
+	// so released IPs stay on the ENI for the next Pod
+	WarmIPTarget int `json:"warmIPTarget"`
+
+	// EC2Endpoint and Region override the EC2 API endpoint and the
+	// region from instance metadata, e.g. in GovCloud or China
+	EC2Endpoint string `json:"ec2Endpoint"`
+	Region      string `json:"region"`
+
+	// MetadataCacheSeconds is how long interface metadata is shared
+	// between invocations, 0 disables the cache
+	MetadataCacheSeconds int `json:"metadataCacheSeconds"`
+
+	// PrefixDelegation delegates /28 prefixes to the ENIs and carves
+	// the Pod IPs out of them, instead of assigning a secondary IP per
+	// Pod
+	PrefixDelegation bool `json:"prefixDelegation"`
+}
+
+// LoadIPAMConf parses the configuration of the IPAM plugin, applying
+// its defaults, and fails on the first problem found
+func LoadIPAMConf(stdin []byte) (*IPAMConf, error) {
+	conf, problems := loadIPAMConf(stdin)
+	if len(problems) > 0 {
+		return nil, problems[0]
+	}
+	return conf, nil
+}
+
+func loadIPAMConf(stdin []byte) (*IPAMConf, []error) {
+	conf := IPAMConf{
+		ReuseIPWait:      60, // default 60 second wait
+		CordonFile:       lib.DefaultCordonPath,
+		AllowENICreation: true,
+
+		AllocateRetries:     aws.DefaultAllocateRetry.Retries,
+		AllocateRetryBaseMs: int(aws.DefaultAllocateRetry.BaseDelay / time.Millisecond),
+
+		MetadataCacheSeconds: int(aws.MetadataCacheTTL / time.Second),
+	}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, []error{fmt.Errorf("failed to parse network configuration: %v", err)}
+	}
+	return &conf, conf.validate()
+}
+
+// validate returns every problem of conf
+func (conf *IPAMConf) validate() []error {
+	var problems []error
+	// without secGroupIds, new ENIs get the groups of the primary ENI
+	for _, id := range conf.SecGroupIds {
+		if !strings.HasPrefix(id, "sg-") {
+			problems = append(problems, fmt.Errorf("secGroupIds entry %q is not a security group ID", id))
+		}
+	}
+	if conf.IfaceIndex < 0 {
+		problems = append(problems, fmt.Errorf("interfaceIndex %d must not be negative", conf.IfaceIndex))
+	}
+	if conf.ReuseIPWait < 0 {
+		problems = append(problems, fmt.Errorf("reuseIPWait %d must not be negative", conf.ReuseIPWait))
+	}
+	if conf.PerENIIPTarget < 0 {
+		problems = append(problems, fmt.Errorf("perENIIPTarget %d must not be negative", conf.PerENIIPTarget))
+	}
+	if conf.ENIPrimaryIP != "" && conf.ENIPrimaryIP != aws.PrimaryIPLowestFree && net.ParseIP(conf.ENIPrimaryIP) == nil {
+		problems = append(problems, fmt.Errorf("eniPrimaryIP %q is not an IP address", conf.ENIPrimaryIP))
+	}
+	if conf.ExternalIPAMWebhook != "" {
+		if u, err := url.Parse(conf.ExternalIPAMWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, fmt.Errorf("externalIPAMWebhook %q is not an http(s) URL", conf.ExternalIPAMWebhook))
+		}
+	} else if conf.RequireExternalIPAM {
+		problems = append(problems, fmt.Errorf("requireExternalIPAM is set without an externalIPAMWebhook"))
+	}
+
+	if conf.AllocateRetries < 0 || conf.AllocateRetryBaseMs < 0 {
+		problems = append(problems, fmt.Errorf("allocateRetries and allocateRetryBaseMs must not be negative"))
+	}
+	if conf.WarmIPTarget < 0 {
+		problems = append(problems, fmt.Errorf("warmIPTarget must not be negative"))
+	}
+	if conf.EC2Endpoint != "" {
+		if err := aws.ValidateEndpoint(conf.EC2Endpoint); err != nil {
+			problems = append(problems, fmt.Errorf("invalid ec2Endpoint: %v", err))
+		}
+	}
+	if conf.MetadataCacheSeconds < 0 {
+		problems = append(problems, fmt.Errorf("metadataCacheSeconds must not be negative"))
+	}
+	return problems
+}
@@ -0,0 +1,128 @@
+package netconf
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/vishvananda/netlink"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+)
+
+const (
+	defaultNetnsOpenRetries = 3
+	defaultNetnsOpenBackoff = 100 // ms
+)
+
+// IpvlanConf contains the configuration parameters of the ipvlan plugin
+type IpvlanConf struct {
+	types.NetConf
+
+	// support chaining for master interface and IP decisions
+	// occurring prior to running ipvlan plugin
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
+
+	Master string `json:"master"`
+	Mode   string `json:"mode"`
+	MTU    int    `json:"mtu"`
+
+	NetnsOpenRetries int `json:"netnsOpenRetries"`
+	NetnsOpenBackoff int `json:"netnsOpenBackoff"`
+
+	// ValidateENIMac checks the master interface is an ENI attached to
+	// this instance when EC2 metadata is available
+	ValidateENIMac bool `json:"validateENIMac"`
+}
+
+// LoadIpvlanConf parses the configuration of the ipvlan plugin and its
+// prevResult, applying its defaults, and fails on the first problem
+// found. The master interface may be left to the prevResult.
+func LoadIpvlanConf(bytes []byte) (*IpvlanConf, error) {
+	conf, problems := loadIpvlanConf(bytes)
+	if len(problems) > 0 {
+		return nil, problems[0]
+	}
+	return conf, nil
+}
+
+func loadIpvlanConf(bytes []byte) (*IpvlanConf, []error) {
+	n := &IpvlanConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, []error{fmt.Errorf("failed to load netconf: %v", err)}
+	}
+	if n.NetnsOpenRetries == 0 {
+		n.NetnsOpenRetries = defaultNetnsOpenRetries
+	}
+	if n.NetnsOpenBackoff == 0 {
+		n.NetnsOpenBackoff = defaultNetnsOpenBackoff
+	}
+	// Parse previous result
+	if n.RawPrevResult != nil {
+		var err error
+		if n.PrevResult, err = parsePrevResult(n.CNIVersion, n.RawPrevResult); err != nil {
+			return nil, []error{err}
+		}
+		n.RawPrevResult = nil
+	}
+	return n, n.validate()
+}
+
+// validate returns every problem of n
+func (n *IpvlanConf) validate() []error {
+	var problems []error
+	if _, err := IpvlanMode(n.Mode); err != nil {
+		problems = append(problems, err)
+	}
+	if n.MTU < 0 {
+		problems = append(problems, fmt.Errorf("mtu %d must not be negative", n.MTU))
+	}
+	if n.NetnsOpenBackoff < 0 {
+		problems = append(problems, fmt.Errorf("netnsOpenBackoff %d must not be negative", n.NetnsOpenBackoff))
+	}
+	return problems
+}
+
+// IpvlanMode returns the ipvlan mode named s, l2 by default
+func IpvlanMode(s string) (netlink.IPVlanMode, error) {
+	switch s {
+	case "", "l2":
+		return netlink.IPVLAN_MODE_L2, nil
+	case "l3":
+		return netlink.IPVLAN_MODE_L3, nil
+	case "l3s":
+		return netlink.IPVLAN_MODE_L3S, nil
+	default:
+		return 0, fmt.Errorf("unknown ipvlan mode: %q", s)
+	}
+}
+
+// parsePrevResult parses the raw prevResult of a configuration of
+// version cniVersion
+func parsePrevResult(cniVersion string, raw *map[string]interface{}) (*current.Result, error) {
+	resultBytes, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize prevResult: %v", err)
+	}
+	res, err := version.NewResult(lib.ResultVersion(cniVersion), resultBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse prevResult: %v", err)
+	}
+	result, err := current.NewResultFromResult(res)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert result to current version: %v", err)
+	}
+	// 1.0.0 results leave the version of IPs to their address
+	for _, ipc := range result.IPs {
+		if ipc.Version == "" {
+			ipc.Version = "6"
+			if ipc.Address.IP.To4() != nil {
+				ipc.Version = "4"
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,27 @@
+package netconf
+
+import (
+	"testing"
+)
+
+func TestLoadIpvlanConfPrevResult040(t *testing.T) {
+	conf, err := LoadIpvlanConf([]byte(`{
+		"cniVersion": "0.4.0",
+		"name": "net",
+		"type": "cni-ipvlan-vpc-k8s-ipvlan",
+		"prevResult": {
+			"cniVersion": "0.4.0",
+			"interfaces": [{"name": "eth1"}],
+			"ips": [{"version": "4", "address": "10.0.0.5/24", "interface": 0}]
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to load a 0.4.0 config: %v", err)
+	}
+	if len(conf.PrevResult.Interfaces) != 1 || conf.PrevResult.Interfaces[0].Name != "eth1" || len(conf.PrevResult.IPs) != 1 {
+		t.Errorf("Unexpected prevResult %v", conf.PrevResult)
+	}
+	if conf.NetnsOpenRetries != defaultNetnsOpenRetries || conf.NetnsOpenBackoff != defaultNetnsOpenBackoff {
+		t.Errorf("Defaults were not applied: %+v", conf)
+	}
+}
@@ -0,0 +1,78 @@
+// Package netconf parses and validates the network configurations of
+// the plugins of this repository, for the plugins themselves and for
+// the tool validating configurations ahead of time
+package netconf
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Plugin types shipped by this repository
+const (
+	IPAMPluginType          = "cni-ipvlan-vpc-k8s-ipam"
+	IpvlanPluginType        = "cni-ipvlan-vpc-k8s-ipvlan"
+	UnnumberedPtpPluginType = "cni-ipvlan-vpc-k8s-unnumbered-ptp"
+)
+
+// Plugin is one plugin of a network configuration
+type Plugin struct {
+	Type string
+	Raw  json.RawMessage
+}
+
+// Plugins returns the plugins of a network configuration list, or the
+// single plugin of a network configuration
+func Plugins(data []byte) ([]Plugin, error) {
+	list := struct {
+		Type    string            `json:"type"`
+		Plugins []json.RawMessage `json:"plugins"`
+	}{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+
+	raws := list.Plugins
+	if list.Plugins == nil {
+		raws = []json.RawMessage{data}
+	}
+
+	var plugins []Plugin
+	for _, raw := range raws {
+		plugin := struct {
+			Type string `json:"type"`
+		}{}
+		if err := json.Unmarshal(raw, &plugin); err != nil {
+			return nil, fmt.Errorf("failed to parse plugin configuration: %v", err)
+		}
+		plugins = append(plugins, Plugin{plugin.Type, raw})
+	}
+	return plugins, nil
+}
+
+// Validate checks a network configuration (or configuration list) for
+// the plugins of this repository as they parse it, without applying
+// it, and returns every problem found
+func Validate(data []byte) []error {
+	plugins, err := Plugins(data)
+	if err != nil {
+		return []error{err}
+	}
+
+	var problems []error
+	for _, plugin := range plugins {
+		var errs []error
+		switch plugin.Type {
+		case IPAMPluginType:
+			_, errs = loadIPAMConf(plugin.Raw)
+		case IpvlanPluginType:
+			_, errs = loadIpvlanConf(plugin.Raw)
+		case UnnumberedPtpPluginType:
+			_, errs = loadPtpConf(plugin.Raw)
+		}
+		for _, err := range errs {
+			problems = append(problems, fmt.Errorf("%s: %v", plugin.Type, err))
+		}
+	}
+	return problems
+}
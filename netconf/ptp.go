@@ -0,0 +1,591 @@
+package netconf
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+// defaults and bounds of the unnumbered-ptp plugin configuration
+const (
+	// full jitter backoff of the route table allocation in
+	// milliseconds
+	DefaultTableAllocMaxSleepMs  = 10000 // 10.00s
+	DefaultTableAllocBaseSleepMs = 20    //  0.02
+	DefaultTableAllocRetries     = 10
+
+	// EgressRulePriority is the priority of the egress steering rules,
+	// which take precedence over the per-Pod tables
+	EgressRulePriority = 768
+
+	defaultGratuitousArpCount = 1
+
+	// interface names are limited to 15 characters
+	MaxIfNameLen         = 15
+	maxHostVethPrefixLen = 7
+
+	// route protocols up to RTPROT_STATIC are set by the kernel and ip
+	minRouteProtocol = 5
+
+	// route table allocation modes
+	TableAllocRandom  = "random"
+	TableAllocHash    = "hash"
+	DefaultTableRange = 1000
+	DefaultTableEnd   = math.MaxUint32
+)
+
+// KernelReservedTables are the default, main and local tables, never
+// used for Pods
+var KernelReservedTables = []int{253, 254, 255}
+
+// PtpConf contains the configuration parameters of the unnumbered-ptp
+// plugin
+type PtpConf struct {
+	types.NetConf
+
+	// This is the previous result, when called in the context of a chained
+	// plugin. Because this plugin supports multiple versions, we'll have to
+	// parse this in two passes. If your plugin is not chained, this can be
+	// removed (though you may wish to error if a non-chainable plugin is
+	// chained.
+	// If you need to modify the result before returning it, you will need
+	// to actually convert it to a concrete versioned struct.
+	RawPrevResult *map[string]interface{} `json:"prevResult"`
+	PrevResult    *current.Result         `json:"-"`
+	// PrevResultMTUs holds the MTU of the prevResult interfaces, which
+	// the ipvlan plugin reports
+	PrevResultMTUs map[string]int `json:"-"`
+	// Unchained is set when the IPAM plugin is run for the Pod IPs,
+	// and the container veth is the Pod interface
+	Unchained bool `json:"-"`
+
+	IPMasq             bool   `json:"ipMasq"`
+	HostInterface      string `json:"hostInterface"`
+	ContainerInterface string `json:"containerInterface"`
+	// ContainerIfName replaces containerInterface as the name the
+	// container veth of each Pod interface is derived from
+	ContainerIfName string `json:"containerIfName"`
+	MTU             int    `json:"mtu"`
+	TableStart      int    `json:"routeTableStart"`
+	MaxRouteTables  int    `json:"maxRouteTables"`
+	// TableWarnThreshold warns, without failing ADD, once more route
+	// tables than it are allocated, as an early sign of exhaustion
+	TableWarnThreshold int    `json:"routeTableWarnThreshold"`
+	TableAllocMode     string `json:"routeTableAllocMode"`
+	TableRange         int    `json:"routeTableRange"`
+	// TableEnd bounds the tables used for Pods to [TableStart, TableEnd),
+	// skipping ReservedTables and the tables reserved by the kernel
+	TableEnd       int   `json:"routeTableEnd"`
+	ReservedTables []int `json:"reservedRouteTables"`
+	// TableLockPath is a lock file serializing the table allocation of
+	// concurrent ADDs when set
+	TableLockPath string `json:"routeTableLockPath"`
+	// SharedTablePerENI routes the Pods behind the same ENI through one
+	// table, holding routes out of the ENI via the VPC router of its
+	// subnet, instead of a table per Pod. The policy rules of a Pod
+	// match its IPv4 source addresses, and the table is removed along
+	// with the last rule pointing to it.
+	SharedTablePerENI bool `json:"sharedTablePerENI"`
+
+	// full jitter backoff between attempts to find a free route table
+	TableAllocMaxSleepMs  int    `json:"routeTableAllocMaxSleepMs"`
+	TableAllocBaseSleepMs int    `json:"routeTableAllocBaseSleepMs"`
+	TableAllocRetries     int    `json:"routeTableAllocRetries"`
+	NodePortMark          int    `json:"nodePortMark"`
+	NodePorts             string `json:"nodePorts"`
+	NodePortSCTP          bool   `json:"nodePortSCTP"`
+	// EnableNodePort sets up the NodePort marking rules, loose rp_filter
+	// and main table rule on ADD. Nodes where kube-proxy runs in IPVS
+	// mode or NodePorts are unused can turn it off.
+	EnableNodePort bool `json:"enableNodePort"`
+	// IptablesPath is the iptables binary rules are added with, e.g.
+	// /usr/sbin/iptables-legacy to match the backend of kube-proxy. The
+	// ip6tables binary is expected next to it.
+	IptablesPath string `json:"iptablesPath"`
+	// LocalPodRoutes keeps the traffic between Pods of the node on the
+	// host instead of hairpinning through their ENIs
+	LocalPodRoutes bool `json:"localPodRoutes"`
+	// HostVethPrefix names the host veths of Pods, which NodePort marks
+	// are restored on
+	HostVethPrefix string `json:"hostVethPrefix"`
+	ClampMSS       bool   `json:"clampMSS"`
+	// ClampMSSToMTU clamps to the MSS fitting the veth MTU instead of
+	// the path MTU
+	ClampMSSToMTU bool `json:"clampMSSToMTU"`
+	// EnforceMTU keeps the Pod veth MTU equal to the MTU of the ENI: ADD
+	// uses the ENI MTU whatever MTU the Pod interface reports, and CHECK
+	// fails on a mismatch, e.g. after jumbo frames were toggled
+	EnforceMTU bool `json:"enforceMTU"`
+	// PreferredSrc sets the first Pod IPv4 address as the source of the
+	// IPv4 default route of the Pod
+	PreferredSrc bool `json:"preferredSrc"`
+	// NodePortMarkMask are the connection mark bits NodePortMark is
+	// set and restored in, defaulting to NodePortMark
+	NodePortMarkMask int `json:"nodePortMarkMask"`
+	// DisableIPMasqV6 keeps IPv6 Pod traffic from being masqueraded when
+	// IPMasq is set, e.g. when the VPC routes every Pod IPv6 address
+	DisableIPMasqV6 bool `json:"disableIPMasqV6"`
+
+	// ExcludeInterfaces lists interface names (or regular expressions)
+	// never chosen when the hostInterface is auto-detected
+	ExcludeInterfaces []string `json:"excludeInterfaces"`
+
+	NetnsOpenRetries int `json:"netnsOpenRetries"`
+	NetnsOpenBackoff int `json:"netnsOpenBackoff"`
+
+	// PerENIHostInterface uses the host interface of the ENI owning the
+	// Pod IP, when it can be resolved, instead of HostInterface
+	PerENIHostInterface bool `json:"perENIHostInterface"`
+
+	// HostInterfaces are the ENI devices NodePort traffic is marked on.
+	// The host interface of a Pod is the one of them owning the Pod
+	// subnet, falling back to HostInterface, which defaults to the first.
+	HostInterfaces []string `json:"hostInterfaces"`
+
+	// ValidatePodSubnet rejects Pod IPs outside the subnets of the
+	// host interface, whose traffic would otherwise blackhole
+	ValidatePodSubnet bool `json:"validatePodSubnet"`
+
+	// GratuitousArpCount gratuitous ARPs, or unsolicited neighbor
+	// advertisements for IPv6, are sent per address
+	// GratuitousArpIntervalMs apart
+	GratuitousArpCount      int `json:"gratuitousArpCount"`
+	GratuitousArpIntervalMs int `json:"gratuitousArpIntervalMs"`
+
+	// AdditionalContainerRoutes are added in the Pod namespace on top of
+	// the default routes, e.g. towards a peered VPC range
+	AdditionalContainerRoutes []types.Route `json:"additionalContainerRoutes"`
+
+	// DryRun makes ADD print the operations it would perform instead of
+	// changing the host or the Pod namespace
+	DryRun bool `json:"dryRun"`
+
+	// RuntimeConfig carries the per-call options of the runtime
+	RuntimeConfig struct {
+		MTU        int        `json:"mtu"`
+		EgressMark int        `json:"egressMark"`
+		Bandwidth  *Bandwidth `json:"bandwidth"`
+	} `json:"runtimeConfig"`
+
+	// IngressRateBps and EgressRateBps limit the traffic to and from
+	// each Pod in bits per second, IngressBurstBits and
+	// EgressBurstBits set the size of their token buckets. The
+	// bandwidth runtime config of a Pod overrides them. 0 leaves the
+	// traffic unshaped.
+	IngressRateBps   int64 `json:"ingressRateBps"`
+	IngressBurstBits int64 `json:"ingressBurstBits"`
+	EgressRateBps    int64 `json:"egressRateBps"`
+	EgressBurstBits  int64 `json:"egressBurstBits"`
+
+	// EgressSteering routes the egress traffic of selected Pods through
+	// a dedicated route table
+	EgressSteering []EgressSteering `json:"egressSteering"`
+
+	// EgressPaths are alternate egress routes, e.g. via an ENI routing
+	// to a dedicated NAT gateway, selected per Pod by its egressMark
+	EgressPaths []EgressPath `json:"egressPaths"`
+
+	// ClusterID scopes iptables chain names and comments to one cluster
+	// on nodes running the CNI of several clusters
+	ClusterID string `json:"clusterID"`
+
+	// LogFile receives JSON lines describing the steps of each call
+	// when set
+	LogFile string `json:"logFile"`
+
+	// MetricsFile is a Prometheus text file, as read by the
+	// node_exporter textfile collector, that counters are added to
+	MetricsFile string `json:"metricsFile"`
+
+	// RouteProtocol tags the routes of Pods so they can be told apart
+	// with "ip route show proto", and scopes what DEL and GC remove to
+	// them. 0 leaves them untagged.
+	RouteProtocol int `json:"routeProtocol"`
+
+	// RouteMetric is the priority of the Pod default route and the
+	// routes in the per-Pod policy routing table
+	RouteMetric int `json:"routeMetric"`
+
+	// DefaultRouteMetric overrides RouteMetric for the routes in the Pod
+	// namespace, so the Pod default route can lose against, or win
+	// over, the routes of other interfaces of the Pod. 0 keeps
+	// RouteMetric.
+	DefaultRouteMetric int `json:"defaultRouteMetric"`
+
+	// GatewayV4 and GatewayV6 replace the Pod IP as the next hop of the
+	// routes of their family in the per-Pod table, e.g. with a custom
+	// on-link next hop. They must be reachable on-link via the host
+	// veth.
+	GatewayV4 net.IP `json:"gatewayV4"`
+	GatewayV6 net.IP `json:"gatewayV6"`
+
+	// GatewayPrefixFromInterface makes the on-link routes to the host
+	// addresses in the Pod namespace cover the prefix of the address on
+	// the host interface instead of the address alone, e.g. a /31.
+	// GatewayPrefixLenV4 and GatewayPrefixLenV6 override the prefix
+	// length per family.
+	GatewayPrefixFromInterface bool `json:"gatewayPrefixFromInterface"`
+	GatewayPrefixLenV4         int  `json:"gatewayPrefixLenV4"`
+	GatewayPrefixLenV6         int  `json:"gatewayPrefixLenV6"`
+
+	// PodRulePriority and MainTableRulePriority are the priorities of
+	// the per-Pod policy rules and of the NodePort main table rule
+	PodRulePriority       int `json:"podRulePriority"`
+	MainTableRulePriority int `json:"mainTableRulePriority"`
+}
+
+// EgressSteering selects Pods by namespace and name (regular expression,
+// matched in full) and sets Mark on their traffic, which a policy rule
+// routes through Table. Empty selectors match every Pod.
+type EgressSteering struct {
+	Namespace string `json:"namespace"`
+	PodName   string `json:"podName"`
+	Mark      int    `json:"mark"`
+	Table     int    `json:"table"`
+}
+
+// EgressPath routes the traffic of Pods passing Mark as their egressMark
+// through Table, whose default route via Interface the plugin installs.
+// Gateway defaults to the VPC router of the subnet of Interface.
+type EgressPath struct {
+	Name      string `json:"name"`
+	Mark      int    `json:"mark"`
+	Table     int    `json:"table"`
+	Interface string `json:"interface"`
+	Gateway   string `json:"gateway"`
+}
+
+// Bandwidth are the rates in bits per second and bursts in bits of the
+// traffic to (ingress) and from (egress) a Pod, as in the bandwidth
+// runtime config of the CNI conventions
+type Bandwidth struct {
+	IngressRate  int64 `json:"ingressRate"`
+	IngressBurst int64 `json:"ingressBurst"`
+	EgressRate   int64 `json:"egressRate"`
+	EgressBurst  int64 `json:"egressBurst"`
+}
+
+// MinTbfBurst is the smallest default burst in bits. The token bucket
+// filter drops packets larger than its bucket, so it must hold a GSO
+// packet.
+const MinTbfBurst = 64 * 1024 * 8
+
+// Bandwidth returns the shaping of the Pod, from its runtime config or
+// else conf, with the bursts of limited directions defaulting to 100ms
+// at the rate
+func (conf *PtpConf) Bandwidth() Bandwidth {
+	bw := Bandwidth{
+		IngressRate:  conf.IngressRateBps,
+		IngressBurst: conf.IngressBurstBits,
+		EgressRate:   conf.EgressRateBps,
+		EgressBurst:  conf.EgressBurstBits,
+	}
+	if conf.RuntimeConfig.Bandwidth != nil {
+		bw = *conf.RuntimeConfig.Bandwidth
+	}
+	defaultBurst := func(rate int64, burst *int64) {
+		if rate > 0 && *burst == 0 {
+			*burst = rate / 10
+			if *burst < MinTbfBurst {
+				*burst = MinTbfBurst
+			}
+		}
+	}
+	defaultBurst(bw.IngressRate, &bw.IngressBurst)
+	defaultBurst(bw.EgressRate, &bw.EgressBurst)
+	return bw
+}
+
+// validate checks the rates and bursts fit a token bucket filter
+func (bw Bandwidth) validate() error {
+	for _, dir := range []struct {
+		name        string
+		rate, burst int64
+	}{{"ingress", bw.IngressRate, bw.IngressBurst}, {"egress", bw.EgressRate, bw.EgressBurst}} {
+		if dir.rate < 0 || dir.burst < 0 {
+			return fmt.Errorf("%s rate %d and burst %d must not be negative", dir.name, dir.rate, dir.burst)
+		}
+		if dir.rate > 0 && dir.rate < 8 {
+			return fmt.Errorf("%s rate %d must be at least 8 bits per second", dir.name, dir.rate)
+		}
+		if dir.burst/8 > math.MaxUint32 {
+			return fmt.Errorf("%s burst %d must be below %d bits", dir.name, dir.burst, uint64(math.MaxUint32)*8)
+		}
+	}
+	return nil
+}
+
+// Shaped reports whether traffic in any direction is limited
+func (bw Bandwidth) Shaped() bool {
+	return bw.IngressRate > 0 || bw.EgressRate > 0
+}
+
+// CompileExcludes turns interface names or patterns into anchored
+// regular expressions
+func CompileExcludes(excludes []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, exclude := range excludes {
+		re, err := regexp.Compile("^(?:" + exclude + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid excludeInterfaces entry %q: %v", exclude, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// LoadPtpConf parses the configuration of the unnumbered-ptp plugin and
+// its prevResult, applying its defaults, and fails on the first problem
+// found
+func LoadPtpConf(stdin []byte) (*PtpConf, error) {
+	conf, problems := loadPtpConf(stdin)
+	if len(problems) > 0 {
+		return nil, problems[0]
+	}
+	return conf, nil
+}
+
+func loadPtpConf(stdin []byte) (*PtpConf, []error) {
+	conf := PtpConf{
+		TableAllocMaxSleepMs:  DefaultTableAllocMaxSleepMs,
+		TableAllocBaseSleepMs: DefaultTableAllocBaseSleepMs,
+		TableAllocRetries:     DefaultTableAllocRetries,
+		EnableNodePort:        true,
+	}
+
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, []error{fmt.Errorf("failed to parse network configuration: %v", err)}
+	}
+
+	// Parse previous result.
+	if conf.RawPrevResult != nil {
+		var err error
+		conf.PrevResultMTUs = lib.ResultMTUs(*conf.RawPrevResult)
+		if conf.PrevResult, err = parsePrevResult(conf.CNIVersion, conf.RawPrevResult); err != nil {
+			return nil, []error{err}
+		}
+		conf.RawPrevResult = nil
+	}
+	// End previous result parsing
+	conf.Unchained = conf.PrevResult == nil && conf.IPAM.Type != ""
+
+	if conf.HostInterface == "" && len(conf.HostInterfaces) > 0 {
+		conf.HostInterface = conf.HostInterfaces[0]
+	}
+	if conf.NodePorts == "" {
+		conf.NodePorts = nl.DefaultNodePorts
+	}
+	if conf.NodePortMark == 0 {
+		conf.NodePortMark = nl.DefaultNodePortMark
+	}
+	if conf.NodePortMarkMask == 0 {
+		conf.NodePortMarkMask = conf.NodePortMark
+	}
+	if conf.HostVethPrefix == "" {
+		conf.HostVethPrefix = nl.DefaultHostVethPrefix
+	}
+	if conf.PodRulePriority == 0 {
+		conf.PodRulePriority = nl.PodRulePriority
+	}
+	if conf.MainTableRulePriority == 0 {
+		conf.MainTableRulePriority = nl.NodePortRulePriority
+	}
+	// start using tables by default at 256
+	if conf.TableStart == 0 {
+		conf.TableStart = 256
+	}
+	if conf.TableAllocMode == "" {
+		conf.TableAllocMode = TableAllocRandom
+	}
+	if conf.TableEnd == 0 {
+		conf.TableEnd = DefaultTableEnd
+	}
+	if conf.TableRange == 0 {
+		conf.TableRange = DefaultTableRange
+	}
+	if conf.NetnsOpenRetries == 0 {
+		conf.NetnsOpenRetries = defaultNetnsOpenRetries
+	}
+	if conf.NetnsOpenBackoff == 0 {
+		conf.NetnsOpenBackoff = defaultNetnsOpenBackoff
+	}
+	if conf.GratuitousArpCount == 0 {
+		conf.GratuitousArpCount = defaultGratuitousArpCount
+	}
+
+	problems := conf.validate()
+	// table slots must fall within the window
+	if len(problems) == 0 && conf.TableRange > conf.TableEnd-conf.TableStart {
+		conf.TableRange = conf.TableEnd - conf.TableStart
+	}
+	return &conf, problems
+}
+
+// validate returns every problem of conf, whose defaults are applied
+func (conf *PtpConf) validate() []error {
+	var problems []error
+	add := func(err error) {
+		problems = append(problems, err)
+	}
+
+	if _, err := CompileExcludes(conf.ExcludeInterfaces); err != nil {
+		add(err)
+	}
+
+	if conf.ContainerInterface == "" {
+		add(fmt.Errorf("containerInterface must be specified"))
+	}
+	if len(conf.ContainerIfName) > MaxIfNameLen || strings.ContainsAny(conf.ContainerIfName, "/ \t\n") {
+		add(fmt.Errorf("containerIfName %q is not a valid interface name", conf.ContainerIfName))
+	}
+	if conf.MTU < 0 {
+		add(fmt.Errorf("mtu %d must not be negative", conf.MTU))
+	}
+
+	for _, steering := range conf.EgressSteering {
+		if steering.Mark <= 0 || steering.Table <= 0 {
+			add(fmt.Errorf("egressSteering entries need a positive mark and table: %+v", steering))
+		}
+		if _, err := regexp.Compile("^(?:" + steering.PodName + ")$"); err != nil {
+			add(fmt.Errorf("invalid egressSteering podName %q: %v", steering.PodName, err))
+		}
+	}
+
+	marks := make(map[int]bool)
+	for _, path := range conf.EgressPaths {
+		if path.Mark <= 0 || path.Table <= 0 || path.Interface == "" {
+			add(fmt.Errorf("egressPaths entries need a positive mark and table and an interface: %+v", path))
+		}
+		if path.Gateway != "" && net.ParseIP(path.Gateway).To4() == nil {
+			add(fmt.Errorf("egressPaths entry %q has an invalid gateway %q", path.Name, path.Gateway))
+		}
+		if marks[path.Mark] {
+			add(fmt.Errorf("egressPaths mark %d is used more than once", path.Mark))
+		}
+		marks[path.Mark] = true
+	}
+
+	for _, route := range conf.AdditionalContainerRoutes {
+		if route.GW != nil && (route.GW.To4() == nil) != (route.Dst.IP.To4() == nil) {
+			add(fmt.Errorf("additionalContainerRoutes entry %v has a gateway of another address family", route.String()))
+		}
+	}
+
+	if err := nl.ValidateNodePorts(conf.NodePorts); err != nil {
+		add(err)
+	}
+
+	if conf.IptablesPath != "" && !filepath.IsAbs(conf.IptablesPath) {
+		add(fmt.Errorf("iptablesPath %q must be absolute", conf.IptablesPath))
+	} else if conf.IptablesPath != "" && !strings.HasPrefix(filepath.Base(conf.IptablesPath), "iptables") {
+		add(fmt.Errorf("iptablesPath %q does not name an iptables binary", conf.IptablesPath))
+	}
+	// host veths are named with the prefix and a hash
+	if len(conf.HostVethPrefix) > maxHostVethPrefixLen {
+		add(fmt.Errorf("hostVethPrefix %q is longer than %d characters", conf.HostVethPrefix, maxHostVethPrefixLen))
+	}
+
+	if err := nl.ValidateNodePortMark(conf.NodePortMark, conf.NodePortMarkMask); err != nil {
+		add(err)
+	}
+
+	if conf.RouteProtocol != 0 && (conf.RouteProtocol < minRouteProtocol || conf.RouteProtocol > 255) {
+		add(fmt.Errorf("routeProtocol %d must be between %d and 255, lower values are used by the kernel", conf.RouteProtocol, minRouteProtocol))
+	}
+
+	if err := nl.ValidateRulePriorities(conf.PodRulePriority, conf.MainTableRulePriority); err != nil {
+		add(err)
+	}
+	// the local Pod rules sort right before the per-Pod rules
+	if conf.LocalPodRoutes && (conf.PodRulePriority-1 < nl.MinRulePriority || conf.PodRulePriority-1 == conf.MainTableRulePriority || conf.PodRulePriority-1 == EgressRulePriority) {
+		add(fmt.Errorf("localPodRoutes needs rule priority %d, below podRulePriority, to be free", conf.PodRulePriority-1))
+	}
+	// the egress rules must sort before the per-Pod rules to take effect
+	if len(conf.EgressSteering)+len(conf.EgressPaths) > 0 && (conf.PodRulePriority <= EgressRulePriority || conf.MainTableRulePriority == EgressRulePriority) {
+		add(fmt.Errorf("egressSteering and egressPaths need podRulePriority above %d and mainTableRulePriority other than %d", EgressRulePriority, EgressRulePriority))
+	}
+
+	if conf.TableStart < 0 || (conf.TableStart >= KernelReservedTables[0] && conf.TableStart <= KernelReservedTables[len(KernelReservedTables)-1]) {
+		add(fmt.Errorf("routeTableStart %d is negative or a reserved table", conf.TableStart))
+	}
+	switch conf.TableAllocMode {
+	case TableAllocRandom, TableAllocHash:
+	default:
+		add(fmt.Errorf("unknown routeTableAllocMode %q", conf.TableAllocMode))
+	}
+	if conf.TableEnd <= conf.TableStart {
+		add(fmt.Errorf("routeTableEnd %d must be above routeTableStart %d", conf.TableEnd, conf.TableStart))
+	}
+	for _, table := range conf.ReservedTables {
+		if table <= 0 {
+			add(fmt.Errorf("reservedRouteTables entry %d must be positive", table))
+		}
+	}
+	if conf.MaxRouteTables < 0 {
+		add(fmt.Errorf("maxRouteTables %d must not be negative", conf.MaxRouteTables))
+	}
+	if conf.TableRange < 0 {
+		add(fmt.Errorf("routeTableRange %d must not be negative", conf.TableRange))
+	}
+
+	if conf.GatewayV4 != nil && conf.GatewayV4.To4() == nil {
+		add(fmt.Errorf("gatewayV4 %v is not an IPv4 address", conf.GatewayV4))
+	}
+	if conf.GatewayV6 != nil && conf.GatewayV6.To4() != nil {
+		add(fmt.Errorf("gatewayV6 %v is not an IPv6 address", conf.GatewayV6))
+	}
+
+	if conf.SharedTablePerENI && (conf.GatewayV4 != nil || conf.GatewayV6 != nil) {
+		add(fmt.Errorf("sharedTablePerENI routes via the VPC router and cannot be combined with gatewayV4 or gatewayV6"))
+	}
+
+	if conf.GatewayPrefixLenV4 < 0 || conf.GatewayPrefixLenV4 > 32 {
+		add(fmt.Errorf("gatewayPrefixLenV4 %d must be between 0 and 32", conf.GatewayPrefixLenV4))
+	}
+	if conf.GatewayPrefixLenV6 < 0 || conf.GatewayPrefixLenV6 > 128 {
+		add(fmt.Errorf("gatewayPrefixLenV6 %d must be between 0 and 128", conf.GatewayPrefixLenV6))
+	}
+
+	if err := conf.Bandwidth().validate(); err != nil {
+		add(fmt.Errorf("invalid bandwidth: %v", err))
+	}
+
+	if conf.RouteMetric < 0 {
+		add(fmt.Errorf("routeMetric %d must not be negative", conf.RouteMetric))
+	}
+	if conf.DefaultRouteMetric < 0 {
+		add(fmt.Errorf("defaultRouteMetric %d must not be negative", conf.DefaultRouteMetric))
+	}
+
+	if conf.TableWarnThreshold < 0 {
+		add(fmt.Errorf("routeTableWarnThreshold %d must not be negative", conf.TableWarnThreshold))
+	}
+
+	if conf.TableAllocRetries < 1 {
+		add(fmt.Errorf("routeTableAllocRetries %d must be at least 1", conf.TableAllocRetries))
+	}
+	if conf.TableAllocBaseSleepMs < 0 || conf.TableAllocMaxSleepMs < 0 {
+		add(fmt.Errorf("routeTableAllocBaseSleepMs %d and routeTableAllocMaxSleepMs %d must not be negative",
+			conf.TableAllocBaseSleepMs, conf.TableAllocMaxSleepMs))
+	}
+
+	if conf.NetnsOpenBackoff < 0 {
+		add(fmt.Errorf("netnsOpenBackoff %d must not be negative", conf.NetnsOpenBackoff))
+	}
+
+	if conf.GratuitousArpCount < 0 || conf.GratuitousArpIntervalMs < 0 {
+		add(fmt.Errorf("gratuitousArpCount %d and gratuitousArpIntervalMs %d must not be negative",
+			conf.GratuitousArpCount, conf.GratuitousArpIntervalMs))
+	}
+	return problems
+}
@@ -0,0 +1,69 @@
+package netconf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := `{
+		"cniVersion": "0.3.1",
+		"name": "cni-ipvlan-vpc-k8s",
+		"plugins": [
+			{"type": "cni-ipvlan-vpc-k8s-ipam", "secGroupIds": ["sg-1"], "interfaceIndex": 1},
+			{"type": "cni-ipvlan-vpc-k8s-ipvlan", "mode": "l2"},
+			{"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp", "containerInterface": "veth0", "nodePorts": "30000:32767"}
+		]
+	}`
+	if problems := Validate([]byte(valid)); len(problems) != 0 {
+		t.Errorf("Valid configuration reported problems: %v", problems)
+	}
+
+	malformed := `{
+		"cniVersion": "0.3.1",
+		"name": "cni-ipvlan-vpc-k8s",
+		"plugins": [
+			{"type": "cni-ipvlan-vpc-k8s-ipam", "secGroupIds": ["default"], "eniPrimaryIP": "10.0.0", "requireExternalIPAM": true},
+			{"type": "cni-ipvlan-vpc-k8s-ipvlan", "mode": "l4"},
+			{"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp", "nodePorts": "32767:30000", "routeTableStart": 254, "routeTableEnd": 200, "excludeInterfaces": ["eth("], "iptablesPath": "/usr/sbin/nft"}
+		]
+	}`
+	expected := []string{
+		`secGroupIds entry "default" is not a security group ID`,
+		`eniPrimaryIP "10.0.0" is not an IP address`,
+		"requireExternalIPAM is set without an externalIPAMWebhook",
+		`unknown ipvlan mode: "l4"`,
+		"containerInterface must be specified",
+		"is reversed",
+		"routeTableStart 254 is negative or a reserved table",
+		"routeTableEnd 200 must be above routeTableStart 254",
+		`invalid excludeInterfaces entry "eth("`,
+		`iptablesPath "/usr/sbin/nft" does not name an iptables binary`,
+	}
+	problems := Validate([]byte(malformed))
+	if len(problems) != len(expected) {
+		t.Errorf("Expected %d problems, got %v", len(expected), problems)
+	}
+	for _, e := range expected {
+		found := false
+		for _, problem := range problems {
+			if strings.Contains(problem.Error(), e) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Problem %q was not reported in %v", e, problems)
+		}
+	}
+}
+
+func TestValidateSinglePlugin(t *testing.T) {
+	problems := Validate([]byte(`{"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp", "containerInterface": "veth0", "nodePorts": "http"}`))
+	if len(problems) != 1 || !strings.Contains(problems[0].Error(), "must be a port or a lo:hi port range") {
+		t.Errorf("Unexpected problems %v", problems)
+	}
+
+	if problems := Validate([]byte(`{"plugins": [`)); len(problems) != 1 {
+		t.Errorf("Unparseable configuration was not reported: %v", problems)
+	}
+}
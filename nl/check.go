@@ -0,0 +1,281 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// PodCheck is the outcome of one check of the datapath of a Pod, Err is
+// nil when it passed
+type PodCheck struct {
+	Name string
+	Err  error
+}
+
+// PodCheckConf describes the datapath CheckPod expects for a Pod
+type PodCheckConf struct {
+	// IfName holds the Pod IPs and VethName is the container veth, in
+	// the namespace of the Pod
+	IfName   string
+	VethName string
+	// PodIPs must be addresses of IfName, which must have a global
+	// address when PodIPs is empty
+	PodIPs []net.IP
+	// PodRulePriority is the priority of the policy rule of the host
+	// veth
+	PodRulePriority int
+	// NodePortMark, NodePortMarkMask and MainTableRulePriority match the
+	// NodePort main table rule, which is not checked when NodePortMark
+	// is 0
+	NodePortMark          int
+	NodePortMarkMask      int
+	MainTableRulePriority int
+	// MTU is the MTU of the container veth, which is not checked when
+	// it is 0
+	MTU int
+	// TableLinkIndex is the link the routes of the rule table go
+	// through, the ENI of a table shared per ENI. They go through the
+	// host veth when it is 0.
+	TableLinkIndex int
+}
+
+// CheckPod checks the datapath the unnumbered-ptp plugin sets up for a
+// running Pod: the Pod IPs and the default route via the container veth
+// in netns, then the host veth, its policy rule, the routes of the rule
+// table, the host routes to the Pod IPs and the NodePort rule. Checks
+// depending on a failed one fail as well.
+func CheckPod(netns ns.NetNS, conf PodCheckConf) []PodCheck {
+	var checks []PodCheck
+	failed := make(map[string]bool)
+	check := func(name string, fn func() error, requires ...string) {
+		var err error
+		for _, req := range requires {
+			if failed[req] {
+				err = fmt.Errorf("%s failed", req)
+				break
+			}
+		}
+		if err == nil {
+			err = fn()
+		}
+		failed[name] = err != nil
+		checks = append(checks, PodCheck{Name: name, Err: err})
+	}
+
+	podIPs := conf.PodIPs
+	var veth, peer netlink.Link
+	peerIndex := -1
+	nsChecks := func() {
+		check("pod-ip", func() (err error) {
+			if len(conf.PodIPs) == 0 {
+				podIPs, err = podAddrs(conf.IfName)
+				return err
+			}
+			return hasAddrs(conf.IfName, conf.PodIPs)
+		}, "netns")
+		check("container-veth", func() (err error) {
+			if veth, err = netlink.LinkByName(conf.VethName); err != nil {
+				return fmt.Errorf("container veth %q is missing: %v", conf.VethName, err)
+			}
+			return nil
+		}, "netns")
+		check("default-route", func() error {
+			return defaultRoute(veth)
+		}, "container-veth")
+		check("veth-peer", func() (err error) {
+			if peerIndex, err = netlink.VethPeerIndex(&netlink.Veth{LinkAttrs: *veth.Attrs()}); err != nil {
+				return fmt.Errorf("failed to find the host peer of %q: %v", conf.VethName, err)
+			}
+			return nil
+		}, "container-veth")
+	}
+	err := netns.Do(func(_ ns.NetNS) error {
+		check("netns", func() error { return nil })
+		nsChecks()
+		return nil
+	})
+	if err != nil {
+		check("netns", func() error {
+			return fmt.Errorf("failed to enter %q: %v", netns.Path(), err)
+		})
+		nsChecks()
+	}
+
+	if conf.MTU > 0 {
+		check("mtu", func() error {
+			if veth.Attrs().MTU != conf.MTU {
+				return fmt.Errorf("MTU %d of %q differs from the expected MTU %d", veth.Attrs().MTU, conf.VethName, conf.MTU)
+			}
+			return nil
+		}, "container-veth")
+	}
+
+	check("host-veth", func() (err error) {
+		if peer, err = netlink.LinkByIndex(peerIndex); err != nil {
+			return fmt.Errorf("host veth of %q is missing: %v", conf.VethName, err)
+		}
+		return nil
+	}, "veth-peer")
+
+	var podRules []netlink.Rule
+	check("src-rule", func() error {
+		rules, err := PodRules(conf.PodRulePriority)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if rule.IifName == peer.Attrs().Name {
+				podRules = append(podRules, rule)
+			}
+		}
+		if len(podRules) == 0 {
+			return fmt.Errorf("policy rule for traffic from %q at priority %d is missing", peer.Attrs().Name, conf.PodRulePriority)
+		}
+		return nil
+	}, "host-veth")
+	check("route-table", func() error {
+		if conf.TableLinkIndex != 0 {
+			return checkRuleTables(podRules, conf.TableLinkIndex)
+		}
+		return checkRuleTables(podRules, peer.Attrs().Index)
+	}, "src-rule")
+	check("dst-route", func() error {
+		routes, err := netlink.RouteList(peer, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list routes of %q: %v", peer.Attrs().Name, err)
+		}
+		return missingHostRoutes(podIPs, routes)
+	}, "host-veth", "pod-ip")
+
+	if conf.NodePortMark != 0 {
+		check("nodeport-rule", func() error {
+			return nodePortRule(conf.NodePortMark, conf.NodePortMarkMask, conf.MainTableRulePriority)
+		})
+	}
+	return checks
+}
+
+// hasAddrs checks every IP of ips is an address of ifName
+func hasAddrs(ifName string, ips []net.IP) error {
+	iface, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	addrs, err := netlink.AddrList(iface, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
+	}
+IPS:
+	for _, ip := range ips {
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				continue IPS
+			}
+		}
+		return fmt.Errorf("pod IP %v is missing from %q", ip, ifName)
+	}
+	return nil
+}
+
+// nodePortRule checks the main table rule of the NodePort replies is
+// in place
+func nodePortRule(mark int, mask int, priority int) error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("failed to list policy rules: %v", err)
+		}
+		for _, rule := range rules {
+			if rule.Priority == priority && rule.Mark == mark && rule.Mask == mask {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("NodePort policy rule for mark %#x is missing", mark)
+}
+
+// podAddrs returns the global addresses of ifName
+func podAddrs(ifName string) ([]net.IP, error) {
+	iface, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	addrs, err := netlink.AddrList(iface, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%q has no Pod IP", ifName)
+	}
+	return ips, nil
+}
+
+// defaultRoute checks the Pod has a default route via veth
+func defaultRoute(veth netlink.Link) error {
+	routes, err := netlink.RouteList(veth, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("failed to list routes of %q: %v", veth.Attrs().Name, err)
+	}
+	for _, route := range routes {
+		if route.Dst == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("default route via %q is missing", veth.Attrs().Name)
+}
+
+// checkRuleTables checks the table of every rule has routes, all of
+// them via the link at linkIndex
+func checkRuleTables(rules []netlink.Rule, linkIndex int) error {
+	for _, rule := range rules {
+		routes, err := netlink.RouteListFiltered(rule.Family, &netlink.Route{Table: rule.Table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("failed to list routes of table %d: %v", rule.Table, err)
+		}
+		if err := checkTableRoutes(rule.Table, routes, linkIndex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTableRoutes checks the routes of a Pod table are all via the
+// link at linkIndex
+func checkTableRoutes(table int, routes []netlink.Route, linkIndex int) error {
+	if len(routes) == 0 {
+		return fmt.Errorf("route table %d is empty", table)
+	}
+	for _, route := range routes {
+		if route.LinkIndex != linkIndex {
+			return fmt.Errorf("route %v of table %d is not via link %d", route.Dst, table, linkIndex)
+		}
+	}
+	return nil
+}
+
+// missingHostRoutes checks every Pod IP has a host route among the
+// routes of its host veth
+func missingHostRoutes(podIPs []net.IP, routes []netlink.Route) error {
+IPS:
+	for _, ip := range podIPs {
+		for _, route := range routes {
+			if route.Dst == nil || !route.Dst.IP.Equal(ip) {
+				continue
+			}
+			if ones, bits := route.Dst.Mask.Size(); ones == bits {
+				continue IPS
+			}
+		}
+		return fmt.Errorf("host route to Pod IP %v is missing", ip)
+	}
+	return nil
+}
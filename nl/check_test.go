@@ -0,0 +1,83 @@
+package nl
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestCheckTableRoutes(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("0.0.0.0/0")
+	if err := checkTableRoutes(300, nil, 7); err == nil {
+		t.Errorf("Empty table accepted")
+	}
+	if err := checkTableRoutes(300, []netlink.Route{{Dst: dst, LinkIndex: 7}}, 7); err != nil {
+		t.Errorf("Table via the host veth rejected: %v", err)
+	}
+	if err := checkTableRoutes(300, []netlink.Route{{Dst: dst, LinkIndex: 7}, {Dst: dst, LinkIndex: 8}}, 7); err == nil {
+		t.Errorf("Table with a route via another link accepted")
+	}
+}
+
+func TestMissingHostRoutes(t *testing.T) {
+	_, host, _ := net.ParseCIDR("10.0.0.5/32")
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	podIPs := []net.IP{net.ParseIP("10.0.0.5")}
+
+	if err := missingHostRoutes(podIPs, []netlink.Route{{Dst: host}}); err != nil {
+		t.Errorf("Host route rejected: %v", err)
+	}
+	// a subnet route does not route the Pod IP to its own veth
+	if err := missingHostRoutes(podIPs, []netlink.Route{{Dst: subnet}, {}}); err == nil {
+		t.Errorf("Missing host route accepted")
+	}
+}
+
+func TestCheckPodMissingVeth(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer testNS.Close()
+
+	err = testNS.Do(func(_ ns.NetNS) error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(lo); err != nil {
+			return err
+		}
+
+		checks := CheckPod(testNS, PodCheckConf{
+			IfName:                "lo",
+			VethName:              "veth0",
+			PodIPs:                []net.IP{net.ParseIP("127.0.0.1")},
+			PodRulePriority:       PodRulePriority,
+			NodePortMark:          DefaultNodePortMark,
+			NodePortMarkMask:      DefaultNodePortMark,
+			MainTableRulePriority: NodePortRulePriority,
+		})
+		passed := map[string]bool{"netns": true, "pod-ip": true}
+		for _, check := range checks {
+			if (check.Err == nil) != passed[check.Name] {
+				t.Errorf("Unexpected result of check %s: %v", check.Name, check.Err)
+			}
+		}
+		if len(checks) != 10 {
+			t.Errorf("Expected 10 checks, got %v", checks)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to check the Pod: %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/j-keck/arping"
+)
+
+// gratuitousArpOverIface is replaced in tests
+var gratuitousArpOverIface = arping.GratuitousArpOverIface
+
+// GratuitousArp sends a gratuitous ARP for the IPv4 address ip over
+// iface. The arping library panics on some interfaces without an
+// Ethernet address, such as tunnel devices, so those are refused and
+// any panic is logged and returned as an error instead of crashing
+// the plugin.
+func GratuitousArp(ip net.IP, iface net.Interface) (err error) {
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("%q has no Ethernet address to send a gratuitous ARP from", iface.Name)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "gratuitous ARP for %v over %q panicked: %v\n", ip, iface.Name, r)
+			err = fmt.Errorf("gratuitous ARP for %v over %q failed: %v", ip, iface.Name, r)
+		}
+	}()
+	return gratuitousArpOverIface(ip, iface)
+}
@@ -0,0 +1,36 @@
+package nl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGratuitousArpNoMAC(t *testing.T) {
+	defer func(orig func(net.IP, net.Interface) error) { gratuitousArpOverIface = orig }(gratuitousArpOverIface)
+	called := false
+	gratuitousArpOverIface = func(net.IP, net.Interface) error {
+		called = true
+		return nil
+	}
+
+	err := GratuitousArp(net.ParseIP("10.0.0.5"), net.Interface{Name: "lyft-tun", Index: 1})
+	if err == nil {
+		t.Errorf("Gratuitous ARP over an interface without a MAC was not refused")
+	}
+	if called {
+		t.Errorf("arping was called for an interface without a MAC")
+	}
+}
+
+func TestGratuitousArpRecovers(t *testing.T) {
+	defer func(orig func(net.IP, net.Interface) error) { gratuitousArpOverIface = orig }(gratuitousArpOverIface)
+	gratuitousArpOverIface = func(net.IP, net.Interface) error {
+		panic("index out of range")
+	}
+
+	mac, _ := net.ParseMAC("02:00:00:00:00:05")
+	err := GratuitousArp(net.ParseIP("10.0.0.5"), net.Interface{Name: "lyft-eth", Index: 1, HardwareAddr: mac})
+	if err == nil {
+		t.Errorf("Panic of arping was not returned as an error")
+	}
+}
@@ -0,0 +1,223 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// StalePodRules lists the Pod policy rules at priority whose host veth
+// no longer exists. Host veths disappear along with the Pod network
+// namespace, so a rule without one belongs to a Pod that is gone. Policy
+// rules carry no protocol, so unless protocol is 0 only rules whose
+// table holds a route tagged with it are listed.
+func StalePodRules(priority int, protocol int) ([]netlink.Rule, error) {
+	var stale []netlink.Rule
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list rules: %v", err)
+		}
+		for _, rule := range rules {
+			if rule.Priority != priority || rule.IifName == "" {
+				continue
+			}
+			if protocol != 0 && !tableHasProtocol(family, rule.Table, protocol) {
+				continue
+			}
+			if _, err := netlink.LinkByName(rule.IifName); err == nil {
+				continue
+			}
+			rule.Family = family
+			stale = append(stale, rule)
+		}
+	}
+	return stale, nil
+}
+
+// tableHasProtocol tells whether table holds a route of family tagged
+// with protocol
+func tableHasProtocol(family int, table int, protocol int) bool {
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return false
+	}
+	for _, route := range routes {
+		if route.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// PodRules lists the Pod policy rules at priority
+func PodRules(priority int) ([]netlink.Rule, error) {
+	var podRules []netlink.Rule
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list rules: %v", err)
+		}
+		for _, rule := range rules {
+			if rule.Priority == priority && rule.IifName != "" {
+				rule.Family = family
+				podRules = append(podRules, rule)
+			}
+		}
+	}
+	return podRules, nil
+}
+
+// RemovePodRule removes a Pod policy rule along with the routes of its
+// table, unless other rules still point to the table, as the rules of
+// the Pods sharing the table of their ENI do
+func RemovePodRule(rule netlink.Rule) error {
+	if err := netlink.RuleDel(&rule); err != nil {
+		return fmt.Errorf("failed to remove policy rule %v: %v", rule, err)
+	}
+	rules, err := netlink.RuleList(rule.Family)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	if tableReferenced(rules, rule.Table) {
+		return nil
+	}
+	routes, err := netlink.RouteListFiltered(rule.Family, &netlink.Route{Table: rule.Table}, netlink.RT_FILTER_TABLE)
+	if err == nil {
+		for i := range routes {
+			_ = netlink.RouteDel(&routes[i])
+		}
+	}
+	return nil
+}
+
+// tableReferenced reports whether any of rules points to table
+func tableReferenced(rules []netlink.Rule, table int) bool {
+	for _, rule := range rules {
+		if rule.Table == table {
+			return true
+		}
+	}
+	return false
+}
+
+// PodIPs returns the Pod IPs routed to a host veth
+func PodIPs() ([]net.IP, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+
+	veths := make(map[int]bool)
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	for _, link := range links {
+		if link.Type() == "veth" {
+			veths[link.Attrs().Index] = true
+		}
+	}
+
+	var ips []net.IP
+	for _, route := range routes {
+		if route.Dst == nil || !veths[route.LinkIndex] {
+			continue
+		}
+		if ones, bits := route.Dst.Mask.Size(); ones != bits {
+			continue
+		}
+		ips = append(ips, route.Dst.IP)
+	}
+	return ips, nil
+}
+
+// PodTables maps the Pod IPs routed to a host veth to the route table
+// of the Pod policy rule at priority matching the veth
+func PodTables(priority int) (map[string]int, error) {
+	rules, err := PodRules(priority)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]int)
+	for _, rule := range rules {
+		tables[rule.IifName] = rule.Table
+	}
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %v", err)
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %v", err)
+	}
+	names := make(map[int]string)
+	for _, link := range links {
+		if link.Type() == "veth" {
+			names[link.Attrs().Index] = link.Attrs().Name
+		}
+	}
+
+	podTables := make(map[string]int)
+	for _, route := range routes {
+		name, ok := names[route.LinkIndex]
+		if !ok || route.Dst == nil {
+			continue
+		}
+		if ones, bits := route.Dst.Mask.Size(); ones != bits {
+			continue
+		}
+		if table, ok := tables[name]; ok {
+			podTables[route.Dst.IP.String()] = table
+		}
+	}
+	return podTables, nil
+}
+
+// IPMasqRule is a rule of the nat POSTROUTING chain jumping to the IP
+// masquerade chain of a container
+type IPMasqRule struct {
+	Source *net.IPNet
+	Name   string
+	ID     string
+	Chain  string
+}
+
+var ipMasqCommentRe = regexp.MustCompile(`-s (\S+) .*--comment "name: \\"(.*)\\" id: \\"(.*)\\"" -j (CNI-\S+)`)
+
+// ListIPMasqRules returns the IP masquerade rules of the network name,
+// listed with the iptables at iptablesPath
+func ListIPMasqRules(iptablesPath string, name string) ([]IPMasqRule, error) {
+	var masqRules []IPMasqRule
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := NewIptables(iptablesPath, proto)
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate iptables: %v", err)
+		}
+		rules, err := ipt.List("nat", "POSTROUTING")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list nat rules: %v", err)
+		}
+		for _, rule := range rules {
+			match := ipMasqCommentRe.FindStringSubmatch(rule)
+			if match == nil || match[2] != name {
+				continue
+			}
+			_, ipn, err := net.ParseCIDR(match[1])
+			if err != nil {
+				continue
+			}
+			masqRules = append(masqRules, IPMasqRule{
+				Source: ipn,
+				Name:   match[2],
+				ID:     match[3],
+				Chain:  match[4],
+			})
+		}
+	}
+	return masqRules, nil
+}
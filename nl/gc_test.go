@@ -0,0 +1,111 @@
+package nl
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestStalePodRules(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer testNS.Close()
+
+	err = testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-live"}}); err != nil {
+			return err
+		}
+		for _, iif := range []string{"lyft-live", "lyft-gone"} {
+			rule := netlink.NewRule()
+			rule.IifName = iif
+			rule.Table = 300
+			rule.Priority = PodRulePriority
+			if err := netlink.RuleAdd(rule); err != nil {
+				return err
+			}
+		}
+
+		stale, err := StalePodRules(PodRulePriority, 0)
+		if err != nil {
+			return err
+		}
+		if len(stale) != 1 || stale[0].IifName != "lyft-gone" {
+			t.Fatalf("Unexpected stale rules %v", stale)
+		}
+
+		if err := RemovePodRule(stale[0]); err != nil {
+			return err
+		}
+		stale, err = StalePodRules(PodRulePriority, 0)
+		if err != nil {
+			return err
+		}
+		if len(stale) != 0 {
+			t.Errorf("Stale rules were not removed %v", stale)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list stale rules: %v", err)
+	}
+}
+
+func TestPodTables(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer testNS.Close()
+
+	err = testNS.Do(func(_ ns.NetNS) error {
+		veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth-pod"}, PeerName: "veth-peer"}
+		if err := netlink.LinkAdd(veth); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("veth-pod")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+		podIP := &net.IPNet{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(32, 32)}
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: podIP, Scope: netlink.SCOPE_LINK}); err != nil {
+			return err
+		}
+		rule := netlink.NewRule()
+		rule.IifName = "veth-pod"
+		rule.Table = 301
+		rule.Priority = PodRulePriority
+		if err := netlink.RuleAdd(rule); err != nil {
+			return err
+		}
+
+		tables, err := PodTables(PodRulePriority)
+		if err != nil {
+			return err
+		}
+		if len(tables) != 1 || tables["192.0.2.10"] != 301 {
+			t.Errorf("Unexpected Pod tables %v", tables)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list Pod tables: %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package nl
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// iptables backends, as reported by iptables --version
+const (
+	IptablesLegacy = "legacy"
+	IptablesNft    = "nf_tables"
+)
+
+// iptablesOutput runs an iptables binary, replaced in tests
+var iptablesOutput = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+var iptablesBackendRe = regexp.MustCompile(`\((legacy|nf_tables)\)`)
+
+// parseIptablesBackend returns the backend in the output of iptables
+// --version. Releases before 1.8 only had the legacy backend and do not
+// name it.
+func parseIptablesBackend(version string) string {
+	if m := iptablesBackendRe.FindStringSubmatch(version); m != nil {
+		return m[1]
+	}
+	return IptablesLegacy
+}
+
+// IptablesBackend returns the backend of the iptables binary at
+// iptablesPath, or of the one in PATH when iptablesPath is empty
+func IptablesBackend(iptablesPath string) (string, error) {
+	path, err := iptablesBinary(iptablesPath, iptables.ProtocolIPv4)
+	if err != nil {
+		return "", err
+	}
+	out, err := iptablesOutput(path, "--version")
+	if err != nil {
+		return "", fmt.Errorf("failed to run iptables --version: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return parseIptablesBackend(string(out)), nil
+}
+
+// KubeProxyBackend returns the backend holding the KUBE-SERVICES nat
+// chain of kube-proxy, or "" when it is found in neither or both, or
+// the backend specific binaries are missing
+func KubeProxyBackend() string {
+	found := ""
+	for backend, name := range map[string]string{IptablesLegacy: "iptables-legacy", IptablesNft: "iptables-nft"} {
+		if _, err := iptablesOutput(name, "-w", "-t", "nat", "-S", "KUBE-SERVICES"); err != nil {
+			continue
+		}
+		if found != "" {
+			return ""
+		}
+		found = backend
+	}
+	return found
+}
+
+// CheckIptablesBackend fails when kube-proxy is detected on another
+// backend than the iptables binary at iptablesPath the rules are added
+// with, where the CONNMARK rules of NodePorts would never see its traffic
+func CheckIptablesBackend(iptablesPath string) error {
+	backend, err := IptablesBackend(iptablesPath)
+	if err != nil {
+		return err
+	}
+	kubeProxy := KubeProxyBackend()
+	if kubeProxy != "" && kubeProxy != backend {
+		return fmt.Errorf("iptables uses the %s backend but kube-proxy rules are in %s, set iptablesPath to the iptables-%s binary",
+			backend, kubeProxy, strings.TrimPrefix(kubeProxy, "nf_"))
+	}
+	return nil
+}
+
+// Iptables runs the iptables or ip6tables binary at a given path, which
+// the go-iptables version we build against cannot be told. It requires
+// iptables 1.4.20 or later for --check and --wait.
+type Iptables struct {
+	path           string
+	nft            bool
+	hasRandomFully bool
+}
+
+var iptablesVersionRe = regexp.MustCompile(`v([0-9]+)\.([0-9]+)\.([0-9]+)`)
+
+// iptablesBinary returns the binary of proto: iptablesPath or the
+// ip6tables binary next to it with the same suffix, e.g.
+// /usr/sbin/ip6tables-legacy for /usr/sbin/iptables-legacy, or the
+// binary found in PATH when iptablesPath is empty
+func iptablesBinary(iptablesPath string, proto iptables.Protocol) (string, error) {
+	if iptablesPath == "" {
+		name := "iptables"
+		if proto == iptables.ProtocolIPv6 {
+			name = "ip6tables"
+		}
+		return exec.LookPath(name)
+	}
+	if !filepath.IsAbs(iptablesPath) {
+		return "", fmt.Errorf("iptables path %q is not absolute", iptablesPath)
+	}
+	dir, name := filepath.Split(iptablesPath)
+	if !strings.HasPrefix(name, "iptables") {
+		return "", fmt.Errorf("iptables path %q does not name an iptables binary", iptablesPath)
+	}
+	if proto == iptables.ProtocolIPv6 {
+		return filepath.Join(dir, "ip6"+strings.TrimPrefix(name, "ip")), nil
+	}
+	return iptablesPath, nil
+}
+
+// NewIptables returns the iptables of proto, run from iptablesPath as
+// described by iptablesBinary
+func NewIptables(iptablesPath string, proto iptables.Protocol) (*Iptables, error) {
+	path, err := iptablesBinary(iptablesPath, proto)
+	if err != nil {
+		return nil, err
+	}
+	out, err := iptablesOutput(path, "--version")
+	if err != nil {
+		return nil, fmt.Errorf("failed to run %s --version: %v: %s", path, err, strings.TrimSpace(string(out)))
+	}
+	ipt := &Iptables{
+		path: path,
+		nft:  parseIptablesBackend(string(out)) == IptablesNft,
+	}
+	if m := iptablesVersionRe.FindStringSubmatch(string(out)); m != nil {
+		var v [3]int
+		for i := range v {
+			v[i], _ = strconv.Atoi(m[i+1])
+		}
+		// --random-fully came with 1.6.2
+		ipt.hasRandomFully = v[0] > 1 || (v[0] == 1 && (v[1] > 6 || (v[1] == 6 && v[2] >= 2)))
+	}
+	return ipt, nil
+}
+
+// IptablesError is a failed run of iptables
+type IptablesError struct {
+	Args       []string
+	ExitStatus int
+	Msg        string
+}
+
+func (e *IptablesError) Error() string {
+	return fmt.Sprintf("running %v: exit status %d: %v", e.Args, e.ExitStatus, e.Msg)
+}
+
+// run runs iptables with args, returning its standard output
+func (ipt *Iptables) run(args ...string) ([]byte, error) {
+	args = append(args, "--wait")
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(ipt.path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, err
+		}
+		status := -1
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			status = ws.ExitStatus()
+		}
+		return nil, &IptablesError{Args: cmd.Args, ExitStatus: status, Msg: strings.TrimSpace(stderr.String())}
+	}
+	return stdout.Bytes(), nil
+}
+
+// HasRandomFully reports whether the MASQUERADE target takes
+// --random-fully
+func (ipt *Iptables) HasRandomFully() bool {
+	return ipt.hasRandomFully
+}
+
+// Exists reports whether rulespec is in chain of table
+func (ipt *Iptables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	_, err := ipt.run(append([]string{"-t", table, "-C", chain}, rulespec...)...)
+	if e, ok := err.(*IptablesError); ok && e.ExitStatus == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Append appends rulespec to chain of table
+func (ipt *Iptables) Append(table, chain string, rulespec ...string) error {
+	_, err := ipt.run(append([]string{"-t", table, "-A", chain}, rulespec...)...)
+	return err
+}
+
+// AppendUnique appends rulespec to chain of table unless it is there
+func (ipt *Iptables) AppendUnique(table, chain string, rulespec ...string) error {
+	exists, err := ipt.Exists(table, chain, rulespec...)
+	if err != nil || exists {
+		return err
+	}
+	return ipt.Append(table, chain, rulespec...)
+}
+
+// Delete removes rulespec from chain of table
+func (ipt *Iptables) Delete(table, chain string, rulespec ...string) error {
+	_, err := ipt.run(append([]string{"-t", table, "-D", chain}, rulespec...)...)
+	return err
+}
+
+// List returns the rules of chain in table, in iptables -S format
+func (ipt *Iptables) List(table, chain string) ([]string, error) {
+	out, err := ipt.run("-t", table, "-S", chain)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"), nil
+}
+
+// ListChains returns the chains of table
+func (ipt *Iptables) ListChains(table string) ([]string, error) {
+	out, err := ipt.run("-t", table, "-S")
+	if err != nil {
+		return nil, err
+	}
+	var chains []string
+	for _, line := range strings.Split(string(out), "\n") {
+		// chains are listed before the rules
+		if !strings.HasPrefix(line, "-P ") && !strings.HasPrefix(line, "-N ") {
+			break
+		}
+		chains = append(chains, strings.Fields(line)[1])
+	}
+	return chains, nil
+}
+
+// NewChain creates chain in table
+func (ipt *Iptables) NewChain(table, chain string) error {
+	_, err := ipt.run("-t", table, "-N", chain)
+	return err
+}
+
+// ClearChain flushes chain in table, creating it when it is missing
+func (ipt *Iptables) ClearChain(table, chain string) error {
+	err := ipt.NewChain(table, chain)
+	// nf_tables reports an existing chain with another status
+	existsStatus := 1
+	if ipt.nft {
+		existsStatus = 4
+	}
+	if e, ok := err.(*IptablesError); ok && e.ExitStatus == existsStatus {
+		_, err = ipt.run("-t", table, "-F", chain)
+	}
+	return err
+}
+
+// DeleteChain deletes the empty chain in table
+func (ipt *Iptables) DeleteChain(table, chain string) error {
+	_, err := ipt.run("-t", table, "-X", chain)
+	return err
+}
+
+// iptablesForIPNet returns the iptables of the family of ipn
+func iptablesForIPNet(iptablesPath string, ipn *net.IPNet) (*Iptables, error) {
+	proto := iptables.ProtocolIPv4
+	if ipn.IP.To4() == nil {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := NewIptables(iptablesPath, proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	return ipt, nil
+}
+
+// SetupIPMasq is ip.SetupIPMasq of the CNI plugins, masquerading the
+// traffic of ipn leaving it, with the iptables at iptablesPath
+func SetupIPMasq(iptablesPath string, ipn *net.IPNet, chain string, comment string) error {
+	ipt, err := iptablesForIPNet(iptablesPath, ipn)
+	if err != nil {
+		return err
+	}
+	multicastNet := "224.0.0.0/4"
+	if ipn.IP.To4() == nil {
+		multicastNet = "ff00::/8"
+	}
+
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return fmt.Errorf("failed to list chains: %v", err)
+	}
+	if !containsString(chains, chain) {
+		if err := ipt.NewChain("nat", chain); err != nil {
+			return err
+		}
+	}
+	// packets to ipn, and multicast to other Pods, are not touched
+	if err := ipt.AppendUnique("nat", chain, "-d", ipn.String(), "-j", "ACCEPT", "-m", "comment", "--comment", comment); err != nil {
+		return err
+	}
+	if err := ipt.AppendUnique("nat", chain, "!", "-d", multicastNet, "-j", "MASQUERADE", "-m", "comment", "--comment", comment); err != nil {
+		return err
+	}
+	return ipt.AppendUnique("nat", "POSTROUTING", "-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment)
+}
+
+// TeardownIPMasq undoes SetupIPMasq
+func TeardownIPMasq(iptablesPath string, ipn *net.IPNet, chain string, comment string) error {
+	ipt, err := iptablesForIPNet(iptablesPath, ipn)
+	if err != nil {
+		return err
+	}
+	if err := ipt.Delete("nat", "POSTROUTING", "-s", ipn.String(), "-j", chain, "-m", "comment", "--comment", comment); err != nil {
+		return err
+	}
+	if err := ipt.ClearChain("nat", chain); err != nil {
+		return err
+	}
+	return ipt.DeleteChain("nat", chain)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package nl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+func TestParseIptablesBackend(t *testing.T) {
+	for version, expected := range map[string]string{
+		"iptables v1.8.7 (nf_tables)\n": IptablesNft,
+		"iptables v1.8.4 (legacy)\n":    IptablesLegacy,
+		"iptables v1.6.1\n":             IptablesLegacy,
+	} {
+		if backend := parseIptablesBackend(version); backend != expected {
+			t.Errorf("Backend of %q is %q, expected %q", version, backend, expected)
+		}
+	}
+}
+
+func TestCheckIptablesBackend(t *testing.T) {
+	defer func(orig func(string, ...string) ([]byte, error)) { iptablesOutput = orig }(iptablesOutput)
+
+	// kube-proxy chains are only in the legacy backend
+	kubeProxy := map[string]bool{"iptables-legacy": true}
+	version := "iptables v1.8.7 (nf_tables)"
+	iptablesOutput = func(name string, args ...string) ([]byte, error) {
+		if name == "/usr/sbin/iptables" {
+			return []byte(version), nil
+		}
+		if kubeProxy[name] {
+			return []byte("-N KUBE-SERVICES"), nil
+		}
+		return nil, fmt.Errorf("exit status 1")
+	}
+
+	if err := CheckIptablesBackend("/usr/sbin/iptables"); err == nil {
+		t.Errorf("Backend mismatch with kube-proxy was not detected")
+	}
+	version = "iptables v1.8.7 (legacy)"
+	if err := CheckIptablesBackend("/usr/sbin/iptables"); err != nil {
+		t.Errorf("Matching backends reported as a mismatch: %v", err)
+	}
+
+	// chains in both backends can't be attributed
+	kubeProxy["iptables-nft"] = true
+	if backend := KubeProxyBackend(); backend != "" {
+		t.Errorf("Expected an unknown kube-proxy backend, got %q", backend)
+	}
+}
+
+func TestIptablesBinary(t *testing.T) {
+	for _, c := range []struct {
+		Path     string
+		Proto    iptables.Protocol
+		Expected string
+	}{
+		{Path: "/usr/sbin/iptables-legacy", Proto: iptables.ProtocolIPv4, Expected: "/usr/sbin/iptables-legacy"},
+		{Path: "/usr/sbin/iptables-legacy", Proto: iptables.ProtocolIPv6, Expected: "/usr/sbin/ip6tables-legacy"},
+		{Path: "/sbin/iptables", Proto: iptables.ProtocolIPv6, Expected: "/sbin/ip6tables"},
+	} {
+		if path, err := iptablesBinary(c.Path, c.Proto); err != nil || path != c.Expected {
+			t.Errorf("Binary of %v for %v is %q, expected %q: %v", c.Path, c.Proto, path, c.Expected, err)
+		}
+	}
+
+	for _, path := range []string{"iptables-legacy", "/usr/sbin/nft"} {
+		if _, err := iptablesBinary(path, iptables.ProtocolIPv4); err == nil {
+			t.Errorf("iptables path %q was accepted", path)
+		}
+	}
+}
+
+func TestIptables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iptables")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the fake binary knows the rule "-j ACCEPT" and the chain CNI-1
+	script := `#!/bin/sh
+case "$*" in
+--version) echo "iptables v1.8.7 (nf_tables)" ;;
+*"-C INPUT -j ACCEPT --wait") exit 0 ;;
+*"-C "*) echo "Bad rule" >&2; exit 1 ;;
+*"-N CNI-1 --wait") echo "Chain already exists." >&2; exit 4 ;;
+*"-S --wait") printf -- "-P INPUT ACCEPT\n-N CNI-1\n-A CNI-1 -j MASQUERADE\n" ;;
+*) exit 0 ;;
+esac
+`
+	path := filepath.Join(dir, "iptables-nft")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to create %v: %v", path, err)
+	}
+	ipt, err := NewIptables(path, iptables.ProtocolIPv4)
+	if err != nil {
+		t.Fatalf("Failed to use %v: %v", path, err)
+	}
+	if !ipt.HasRandomFully() || !ipt.nft {
+		t.Errorf("Version of %v was not parsed", path)
+	}
+
+	if exists, err := ipt.Exists("filter", "INPUT", "-j", "ACCEPT"); err != nil || !exists {
+		t.Errorf("Existing rule was not found: %v", err)
+	}
+	if exists, err := ipt.Exists("filter", "INPUT", "-j", "DROP"); err != nil || exists {
+		t.Errorf("Missing rule was found: %v", err)
+	}
+	if chains, err := ipt.ListChains("nat"); err != nil || len(chains) != 2 || chains[1] != "CNI-1" {
+		t.Errorf("Unexpected chains %v: %v", chains, err)
+	}
+	if err := ipt.ClearChain("nat", "CNI-1"); err != nil {
+		t.Errorf("Existing nf_tables chain was not flushed: %v", err)
+	}
+
+	if _, err := NewIptables(path, iptables.ProtocolIPv6); err == nil {
+		t.Errorf("Missing ip6tables binary was accepted")
+	}
+}
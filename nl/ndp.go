@@ -0,0 +1,62 @@
+package nl
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ICMPv6 Neighbor Advertisement fields (RFC 4861)
+const (
+	icmpv6NeighborAdvertisement = 136
+	naFlagOverride              = 0x20
+	ndpOptTargetLinkLayerAddr   = 2
+	ndpHopLimit                 = 255
+)
+
+// neighborAdvertisement builds an unsolicited Neighbor Advertisement
+// for ip owned by mac. The checksum is left for the kernel to fill in.
+func neighborAdvertisement(ip net.IP, mac net.HardwareAddr) []byte {
+	msg := make([]byte, 24, 32)
+	msg[0] = icmpv6NeighborAdvertisement
+	// unsolicited, so the Solicited flag stays clear; Override makes
+	// neighbors replace cached entries
+	msg[4] = naFlagOverride
+	copy(msg[8:24], ip.To16())
+
+	if len(mac) == 6 {
+		msg = append(msg, ndpOptTargetLinkLayerAddr, 1)
+		msg = append(msg, mac...)
+	}
+	return msg
+}
+
+// SendUnsolicitedNA sends an unsolicited Neighbor Advertisement for
+// the IPv6 address ip to all nodes on iface, the IPv6 counterpart of a
+// gratuitous ARP, so neighbors update stale entries
+func SendUnsolicitedNA(ip net.IP, iface net.Interface) error {
+	if ip.To4() != nil || ip.To16() == nil {
+		return fmt.Errorf("%v is not an IPv6 address", ip)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_ICMPV6)
+	if err != nil {
+		return fmt.Errorf("failed to open ICMPv6 socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	// neighbor discovery messages must be sent with a hop limit of 255
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ndpHopLimit); err != nil {
+		return fmt.Errorf("failed to set the hop limit: %v", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, iface.Index); err != nil {
+		return fmt.Errorf("failed to select %q: %v", iface.Name, err)
+	}
+
+	dst := &syscall.SockaddrInet6{ZoneId: uint32(iface.Index)}
+	copy(dst.Addr[:], net.IPv6linklocalallnodes)
+	if err := syscall.Sendto(fd, neighborAdvertisement(ip, iface.HardwareAddr), 0, dst); err != nil {
+		return fmt.Errorf("failed to send neighbor advertisement for %v over %q: %v", ip, iface.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package nl
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestNeighborAdvertisement(t *testing.T) {
+	ip := net.ParseIP("2001:db8::5")
+	mac, _ := net.ParseMAC("02:00:00:00:00:05")
+
+	msg := neighborAdvertisement(ip, mac)
+	if len(msg) != 32 {
+		t.Fatalf("Expected a 32 byte message, got %d", len(msg))
+	}
+	if msg[0] != 136 || msg[1] != 0 {
+		t.Errorf("Unexpected type %d code %d", msg[0], msg[1])
+	}
+	if msg[4] != 0x20 {
+		t.Errorf("Expected only the override flag, got %#x", msg[4])
+	}
+	if !net.IP(msg[8:24]).Equal(ip) {
+		t.Errorf("Unexpected target %v", net.IP(msg[8:24]))
+	}
+	if msg[24] != 2 || msg[25] != 1 || !bytes.Equal(msg[26:32], mac) {
+		t.Errorf("Unexpected target link-layer address option %v", msg[24:])
+	}
+}
+
+func TestSendUnsolicitedNARejectsIPv4(t *testing.T) {
+	if err := SendUnsolicitedNA(net.ParseIP("10.0.0.5"), net.Interface{Name: "lo", Index: 1}); err == nil {
+		t.Errorf("Neighbor advertisement for an IPv4 address was not refused")
+	}
+}
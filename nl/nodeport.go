@@ -0,0 +1,345 @@
+package nl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// Defaults for NodePort traffic handling
+const (
+	DefaultNodePorts     = "30000:32767"
+	DefaultNodePortMark  = 0x2000
+	NodePortRulePriority = 512
+	RPFilterTemplate     = "net.ipv4.conf.%s.rp_filter"
+
+	// DefaultHostVethPrefix is the name prefix of the host veths of
+	// Pods, as created by ip.SetupVeth
+	DefaultHostVethPrefix = "veth"
+)
+
+// rpFilterStateDir keeps the rp_filter value of each host interface
+// from before SetupNodePortRule loosened it
+var rpFilterStateDir = "/run"
+
+// Policy rule priorities. The Pod rules sort after the main table rule
+// for NodePort replies, and both must come before the main table rule
+// of the kernel at MaxRulePriority + 1.
+const (
+	PodRulePriority = 1024
+	MinRulePriority = 1
+	MaxRulePriority = 32765
+)
+
+// ValidateRulePriorities checks that the Pod and main table rule
+// priorities are within the range of user rules, and that the main table
+// rule sorts first so that NodePort replies skip the per-Pod tables
+func ValidateRulePriorities(podPriority int, mainTablePriority int) error {
+	for _, priority := range []int{podPriority, mainTablePriority} {
+		if priority < MinRulePriority || priority > MaxRulePriority {
+			return fmt.Errorf("rule priority %d is outside of %d-%d", priority, MinRulePriority, MaxRulePriority)
+		}
+	}
+	if mainTablePriority >= podPriority {
+		return fmt.Errorf("mainTableRulePriority %d must be below podRulePriority %d", mainTablePriority, podPriority)
+	}
+	return nil
+}
+
+// ValidateNodePortMark checks that the NodePort mark only has bits of
+// its mask set
+func ValidateNodePortMark(nodePortMark int, nodePortMarkMask int) error {
+	if nodePortMark <= 0 || nodePortMarkMask <= 0 || nodePortMark&^nodePortMarkMask != 0 {
+		return fmt.Errorf("nodePortMark %#x must be a non-zero subset of nodePortMarkMask %#x", nodePortMark, nodePortMarkMask)
+	}
+	return nil
+}
+
+// ValidateNodePorts checks that nodePorts is a port or a lo:hi port
+// range as taken by the iptables --dport match
+func ValidateNodePorts(nodePorts string) error {
+	bounds := strings.Split(nodePorts, ":")
+	if len(bounds) > 2 {
+		return fmt.Errorf("nodePorts %q must be a port or a lo:hi port range", nodePorts)
+	}
+	var ports []int
+	for _, bound := range bounds {
+		port, err := strconv.Atoi(bound)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("nodePorts %q must be a port or a lo:hi port range of ports 1-65535", nodePorts)
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) == 2 && ports[0] > ports[1] {
+		return fmt.Errorf("nodePorts range %q is reversed", nodePorts)
+	}
+	return nil
+}
+
+// SetupNodePortRule marks the NodePort traffic arriving on ifName with
+// the nodePortMarkMask bits of nodePortMark, restores the mark on replies
+// from the veths named with vethPrefix and routes them through the main
+// table rule at priority, with the iptables at iptablesPath. It is
+// idempotent.
+func SetupNodePortRule(iptablesPath string, ifName string, nodePorts string, nodePortMark int, nodePortMarkMask int, priority int, sctp bool, vethPrefix string) error {
+	if err := ValidateNodePortMark(nodePortMark, nodePortMarkMask); err != nil {
+		return err
+	}
+
+	if err := setupNodePortMark(iptablesPath, iptables.ProtocolIPv4, ifName, nodePorts, nodePortMark, nodePortMarkMask, sctp, vethPrefix); err != nil {
+		return err
+	}
+
+	// RP filter does not take mark-based rules into account
+	if err := LoosenRPFilter(ifName); err != nil {
+		return err
+	}
+
+	if err := addNodePortRule(netlink.FAMILY_V4, nodePortMark, nodePortMarkMask, priority); err != nil {
+		return err
+	}
+
+	hasV6, err := hasGlobalV6(ifName)
+	if err != nil || !hasV6 {
+		return err
+	}
+
+	// IPv6 has no rp_filter sysctl, reverse path filtering is only done
+	// by ip6tables rules which don't apply to the marked replies
+	if err := setupNodePortMark(iptablesPath, iptables.ProtocolIPv6, ifName, nodePorts, nodePortMark, nodePortMarkMask, sctp, vethPrefix); err != nil {
+		return err
+	}
+	return addNodePortRule(netlink.FAMILY_V6, nodePortMark, nodePortMarkMask, priority)
+}
+
+// TeardownNodePortRule removes what SetupNodePortRule set up for
+// ifName, restoring the rp_filter of ifName to its value from before the
+// first setup. Rules that are already gone are skipped.
+func TeardownNodePortRule(iptablesPath string, ifName string, nodePorts string, nodePortMark int, nodePortMarkMask int, priority int, vethPrefix string) error {
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, err := NewIptables(iptablesPath, proto)
+		if err != nil {
+			if proto == iptables.ProtocolIPv6 {
+				// nothing was set up without ip6tables
+				continue
+			}
+			return fmt.Errorf("failed to locate iptables: %v", err)
+		}
+		rulespecs := [][]string{restoreMarkRulespec(vethPrefix, nodePortMarkMask)}
+		for _, l4 := range []string{"tcp", "udp", "sctp"} {
+			rulespecs = append(rulespecs, nodePortMarkRulespec(ifName, l4, nodePorts, nodePortMark, nodePortMarkMask))
+		}
+		for _, rulespec := range rulespecs {
+			if exists, err := ipt.Exists("mangle", "PREROUTING", rulespec...); err != nil || !exists {
+				continue
+			}
+			if err := ipt.Delete("mangle", "PREROUTING", rulespec...); err != nil {
+				return fmt.Errorf("failed to remove NodePort mark rule: %v", err)
+			}
+		}
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return fmt.Errorf("Unable to retrive IP rules %v", err)
+		}
+		for i := range rules {
+			r := rules[i]
+			if r.Table == 254 && r.Mark == nodePortMark && r.Mask == nodePortMarkMask && r.Priority == priority {
+				r.Family = family
+				if err := netlink.RuleDel(&r); err != nil {
+					return fmt.Errorf("failed to remove policy rule %v: %v", r, err)
+				}
+			}
+		}
+	}
+
+	return restoreRPFilter(ifName)
+}
+
+// LoosenRPFilter sets the rp_filter of ifName to loose after recording
+// its prior value, which TeardownNodePortRule restores
+func LoosenRPFilter(ifName string) error {
+	if err := saveRPFilter(ifName); err != nil {
+		return err
+	}
+	if _, err := sysctl.Sysctl(fmt.Sprintf(RPFilterTemplate, ifName), "2"); err != nil {
+		return fmt.Errorf("failed to set RP filter to loose for interface %q: %v", ifName, err)
+	}
+	return nil
+}
+
+func rpFilterStatePath(ifName string) string {
+	return filepath.Join(rpFilterStateDir, "cni-ipvlan-rp_filter."+ifName)
+}
+
+// saveRPFilter records the rp_filter of ifName unless an earlier setup
+// already did
+func saveRPFilter(ifName string) error {
+	path := rpFilterStatePath(ifName)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	value, err := sysctl.Sysctl(fmt.Sprintf(RPFilterTemplate, ifName))
+	if err != nil {
+		return fmt.Errorf("failed to read RP filter of interface %q: %v", ifName, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to record RP filter of interface %q: %v", ifName, err)
+	}
+	// keep the prior value in the runtime logs too, as the state file is
+	// gone after a reboot
+	if strings.TrimSpace(value) != "2" {
+		fmt.Fprintf(os.Stderr, "loosening rp_filter of %q from %s, recorded in %s\n", ifName, strings.TrimSpace(value), path)
+	}
+	return nil
+}
+
+// restoreRPFilter sets the rp_filter of ifName back to its recorded
+// value, if any
+func restoreRPFilter(ifName string) error {
+	path := rpFilterStatePath(ifName)
+	value, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read recorded RP filter of interface %q: %v", ifName, err)
+	}
+	if _, err := sysctl.Sysctl(fmt.Sprintf(RPFilterTemplate, ifName), strings.TrimSpace(string(value))); err != nil {
+		return fmt.Errorf("failed to restore RP filter of interface %q: %v", ifName, err)
+	}
+	return os.Remove(path)
+}
+
+// setupNodePortMark creates iptables rules to ensure that nodeport
+// traffic is marked
+func setupNodePortMark(iptablesPath string, proto iptables.Protocol, ifName string, nodePorts string, nodePortMark int, nodePortMarkMask int, sctp bool, vethPrefix string) error {
+	ipt, err := NewIptables(iptablesPath, proto)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+
+	// rules of older versions set the whole connection mark
+	for _, rulespec := range legacyNodePortMarkRulespecs(ifName, nodePorts, nodePortMark) {
+		if exists, err := ipt.Exists("mangle", "PREROUTING", rulespec...); err == nil && exists {
+			if err := ipt.Delete("mangle", "PREROUTING", rulespec...); err != nil {
+				return fmt.Errorf("failed to remove unmasked NodePort mark rule: %v", err)
+			}
+		}
+	}
+
+	if err := ipt.AppendUnique("mangle", "PREROUTING", nodePortMarkRulespec(ifName, "tcp", nodePorts, nodePortMark, nodePortMarkMask)...); err != nil {
+		return err
+	}
+	if err := ipt.AppendUnique("mangle", "PREROUTING", nodePortMarkRulespec(ifName, "udp", nodePorts, nodePortMark, nodePortMarkMask)...); err != nil {
+		return err
+	}
+	if sctp {
+		if err := ipt.AppendUnique("mangle", "PREROUTING", nodePortMarkRulespec(ifName, "sctp", nodePorts, nodePortMark, nodePortMarkMask)...); err != nil {
+			return fmt.Errorf("failed to mark SCTP NodePorts, is the sctp kernel module available? %v", err)
+		}
+	}
+	return ipt.AppendUnique("mangle", "PREROUTING", restoreMarkRulespec(vethPrefix, nodePortMarkMask)...)
+}
+
+func nodePortMarkRulespec(ifName string, proto string, nodePorts string, nodePortMark int, nodePortMarkMask int) []string {
+	return []string{"-i", ifName, "-p", proto, "--dport", nodePorts, "-j", "CONNMARK", "--set-xmark", fmt.Sprintf("%#x/%#x", nodePortMark, nodePortMarkMask), "-m", "comment", "--comment", "NodePort Mark"}
+}
+
+func restoreMarkRulespec(vethPrefix string, nodePortMarkMask int) []string {
+	mask := fmt.Sprintf("%#x", nodePortMarkMask)
+	return []string{"-i", vethPrefix + "+", "-j", "CONNMARK", "--restore-mark", "--nfmask", mask, "--ctmask", mask, "-m", "comment", "--comment", "NodePort Mark"}
+}
+
+func legacyNodePortMarkRulespecs(ifName string, nodePorts string, nodePortMark int) [][]string {
+	var rulespecs [][]string
+	for _, proto := range []string{"tcp", "udp", "sctp"} {
+		rulespecs = append(rulespecs, []string{"-i", ifName, "-p", proto, "--dport", nodePorts, "-j", "CONNMARK", "--set-mark", strconv.Itoa(nodePortMark), "-m", "comment", "--comment", "NodePort Mark"})
+	}
+	return append(rulespecs, []string{"-i", "veth+", "-j", "CONNMARK", "--restore-mark", "-m", "comment", "--comment", "NodePort Mark"})
+}
+
+// PlanNodePortRule describes the iptables rules, sysctls and policy
+// rules SetupNodePortRule ensures, without changing anything
+func PlanNodePortRule(ifName string, nodePorts string, nodePortMark int, nodePortMarkMask int, priority int, sctp bool, vethPrefix string) ([]string, error) {
+	hasV6, err := hasGlobalV6(ifName)
+	if err != nil {
+		return nil, err
+	}
+
+	protos := []string{"tcp", "udp"}
+	if sctp {
+		protos = append(protos, "sctp")
+	}
+	commands := []string{"iptables"}
+	if hasV6 {
+		commands = append(commands, "ip6tables")
+	}
+
+	var ops []string
+	for _, command := range commands {
+		for _, proto := range protos {
+			ops = append(ops, fmt.Sprintf("%s -t mangle -A PREROUTING %s", command, strings.Join(nodePortMarkRulespec(ifName, proto, nodePorts, nodePortMark, nodePortMarkMask), " ")))
+		}
+		ops = append(ops, fmt.Sprintf("%s -t mangle -A PREROUTING %s", command, strings.Join(restoreMarkRulespec(vethPrefix, nodePortMarkMask), " ")))
+		family := "-6"
+		if command == "iptables" {
+			ops = append(ops, fmt.Sprintf("sysctl %s=2", fmt.Sprintf(RPFilterTemplate, ifName)))
+			family = "-4"
+		}
+		ops = append(ops, fmt.Sprintf("ip %s rule add fwmark %#x/%#x lookup main priority %d", family, nodePortMark, nodePortMarkMask, priority))
+	}
+	return ops, nil
+}
+
+// addNodePortRule adds a policy route for traffic marked as nodeport
+func addNodePortRule(family int, nodePortMark int, nodePortMarkMask int, priority int) error {
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Mark = nodePortMark
+	rule.Mask = nodePortMarkMask
+	rule.Table = 254 // main table
+	rule.Priority = priority
+
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		return fmt.Errorf("Unable to retrive IP rules %v", err)
+	}
+
+	for _, r := range rules {
+		if r.Table == rule.Table && r.Mark == rule.Mark && r.Mask == rule.Mask && r.Priority == rule.Priority {
+			return nil
+		}
+	}
+	if err := netlink.RuleAdd(rule); err != nil {
+		return fmt.Errorf("failed to add policy rule %v: %v", rule, err)
+	}
+	return nil
+}
+
+// hasGlobalV6 reports whether ifName has a global scope IPv6 address
+func hasGlobalV6(ifName string) (bool, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return false, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return false, fmt.Errorf("failed to get IPv6 addresses of %q: %v", ifName, err)
+	}
+	for _, addr := range addrs {
+		if addr.Scope == int(netlink.SCOPE_UNIVERSE) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
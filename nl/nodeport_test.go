@@ -0,0 +1,421 @@
+package nl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+func TestSetupNodePortRuleIdempotent(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer testNS.Close()
+
+	err = testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-np"}}); err != nil {
+			return err
+		}
+
+		// a bootstrap followed by a Pod ADD must not duplicate anything
+		for i := 0; i < 2; i++ {
+			if err := SetupNodePortRule("", "lyft-np", DefaultNodePorts, DefaultNodePortMark, DefaultNodePortMark, NodePortRulePriority, false, DefaultHostVethPrefix); err != nil {
+				return err
+			}
+		}
+
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		count := 0
+		for _, rule := range rules {
+			if rule.Priority == NodePortRulePriority && rule.Mark == DefaultNodePortMark && rule.Table == 254 {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("Expected one NodePort policy rule, got %d", count)
+		}
+
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return err
+		}
+		for _, proto := range []string{"tcp", "udp"} {
+			exists, err := ipt.Exists("mangle", "PREROUTING", "-i", "lyft-np", "-p", proto, "--dport", DefaultNodePorts,
+				"-j", "CONNMARK", "--set-xmark", fmt.Sprintf("%#x/%#x", DefaultNodePortMark, DefaultNodePortMark), "-m", "comment", "--comment", "NodePort Mark")
+			if !exists || err != nil {
+				t.Errorf("NodePort %v mark rule missing: %v", proto, err)
+			}
+		}
+
+		value, err := sysctl.Sysctl("net.ipv4.conf.lyft-np.rp_filter")
+		if err != nil {
+			return err
+		}
+		if value != "2" {
+			t.Errorf("Expected loose rp_filter, got %v", value)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up NodePort rules: %v", err)
+	}
+}
+
+func TestSetupNodePortRuleIPv6(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer testNS.Close()
+
+	countV6Rules := func() int {
+		rules, _ := netlink.RuleList(netlink.FAMILY_V6)
+		count := 0
+		for _, rule := range rules {
+			if rule.Priority == NodePortRulePriority && rule.Mark == DefaultNodePortMark {
+				count++
+			}
+		}
+		return count
+	}
+
+	err = testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-np"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("lyft-np")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+
+		// no IPv6 address, no IPv6 rule
+		if err := SetupNodePortRule("", "lyft-np", DefaultNodePorts, DefaultNodePortMark, DefaultNodePortMark, NodePortRulePriority, false, DefaultHostVethPrefix); err != nil {
+			return err
+		}
+		if count := countV6Rules(); count != 0 {
+			t.Errorf("Expected no IPv6 NodePort rule without IPv6 addresses, got %d", count)
+		}
+
+		addr, _ := netlink.ParseAddr("2001:db8::1/64")
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		if err := SetupNodePortRule("", "lyft-np", DefaultNodePorts, DefaultNodePortMark, DefaultNodePortMark, NodePortRulePriority, false, DefaultHostVethPrefix); err != nil {
+			return err
+		}
+		if count := countV6Rules(); count != 1 {
+			t.Errorf("Expected one IPv6 NodePort rule, got %d", count)
+		}
+
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			return err
+		}
+		exists, err := ipt.Exists("mangle", "PREROUTING", "-i", "lyft-np", "-p", "tcp", "--dport", DefaultNodePorts,
+			"-j", "CONNMARK", "--set-xmark", fmt.Sprintf("%#x/%#x", DefaultNodePortMark, DefaultNodePortMark), "-m", "comment", "--comment", "NodePort Mark")
+		if !exists || err != nil {
+			t.Errorf("IPv6 NodePort mark rule missing: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up NodePort rules: %v", err)
+	}
+}
+
+func TestValidateRulePriorities(t *testing.T) {
+	tests := []struct {
+		pod, mainTable int
+		valid          bool
+	}{
+		{PodRulePriority, NodePortRulePriority, true},
+		{2000, 100, true},
+		{100, 2000, false},
+		{1024, 1024, false},
+		{0, 512, false},
+		{1024, 32766, false},
+	}
+	for _, test := range tests {
+		err := ValidateRulePriorities(test.pod, test.mainTable)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateRulePriorities(%d, %d) = %v, expected valid %v", test.pod, test.mainTable, err, test.valid)
+		}
+	}
+}
+
+func TestValidateNodePorts(t *testing.T) {
+	tests := []struct {
+		nodePorts string
+		valid     bool
+	}{
+		{DefaultNodePorts, true},
+		{"30080", true},
+		{"1:65535", true},
+		{"8080:8080", true},
+		{"30000-32767", false},
+		{"32767:30000", false},
+		{"0:100", false},
+		{"30000:65536", false},
+		{"30000:", false},
+		{":32767", false},
+		{"1:2:3", false},
+		{"http", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := ValidateNodePorts(test.nodePorts)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateNodePorts(%q) = %v, expected valid %v", test.nodePorts, err, test.valid)
+		}
+	}
+}
+
+func TestSetupNodePortRuleSCTP(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer testNS.Close()
+
+	err = testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-np"}}); err != nil {
+			return err
+		}
+		if err := SetupNodePortRule("", "lyft-np", DefaultNodePorts, DefaultNodePortMark, DefaultNodePortMark, NodePortRulePriority, true, DefaultHostVethPrefix); err != nil {
+			if strings.Contains(err.Error(), "sctp kernel module") {
+				t.Skip("SCTP is not available - skipped")
+			}
+			return err
+		}
+
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return err
+		}
+		exists, err := ipt.Exists("mangle", "PREROUTING", "-i", "lyft-np", "-p", "sctp", "--dport", DefaultNodePorts,
+			"-j", "CONNMARK", "--set-xmark", fmt.Sprintf("%#x/%#x", DefaultNodePortMark, DefaultNodePortMark), "-m", "comment", "--comment", "NodePort Mark")
+		if !exists || err != nil {
+			t.Errorf("NodePort sctp mark rule missing: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up NodePort rules: %v", err)
+	}
+}
+
+func TestPlanNodePortRule(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer testNS.Close()
+
+	err = testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-np"}}); err != nil {
+			return err
+		}
+
+		ops, err := PlanNodePortRule("lyft-np", DefaultNodePorts, DefaultNodePortMark, DefaultNodePortMark, NodePortRulePriority, true, DefaultHostVethPrefix)
+		if err != nil {
+			return err
+		}
+		// tcp, udp and sctp marks, the restore mark, rp_filter and the rule
+		if len(ops) != 6 {
+			t.Errorf("Expected 6 IPv4 operations, got %v", ops)
+		}
+		for _, op := range ops {
+			if strings.HasPrefix(op, "ip6tables") {
+				t.Errorf("Unexpected IPv6 operation %q without a global IPv6 address", op)
+			}
+		}
+
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if rule.Priority == NodePortRulePriority {
+				t.Errorf("Planning added rule %v", rule)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupNodePortRuleMask(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer testNS.Close()
+
+	err = testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-np"}}); err != nil {
+			return err
+		}
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return err
+		}
+		// an unmasked rule left by an older version
+		legacy := []string{"-i", "lyft-np", "-p", "tcp", "--dport", DefaultNodePorts,
+			"-j", "CONNMARK", "--set-mark", strconv.Itoa(DefaultNodePortMark), "-m", "comment", "--comment", "NodePort Mark"}
+		if err := ipt.Append("mangle", "PREROUTING", legacy...); err != nil {
+			return err
+		}
+
+		if err := SetupNodePortRule("", "lyft-np", DefaultNodePorts, DefaultNodePortMark, 0x6000, NodePortRulePriority, false, DefaultHostVethPrefix); err != nil {
+			return err
+		}
+
+		if exists, err := ipt.Exists("mangle", "PREROUTING", legacy...); exists || err != nil {
+			t.Errorf("Unmasked NodePort mark rule was not removed: %v", err)
+		}
+		exists, err := ipt.Exists("mangle", "PREROUTING", "-i", "veth+", "-j", "CONNMARK", "--restore-mark",
+			"--nfmask", "0x6000", "--ctmask", "0x6000", "-m", "comment", "--comment", "NodePort Mark")
+		if !exists || err != nil {
+			t.Errorf("Masked restore mark rule missing: %v", err)
+		}
+
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, rule := range rules {
+			if rule.Priority == NodePortRulePriority && rule.Mark == DefaultNodePortMark && rule.Mask == 0x6000 {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Masked NodePort policy rule missing from %v", rules)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateNodePortMark(0x8000, 0x6000); err == nil {
+		t.Errorf("Mark outside of its mask was accepted")
+	}
+}
+
+func TestTeardownNodePortRule(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	stateDir, err := ioutil.TempDir("", "lyft-rp-filter")
+	if err != nil {
+		t.Fatalf("Failed to create state dir: %v", err)
+	}
+	defer os.RemoveAll(stateDir)
+	oldStateDir := rpFilterStateDir
+	defer func() { rpFilterStateDir = oldStateDir }()
+	rpFilterStateDir = stateDir
+
+	testNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer testNS.Close()
+
+	err = testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-np"}}); err != nil {
+			return err
+		}
+		rpFilter := fmt.Sprintf(RPFilterTemplate, "lyft-np")
+		if _, err := sysctl.Sysctl(rpFilter, "1"); err != nil {
+			return err
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := SetupNodePortRule("", "lyft-np", DefaultNodePorts, DefaultNodePortMark, DefaultNodePortMark, NodePortRulePriority, false, DefaultHostVethPrefix); err != nil {
+				return err
+			}
+		}
+		// the second setup must not record the loosened value
+		if recorded, err := ioutil.ReadFile(rpFilterStatePath("lyft-np")); err != nil || strings.TrimSpace(string(recorded)) != "1" {
+			t.Errorf("Expected the prior rp_filter 1 to be recorded, got %q: %v", recorded, err)
+		}
+		if err := TeardownNodePortRule("", "lyft-np", DefaultNodePorts, DefaultNodePortMark, DefaultNodePortMark, NodePortRulePriority, DefaultHostVethPrefix); err != nil {
+			return err
+		}
+
+		if value, err := sysctl.Sysctl(rpFilter); err != nil || value != "1" {
+			t.Errorf("Expected the prior rp_filter 1, got %q: %v", value, err)
+		}
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if rule.Priority == NodePortRulePriority {
+				t.Errorf("NodePort policy rule was not removed: %v", rule)
+			}
+		}
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return err
+		}
+		if exists, err := ipt.Exists("mangle", "PREROUTING", restoreMarkRulespec(DefaultHostVethPrefix, DefaultNodePortMark)...); err != nil || exists {
+			t.Errorf("NodePort restore mark rule was not removed: %v", err)
+		}
+
+		if _, err := os.Stat(rpFilterStatePath("lyft-np")); !os.IsNotExist(err) {
+			t.Errorf("Recorded rp_filter was not removed: %v", err)
+		}
+
+		// a second teardown finds nothing left to remove
+		return TeardownNodePortRule("", "lyft-np", DefaultNodePorts, DefaultNodePortMark, DefaultNodePortMark, NodePortRulePriority, DefaultHostVethPrefix)
+	})
+	if err != nil {
+		t.Fatalf("Failed to tear down NodePort rules: %v", err)
+	}
+}
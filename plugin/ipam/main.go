@@ -21,6 +21,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
 	"runtime"
 	"time"
 
@@ -33,20 +35,12 @@ import (
 
 	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
 	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/netconf"
 	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
 // PluginConf contains configuration parameters
-type PluginConf struct {
-	Name             string            `json:"name"`
-	CNIVersion       string            `json:"cniVersion"`
-	SecGroupIds      []string          `json:"secGroupIds"`
-	SubnetTags       map[string]string `json:"subnetTags"`
-	IfaceIndex       int               `json:"interfaceIndex"`
-	SkipDeallocation bool              `json:"skipDeallocation"`
-	RouteToVPCPeers  bool              `json:"routeToVpcPeers"`
-	ReuseIPWait      int               `json:"reuseIPWait"`
-}
+type PluginConf = netconf.IPAMConf
 
 func init() {
 	// this ensures that main runs only on main thread (thread group leader).
@@ -57,36 +51,261 @@ func init() {
 
 // parseConfig parses the supplied configuration from stdin.
 func parseConfig(stdin []byte) (*PluginConf, error) {
-	conf := PluginConf{
-		ReuseIPWait: 60, // default 60 second wait
+	conf, err := netconf.LoadIPAMConf(stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := aws.SetEC2Endpoint(conf.EC2Endpoint, conf.Region); err != nil {
+		return nil, fmt.Errorf("invalid ec2Endpoint: %v", err)
+	}
+	aws.MetadataCacheTTL = time.Duration(conf.MetadataCacheSeconds) * time.Second
+
+	return conf, nil
+}
+
+// writeCapacity records the IP capacity of the instance for node-local
+// readers such as scheduler extenders. Failures are only logged.
+func writeCapacity(conf *PluginConf, allocating []net.IP, releasing []net.IP) {
+	if conf.CapacityFile == "" {
+		return
 	}
 
-	if err := json.Unmarshal(stdin, &conf); err != nil {
-		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	capacity, err := aws.CapacityAtIndex(conf.IfaceIndex, allocating, releasing)
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(capacity)
+		if err == nil {
+			err = lib.WriteFileAtomic(conf.CapacityFile, data, 0644)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to write capacity file %v: %v\n", conf.CapacityFile, err)
+	}
+}
+
+// notifyExternalIPAM tells the external IPAM webhook, if any, that ip
+// on the ENI eniID was allocated (http.MethodPost) or released
+// (http.MethodDelete) for the Pod.
+func notifyExternalIPAM(conf *PluginConf, args *skel.CmdArgs, method string, ip net.IP, eniID string) error {
+	if conf.ExternalIPAMWebhook == "" {
+		return nil
 	}
 
-	if conf.SecGroupIds == nil {
-		return nil, fmt.Errorf("secGroupIds must be specified")
+	pod, err := lib.LoadK8sArgs(args.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to parse CNI_ARGS: %v\n", err)
+		pod = &lib.K8sArgs{}
+	}
+	nodeName, _ := os.Hostname()
+	lease := lib.IPAMLease{
+		IP:        ip.String(),
+		PodName:   string(pod.K8S_POD_NAME),
+		Namespace: string(pod.K8S_POD_NAMESPACE),
+		NodeName:  nodeName,
+		ENIID:     eniID,
+	}
+
+	err = lib.NotifyIPAMWebhook(conf.ExternalIPAMWebhook, method, lease,
+		lib.DefaultWebhookTimeout, lib.DefaultWebhookRetries)
+	if err != nil && !conf.RequireExternalIPAM {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return nil
+	}
+	return err
+}
+
+// ipRegistry is the part of the registry an ADD hands IPs out with
+type ipRegistry interface {
+	AssignIP(ip net.IP, containerID string) error
+	TrackIPAt(ip net.IP, t time.Time) error
+	AssignedIPs() (map[string]string, error)
+}
+
+// claimIP notifies the external IPAM of the IP of alloc and assigns it
+// to the container. When either fails, the IP is tracked as free at
+// once and its lease released, so it is neither held by the ENI nor by
+// the external IPAM for a Pod that never got it. An IP found assigned
+// to another container is left to that container.
+func claimIP(conf *PluginConf, args *skel.CmdArgs, registry ipRegistry, alloc *aws.AllocationResult) error {
+	ip := *alloc.IP
+	err := notifyExternalIPAM(conf, args, http.MethodPost, ip, alloc.Interface.ID)
+	if err == nil {
+		err = registry.AssignIP(ip, args.ContainerID)
+		if err != nil {
+			if assigned, aerr := registry.AssignedIPs(); aerr == nil {
+				if owner, ok := assigned[ip.String()]; ok && owner != args.ContainerID {
+					return err
+				}
+			}
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	if terr := registry.TrackIPAt(ip, time.Time{}); terr != nil {
+		fmt.Fprintf(os.Stderr, "failed to track %v as free: %v\n", ip, terr)
+	}
+	// releases are best-effort, the error of the ADD is returned
+	if nerr := notifyExternalIPAM(conf, args, http.MethodDelete, ip, alloc.Interface.ID); nerr != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", nerr)
+	}
+	return err
+}
+
+// registryAssignmentGrace is how long an IP handed to a container may
+// stay unbound before the registry forgets the assignment
+const registryAssignmentGrace = 5 * time.Minute
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tracer records the spans of the current call, nil when tracing is
+// disabled
+var tracer *lib.Tracer
+
+func setTracer(t *lib.Tracer) {
+	tracer = t
+}
+
+// allocateIP assigns a new IP in EC2, on an existing interface with
+// room for it or, when allowed, on a new interface
+func allocateIP(conf *PluginConf, client aws.Client) (*aws.AllocationResult, error) {
+	// allocate an IP on an available interface
+	span := tracer.StartSpan("ec2-allocate")
+	alloc, err := client.AllocateIPFirstAvailableAtIndex(conf.IfaceIndex, conf.PerENIIPTarget, conf.SubnetTags)
+	if err == nil {
+		span.SetAttribute(lib.AttrENIID, alloc.Interface.ID)
+	}
+	span.Finish(err)
+	if err == nil {
+		return alloc, nil
+	}
+	if aws.IsTransient(err) {
+		// a throttled assignment does not mean the interfaces are full
+		return nil, lib.TryAgainLater(err)
+	}
+
+	if !conf.AllowENICreation {
+		// ENIs are provisioned out-of-band, only fill the existing ones
+		if conf.PerENIIPTarget > 0 {
+			if alloc, err := client.AllocateIPFirstAvailableAtIndex(conf.IfaceIndex, 0, conf.SubnetTags); err == nil {
+				return alloc, nil
+			}
+		}
+		return nil, aws.ErrENILimitReached
+	}
+
+	// failed, so attempt to add an IP to a new interface
+	span = tracer.StartSpan("eni-attach")
+	newIf, err := client.NewInterface(conf.SecGroupIds, conf.SubnetTags, conf.ENIPrimaryIP)
+	if err == nil {
+		span.SetAttribute(lib.AttrENIID, newIf.ID)
+	}
+	span.Finish(err)
+	if err != nil && conf.PerENIIPTarget > 0 {
+		// no new interface can be attached, fill the existing
+		// interfaces up to the instance type limit instead
+		var fillErr error
+		alloc, fillErr = client.AllocateIPFirstAvailableAtIndex(conf.IfaceIndex, 0, conf.SubnetTags)
+		if fillErr == nil {
+			err = nil
+		}
+	} else if err == nil && len(newIf.IPv4s) == 1 {
+		// Freshly allocated interfaces only have their primary IP,
+		// which is reserved - allocate a secondary IP for the Pod.
+		alloc, err = client.AllocateIPOn(*newIf)
+	}
+	// alloc is unset when no interface could be created, or when the new
+	// interface gained secondary IPs since being created, which a
+	// subsequent run finds free
+	if alloc == nil {
+		allocErr := fmt.Errorf("unable to create a new elastic network interface due to %v",
+			err)
+		if aws.IsTransient(err) {
+			return nil, lib.TryAgainLater(allocErr)
+		}
+		return nil, allocErr
 	}
+	return alloc, nil
+}
 
-	return &conf, nil
+// allocatePrefixIP carves an IP out of the prefixes delegated to the
+// interfaces, delegating a new prefix, when allowed on a new interface,
+// once they are all in use
+func allocatePrefixIP(conf *PluginConf, client aws.Client) (*aws.AllocationResult, error) {
+	reuseWait := time.Duration(conf.ReuseIPWait) * time.Second
+	span := tracer.StartSpan("ec2-allocate-prefix")
+	alloc, err := aws.AllocatePrefixIPAtIndex(conf.IfaceIndex, reuseWait, conf.SubnetTags)
+	if err == nil {
+		span.SetAttribute(lib.AttrENIID, alloc.Interface.ID)
+	}
+	span.Finish(err)
+	if err == aws.ErrENILimitReached && conf.AllowENICreation {
+		span = tracer.StartSpan("eni-attach")
+		var newIf *aws.Interface
+		newIf, err = client.NewInterface(conf.SecGroupIds, conf.SubnetTags, conf.ENIPrimaryIP)
+		if err == nil {
+			span.SetAttribute(lib.AttrENIID, newIf.ID)
+			alloc, err = aws.AllocatePrefixIPOn(*newIf)
+		}
+		span.Finish(err)
+	}
+	if err != nil {
+		if aws.IsTransient(err) {
+			return nil, lib.TryAgainLater(err)
+		}
+		return nil, err
+	}
+	return alloc, nil
 }
 
 // cmdAdd is called for ADD requests
 func cmdAdd(args *skel.CmdArgs) error {
 	conf, err := parseConfig(args.StdinData)
 	if err != nil {
-		return err
+		return lib.InvalidConfig(err)
+	}
+
+	// Existing Pods and DELs are unaffected, only new allocations are blocked
+	if lib.IsCordoned(conf.CordonFile) {
+		return lib.ErrCordoned
 	}
 
+	aws.DefaultAllocateRetry.Retries = conf.AllocateRetries
+	aws.DefaultAllocateRetry.BaseDelay = time.Duration(conf.AllocateRetryBaseMs) * time.Millisecond
+
 	var alloc *aws.AllocationResult
 	registry := &aws.Registry{}
 
+	// self-heal the registry from IPs gone from the ENIs or handed to
+	// ADDs that failed later on
+	if interfaces, err := aws.DefaultClient.GetInterfaces(); err == nil {
+		if bound, err := nl.GetIPs(); err == nil {
+			var boundIPs []net.IP
+			for _, b := range bound {
+				boundIPs = append(boundIPs, b.IP)
+			}
+			registry.Reconcile(interfaces, boundIPs, registryAssignmentGrace)
+		}
+	}
+
 	// Try to find a free IP first - possibly from a broken
 	// container, or torn down namespace. IP must also be at least
 	// conf.ReuseIPWait seconds old in the registry to be
 	// considered for use.
 	free, err := aws.FindFreeIPsAtIndex(conf.IfaceIndex, true)
+	if conf.PrefixDelegation {
+		// Pod IPs only come from the delegated prefixes
+		free = nil
+	}
 	if err == nil && len(free) > 0 {
 		registryFreeIPs, err := registry.TrackedBefore(time.Now().Add(time.Duration(-conf.ReuseIPWait) * time.Second))
 		if err == nil && len(registryFreeIPs) > 0 {
@@ -105,24 +324,15 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	// No free IPs available for use, so let's allocate one
-	if alloc == nil {
-		// allocate an IP on an available interface
-		alloc, err = aws.DefaultClient.AllocateIPFirstAvailableAtIndex(conf.IfaceIndex)
+	if alloc == nil && conf.PrefixDelegation {
+		alloc, err = allocatePrefixIP(conf, aws.DefaultClient)
 		if err != nil {
-			// failed, so attempt to add an IP to a new interface
-			newIf, err := aws.DefaultClient.NewInterface(conf.SecGroupIds, conf.SubnetTags)
-			// If this interface has somehow gained more than one IP since being allocated,
-			// abort this process and let a subsequent run find a valid IP.
-			if err != nil || len(newIf.IPv4s) != 1 {
-				return fmt.Errorf("unable to create a new elastic network interface due to %v",
-					err)
-			}
-			// Freshly allocated interfaces will always have one valid IP - use
-			// this IP address.
-			alloc = &aws.AllocationResult{
-				&newIf.IPv4s[0],
-				*newIf,
-			}
+			return err
+		}
+	} else if alloc == nil {
+		alloc, err = allocateIP(conf, aws.DefaultClient)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -186,17 +396,21 @@ func cmdAdd(args *skel.CmdArgs) error {
 		result.Routes = append(result.Routes, &types.Route{*dst, gw})
 	}
 
-	// remove the IP from the registry just before handing off to ipvlan
-	registry.ForgetIP(*alloc.IP)
+	// assign the IP to the container just before handing off to ipvlan
+	if err := claimIP(conf, args, registry, alloc); err != nil {
+		return err
+	}
 
-	return types.PrintResult(result, conf.CNIVersion)
+	writeCapacity(conf, []net.IP{*alloc.IP}, nil)
+
+	return lib.PrintResult(result, conf.CNIVersion, nil)
 }
 
 // cmdDel is called for DELETE requests
 func cmdDel(args *skel.CmdArgs) error {
 	conf, err := parseConfig(args.StdinData)
 	if err != nil {
-		return err
+		return lib.InvalidConfig(err)
 	}
 	_ = conf
 
@@ -212,25 +426,97 @@ func cmdDel(args *skel.CmdArgs) error {
 		return err
 	})
 
-	if !conf.SkipDeallocation {
-		// deallocate IPs outside of the namespace so creds are correct
+	if conf.ExternalIPAMWebhook != "" && len(addrs) > 0 {
+		// resolve the ENIs before the IPs are released from them
+		eniIDs := make(map[string]string)
+		if interfaces, err := aws.DefaultClient.GetInterfaces(); err == nil {
+			for _, intf := range interfaces {
+				for _, ip := range intf.IPv4s {
+					eniIDs[ip.String()] = intf.ID
+				}
+			}
+		}
+		// releases are best-effort, a failure never blocks DEL
 		for _, addr := range addrs {
-			aws.DefaultClient.DeallocateIP(&addr.IP)
+			if err := notifyExternalIPAM(conf, args, http.MethodDelete, addr.IP, eniIDs[addr.IP.String()]); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
 		}
 	}
 
 	// Mark this IP as free in the registry
 	registry := &aws.Registry{}
+	var released []net.IP
 	for _, addr := range addrs {
 		registry.TrackIP(addr.IP)
+		released = append(released, addr.IP)
+	}
+	// the IPs assigned to the container are released even when its
+	// namespace is already gone
+	if assigned, err := registry.ReleaseIPs(args.ContainerID); err == nil {
+		for _, ip := range assigned {
+			if !containsIP(released, ip) {
+				released = append(released, ip)
+			}
+		}
 	}
 
+	if !conf.SkipDeallocation && conf.PrefixDelegation {
+		// prefix IPs can't be unassigned alone, only whole prefixes
+		// once their last Pod is gone
+		span := tracer.StartSpan("ec2-deallocate")
+		_, err := aws.ReleaseEmptyPrefixes(conf.IfaceIndex, released)
+		span.Finish(err)
+	} else if !conf.SkipDeallocation {
+		// IPs returned to the warm pool stay assigned to their ENI
+		unassign, err := aws.WarmPoolSurplus(conf.IfaceIndex, conf.WarmIPTarget, released)
+		if err != nil {
+			unassign = released
+		}
+		// deallocate IPs outside of the namespace so creds are correct
+		for i := range unassign {
+			span := tracer.StartSpan("ec2-deallocate")
+			span.Finish(aws.DefaultClient.DeallocateIP(&unassign[i]))
+		}
+	}
+
+	writeCapacity(conf, nil, released)
+
 	return nil
 }
 
+// cmdStatus is called for STATUS requests. The plugin is available when
+// AWS can be reached and an IP can be handed out.
+func cmdStatus(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	return aws.CheckIPCapacity(conf.IfaceIndex)
+}
+
+// cmdGC is called for GC requests. IPs which are assigned in EC2 but no
+// longer bound to any Pod are tracked as free in the registry so they
+// are reused or released by registry-gc.
+func cmdGC(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	_, err = aws.FindFreeIPsAtIndex(conf.IfaceIndex, true)
+	return err
+}
+
 func main() {
 	run := func() error {
-		skel.PluginMain(cmdAdd, cmdDel, version.PluginSupports(version.Current()))
+		lib.PluginMain(lib.PluginFuncs{
+			Add:    lib.TraceVerb("cmdAdd", setTracer, cmdAdd),
+			Del:    lib.TraceVerb("cmdDel", setTracer, cmdDel),
+			Status: cmdStatus,
+			GC:     cmdGC,
+		}, version.PluginSupports(version.Current(), lib.CNIVersion040, lib.CNIVersion100, lib.CNIVersion110))
 		return nil
 	}
 	_ = lib.LockfileRun(run)
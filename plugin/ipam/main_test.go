@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+)
+
+type allocateClientMock struct {
+	aws.Client
+	Full          bool
+	Err           error
+	NewInterfaces int
+}
+
+func (c *allocateClientMock) AllocateIPFirstAvailableAtIndex(index int, ipTarget int, subnetTags map[string]string) (*aws.AllocationResult, error) {
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	if c.Full {
+		return nil, fmt.Errorf("Unable to allocate - no IPs available on any interfaces")
+	}
+	ip := net.ParseIP("10.0.0.5")
+	return &aws.AllocationResult{IP: &ip, Interface: aws.Interface{ID: "eni-lyft"}}, nil
+}
+
+func (c *allocateClientMock) NewInterface(secGrps []string, requiredTags map[string]string, primaryIP string) (*aws.Interface, error) {
+	c.NewInterfaces++
+	return nil, fmt.Errorf("too many adapters on this instance already")
+}
+
+func TestAllocateIPWithoutENICreation(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"secGroupIds": ["sg-1"], "allowENICreation": false}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	client := &allocateClientMock{}
+	if alloc, err := allocateIP(conf, client); err != nil || !alloc.IP.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("Existing interface capacity was not used: %v %v", alloc, err)
+	}
+
+	client.Full = true
+	if _, err := allocateIP(conf, client); err != aws.ErrENILimitReached {
+		t.Errorf("Expected ErrENILimitReached, got %v", err)
+	}
+	if client.NewInterfaces != 0 {
+		t.Errorf("An interface was created although ENI creation is disabled")
+	}
+}
+
+func TestAllocateIPDefaultsToENICreation(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"secGroupIds": ["sg-1"]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	client := &allocateClientMock{Full: true}
+	if _, err := allocateIP(conf, client); err == nil {
+		t.Errorf("Allocation succeeded without capacity")
+	}
+	if client.NewInterfaces != 1 {
+		t.Errorf("Expected an interface to be created, got %d", client.NewInterfaces)
+	}
+}
+
+func TestAllocateIPThrottled(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"secGroupIds": ["sg-1"]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	client := &allocateClientMock{Err: awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)}
+	_, err = allocateIP(conf, client)
+	if e, ok := err.(*types.Error); !ok || e.Code != lib.ErrCodeTryAgainLater {
+		t.Errorf("Expected a try again later error, got %v", err)
+	}
+	if client.NewInterfaces != 0 {
+		t.Errorf("An interface was created for a throttled assignment")
+	}
+}
+
+func TestAllocateIPTracing(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"secGroupIds": ["sg-1"]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	exporter := &lib.MemoryExporter{}
+	setTracer(lib.NewTracer(exporter))
+	defer setTracer(nil)
+
+	if _, err := allocateIP(conf, &allocateClientMock{}); err != nil {
+		t.Fatalf("Failed to allocate: %v", err)
+	}
+	if err := tracer.Flush(); err != nil {
+		t.Fatalf("Failed to flush spans: %v", err)
+	}
+
+	if len(exporter.Spans) != 1 || exporter.Spans[0].Name != "ec2-allocate" {
+		t.Fatalf("Unexpected spans %v", exporter.Spans)
+	}
+	if eni := exporter.Spans[0].Attributes[lib.AttrENIID]; eni != "eni-lyft" {
+		t.Errorf("Expected the ENI id as attribute, got %q", eni)
+	}
+}
+
+func TestParseConfigAllocateRetry(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"secGroupIds": ["sg-1"]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if conf.AllocateRetries != aws.DefaultAllocateRetry.Retries || conf.AllocateRetryBaseMs != 100 {
+		t.Errorf("Unexpected retry defaults %d %d", conf.AllocateRetries, conf.AllocateRetryBaseMs)
+	}
+
+	conf, err = parseConfig([]byte(`{"secGroupIds": ["sg-1"], "allocateRetries": 0}`))
+	if err != nil || conf.AllocateRetries != 0 {
+		t.Errorf("Retries could not be disabled: %v", err)
+	}
+
+	if _, err := parseConfig([]byte(`{"secGroupIds": ["sg-1"], "allocateRetryBaseMs": -1}`)); err == nil {
+		t.Errorf("Negative retry delay was accepted")
+	}
+}
+
+type registryMock struct {
+	AssignErr error
+	Assigned  map[string]string
+	Tracked   map[string]time.Time
+}
+
+func (r *registryMock) AssignIP(ip net.IP, containerID string) error {
+	if r.AssignErr != nil {
+		return r.AssignErr
+	}
+	r.Assigned[ip.String()] = containerID
+	return nil
+}
+
+func (r *registryMock) TrackIPAt(ip net.IP, t time.Time) error {
+	r.Tracked[ip.String()] = t
+	return nil
+}
+
+func (r *registryMock) AssignedIPs() (map[string]string, error) {
+	return r.Assigned, nil
+}
+
+func TestClaimIPFailure(t *testing.T) {
+	var methods []string
+	postStatus := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		methods = append(methods, req.Method)
+		if req.Method == http.MethodPost {
+			w.WriteHeader(postStatus)
+		}
+	}))
+	defer server.Close()
+
+	conf, err := parseConfig([]byte(`{"externalIPAMWebhook": "` + server.URL + `", "requireExternalIPAM": true}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	args := &skel.CmdArgs{ContainerID: "container"}
+	ip := net.ParseIP("10.0.0.5")
+	alloc := &aws.AllocationResult{IP: &ip, Interface: aws.Interface{ID: "eni-lyft"}}
+
+	// the webhook refuses the lease
+	postStatus = http.StatusInternalServerError
+	registry := &registryMock{Assigned: map[string]string{}, Tracked: map[string]time.Time{}}
+	if err := claimIP(conf, args, registry, alloc); err == nil {
+		t.Fatalf("Refused lease did not fail the ADD")
+	}
+	if tracked, ok := registry.Tracked["10.0.0.5"]; !ok || !tracked.IsZero() {
+		t.Errorf("IP of the refused lease is not free at once: %v", registry.Tracked)
+	}
+	if len(registry.Assigned) != 0 {
+		t.Errorf("IP of the refused lease was assigned: %v", registry.Assigned)
+	}
+	if last := methods[len(methods)-1]; last != http.MethodDelete {
+		t.Errorf("Refused lease was not released, got %v", methods)
+	}
+
+	// the registry fails after the lease was taken
+	postStatus = http.StatusOK
+	methods = nil
+	registry = &registryMock{AssignErr: fmt.Errorf("read-only file system"), Assigned: map[string]string{}, Tracked: map[string]time.Time{}}
+	if err := claimIP(conf, args, registry, alloc); err == nil {
+		t.Fatalf("Registry failure did not fail the ADD")
+	}
+	if _, ok := registry.Tracked["10.0.0.5"]; !ok {
+		t.Errorf("IP was not tracked as free after the registry failure")
+	}
+	if len(methods) != 2 || methods[0] != http.MethodPost || methods[1] != http.MethodDelete {
+		t.Errorf("Expected the lease to be taken and released, got %v", methods)
+	}
+
+	// the IP went to another container in the meantime
+	methods = nil
+	registry = &registryMock{AssignErr: fmt.Errorf("already assigned"), Assigned: map[string]string{"10.0.0.5": "other"}, Tracked: map[string]time.Time{}}
+	if err := claimIP(conf, args, registry, alloc); err == nil {
+		t.Fatalf("IP assigned to another container was handed out")
+	}
+	if len(registry.Tracked) != 0 || len(methods) != 1 {
+		t.Errorf("IP of another container was released: %v %v", registry.Tracked, methods)
+	}
+}
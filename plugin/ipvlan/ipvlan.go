@@ -15,34 +15,26 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
-	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
-	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/netconf"
 )
 
 // NetConf contains network configuration parameters
-type NetConf struct {
-	types.NetConf
-
-	// support chaining for master interface and IP decisions
-	// occurring prior to running ipvlan plugin
-	RawPrevResult *map[string]interface{} `json:"prevResult"`
-	PrevResult    *current.Result         `json:"-"`
-
-	Master string `json:"master"`
-	Mode   string `json:"mode"`
-	MTU    int    `json:"mtu"`
-}
+type NetConf = netconf.IpvlanConf
 
 const (
 	cniAdd = iota
@@ -57,70 +49,87 @@ func init() {
 }
 
 func loadConf(bytes []byte, cmd int) (*NetConf, string, error) {
-	n := &NetConf{}
-	if err := json.Unmarshal(bytes, n); err != nil {
-		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
-	}
-	// Parse previous result
-	if n.RawPrevResult != nil {
-		resultBytes, err := json.Marshal(n.RawPrevResult)
-		if err != nil {
-			return nil, "", fmt.Errorf("could not serialize prevResult: %v", err)
-		}
-		res, err := version.NewResult(n.CNIVersion, resultBytes)
-		if err != nil {
-			return nil, "", fmt.Errorf("could not parse prevResult: %v", err)
-		}
-		n.RawPrevResult = nil
-		n.PrevResult, err = current.NewResultFromResult(res)
-		if err != nil {
-			return nil, "", fmt.Errorf("could not convert result to current version: %v", err)
-		}
+	n, err := netconf.LoadIpvlanConf(bytes)
+	if err != nil {
+		return nil, "", err
 	}
 	if n.Master == "" && cmd != cniDel {
 		if n.PrevResult == nil {
 			return nil, "", fmt.Errorf(`"master" field is required. It specifies the host interface name to virtualize`)
 		}
-		if len(n.PrevResult.Interfaces) == 1 && n.PrevResult.Interfaces[0].Name != "" {
-			n.Master = n.PrevResult.Interfaces[0].Name
-		} else {
-			return nil, "", fmt.Errorf("chained master failure. PrevResult lacks a single named interface")
+		master, err := prevResultMaster(n.PrevResult)
+		if err != nil {
+			return nil, "", err
 		}
+		n.Master = master
 	}
 	return n, n.CNIVersion, nil
 }
 
-func modeFromString(s string) (netlink.IPVlanMode, error) {
-	switch s {
-	case "", "l2":
-		return netlink.IPVLAN_MODE_L2, nil
-	case "l3":
-		return netlink.IPVLAN_MODE_L3, nil
-	case "l3s":
-		return netlink.IPVLAN_MODE_L3S, nil
-	default:
-		return 0, fmt.Errorf("unknown ipvlan mode: %q", s)
+// prevResultMaster returns the ENI named by a chained IPAM result, which
+// must carry exactly one named interface.
+func prevResultMaster(result *current.Result) (string, error) {
+	if len(result.Interfaces) == 0 {
+		return "", fmt.Errorf("prevResult has no interfaces; cannot determine ENI")
+	}
+	if len(result.Interfaces) != 1 || result.Interfaces[0].Name == "" {
+		return "", fmt.Errorf("chained master failure. PrevResult lacks a single named interface")
+	}
+	return result.Interfaces[0].Name, nil
+}
+
+// validateMaster ensures the master interface, usually named by the
+// IPAM plugin result, exists and optionally that its MAC belongs to an
+// ENI known to EC2.
+func validateMaster(master string, checkENI bool) error {
+	link, err := netlink.LinkByName(master)
+	if err != nil {
+		return fmt.Errorf("master interface %q does not exist on the host: %v", master, err)
+	}
+
+	if !checkENI || !aws.DefaultClient.Available() {
+		return nil
+	}
+
+	mac := link.Attrs().HardwareAddr.String()
+	interfaces, err := aws.DefaultClient.GetInterfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list ENIs to validate master %q: %v", master, err)
 	}
+	for _, intf := range interfaces {
+		if strings.EqualFold(intf.Mac, mac) {
+			return nil
+		}
+	}
+	return fmt.Errorf("master interface %q has MAC %v which does not match any ENI attached to this instance", master, mac)
 }
 
-func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
+// createIpvlan creates the ipvlan interface ifName in netns, returning
+// it along with its MTU
+func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interface, int, error) {
 	ipvlan := &current.Interface{}
+	mtu := 0
 
-	mode, err := modeFromString(conf.Mode)
+	mode, err := netconf.IpvlanMode(conf.Mode)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	m, err := netlink.LinkByName(conf.Master)
 	if err != nil {
-		return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+		return nil, 0, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
+	}
+
+	// an unset MTU is inherited from the master
+	if conf.MTU > m.Attrs().MTU {
+		return nil, 0, fmt.Errorf("mtu %d exceeds the MTU %d of master %q", conf.MTU, m.Attrs().MTU, conf.Master)
 	}
 
 	// due to kernel bug we have to create with tmpname or it might
 	// collide with the name on the host and error out
 	tmpName, err := ip.RandomVethName()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	mv := &netlink.IPVlan{
@@ -134,7 +143,7 @@ func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interf
 	}
 
 	if err := netlink.LinkAdd(mv); err != nil {
-		return nil, fmt.Errorf("failed to create ipvlan: %v", err)
+		return nil, 0, fmt.Errorf("failed to create ipvlan: %v", err)
 	}
 
 	err = netns.Do(func(_ ns.NetNS) error {
@@ -151,14 +160,15 @@ func createIpvlan(conf *NetConf, ifName string, netns ns.NetNS) (*current.Interf
 		}
 		ipvlan.Mac = contIpvlan.Attrs().HardwareAddr.String()
 		ipvlan.Sandbox = netns.Path()
+		mtu = contIpvlan.Attrs().MTU
 
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	return ipvlan, nil
+	return ipvlan, mtu, nil
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
@@ -167,13 +177,18 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	netns, err := ns.GetNS(args.Netns)
+	if err := validateMaster(n.Master, n.ValidateENIMac); err != nil {
+		return err
+	}
+
+	netns, err := lib.GetNSWithRetry(args.Netns, n.NetnsOpenRetries,
+		time.Duration(n.NetnsOpenBackoff)*time.Millisecond)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return err
 	}
 	defer netns.Close()
 
-	ipvlanInterface, err := createIpvlan(n, args.IfName, netns)
+	ipvlanInterface, mtu, err := createIpvlan(n, args.IfName, netns)
 	if err != nil {
 		return err
 	}
@@ -185,7 +200,11 @@ func cmdAdd(args *skel.CmdArgs) error {
 		result = n.PrevResult
 	} else {
 		// run the IPAM plugin and get back the config to apply
-		r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
+		stdin, err := lib.DelegateConf(args.StdinData)
+		if err != nil {
+			return err
+		}
+		r, err := ipam.ExecAdd(n.IPAM.Type, stdin)
 		if err != nil {
 			return err
 		}
@@ -215,7 +234,8 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	result.DNS = n.DNS
 
-	return types.PrintResult(result, cniVersion)
+	// the MTU lets chained plugins size their interfaces consistently
+	return lib.PrintResult(result, cniVersion, map[string]int{args.IfName: mtu})
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -226,7 +246,11 @@ func cmdDel(args *skel.CmdArgs) error {
 
 	// On chained invocation, IPAM block can be empty
 	if n.IPAM.Type != "" {
-		err = ipam.ExecDel(n.IPAM.Type, args.StdinData)
+		stdin, err := lib.DelegateConf(args.StdinData)
+		if err != nil {
+			return err
+		}
+		err = ipam.ExecDel(n.IPAM.Type, stdin)
 		if err != nil {
 			return err
 		}
@@ -256,5 +280,10 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	// ipvlan links are removed along with the Pod namespace so there is
+	// nothing to garbage collect
+	lib.PluginMain(lib.PluginFuncs{
+		Add: cmdAdd,
+		Del: cmdDel,
+	}, lib.AllVersions)
 }
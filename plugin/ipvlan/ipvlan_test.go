@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func TestValidateMasterMissing(t *testing.T) {
+	err := validateMaster("lyft-absent0", false)
+	if err == nil {
+		t.Fatalf("Missing master interface was accepted")
+	}
+	if !strings.Contains(err.Error(), `master interface "lyft-absent0" does not exist`) {
+		t.Errorf("Unexpected error for a missing master: %v", err)
+	}
+}
+
+func TestPrevResultMaster(t *testing.T) {
+	_, err := prevResultMaster(&current.Result{})
+	if err == nil || !strings.Contains(err.Error(), "prevResult has no interfaces") {
+		t.Errorf("Unexpected error for a prevResult without interfaces: %v", err)
+	}
+
+	_, err = prevResultMaster(&current.Result{Interfaces: []*current.Interface{{}}})
+	if err == nil {
+		t.Errorf("Unnamed prevResult interface was accepted")
+	}
+
+	master, err := prevResultMaster(&current.Result{Interfaces: []*current.Interface{{Name: "eth1"}}})
+	if err != nil || master != "eth1" {
+		t.Errorf("Expected master eth1, got %q: %v", master, err)
+	}
+}
+
+func TestCreateIpvlanMTU(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer hostNS.Close()
+	contNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	defer contNS.Close()
+
+	err = hostNS.Do(func(_ ns.NetNS) error {
+		err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-eni", MTU: 9001}})
+		if err != nil {
+			return err
+		}
+
+		conf := &NetConf{Master: "lyft-eni", MTU: 9500}
+		if _, _, err := createIpvlan(conf, "eth0", contNS); err == nil {
+			t.Errorf("MTU above the master MTU was accepted")
+		}
+
+		conf.MTU = 1400
+		_, mtu, err := createIpvlan(conf, "eth0", contNS)
+		if err == nil && mtu != 1400 {
+			t.Errorf("Expected the reported MTU 1400, got %d", mtu)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to create ipvlan: %v", err)
+	}
+
+	err = contNS.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		if link.Attrs().MTU != 1400 {
+			t.Errorf("Expected MTU 1400, got %d", link.Attrs().MTU)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to lookup ipvlan: %v", err)
+	}
+}
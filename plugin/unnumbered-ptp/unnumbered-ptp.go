@@ -18,39 +18,60 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"math"
 	"math/rand"
 	"net"
 	"os"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/current"
-	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils"
-	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/coreos/go-iptables/iptables"
-	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/netconf"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
 )
 
 // constants for full jitter backoff in milliseconds, and for nodeport marks
 const (
-	maxSleep             = 10000 // 10.00s
-	baseSleep            = 20    //  0.02
-	RPFilterTemplate     = "net.ipv4.conf.%s.rp_filter"
-	podRulePriority      = 1024
-	nodePortRulePriority = 512
+	maxSleep             = netconf.DefaultTableAllocMaxSleepMs
+	baseSleep            = netconf.DefaultTableAllocBaseSleepMs
+	tableAllocRetries    = netconf.DefaultTableAllocRetries
+	podRulePriority      = nl.PodRulePriority
+	nodePortRulePriority = nl.NodePortRulePriority
+	egressRulePriority   = netconf.EgressRulePriority
+
+	maxIfNameLen = netconf.MaxIfNameLen
+
+	tableAllocRandom  = netconf.TableAllocRandom
+	tableAllocHash    = netconf.TableAllocHash
+	defaultTableRange = netconf.DefaultTableRange
+	defaultTableEnd   = netconf.DefaultTableEnd
 )
 
+// kernelReservedTables are the default, main and local tables, never
+// used for Pods
+var kernelReservedTables = netconf.KernelReservedTables
+
 func init() {
 	// this ensures that main runs only on main thread (thread group leader).
 	// since namespace ops (unshare, setns) are done for a single thread, we
@@ -58,427 +79,2443 @@ func init() {
 	runtime.LockOSThread()
 }
 
-// PluginConf is whatever you expect your configuration json to be. This is whatever
-// is passed in on stdin. Your plugin may wish to expose its functionality via
-// runtime args, see CONVENTIONS.md in the CNI spec.
+// PluginConf is the configuration of the plugin, as parsed and
+// validated by the netconf package
 type PluginConf struct {
-	types.NetConf
-
-	// This is the previous result, when called in the context of a chained
-	// plugin. Because this plugin supports multiple versions, we'll have to
-	// parse this in two passes. If your plugin is not chained, this can be
-	// removed (though you may wish to error if a non-chainable plugin is
-	// chained.
-	// If you need to modify the result before returning it, you will need
-	// to actually convert it to a concrete versioned struct.
-	RawPrevResult *map[string]interface{} `json:"prevResult"`
-	PrevResult    *current.Result         `json:"-"`
-
-	IPMasq             bool   `json:"ipMasq"`
-	HostInterface      string `json:"hostInterface"`
-	ContainerInterface string `json:"containerInterface"`
-	MTU                int    `json:"mtu"`
-	TableStart         int    `json:"routeTableStart"`
-	NodePortMark       int    `json:"nodePortMark"`
-	NodePorts          string `json:"nodePorts"`
-}
-
-// parseConfig parses the supplied configuration (and prevResult) from stdin.
-func parseConfig(stdin []byte) (*PluginConf, error) {
-	conf := PluginConf{}
+	netconf.PtpConf
+}
 
-	if err := json.Unmarshal(stdin, &conf); err != nil {
-		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+// hostInterfaceFor returns the host interface of the Pod with the
+// given IPs, whose interface ifName in netnsPath shares the MAC of the
+// ENI it is an ipvlan child of
+func (conf *PluginConf) hostInterfaceFor(ips []net.IP, netnsPath, ifName string) string {
+	if len(conf.HostInterfaces) == 0 && !conf.PerENIHostInterface {
+		return conf.HostInterface
 	}
+	return podHostInterface(ips, podMAC(netnsPath, ifName), conf.HostInterfaces, conf.HostInterface)
+}
 
-	// Parse previous result.
-	if conf.RawPrevResult != nil {
-		resultBytes, err := json.Marshal(conf.RawPrevResult)
-		if err != nil {
-			return nil, fmt.Errorf("could not serialize prevResult: %v", err)
-		}
-		res, err := version.NewResult(conf.CNIVersion, resultBytes)
-		if err != nil {
-			return nil, fmt.Errorf("could not parse prevResult: %v", err)
-		}
-		conf.RawPrevResult = nil
-		conf.PrevResult, err = current.NewResultFromResult(res)
-		if err != nil {
-			return nil, fmt.Errorf("could not convert result to current version: %v", err)
+// nodePortInterfaces returns the host interfaces NodePort traffic is
+// marked on, along with hostIfName of the Pod
+func (conf *PluginConf) nodePortInterfaces(hostIfName string) []string {
+	for _, ifName := range conf.HostInterfaces {
+		if ifName == hostIfName {
+			return conf.HostInterfaces
 		}
 	}
-	// End previous result parsing
+	return append([]string{hostIfName}, conf.HostInterfaces...)
+}
 
-	if conf.HostInterface == "" {
-		return nil, fmt.Errorf("hostInterface must be specified")
-	}
+// masquerade reports whether the traffic of a Pod IP is masqueraded
+func (conf *PluginConf) masquerade(ip net.IP) bool {
+	return conf.IPMasq && (ip.To4() != nil || !conf.DisableIPMasqV6)
+}
 
-	if conf.ContainerInterface == "" {
-		return nil, fmt.Errorf("containerInterface must be specified")
+// mergeDNS merges the DNS settings of the config into those of the
+// result. The nameservers, search domains and options of the config
+// come first and the domain of the config replaces the one of the
+// result, without dropping what the result already carries.
+func mergeDNS(result *types.DNS, conf types.DNS) {
+	if conf.Domain != "" {
+		result.Domain = conf.Domain
 	}
+	result.Nameservers = mergeDNSList(conf.Nameservers, result.Nameservers)
+	result.Search = mergeDNSList(conf.Search, result.Search)
+	result.Options = mergeDNSList(conf.Options, result.Options)
+}
 
-	if conf.NodePorts == "" {
-		conf.NodePorts = "30000:32767"
+// mergeDNSList returns first followed by the entries of second missing
+// from it
+func mergeDNSList(first, second []string) []string {
+	if len(first) == 0 {
+		return second
 	}
-
-	if conf.NodePortMark == 0 {
-		conf.NodePortMark = 0x2000
+	merged := append([]string{}, first...)
+	for _, entry := range second {
+		found := false
+		for _, m := range merged {
+			if m == entry {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, entry)
+		}
 	}
+	return merged
+}
 
-	// start using tables by default at 256
-	if conf.TableStart == 0 {
-		conf.TableStart = 256
-	}
+// TableAlloc holds the options choosing the per-Pod route table
+type TableAlloc struct {
+	Start       int
+	End         int
+	Reserved    map[int]bool
+	LockPath    string
+	Max         int
+	WarnAbove   int
+	Mode        string
+	Range       int
+	Retries     int
+	BaseSleepMs int
+	MaxSleepMs  int
+	// Rand jitters the table slots and backoffs, tests pass a fixed
+	// seed to make collisions reproducible
+	Rand *rand.Rand
+	// ENI is the key of the table shared by the Pods behind the ENI of
+	// the Pod when sharedTablePerENI is set, nil for a per-Pod table
+	ENI *ENITable
+}
 
-	return &conf, nil
+// ENITable keys the table shared by the Pods behind an ENI: its routes
+// leave through the ENI at LinkIndex via Gateway, the VPC router of the
+// Pod subnet
+type ENITable struct {
+	LinkIndex int
+	Gateway   net.IP
 }
 
-func enableForwarding(ipv4 bool, ipv6 bool) error {
-	if ipv4 {
-		err := ip.EnableIP4Forward()
-		if err != nil {
-			return fmt.Errorf("Could not enable IPv6 forwarding: %v", err)
-		}
+// eniTable returns the key of the table shared by the Pods behind link
+func eniTable(link netlink.Link, ips []*current.IPConfig) (*ENITable, error) {
+	gw := eniGateway(ips)
+	if gw == nil {
+		return nil, fmt.Errorf("sharedTablePerENI needs an IPv4 Pod subnet to route %q through", link.Attrs().Name)
 	}
-	if ipv6 {
-		err := ip.EnableIP6Forward()
-		if err != nil {
-			return fmt.Errorf("Could not enable IPv6 forwarding: %v", err)
+	return &ENITable{LinkIndex: link.Attrs().Index, Gateway: gw}, nil
+}
+
+// eniGateway returns the gateway of the first IPv4 Pod IP in ips, by
+// default the VPC router of its subnet, nil when there is none
+func eniGateway(ips []*current.IPConfig) net.IP {
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() == nil {
+			continue
+		}
+		if ipc.Gateway != nil {
+			return ipc.Gateway
+		}
+		if ones, bits := ipc.Address.Mask.Size(); ones < bits {
+			return subnetRouter(&ipc.Address)
 		}
 	}
 	return nil
 }
 
-func setupSNAT(ifName string, comment string) error {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		return fmt.Errorf("failed to locate iptables: %v", err)
+// tableAlloc returns the route table options of conf
+func (conf *PluginConf) tableAlloc() TableAlloc {
+	reserved := make(map[int]bool)
+	for _, table := range append(kernelReservedTables, conf.ReservedTables...) {
+		reserved[table] = true
 	}
-	rulespec := []string{"-o", ifName, "-j", "MASQUERADE"}
-	if ipt.HasRandomFully() {
-		rulespec = append(rulespec, "--random-fully")
+	return TableAlloc{
+		Start:       conf.TableStart,
+		End:         conf.TableEnd,
+		Reserved:    reserved,
+		LockPath:    conf.TableLockPath,
+		Max:         conf.MaxRouteTables,
+		WarnAbove:   conf.TableWarnThreshold,
+		Mode:        conf.TableAllocMode,
+		Range:       conf.TableRange,
+		Retries:     conf.TableAllocRetries,
+		BaseSleepMs: conf.TableAllocBaseSleepMs,
+		MaxSleepMs:  conf.TableAllocMaxSleepMs,
+		Rand:        tableRand,
 	}
-	rulespec = append(rulespec, "-m", "comment", "--comment", comment)
-	return ipt.AppendUnique("nat", "POSTROUTING", rulespec...)
 }
 
-func findFreeTable(start int) (int, error) {
-	allocatedTableIDs := make(map[int]bool)
-	// combine V4 and V6 tables
-	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
-		rules, err := netlink.RuleList(family)
-		if err != nil {
-			return -1, err
-		}
-		for _, rule := range rules {
-			allocatedTableIDs[rule.Table] = true
-		}
+// Announce holds how often addresses are announced to neighbors
+type Announce struct {
+	Count      int
+	IntervalMs int
+}
+
+// containerRouteMetric returns the metric of the routes in the Pod
+// namespace
+func (conf *PluginConf) containerRouteMetric() int {
+	if conf.DefaultRouteMetric > 0 {
+		return conf.DefaultRouteMetric
 	}
-	// find first slot that's available for both V4 and V6 usage
-	for i := start; i < math.MaxUint32; i++ {
-		if !allocatedTableIDs[i] {
-			return i, nil
+	return conf.RouteMetric
+}
+
+// tableGateways returns the configured next hops of the per-Pod table
+func (conf *PluginConf) tableGateways() []net.IP {
+	var gateways []net.IP
+	for _, gw := range []net.IP{conf.GatewayV4, conf.GatewayV6} {
+		if gw != nil {
+			gateways = append(gateways, gw)
 		}
 	}
-	return -1, fmt.Errorf("failed to find free route table")
+	return gateways
 }
 
-func addPolicyRules(veth *net.Interface, ipc *current.IPConfig, routes []*types.Route, tableStart int) error {
-	table := -1
-
-	// depend on netlink atomicity to win races for table slots on initial route add
-	sort.Slice(routes, func(i, j int) bool {
-		return routes[i].Dst.String() < routes[j].Dst.String()
-	})
+// gatewayRoutes returns the destinations of the on-link routes to
+// hostAddrs in the Pod namespace, as configured in conf
+func (conf *PluginConf) gatewayRoutes(hostAddrs []netlink.Addr) []*net.IPNet {
+	return gatewayRoutes(hostAddrs, conf.GatewayPrefixFromInterface, conf.GatewayPrefixLenV4, conf.GatewayPrefixLenV6)
+}
 
-	// try 10 times to write to an empty table slot
-	for i := 0; i < 10 && table == -1; i++ {
-		var err error
-		// jitter looking for an initial free table slot
-		table, err = findFreeTable(tableStart + rand.Intn(1000))
-		if err != nil {
-			return err
-		}
+// announce returns the address announcement options of conf
+func (conf *PluginConf) announce() Announce {
+	return Announce{
+		Count:      conf.GratuitousArpCount,
+		IntervalMs: conf.GratuitousArpIntervalMs,
+	}
+}
 
-		// add routes to the policy routing table
-		for _, route := range routes {
-			err := netlink.RouteAdd(&netlink.Route{
-				LinkIndex: veth.Index,
-				Dst:       &route.Dst,
-				Gw:        ipc.Address.IP,
-				Table:     table,
-			})
-			if err != nil {
-				table = -1
-				break
-			}
+// send announces addr on iface with a gratuitous ARP for IPv4 and an
+// unsolicited neighbor advertisement for IPv6. Announcements are best
+// effort, failures are ignored.
+func (a Announce) send(addr net.IP, iface net.Interface) {
+	for i := 0; i < a.Count; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(a.IntervalMs) * time.Millisecond)
 		}
-
-		if table == -1 {
-			// failed to add routes so sleep and try again on a different table
-			wait := time.Duration(rand.Intn(int(math.Min(maxSleep,
-				baseSleep*math.Pow(2, float64(i)))))) * time.Millisecond
-			fmt.Fprintf(os.Stderr, "route table collision, retrying in %v\n", wait)
-			time.Sleep(wait)
+		if addr.To4() != nil {
+			_ = nl.GratuitousArp(addr, iface)
+		} else {
+			_ = nl.SendUnsolicitedNA(addr, iface)
 		}
 	}
+}
 
-	// ensure we have a route table selected
-	if table == -1 {
-		return fmt.Errorf("failed to add routes to a free table")
-	}
-
-	// add policy route for traffic originating from a Pod
-	rule := netlink.NewRule()
-	rule.IifName = veth.Name
-	rule.Table = table
-	rule.Priority = podRulePriority
+// EgressSteering and EgressPath are the egress entries of the
+// configuration
+type (
+	EgressSteering = netconf.EgressSteering
+	EgressPath     = netconf.EgressPath
+)
 
-	err := netlink.RuleAdd(rule)
+// parseConfig parses the supplied configuration (and prevResult) from
+// stdin, detecting the host interface when it is not configured
+func parseConfig(stdin []byte) (*PluginConf, error) {
+	conf, err := loadConfig(stdin)
 	if err != nil {
-		return fmt.Errorf("failed to add policy rule %v: %v", rule, err)
+		return nil, err
 	}
-
-	return nil
-}
-
-func setupNodePortRule(ifName string, nodePorts string, nodePortMark int) error {
-	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		return fmt.Errorf("failed to locate iptables: %v", err)
+	if err := conf.detectHostInterface(); err != nil {
+		return nil, err
 	}
+	return conf, nil
+}
 
-	// Create iptables rules to ensure that nodeport traffic is marked
-	if err := ipt.AppendUnique("mangle", "PREROUTING", "-i", ifName, "-p", "tcp", "--dport", nodePorts, "-j", "CONNMARK", "--set-mark", strconv.Itoa(nodePortMark), "-m", "comment", "--comment", "NodePort Mark"); err != nil {
-		return err
+// detectHostInterface sets HostInterface to the interface of the default
+// route when it is not configured
+func (conf *PluginConf) detectHostInterface() error {
+	if conf.HostInterface != "" {
+		return nil
 	}
-	if err := ipt.AppendUnique("mangle", "PREROUTING", "-i", ifName, "-p", "udp", "--dport", nodePorts, "-j", "CONNMARK", "--set-mark", strconv.Itoa(nodePortMark), "-m", "comment", "--comment", "NodePort Mark"); err != nil {
+	excludes, err := netconf.CompileExcludes(conf.ExcludeInterfaces)
+	if err != nil {
 		return err
 	}
-	if err := ipt.AppendUnique("mangle", "PREROUTING", "-i", "veth+", "-j", "CONNMARK", "--restore-mark", "-m", "comment", "--comment", "NodePort Mark"); err != nil {
-		return err
+	conf.HostInterface, err = detectHostInterface(excludes)
+	if err != nil {
+		return fmt.Errorf("hostInterface was not specified and could not be detected: %v", err)
 	}
+	return nil
+}
 
-	// Use loose RP filter on host interface (RP filter does not take mark-based rules into account)
-	_, err = sysctl.Sysctl(fmt.Sprintf(RPFilterTemplate, ifName), "2")
+// loadConfig parses and validates the configuration without detecting
+// the host interface, which DEL can do without
+func loadConfig(stdin []byte) (*PluginConf, error) {
+	conf, err := netconf.LoadPtpConf(stdin)
 	if err != nil {
-		return fmt.Errorf("failed to set RP filter to loose for interface %q: %v", ifName, err)
+		return nil, err
 	}
+	return &PluginConf{*conf}, nil
+}
 
-	// add policy route for traffic from marked as nodeport
-	rule := netlink.NewRule()
-	rule.Mark = nodePortMark
-	rule.Table = 254 // main table
-	rule.Priority = nodePortRulePriority
-
-	exists := false
-	rules, err := netlink.RuleList(netlink.FAMILY_V4)
-	if err != nil {
-		return fmt.Errorf("Unable to retrive IP rules %v", err)
+// Bandwidth is the shaping of the traffic of a Pod
+type Bandwidth = netconf.Bandwidth
+
+// minTbfBurst is the smallest default burst in bits
+const minTbfBurst = netconf.MinTbfBurst
+
+// tbfLatency bounds how long a packet waits in a token bucket filter
+// before it is dropped
+const tbfLatency = 25 * time.Millisecond
+
+// addTbf shapes the traffic leaving the link at linkIndex to rate bits
+// per second with a bucket of burst bits, replacing its root qdisc
+func addTbf(h *netlink.Handle, linkIndex int, rate int64, burst int64) error {
+	rateBytes, burstBytes := uint64(rate/8), uint64(burst/8)
+	qdisc := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   rateBytes,
+		Limit:  uint32(float64(rateBytes)*tbfLatency.Seconds()) + uint32(burstBytes),
+		Buffer: uint32(float64(burstBytes) * float64(netlink.TIME_UNITS_PER_SEC) / float64(rateBytes) * netlink.TickInUsec()),
 	}
+	err := h.QdiscReplace(qdisc)
+	logger.Log("qdisc replace", lib.LogFields{"link": linkIndex, "qdisc": "tbf", "rate": rate, "burst": burst})
+	return err
+}
 
-	for _, r := range rules {
-		if r.Table == rule.Table && r.Mark == rule.Mark && r.Priority == rule.Priority {
-			exists = true
-			break
+// setupBandwidth limits the ingress traffic of the Pod on the host veth
+// and its egress traffic on the container veth in netns
+func setupBandwidth(netns ns.NetNS, hostVethName string, contVethName string, bw Bandwidth) error {
+	if bw.IngressRate > 0 {
+		h, err := newHandle()
+		if err != nil {
+			return err
 		}
-	}
-	if !exists {
-		err := netlink.RuleAdd(rule)
+		defer h.Delete()
+		link, err := h.LinkByName(hostVethName)
 		if err != nil {
-			return fmt.Errorf("failed to add policy rule %v: %v", rule, err)
+			return fmt.Errorf("failed to lookup %q: %v", hostVethName, err)
+		}
+		if err := addTbf(h, link.Attrs().Index, bw.IngressRate, bw.IngressBurst); err != nil {
+			return fmt.Errorf("failed to limit the ingress rate on %q: %v", hostVethName, err)
 		}
 	}
-
-	return nil
-}
-
-func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, hostAddrs []netlink.Addr, masq, containerIPV4, containerIPV6 bool, k8sIfName string, pr *current.Result) (*current.Interface, *current.Interface, error) {
-	hostInterface := &current.Interface{}
-	containerInterface := &current.Interface{}
-
-	err := netns.Do(func(hostNS ns.NetNS) error {
-		hostVeth, contVeth0, err := ip.SetupVeth(ifName, mtu, hostNS)
+	if bw.EgressRate == 0 {
+		return nil
+	}
+	return netns.Do(func(_ ns.NetNS) error {
+		h, err := newHandle()
 		if err != nil {
 			return err
 		}
-		hostInterface.Name = hostVeth.Name
-		hostInterface.Mac = hostVeth.HardwareAddr.String()
-		containerInterface.Name = contVeth0.Name
-		// ip.SetupVeth does not retrieve MAC address from peer in veth
-		containerNetlinkIface, _ := netlink.LinkByName(contVeth0.Name)
-		containerInterface.Mac = containerNetlinkIface.Attrs().HardwareAddr.String()
-		containerInterface.Sandbox = netns.Path()
-
-		pr.Interfaces = append(pr.Interfaces, hostInterface, containerInterface)
-
-		contVeth, err := net.InterfaceByName(ifName)
+		defer h.Delete()
+		link, err := h.LinkByName(contVethName)
 		if err != nil {
-			return fmt.Errorf("failed to look up %q: %v", ifName, err)
+			return fmt.Errorf("failed to lookup %q: %v", contVethName, err)
 		}
+		if err := addTbf(h, link.Attrs().Index, bw.EgressRate, bw.EgressBurst); err != nil {
+			return fmt.Errorf("failed to limit the egress rate on %q: %v", contVethName, err)
+		}
+		return nil
+	})
+}
 
-		if masq {
-			// enable forwarding and SNATing for traffic rerouted from kube-proxy
-			err := enableForwarding(containerIPV4, containerIPV6)
-			if err != nil {
-				return err
-			}
-
-			err = setupSNAT(k8sIfName, "kube-proxy SNAT")
+// removeTbf removes the root token bucket filter of link, if any
+func removeTbf(link netlink.Link) {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return
+	}
+	for _, qdisc := range qdiscs {
+		if tbf, ok := qdisc.(*netlink.Tbf); ok && tbf.Parent == netlink.HANDLE_ROOT {
+			err := netlink.QdiscDel(tbf)
+			fields := lib.LogFields{"link": link.Attrs().Name, "qdisc": "tbf"}
 			if err != nil {
-				return fmt.Errorf("failed to enable SNAT on %q: %v", k8sIfName, err)
+				fields["error"] = err.Error()
 			}
+			logger.Log("qdisc delete", fields)
 		}
+	}
+}
 
-		// add host routes for each dst hostInterface ip on dev contVeth
-		for _, ipc := range hostAddrs {
-			addrBits := 128
-			if ipc.IP.To4() != nil {
-				addrBits = 32
+// runtimeMTU returns the Pod MTU requested through the mtu runtime
+// config or the MTU CNI_ARG, 0 when none is
+func runtimeMTU(conf *PluginConf, cniArgs string) (int, error) {
+	mtu := conf.RuntimeConfig.MTU
+	if mtu == 0 {
+		for _, pair := range strings.Split(cniArgs, ";") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] != "MTU" {
+				continue
+			}
+			var err error
+			if mtu, err = strconv.Atoi(kv[1]); err != nil {
+				return 0, fmt.Errorf("invalid MTU CNI_ARG %q: %v", kv[1], err)
 			}
+		}
+	}
+	if mtu < 0 {
+		return 0, fmt.Errorf("requested mtu %d must not be negative", mtu)
+	}
+	return mtu, nil
+}
 
-			err := netlink.RouteAdd(&netlink.Route{
-				LinkIndex: contVeth.Index,
-				Scope:     netlink.SCOPE_LINK,
-				Dst: &net.IPNet{
-					IP:   ipc.IP,
-					Mask: net.CIDRMask(addrBits, addrBits),
-				},
-			})
+// detectHostInterface picks the interface of the preferred IPv4
+// default route, walking to the next default route when an interface
+// is excluded
+func detectHostInterface(excludes []*regexp.Regexp) (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", fmt.Errorf("failed to list routes: %v", err)
+	}
 
-			if err != nil {
-				return fmt.Errorf("failed to add host route dst %v: %v", ipc.IP, err)
-			}
+	var defaults []netlink.Route
+	for _, route := range routes {
+		if route.Dst == nil && route.LinkIndex > 0 {
+			defaults = append(defaults, route)
 		}
+	}
+	sort.SliceStable(defaults, func(i, j int) bool {
+		return defaults[i].Priority < defaults[j].Priority
+	})
 
-		// add a default gateway pointed at the first hostAddr
-		err = netlink.RouteAdd(&netlink.Route{
-			LinkIndex: contVeth.Index,
-			Scope:     netlink.SCOPE_UNIVERSE,
-			Dst:       nil,
-			Gw:        hostAddrs[0].IP,
-		})
+	var candidates []string
+	for _, route := range defaults {
+		link, err := netlink.LinkByIndex(route.LinkIndex)
 		if err != nil {
-			return fmt.Errorf("failed to add default route %v: %v", hostAddrs[0].IP, err)
+			continue
 		}
+		candidates = append(candidates, link.Attrs().Name)
+	}
 
-		// Send a gratuitous arp for all borrowed v4 addresses
-		for _, ipc := range pr.IPs {
-			if ipc.Version == "4" {
-				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
+	return selectHostInterface(candidates, excludes)
+}
+
+// selectHostInterface returns the first candidate not matching any exclude
+func selectHostInterface(candidates []string, excludes []*regexp.Regexp) (string, error) {
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no default route found")
+	}
+OUTER:
+	for _, candidate := range candidates {
+		for _, exclude := range excludes {
+			if exclude.MatchString(candidate) {
+				continue OUTER
 			}
 		}
-
-		return nil
-	})
-	if err != nil {
-		return nil, nil, err
+		return candidate, nil
 	}
-	return hostInterface, containerInterface, nil
+	return "", fmt.Errorf("all default route interfaces %v are excluded", candidates)
 }
 
-func setupHostVeth(vethName string, hostAddrs []netlink.Addr, masq bool, tableStart int, result *current.Result) error {
-	// no IPs to route
-	if len(result.IPs) == 0 {
-		return nil
-	}
-
-	// lookup by name as interface ids might have changed
-	veth, err := net.InterfaceByName(vethName)
-	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %v", vethName, err)
+func enableForwarding(ipv4 bool, ipv6 bool) error {
+	if ipv4 {
+		err := ip.EnableIP4Forward()
+		if err != nil {
+			return fmt.Errorf("Could not enable IPv4 forwarding: %v", err)
+		}
 	}
-
-	// add destination routes to Pod IPs
-	for _, ipc := range result.IPs {
-		addrBits := 128
-		if ipc.Address.IP.To4() != nil {
-			addrBits = 32
+	if ipv6 {
+		err := ip.EnableIP6Forward()
+		if err != nil {
+			return fmt.Errorf("Could not enable IPv6 forwarding: %v", err)
 		}
+	}
+	return nil
+}
 
-		err := netlink.RouteAdd(&netlink.Route{
-			LinkIndex: veth.Index,
-			Scope:     netlink.SCOPE_LINK,
-			Dst: &net.IPNet{
-				IP:   ipc.Address.IP,
-				Mask: net.CIDRMask(addrBits, addrBits),
-			},
-		})
-
+// setupSNAT masquerades the traffic leaving ifName with iptables for
+// IPv4 and ip6tables for IPv6, for the families the Pod has addresses of
+func setupSNAT(ifName string, comment string, ipv4 bool, ipv6 bool) error {
+	var protos []iptables.Protocol
+	if ipv4 {
+		protos = append(protos, iptables.ProtocolIPv4)
+	}
+	if ipv6 {
+		protos = append(protos, iptables.ProtocolIPv6)
+	}
+	for _, proto := range protos {
+		ipt, err := nl.NewIptables(iptablesPath, proto)
 		if err != nil {
-			return fmt.Errorf("failed to add host route dst %v: %v", ipc.Address.IP, err)
+			return fmt.Errorf("failed to locate iptables: %v", err)
+		}
+		rulespec := []string{"-o", ifName, "-j", "MASQUERADE"}
+		if ipt.HasRandomFully() {
+			rulespec = append(rulespec, "--random-fully")
+		}
+		rulespec = append(rulespec, "-m", "comment", "--comment", comment)
+		if err := ipt.AppendUnique("nat", "POSTROUTING", rulespec...); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// add policy rules for traffic coming in from Pods and destined for the VPC
-	err = addPolicyRules(veth, result.IPs[0], result.Routes, tableStart)
+func iptablesForIP(ipc net.IP) (*nl.Iptables, error) {
+	proto := iptables.ProtocolIPv6
+	if ipc.To4() != nil {
+		proto = iptables.ProtocolIPv4
+	}
+	ipt, err := nl.NewIptables(iptablesPath, proto)
 	if err != nil {
-		return fmt.Errorf("failed to add policy rules: %v", err)
+		return nil, fmt.Errorf("failed to locate iptables: %v", err)
 	}
+	return ipt, nil
+}
 
-	// Send a gratuitous arp for all borrowed v4 addresses
-	for _, ipc := range hostAddrs {
-		if ipc.IP.To4() != nil {
-			_ = arping.GratuitousArpOverIface(ipc.IP, *veth)
-		}
+// mssForMTU returns the MSS of TCP segments from ip that fit in mtu,
+// or 0 to clamp to the path MTU when mtu is not known
+func mssForMTU(ip net.IP, mtu int) int {
+	if mtu <= 0 {
+		return 0
 	}
+	if ip.To4() != nil {
+		return mtu - 40
+	}
+	return mtu - 60
+}
 
-	return nil
+func mssClampRulespec(ipn *net.IPNet, ifName string, mss int, comment string) []string {
+	clamp := []string{"--clamp-mss-to-pmtu"}
+	if mss > 0 {
+		clamp = []string{"--set-mss", strconv.Itoa(mss)}
+	}
+	rulespec := []string{"-s", ipn.String(), "-o", ifName, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS"}
+	rulespec = append(rulespec, clamp...)
+	return append(rulespec, "-m", "comment", "--comment", comment)
 }
 
-// cmdAdd is called for ADD requests
-func cmdAdd(args *skel.CmdArgs) error {
-	conf, err := parseConfig(args.StdinData)
+// setupMSSClamp clamps the MSS of TCP connections from a Pod IP leaving
+// through ifName to mss, or to the path MTU when mss is 0
+func setupMSSClamp(ipn *net.IPNet, ifName string, mss int, comment string) error {
+	ipt, err := iptablesForIP(ipn.IP)
 	if err != nil {
 		return err
 	}
+	return ipt.AppendUnique("mangle", "FORWARD", mssClampRulespec(ipn, ifName, mss, comment)...)
+}
 
-	if conf.PrevResult == nil {
-		return fmt.Errorf("must be called as chained plugin")
+// teardownMSSClamp removes a rule created by setupMSSClamp
+func teardownMSSClamp(ipn *net.IPNet, ifName string, mss int, comment string) error {
+	ipt, err := iptablesForIP(ipn.IP)
+	if err != nil {
+		return err
+	}
+	rulespec := mssClampRulespec(ipn, ifName, mss, comment)
+	exists, err := ipt.Exists("mangle", "FORWARD", rulespec...)
+	if err != nil || !exists {
+		return err
 	}
+	return ipt.Delete("mangle", "FORWARD", rulespec...)
+}
 
-	// This is some sample code to generate the list of container-side IPs.
-	// We're casting the prevResult to a 0.3.0 response, which can also include
-	// host-side IPs (but doesn't when converted from a 0.2.0 response).
-	containerIPs := make([]net.IP, 0, len(conf.PrevResult.IPs))
-	if conf.CNIVersion != "0.3.0" {
-		for _, ip := range conf.PrevResult.IPs {
-			containerIPs = append(containerIPs, ip.Address.IP)
+// selectEgressSteering returns the first entry selecting the Pod, or
+// nil when none does
+func selectEgressSteering(steering []EgressSteering, namespace string, podName string) *EgressSteering {
+	for i := range steering {
+		if steering[i].Namespace != "" && steering[i].Namespace != namespace {
+			continue
 		}
-	} else {
-		for _, ip := range conf.PrevResult.IPs {
-			if ip.Interface == nil {
+		if steering[i].PodName != "" {
+			// patterns were validated by parseConfig
+			if re, err := regexp.Compile("^(?:" + steering[i].PodName + ")$"); err != nil || !re.MatchString(podName) {
 				continue
 			}
-			intIdx := *ip.Interface
-			// Every IP is indexed in to the interfaces array, with "-1" standing
-			// for an unknown interface (which we'll assume to be Container-side
-			// Skip all IPs we know belong to an interface with the wrong name.
-			if intIdx >= 0 && intIdx < len(conf.PrevResult.Interfaces) && conf.PrevResult.Interfaces[intIdx].Name != args.IfName {
-				continue
-			}
-			containerIPs = append(containerIPs, ip.Address.IP)
 		}
+		return &steering[i]
 	}
-	if len(containerIPs) == 0 {
-		return fmt.Errorf("got no container IPs")
+	return nil
+}
+
+func egressMarkRulespec(ipn *net.IPNet, mark int, comment string) []string {
+	return []string{
+		"-s", ipn.String(),
+		"-j", "MARK", "--set-mark", strconv.Itoa(mark),
+		"-m", "comment", "--comment", comment,
 	}
+}
 
-	iface, err := netlink.LinkByName(conf.HostInterface)
+// setupEgressSteering marks traffic from a Pod IPv4 address and routes
+// the mark through the table of the steering entry. The policy rule is
+// shared by all Pods using the same mark and table.
+func setupEgressSteering(ipn *net.IPNet, steering *EgressSteering, comment string) error {
+	ipt, err := nl.NewIptables(iptablesPath, iptables.ProtocolIPv4)
 	if err != nil {
-		return fmt.Errorf("failed to lookup %q: %v", conf.HostInterface, err)
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	if err := ipt.AppendUnique("mangle", "PREROUTING", egressMarkRulespec(ipn, steering.Mark, comment)...); err != nil {
+		return err
 	}
 
-	hostAddrs, err := netlink.AddrList(iface, netlink.FAMILY_ALL)
+	rules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+	for _, r := range rules {
+		if r.Mark == steering.Mark && r.Table == steering.Table && r.Priority == egressRulePriority {
+			return nil
+		}
+	}
+
+	rule := netlink.NewRule()
+	rule.Mark = steering.Mark
+	rule.Table = steering.Table
+	rule.Priority = egressRulePriority
+	err = netlink.RuleAdd(rule)
+	logRule("rule add", rule, err)
+	if err != nil {
+		return fmt.Errorf("failed to add policy rule %v: %v", rule, err)
+	}
+	return nil
+}
+
+// teardownEgressSteering removes the mark rule of a Pod IPv4 address
+func teardownEgressSteering(ipn *net.IPNet, steering *EgressSteering, comment string) error {
+	ipt, err := nl.NewIptables(iptablesPath, iptables.ProtocolIPv4)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	rulespec := egressMarkRulespec(ipn, steering.Mark, comment)
+	exists, err := ipt.Exists("mangle", "PREROUTING", rulespec...)
+	if err != nil || !exists {
+		return err
+	}
+	return ipt.Delete("mangle", "PREROUTING", rulespec...)
+}
+
+// podEgressSteering returns the egress steering entry selecting the
+// Pod identified by the CNI_ARGS, if any
+func podEgressSteering(conf *PluginConf, cniArgs string) *EgressSteering {
+	if len(conf.EgressSteering) == 0 {
+		return nil
+	}
+	pod, err := lib.LoadK8sArgs(cniArgs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to parse CNI_ARGS: %v\n", err)
+		return nil
+	}
+	return selectEgressSteering(conf.EgressSteering, string(pod.K8S_POD_NAMESPACE), string(pod.K8S_POD_NAME))
+}
+
+// podEgressMark returns the egressMark requested through the runtime
+// config or the EgressMark CNI_ARG, 0 when none is
+func podEgressMark(conf *PluginConf, cniArgs string) (int, error) {
+	mark := conf.RuntimeConfig.EgressMark
+	if mark == 0 {
+		for _, pair := range strings.Split(cniArgs, ";") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] != "EgressMark" {
+				continue
+			}
+			var err error
+			if mark, err = strconv.Atoi(kv[1]); err != nil {
+				return 0, fmt.Errorf("invalid EgressMark CNI_ARG %q: %v", kv[1], err)
+			}
+		}
+	}
+	return mark, nil
+}
+
+// podEgress returns the egress steering of a Pod: the egress path its
+// egressMark selects, if any, otherwise its egressSteering entry
+func podEgress(conf *PluginConf, cniArgs string) (*EgressSteering, *EgressPath, error) {
+	mark, err := podEgressMark(conf, cniArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mark == 0 {
+		return podEgressSteering(conf, cniArgs), nil, nil
+	}
+	for i := range conf.EgressPaths {
+		path := &conf.EgressPaths[i]
+		if path.Mark == mark {
+			return &EgressSteering{Mark: path.Mark, Table: path.Table}, path, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("egressMark %d matches no egressPaths entry", mark)
+}
+
+// egressPathGateway returns the gateway of path, by default the VPC
+// router at the first address of the IPv4 subnet of its interface
+func egressPathGateway(path *EgressPath, link netlink.Link) (net.IP, error) {
+	if path.Gateway != "" {
+		return net.ParseIP(path.Gateway), nil
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IP addresses for %q: %v", path.Interface, err)
+	}
+	for _, addr := range addrs {
+		if gw := subnetRouter(addr.IPNet); gw != nil {
+			return gw, nil
+		}
+	}
+	return nil, fmt.Errorf("%q has no IPv4 subnet to route egress path %q through", path.Interface, path.Name)
+}
+
+// subnetRouter returns the first address of an IPv4 subnet, which the
+// VPC reserves for its router
+func subnetRouter(ipn *net.IPNet) net.IP {
+	network := ipn.IP.Mask(ipn.Mask).To4()
+	if network == nil {
+		return nil
+	}
+	gw := make(net.IP, len(network))
+	copy(gw, network)
+	gw[3]++
+	return gw
+}
+
+// checkEgressPath rejects an egress path whose interface is not the ENI
+// owning the Pod IPs, as the EC2 source/destination check drops traffic
+// an ENI sends from addresses it does not own. The ENI is the one
+// sharing podMAC, the MAC of the ipvlan Pod interface, or the one the
+// metadata service lists the IPs on when podMAC is unknown.
+func checkEgressPath(path *EgressPath, link netlink.Link, ips []net.IP, podMAC string) error {
+	mac := podMAC
+	if mac == "" {
+		interfaces, err := getInterfaces()
+		if err != nil {
+			return fmt.Errorf("failed to resolve the ENI of %v for egress path %q: %v", ips, path.Name, err)
+		}
+		mac = eniMACForIPs(ips, interfaces)
+	}
+	if mac == "" || !strings.EqualFold(mac, link.Attrs().HardwareAddr.String()) {
+		return fmt.Errorf("egress path %q: %q is not the ENI of the Pod IPs %v, which drops their traffic", path.Name, path.Interface, ips)
+	}
+	return nil
+}
+
+// addEgressPathTable installs the default route of the table of path
+// via its interface. The table is shared by the Pods using the path.
+// Replies arrive on the interface while the main table routes their
+// source through another one, so its rp_filter is loosened.
+func addEgressPathTable(path *EgressPath) error {
+	link, err := netlink.LinkByName(path.Interface)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q of egress path %q: %v", path.Interface, path.Name, err)
+	}
+	if err := nl.LoosenRPFilter(path.Interface); err != nil {
+		return err
+	}
+	gw, err := egressPathGateway(path, link)
+	if err != nil {
+		return err
+	}
+	_, defaultNet, _ := net.ParseCIDR("0.0.0.0/0")
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       defaultNet,
+		Gw:        gw,
+		Table:     path.Table,
+		Protocol:  routeProtocol,
+	}
+	if err := netlink.RouteReplace(route); err != nil {
+		return fmt.Errorf("failed to add the default route of egress path %q: %v", path.Name, err)
+	}
+	return nil
+}
+
+// removeEgressPathTable removes the policy rule and the routes of the
+// table of path once no Pod marks its traffic with the path mark
+func removeEgressPathTable(path *EgressPath) error {
+	ipt, err := nl.NewIptables(iptablesPath, iptables.ProtocolIPv4)
+	if err != nil {
+		return fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	rules, err := ipt.List("mangle", "PREROUTING")
+	if err != nil {
+		return err
+	}
+	if egressMarkInUse(rules, path.Mark) {
+		return nil
+	}
+
+	rule := netlink.NewRule()
+	rule.Mark = path.Mark
+	rule.Table = path.Table
+	rule.Priority = egressRulePriority
+	if err := netlink.RuleDel(rule); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to remove policy rule of egress path %q: %v\n", path.Name, err)
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: path.Table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return err
+	}
+	for i := range routes {
+		_ = netlink.RouteDel(&routes[i])
+	}
+	return nil
+}
+
+// egressMarkInUse reports whether any of the iptables rules sets mark
+func egressMarkInUse(rules []string, mark int) bool {
+	target := fmt.Sprintf("--set-xmark %#x/", mark)
+	for _, rule := range rules {
+		if strings.Contains(rule, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func findFreeTable(h *netlink.Handle, start int, alloc TableAlloc) (table int, inUse int, err error) {
+	allocatedTableIDs := make(map[int]bool)
+	// combine V4 and V6 tables
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := h.RuleList(family)
+		if err != nil {
+			return -1, 0, err
+		}
+		for _, rule := range rules {
+			allocatedTableIDs[rule.Table] = true
+		}
+	}
+	table, err = freeTable(allocatedTableIDs, start, alloc)
+	return table, tablesInUse(allocatedTableIDs, alloc), err
+}
+
+// tablesInUse counts the allocated tables alloc could hand out
+func tablesInUse(allocated map[int]bool, alloc TableAlloc) int {
+	inUse := 0
+	for table := range allocated {
+		if table >= alloc.Start && table < alloc.End && !alloc.Reserved[table] {
+			inUse++
+		}
+	}
+	return inUse
+}
+
+// warnTableUsage warns when more than alloc.WarnAbove tables are in
+// use, leaving time to drain the node before ADDs start failing
+func warnTableUsage(inUse int, alloc TableAlloc) {
+	if alloc.WarnAbove <= 0 || inUse <= alloc.WarnAbove {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: %d route tables are allocated, above the warning threshold of %d\n", inUse, alloc.WarnAbove)
+	logger.Log("route table warning threshold exceeded", lib.LogFields{"inUse": inUse, "threshold": alloc.WarnAbove})
+	metrics.Inc("cni_ptp_route_table_threshold_warnings_total")
+}
+
+// freeTable returns the first table from start, wrapping around to
+// alloc.Start at alloc.End, that is neither allocated nor reserved
+func freeTable(allocated map[int]bool, start int, alloc TableAlloc) (int, error) {
+	// find first slot that's available for both V4 and V6 usage
+	for i := start; i < alloc.End; i++ {
+		if !allocated[i] && !alloc.Reserved[i] {
+			return i, nil
+		}
+	}
+	for i := alloc.Start; i < start && i < alloc.End; i++ {
+		if !allocated[i] && !alloc.Reserved[i] {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("route table space exhausted: %d tables allocated in [%d, %d)", tablesInUse(allocated, alloc), alloc.Start, alloc.End)
+}
+
+// podTablesInUse counts the route tables at or above tableStart that
+// Pod policy rules point to
+func podTablesInUse(rules []netlink.Rule, tableStart int, priority int) int {
+	tables := make(map[int]bool)
+	for _, rule := range rules {
+		if rule.Priority == priority && rule.Table >= tableStart {
+			tables[rule.Table] = true
+		}
+	}
+	return len(tables)
+}
+
+// checkRouteTableCeiling fails when maxTables > 0 and as many Pod
+// route tables are already in use
+func checkRouteTableCeiling(h *netlink.Handle, tableStart int, maxTables int, priority int) error {
+	if maxTables <= 0 {
+		return nil
+	}
+
+	var rules []netlink.Rule
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		familyRules, err := h.RuleList(family)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, familyRules...)
+	}
+	if inUse := podTablesInUse(rules, tableStart, priority); inUse >= maxTables {
+		return fmt.Errorf("route table ceiling reached: %d of %d tables in use", inUse, maxTables)
+	}
+	return nil
+}
+
+// logger records the steps of the current call, nil when no logFile
+// is configured and tracing is off
+var logger *lib.Logger
+
+// traceEnv names the environment variable which, set to 1 in the
+// environment of the runtime, also writes the log entries of every
+// call to stderr, for debugging a node without changing its config
+const traceEnv = "CNI_IPVLAN_TRACE"
+
+// traceStderr is set from traceEnv in main
+var traceStderr bool
+
+// openLogger points logger at the logFile of conf, and at stderr when
+// tracing. Failing to open the file only disables logging to it.
+func openLogger(conf *PluginConf, args *skel.CmdArgs, cmd string) {
+	logger = nil
+	if conf.LogFile != "" {
+		var err error
+		if logger, err = lib.OpenLogFile(conf.LogFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if traceStderr {
+		logger = logger.Tee(os.Stderr)
+	}
+	if logger == nil {
+		return
+	}
+	logger.Log("parsed config", lib.LogFields{
+		"command":     cmd,
+		"containerID": args.ContainerID,
+		"ifName":      args.IfName,
+		"config":      conf,
+		"prevResult":  conf.PrevResult,
+	})
+}
+
+// metrics accumulates the metrics of the current call, nil when no
+// metricsFile is configured
+var metrics *lib.Metrics
+
+// openMetrics points metrics at the metricsFile of conf and counts the
+// call
+func openMetrics(conf *PluginConf, cmd string) {
+	metrics = nil
+	if conf.MetricsFile != "" {
+		metrics = lib.NewMetrics(conf.MetricsFile)
+	}
+	metrics.Inc("cni_ptp_invocations_total", "command", cmd)
+}
+
+// flushMetrics writes the metrics of the call, failures are only
+// logged
+func flushMetrics() {
+	if err := metrics.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// addRoute adds r, logging the outcome
+func addRoute(h *netlink.Handle, r *netlink.Route) error {
+	r.Protocol = routeProtocol
+	err := h.RouteAdd(r)
+	fields := lib.LogFields{"route": r.String(), "table": r.Table}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	logger.Log("route add", fields)
+	return err
+}
+
+// logRule logs the outcome of adding or deleting rule
+func logRule(msg string, rule *netlink.Rule, err error) {
+	fields := lib.LogFields{
+		"family":   rule.Family,
+		"iif":      rule.IifName,
+		"mark":     rule.Mark,
+		"priority": rule.Priority,
+		"table":    rule.Table,
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	logger.Log(msg, fields)
+}
+
+// logPhase logs the wall-clock time a phase of ADD took since start, to
+// tell which one dominates slow Pod starts
+func logPhase(phase string, start time.Time) {
+	logger.Log("phase done", lib.LogFields{"phase": phase, "duration": time.Since(start).String()})
+}
+
+// ruleAdd is replaced in tests to simulate policy rule failures
+var ruleAdd = (*netlink.Handle).RuleAdd
+
+// setupIPMasq and setupNodePortRule are replaced in tests to simulate
+// failures of the late ADD stages
+var setupIPMasq = nl.SetupIPMasq
+var setupNodePortRule = nl.SetupNodePortRule
+
+// newHandle opens a netlink handle in the current namespace. The
+// package level netlink functions open, bind and close a socket for
+// every request; a handle reuses one socket for all the routes and
+// rules of a call, saving three of the six syscalls of a request.
+func newHandle() (*netlink.Handle, error) {
+	h, err := netlink.NewHandle(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink handle: %v", err)
+	}
+	return h, nil
+}
+
+// routeProtocol tags the routes of the current call, 0 when they are
+// untagged
+var routeProtocol int
+
+// iptablesPath is the iptables binary of the current call, "" for the
+// one in PATH
+var iptablesPath string
+
+// tracer records the spans of the current call, nil when tracing is
+// disabled
+var tracer *lib.Tracer
+
+func setTracer(t *lib.Tracer) {
+	tracer = t
+}
+
+// podGateway returns the first Pod IP of the family of dst, which the
+// per-Pod table routes dst through
+func podGateway(ips []*current.IPConfig, dst net.IP) net.IP {
+	for _, ipc := range ips {
+		if (ipc.Address.IP.To4() != nil) == (dst.To4() != nil) {
+			return ipc.Address.IP
+		}
+	}
+	return nil
+}
+
+// tableGateway returns the next hop of the per-Pod table route to dst:
+// the gateway of its family among gateways, or else its Pod IP
+func tableGateway(ips []*current.IPConfig, gateways []net.IP, dst net.IP) net.IP {
+	for _, gw := range gateways {
+		if (gw.To4() != nil) == (dst.To4() != nil) {
+			return gw
+		}
+	}
+	return podGateway(ips, dst)
+}
+
+// checkGatewayOnLink fails unless gw is reached directly through the
+// link at linkIndex, without a further next hop
+func checkGatewayOnLink(h *netlink.Handle, gw net.IP, linkIndex int) error {
+	routes, err := h.RouteGet(gw)
+	if err != nil {
+		return fmt.Errorf("failed to find the route to gateway %v: %v", gw, err)
+	}
+	for _, route := range routes {
+		if route.LinkIndex == linkIndex && route.Gw == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("gateway %v is not on-link via the host veth", gw)
+}
+
+// tableRand is the time-seeded source of the route table jitter,
+// seeded in main
+var tableRand *rand.Rand
+
+// slot returns the table to start looking for a free one from on the
+// given attempt. In hash mode the slot is derived from the primary Pod
+// IP, so a Pod lands in the same table across retries, and later
+// attempts probe linearly. Otherwise the slot is jittered.
+func (alloc TableAlloc) slot(podIP net.IP, attempt int) int {
+	if alloc.Mode != tableAllocHash {
+		return alloc.Start + alloc.Rand.Intn(alloc.Range)
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(podIP.To16())
+	return alloc.Start + (int(h.Sum32()%uint32(alloc.Range))+attempt)%alloc.Range
+}
+
+// backoff returns the full jitter wait before the attempt following
+// the given one
+func (alloc TableAlloc) backoff(attempt int) time.Duration {
+	ceiling := int(math.Min(float64(alloc.MaxSleepMs), float64(alloc.BaseSleepMs)*math.Pow(2, float64(attempt))))
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(alloc.Rand.Intn(ceiling)) * time.Millisecond
+}
+
+func addPolicyRules(h *netlink.Handle, veth *net.Interface, ips []*current.IPConfig, routes []*types.Route, alloc TableAlloc, routeMetric int, gateways []net.IP, rulePriority int) (table int, err error) {
+	span := tracer.StartSpan("route-programming")
+	start := time.Now()
+	defer func() {
+		span.Finish(err)
+		metrics.Observe("cni_ptp_route_table_allocation_seconds", time.Since(start).Seconds())
+	}()
+
+	if len(routes) == 0 {
+		return -1, fmt.Errorf("the previous result has no routes to add to the Pod table")
+	}
+	for _, route := range routes {
+		if podGateway(ips, route.Dst.IP) == nil {
+			return -1, fmt.Errorf("no Pod IP of the family of route %v", route.Dst.String())
+		}
+		if alloc.ENI != nil && route.Dst.IP.To4() == nil {
+			return -1, fmt.Errorf("sharedTablePerENI only routes IPv4, not %v", route.Dst.String())
+		}
+	}
+
+	for _, gw := range gateways {
+		if err := checkGatewayOnLink(h, gw, veth.Index); err != nil {
+			return -1, err
+		}
+	}
+
+	// depend on netlink atomicity to win races for table slots on initial route add
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Dst.String() < routes[j].Dst.String()
+	})
+
+	// try alloc.Retries times to write to an empty table slot
+	for i := 0; i < alloc.Retries; i++ {
+		table, err = lockedAddPodTable(h, span, veth, ips, routes, alloc, routeMetric, gateways, rulePriority, i)
+		if err != errTableCollision {
+			return table, err
+		}
+
+		metrics.Inc("cni_ptp_route_table_collisions_total")
+		if alloc.Mode == tableAllocHash {
+			// the next attempt probes the following table right away
+			logger.Log("route table collision", lib.LogFields{"attempt": i})
+			continue
+		}
+		// failed to add routes so sleep, with the lock released, and try
+		// again on a different table
+		wait := alloc.backoff(i)
+		fmt.Fprintf(os.Stderr, "route table collision, retrying in %v\n", wait)
+		logger.Log("route table collision", lib.LogFields{"attempt": i, "retryIn": wait.String()})
+		tableBackoff(wait)
+	}
+
+	// concurrent ADDs took the free tables, a later ADD may find one
+	return -1, lib.TryAgainLater(fmt.Errorf("failed to add routes to a free table"))
+}
+
+// errTableCollision reports that the routes of an allocation attempt
+// clashed with those of another table user
+var errTableCollision = errors.New("route table collision")
+
+// tableBackoff waits between table allocation attempts
+var tableBackoff = time.Sleep
+
+// lockedAddPodTable runs an allocation attempt holding alloc.LockPath,
+// when set. Other ADDs only see the table as taken once its rule is
+// added, so the lock is held until then.
+func lockedAddPodTable(h *netlink.Handle, span *lib.Span, veth *net.Interface, ips []*current.IPConfig, routes []*types.Route, alloc TableAlloc, routeMetric int, gateways []net.IP, rulePriority int, attempt int) (table int, err error) {
+	if alloc.LockPath == "" {
+		return addPodTable(h, span, veth, ips, routes, alloc, routeMetric, gateways, rulePriority, attempt)
+	}
+	err = lib.LockfileRunAt(alloc.LockPath, func() (err error) {
+		table, err = addPodTable(h, span, veth, ips, routes, alloc, routeMetric, gateways, rulePriority, attempt)
+		return err
+	})
+	if err == lib.ErrLockfileBusy {
+		return -1, lib.TryAgainLater(fmt.Errorf("route table lock %v is busy", alloc.LockPath))
+	}
+	return table, err
+}
+
+// addPodTable adds routes to a free table and the policy rules pointing
+// the traffic from veth to it, returning the table. It returns
+// errTableCollision when the routes clash with those of the table.
+func addPodTable(h *netlink.Handle, span *lib.Span, veth *net.Interface, ips []*current.IPConfig, routes []*types.Route, alloc TableAlloc, routeMetric int, gateways []net.IP, rulePriority int, attempt int) (int, error) {
+	if alloc.ENI != nil {
+		return addENITable(h, span, veth, ips, routes, alloc, routeMetric, rulePriority, attempt)
+	}
+	if err := checkRouteTableCeiling(h, alloc.Start, alloc.Max, rulePriority); err != nil {
+		return -1, err
+	}
+
+	table, inUse, err := findFreeTable(h, alloc.slot(ips[0].Address.IP, attempt), alloc)
+	if err != nil {
+		return -1, err
+	}
+	if attempt == 0 {
+		warnTableUsage(inUse, alloc)
+	}
+
+	// add routes to the policy routing table
+	var added []*netlink.Route
+	for _, route := range routes {
+		r := &netlink.Route{
+			LinkIndex: veth.Index,
+			Dst:       &route.Dst,
+			Gw:        tableGateway(ips, gateways, route.Dst.IP),
+			Table:     table,
+			Priority:  routeMetric,
+		}
+		if err := addRoute(h, r); err != nil {
+			// don't leave a partial table behind for the next attempt
+			for _, r := range added {
+				_ = h.RouteDel(r)
+			}
+			return -1, errTableCollision
+		}
+		added = append(added, r)
+	}
+
+	span.SetAttribute(lib.AttrRouteTable, table)
+	logger.Log("route table chosen", lib.LogFields{"table": table, "iif": veth.Name})
+
+	// add policy routes for traffic originating from a Pod, one per
+	// family of the routes in the table
+	families := make(map[int]bool)
+	for _, route := range routes {
+		if route.Dst.IP.To4() != nil {
+			families[netlink.FAMILY_V4] = true
+		} else {
+			families[netlink.FAMILY_V6] = true
+		}
+	}
+	var rules []*netlink.Rule
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		if !families[family] {
+			continue
+		}
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.IifName = veth.Name
+		rule.Table = table
+		rule.Priority = rulePriority
+
+		exists, err := podRuleExists(h, rule)
+		if err == nil && exists {
+			// a retried ADD already added the rule
+			continue
+		}
+		if err == nil {
+			err = ruleAdd(h, rule)
+			logRule("rule add", rule, err)
+		}
+		if err != nil {
+			// don't leak the routes of a table no rule points to
+			for _, r := range rules {
+				_ = h.RuleDel(r)
+			}
+			for _, r := range added {
+				if delErr := h.RouteDel(r); delErr != nil {
+					fmt.Fprintf(os.Stderr, "failed to remove route %v from table %d: %v\n", r.Dst, table, delErr)
+				}
+			}
+			return -1, fmt.Errorf("failed to add policy rule %v: %v", rule, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return table, nil
+}
+
+// addENITable points the traffic from veth with a Pod IPv4 source to the
+// table shared by the Pods behind alloc.ENI, setting the table up in a
+// free one for the first of them, and returns the table. It returns
+// errTableCollision when the routes clash with those of the table.
+func addENITable(h *netlink.Handle, span *lib.Span, veth *net.Interface, ips []*current.IPConfig, routes []*types.Route, alloc TableAlloc, routeMetric int, rulePriority int, attempt int) (int, error) {
+	existing, err := h.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 0}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return -1, fmt.Errorf("failed to list routes: %v", err)
+	}
+	table := findENITable(existing, *alloc.ENI, alloc.Start)
+	shared := table != -1
+	if !shared {
+		if err := checkRouteTableCeiling(h, alloc.Start, alloc.Max, rulePriority); err != nil {
+			return -1, err
+		}
+		var inUse int
+		table, inUse, err = findFreeTable(h, alloc.slot(alloc.ENI.Gateway, attempt), alloc)
+		if err != nil {
+			return -1, err
+		}
+		if attempt == 0 {
+			warnTableUsage(inUse, alloc)
+		}
+	}
+
+	// the Pods behind the ENI may have been handed different routes,
+	// only the missing ones are added to a shared table
+	var added []*netlink.Route
+	for _, r := range eniTableRoutes(*alloc.ENI, routes, table, routeMetric) {
+		if shared && tableHasRoute(existing, table, r.Dst) {
+			continue
+		}
+		if err := addRoute(h, r); err != nil {
+			for _, r := range added {
+				_ = h.RouteDel(r)
+			}
+			return -1, errTableCollision
+		}
+		added = append(added, r)
+	}
+
+	span.SetAttribute(lib.AttrRouteTable, table)
+	logger.Log("route table chosen", lib.LogFields{"table": table, "iif": veth.Name, "shared": shared})
+
+	// one rule per Pod IPv4 address, which counts as a reference to the
+	// table
+	var rules []*netlink.Rule
+	for _, ipc := range ips {
+		if ipc.Address.IP.To4() == nil {
+			continue
+		}
+		rule := netlink.NewRule()
+		rule.Family = netlink.FAMILY_V4
+		rule.IifName = veth.Name
+		rule.Src = &net.IPNet{IP: ipc.Address.IP, Mask: net.CIDRMask(32, 32)}
+		rule.Table = table
+		rule.Priority = rulePriority
+
+		exists, err := podRuleExists(h, rule)
+		if err == nil && exists {
+			continue
+		}
+		if err == nil {
+			err = ruleAdd(h, rule)
+			logRule("rule add", rule, err)
+		}
+		if err != nil {
+			for _, r := range rules {
+				_ = h.RuleDel(r)
+			}
+			// the routes added to a table other Pods share stay
+			if !shared {
+				for _, r := range added {
+					_ = h.RouteDel(r)
+				}
+			}
+			return -1, fmt.Errorf("failed to add policy rule %v: %v", rule, err)
+		}
+		rules = append(rules, rule)
+	}
+	return table, nil
+}
+
+// eniTableRoutes returns the routes of the table shared behind key: the
+// on-link route to the gateway, which marks the table as shared, and
+// the routes to the destinations of routes via the gateway
+func eniTableRoutes(key ENITable, routes []*types.Route, table int, routeMetric int) []*netlink.Route {
+	eniRoutes := []*netlink.Route{{
+		LinkIndex: key.LinkIndex,
+		Dst:       &net.IPNet{IP: key.Gateway, Mask: net.CIDRMask(32, 32)},
+		Scope:     netlink.SCOPE_LINK,
+		Table:     table,
+	}}
+	for _, route := range routes {
+		eniRoutes = append(eniRoutes, &netlink.Route{
+			LinkIndex: key.LinkIndex,
+			Dst:       &route.Dst,
+			Gw:        key.Gateway,
+			Table:     table,
+			Priority:  routeMetric,
+		})
+	}
+	return eniRoutes
+}
+
+// eniTables maps the tables at or above tableStart shared by the Pods
+// behind an ENI, told apart by the on-link route to their gateway, to
+// their key. Only routes tagged with routeProtocol are considered when
+// it is set.
+func eniTables(routes []netlink.Route, tableStart int) map[int]ENITable {
+	tables := make(map[int]ENITable)
+	for _, route := range routes {
+		if route.Table < tableStart || route.Gw != nil || route.Dst == nil || route.Scope != netlink.SCOPE_LINK {
+			continue
+		}
+		if routeProtocol != 0 && route.Protocol != routeProtocol {
+			continue
+		}
+		if ones, bits := route.Dst.Mask.Size(); ones != 32 || bits != 32 {
+			continue
+		}
+		tables[route.Table] = ENITable{LinkIndex: route.LinkIndex, Gateway: route.Dst.IP}
+	}
+	return tables
+}
+
+// findENITable returns the table at or above tableStart shared behind
+// key, -1 when there is none yet
+func findENITable(routes []netlink.Route, key ENITable, tableStart int) int {
+	tables := eniTables(routes, tableStart)
+	var found []int
+	for table, k := range tables {
+		if k.LinkIndex == key.LinkIndex && k.Gateway.Equal(key.Gateway) {
+			found = append(found, table)
+		}
+	}
+	if len(found) == 0 {
+		return -1
+	}
+	// concurrent ADDs without a lock may have set up several
+	sort.Ints(found)
+	return found[0]
+}
+
+// tableHasRoute reports whether routes hold a route to dst in table
+func tableHasRoute(routes []netlink.Route, table int, dst *net.IPNet) bool {
+	for _, route := range routes {
+		if route.Table == table && route.Dst != nil && route.Dst.String() == dst.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// unreferencedTables returns the tables no rule points to
+func unreferencedTables(tables map[int]ENITable, rules []netlink.Rule) []int {
+	refs := make(map[int]int)
+	for _, rule := range rules {
+		refs[rule.Table]++
+	}
+	var unreferenced []int
+	for table := range tables {
+		if refs[table] == 0 {
+			unreferenced = append(unreferenced, table)
+		}
+	}
+	sort.Ints(unreferenced)
+	return unreferenced
+}
+
+// releaseENITables removes the routes of the shared tables at or above
+// tableStart once the last Pod rule pointing to them is gone, holding
+// lockPath when set so a concurrent ADD does not pick a table up while
+// it is emptied
+func releaseENITables(tableStart int, lockPath string) error {
+	release := func() error {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 0}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return fmt.Errorf("failed to list routes: %v", err)
+		}
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("failed to list rules: %v", err)
+		}
+		for _, table := range unreferencedTables(eniTables(routes, tableStart), rules) {
+			for _, route := range routes {
+				if route.Table != table {
+					continue
+				}
+				route := route
+				err := netlink.RouteDel(&route)
+				fields := lib.LogFields{"route": route.String(), "table": table}
+				if err != nil {
+					fields["error"] = err.Error()
+				}
+				logger.Log("route delete", fields)
+			}
+		}
+		return nil
+	}
+	if lockPath == "" {
+		return release()
+	}
+	return lib.LockfileRunAt(lockPath, release)
+}
+
+// podRuleExists reports whether a policy rule equivalent to rule, with
+// the same iif, table and priority, is already in place
+func podRuleExists(h *netlink.Handle, rule *netlink.Rule) (bool, error) {
+	rules, err := h.RuleList(rule.Family)
+	if err != nil {
+		return false, fmt.Errorf("failed to list rules: %v", err)
+	}
+	for _, r := range rules {
+		if r.IifName == rule.IifName && r.Table == rule.Table && r.Priority == rule.Priority &&
+			r.Src.String() == rule.Src.String() && r.Dst.String() == rule.Dst.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// podTableRoutes returns the routes of the per-Pod tables, at or above
+// tableStart, that belong to a Pod: routes through its host veth or
+// through one of its IPs. Only routes tagged with routeProtocol are
+// considered when it is set.
+func podTableRoutes(routes []netlink.Route, vethIndex int, podIPs []net.IP, tableStart int) []netlink.Route {
+	var owned []netlink.Route
+	for _, route := range routes {
+		if route.Table < tableStart {
+			continue
+		}
+		if routeProtocol != 0 && route.Protocol != routeProtocol {
+			continue
+		}
+		mine := vethIndex > 0 && route.LinkIndex == vethIndex
+		for _, podIP := range podIPs {
+			if route.Gw != nil && route.Gw.Equal(podIP) {
+				mine = true
+			}
+		}
+		if mine {
+			owned = append(owned, route)
+		}
+	}
+	return owned
+}
+
+// removePodTableRoutes deletes the per-Pod table routes of a Pod, which
+// a failed ADD may have installed without a policy rule pointing to
+// their table
+func removePodTableRoutes(vethIndex int, podIPs []net.IP, tableStart int) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: 0}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to list routes: %v\n", err)
+			continue
+		}
+		for _, route := range podTableRoutes(routes, vethIndex, podIPs, tableStart) {
+			route := route
+			err := netlink.RouteDel(&route)
+			fields := lib.LogFields{"route": route.String(), "table": route.Table}
+			if err != nil {
+				fields["error"] = err.Error()
+			}
+			logger.Log("route delete", fields)
+		}
+	}
+}
+
+// removeStaleLink deletes a pre-existing link with the given name in
+// the current namespace. Removing one end of a veth also removes its
+// peer, so this cleans up a stale host side as well.
+func removeStaleLink(ifName string) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "removing stale %s link %q (index %d)\n", link.Type(), ifName, link.Attrs().Index)
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("failed to remove stale link %q: %v", ifName, err)
+	}
+	return nil
+}
+
+// usableHostAddrs filters out host addresses which can not be used as
+// a gateway by Pods, such as link-local addresses
+func usableHostAddrs(addrs []netlink.Addr) []netlink.Addr {
+	var usable []netlink.Addr
+	for _, addr := range addrs {
+		if addr.IPNet == nil || addr.Scope != int(netlink.SCOPE_UNIVERSE) {
+			continue
+		}
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		usable = append(usable, addr)
+	}
+	return usable
+}
+
+// podGatewayAddrs returns the addresses of the Pod ENI link, or those of
+// fallbackName when the ENI has no usable one, as secondary ipvlan
+// master ENIs usually do
+func podGatewayAddrs(link netlink.Link, fallbackName string) ([]netlink.Addr, error) {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil || len(usableHostAddrs(addrs)) > 0 || link.Attrs().Name == fallbackName {
+		return addrs, err
+	}
+	fallback, err := netlink.LinkByName(fallbackName)
+	if err != nil {
+		return nil, err
+	}
+	return netlink.AddrList(fallback, netlink.FAMILY_ALL)
+}
+
+// ipsOutsideSubnets returns the ips not contained in the subnet of any
+// of addrs
+func ipsOutsideSubnets(ips []net.IP, addrs []netlink.Addr) []net.IP {
+	var outside []net.IP
+	for _, ip := range ips {
+		owned := false
+		for _, addr := range addrs {
+			if addr.IPNet != nil && addr.Contains(ip) {
+				owned = true
+				break
+			}
+		}
+		if !owned {
+			outside = append(outside, ip)
+		}
+	}
+	return outside
+}
+
+// sortHostAddrs orders host addresses deterministically, whatever order
+// the kernel lists them in, so that the first one is a stable gateway:
+// addresses of the preferred family first, then primary addresses
+// before secondary ones, then by address.
+func sortHostAddrs(addrs []netlink.Addr, preferV4 bool) {
+	rank := func(addr netlink.Addr) int {
+		r := 0
+		if (addr.IP.To4() != nil) != preferV4 {
+			r += 2
+		}
+		if addr.Flags&syscall.IFA_F_SECONDARY != 0 {
+			r++
+		}
+		return r
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		ri, rj := rank(addrs[i]), rank(addrs[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return bytes.Compare(addrs[i].IP.To16(), addrs[j].IP.To16()) < 0
+	})
+}
+
+// podGateways returns the first of the sorted host addresses of each
+// family the Pod has an address of, the Pod default gateways
+func podGateways(hostAddrs []netlink.Addr, containerIPV4 bool, containerIPV6 bool) []net.IP {
+	var v4, v6 net.IP
+	for _, addr := range hostAddrs {
+		if addr.IP.To4() != nil {
+			if containerIPV4 && v4 == nil {
+				v4 = addr.IP
+			}
+		} else if containerIPV6 && v6 == nil {
+			v6 = addr.IP
+		}
+	}
+
+	var gateways []net.IP
+	for _, gw := range []net.IP{v4, v6} {
+		if gw != nil {
+			gateways = append(gateways, gw)
+		}
+	}
+	return gateways
+}
+
+// gatewayRoutes returns the destinations of the on-link routes to
+// hostAddrs, the Pod gateways among them. Each covers its address alone
+// unless fromInterface takes the prefix of the address on the host
+// interface, or the prefix length of its family, when not 0, overrides
+// it. Destinations shared by several addresses are returned once.
+func gatewayRoutes(hostAddrs []netlink.Addr, fromInterface bool, prefixLenV4 int, prefixLenV6 int) []*net.IPNet {
+	var routes []*net.IPNet
+	seen := make(map[string]bool)
+	for _, addr := range hostAddrs {
+		addrBits, prefixLen := 128, prefixLenV6
+		if addr.IP.To4() != nil {
+			addrBits, prefixLen = 32, prefixLenV4
+		}
+		mask := net.CIDRMask(addrBits, addrBits)
+		if prefixLen != 0 {
+			mask = net.CIDRMask(prefixLen, addrBits)
+		} else if fromInterface && addr.IPNet != nil && addr.Mask != nil {
+			mask = addr.Mask
+		}
+		dst := &net.IPNet{IP: addr.IP.Mask(mask), Mask: mask}
+		if !seen[dst.String()] {
+			seen[dst.String()] = true
+			routes = append(routes, dst)
+		}
+	}
+	return routes
+}
+
+// podFamilyAddrs returns the host addresses of the families the Pod has
+// an address of
+func podFamilyAddrs(hostAddrs []netlink.Addr, containerIPV4 bool, containerIPV6 bool) []netlink.Addr {
+	var addrs []netlink.Addr
+	for _, addr := range hostAddrs {
+		if addr.IP.To4() != nil && containerIPV4 || addr.IP.To4() == nil && containerIPV6 {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// onLinkGateway reports whether gw is reachable through one of the
+// on-link routes
+func onLinkGateway(gw net.IP, routes []netlink.Route) bool {
+	for _, route := range routes {
+		if route.Scope == netlink.SCOPE_LINK && route.Dst != nil && route.Dst.Contains(gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// podMAC returns the MAC of ifName in netnsPath, or "" when the
+// namespace or the interface is gone
+func podMAC(netnsPath, ifName string) string {
+	var mac string
+	_ = ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return err
+		}
+		mac = link.Attrs().HardwareAddr.String()
+		return nil
+	})
+	return mac
+}
+
+// linkForMAC returns the name of the link whose MAC is mac, or ""
+func linkForMAC(mac string, links []netlink.Link) string {
+	if mac == "" {
+		return ""
+	}
+	for _, link := range links {
+		if strings.EqualFold(link.Attrs().HardwareAddr.String(), mac) {
+			return link.Attrs().Name
+		}
+	}
+	return ""
+}
+
+// eniMACForIPs returns the MAC of the interface that holds the first of
+// ips any interface holds as a secondary IP or in a prefix, or ""
+func eniMACForIPs(ips []net.IP, interfaces []aws.Interface) string {
+	for _, ip := range ips {
+		for _, intf := range interfaces {
+			for _, owned := range append(intf.IPv4s, intf.PrefixIPs()...) {
+				if owned.Equal(ip) {
+					return intf.Mac
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// getInterfaces lists the interfaces of the instance from the metadata
+// service
+var getInterfaces = func() ([]aws.Interface, error) {
+	return aws.DefaultClient.GetInterfaces()
+}
+
+// podHostInterface resolves the host interface of the ENI owning the
+// Pod among candidates, or among all ENI devices when candidates is
+// empty. The ipvlan Pod interface shares the MAC of its ENI; when mac is
+// unknown, the metadata service maps the Pod IPs to the MAC. Falls back
+// to fallback when neither resolves to a device.
+func podHostInterface(ips []net.IP, mac string, candidates []string, fallback string) string {
+	links, err := netlink.LinkList()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list links, using %q: %v\n", fallback, err)
+		return fallback
+	}
+
+	var enis []netlink.Link
+	for _, link := range links {
+		// Pod veths and ipvlan children carry no ENI of their own
+		if link.Type() == "veth" || link.Type() == "ipvlan" {
+			continue
+		}
+		if len(candidates) > 0 && !containsString(candidates, link.Attrs().Name) {
+			continue
+		}
+		enis = append(enis, link)
+	}
+
+	if name := linkForMAC(mac, enis); name != "" {
+		return name
+	}
+	interfaces, err := getInterfaces()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to resolve the ENI of %v, using %q: %v\n", ips, fallback, err)
+		return fallback
+	}
+	if name := linkForMAC(eniMACForIPs(ips, interfaces), enis); name != "" {
+		return name
+	}
+	return fallback
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIptables ensures iptables can be used for the given families
+func checkIptables(ipv4 bool, ipv6 bool) error {
+	if ipv4 {
+		if _, err := nl.NewIptables(iptablesPath, iptables.ProtocolIPv4); err != nil {
+			return fmt.Errorf("failed to locate iptables: %v", err)
+		}
+	}
+	if ipv6 {
+		if _, err := nl.NewIptables(iptablesPath, iptables.ProtocolIPv6); err != nil {
+			return fmt.Errorf("failed to locate ip6tables: %v", err)
+		}
+	}
+	return nil
+}
+
+// defaultPodIfName is the Pod interface the containerInterface and
+// IP masquerade chain names are used for unchanged
+const defaultPodIfName = "eth0"
+
+// containerVethName returns the name of the container side veth used
+// for the Pod interface ifName. Runtimes may call ADD several times for
+// the same network namespace with distinct IfNames, each of which gets
+// its own veth.
+func containerVethName(base string, ifName string) string {
+	if ifName == "" || ifName == defaultPodIfName {
+		return base
+	}
+	name := base + "-" + ifName
+	if len(name) > maxIfNameLen {
+		name = fmt.Sprintf("%s-%x", base, sha1.Sum([]byte(ifName)))
+	}
+	if len(name) > maxIfNameLen {
+		name = name[:maxIfNameLen]
+	}
+	return name
+}
+
+// containerVethName returns the name of the container side veth of the
+// Pod interface ifName, derived from containerIfName when it is set, and
+// ifName itself without chaining
+func (conf *PluginConf) containerVethName(ifName string) string {
+	if conf.Unchained {
+		return ifName
+	}
+	if conf.ContainerIfName != "" {
+		return containerVethName(conf.ContainerIfName, ifName)
+	}
+	return containerVethName(conf.ContainerInterface, ifName)
+}
+
+// hostVethName returns the name of the host side veth of the Pod
+// interface ifName: the prefix and a hash of the container ID and
+// ifName, so that DEL can find the veth without its container peer
+func hostVethName(prefix string, containerID string, ifName string) string {
+	name := fmt.Sprintf("%s%x", prefix, sha1.Sum([]byte(ipMasqID(containerID, ifName))))
+	return name[:maxIfNameLen]
+}
+
+// maxRuleNameLen bounds the network name used in iptables comments so
+// that they stay within the 256 character limit of the comment match
+const maxRuleNameLen = 128
+
+// ruleName returns the network name iptables chain names and comments
+// are derived from, scoped by the cluster ID when one is configured
+func ruleName(conf *PluginConf) string {
+	name := conf.Name
+	if conf.ClusterID != "" {
+		name = conf.ClusterID + "/" + conf.Name
+	}
+	if len(name) > maxRuleNameLen {
+		name = fmt.Sprintf("%x", sha1.Sum([]byte(name)))
+	}
+	return name
+}
+
+// ipMasqID returns the id IP masquerade chains and comments of the Pod
+// interface ifName are derived from
+func ipMasqID(containerID string, ifName string) string {
+	if ifName == "" || ifName == defaultPodIfName {
+		return containerID
+	}
+	return containerID + "-" + ifName
+}
+
+// resultContainerIPs returns the container-side IPs of ifName in the
+// previous result
+func resultContainerIPs(conf *PluginConf, ifName string) []net.IP {
+	// Results from 0.3.0 on, 1.0.0 included, index every IP into the
+	// interfaces array and can also include host-side IPs. Older results
+	// (and those converted from them) only carry container-side IPs.
+	containerIPs := make([]net.IP, 0, len(conf.PrevResult.IPs))
+	if !hasInterfaceIndices(conf.CNIVersion) {
+		for _, ip := range conf.PrevResult.IPs {
+			containerIPs = append(containerIPs, ip.Address.IP)
+		}
+	} else {
+		for _, ip := range conf.PrevResult.IPs {
+			if ip.Interface == nil {
+				continue
+			}
+			intIdx := *ip.Interface
+			// Every IP is indexed in to the interfaces array, with "-1" standing
+			// for an unknown interface (which we'll assume to be Container-side
+			// Skip all IPs we know belong to an interface with the wrong name.
+			if intIdx >= 0 && intIdx < len(conf.PrevResult.Interfaces) && conf.PrevResult.Interfaces[intIdx].Name != ifName {
+				continue
+			}
+			containerIPs = append(containerIPs, ip.Address.IP)
+		}
+	}
+	return containerIPs
+}
+
+// hasInterfaceIndices reports whether results of cniVersion index their
+// IPs into the interfaces array, which all versions after 0.2.0 do
+func hasInterfaceIndices(cniVersion string) bool {
+	switch cniVersion {
+	case "", "0.1.0", "0.2.0":
+		return false
+	default:
+		return true
+	}
+}
+
+// planAdd describes the veths, routes, policy rules and iptables rules
+// ADD would set up for the resolved options, for dryRun. table is the
+// free table the Pod routes would be added to.
+func planAdd(conf *PluginConf, args *skel.CmdArgs, hostIfName string, hostAddrs []netlink.Addr, containerIPs []net.IP, mtu int, table int) []string {
+	hostRoute := func(ip net.IP) *net.IPNet {
+		addrBits := 128
+		if ip.To4() != nil {
+			addrBits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(addrBits, addrBits)}
+	}
+	vethName := conf.containerVethName(args.IfName)
+	comment := utils.FormatComment(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
+
+	ops := []string{fmt.Sprintf("create veth %q with mtu %d in %v and its peer on the host", vethName, mtu, args.Netns)}
+	if conf.IPMasq {
+		ops = append(ops, fmt.Sprintf("enable forwarding and SNAT kube-proxy traffic leaving %q in the container", args.IfName))
+	}
+	for _, dst := range conf.gatewayRoutes(hostAddrs) {
+		ops = append(ops, fmt.Sprintf("add route %v dev %s scope link in the container", dst, vethName))
+	}
+	containerIPV4, containerIPV6 := false, false
+	for _, ip := range containerIPs {
+		if ip.To4() != nil {
+			containerIPV4 = true
+		} else {
+			containerIPV6 = true
+		}
+	}
+	for _, gw := range podGateways(hostAddrs, containerIPV4, containerIPV6) {
+		src := ""
+		if conf.PreferredSrc && gw.To4() != nil {
+			src = fmt.Sprintf(" src %v", podGateway(conf.PrevResult.IPs, gw))
+		}
+		ops = append(ops, fmt.Sprintf("add default route via %v dev %s%s metric %d in the container", gw, vethName, src, conf.containerRouteMetric()))
+	}
+	for _, route := range conf.AdditionalContainerRoutes {
+		if route.GW == nil {
+			ops = append(ops, fmt.Sprintf("add route %v dev %s scope link metric %d in the container", route.Dst.String(), vethName, conf.containerRouteMetric()))
+		} else {
+			ops = append(ops, fmt.Sprintf("add route %v via %v dev %s metric %d in the container, when the gateway is on-link", route.Dst.String(), route.GW, vethName, conf.containerRouteMetric()))
+		}
+	}
+
+	for _, ip := range containerIPs {
+		ops = append(ops, fmt.Sprintf("add route %v dev <host veth> scope link", hostRoute(ip)))
+	}
+	ops = append(ops, planTable(conf, hostIfName, containerIPs, table)...)
+
+	bw := conf.Bandwidth()
+	if bw.IngressRate > 0 {
+		ops = append(ops, fmt.Sprintf("add tbf qdisc rate %dbit burst %dbit on <host veth>", bw.IngressRate, bw.IngressBurst))
+	}
+	if bw.EgressRate > 0 {
+		ops = append(ops, fmt.Sprintf("add tbf qdisc rate %dbit burst %dbit on %s in the container", bw.EgressRate, bw.EgressBurst, vethName))
+	}
+
+	if conf.IPMasq {
+		chain := utils.FormatChainName(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
+		for _, ip := range containerIPs {
+			if conf.masquerade(ip) {
+				ops = append(ops, fmt.Sprintf("add IP masquerade chain %s for %v", chain, hostRoute(ip)))
+			}
+		}
+	}
+	if conf.ClampMSS {
+		vethMTU := 0
+		if conf.ClampMSSToMTU {
+			vethMTU = mtu
+		}
+		for _, ip := range containerIPs {
+			command := "iptables"
+			if ip.To4() == nil {
+				command = "ip6tables"
+			}
+			rulespec := mssClampRulespec(hostRoute(ip), hostIfName, mssForMTU(ip, vethMTU), comment)
+			ops = append(ops, fmt.Sprintf("%s -t mangle -A FORWARD %s", command, strings.Join(rulespec, " ")))
+		}
+	}
+	steering, egressPath, _ := podEgress(conf, args.Args)
+	if egressPath != nil {
+		gw := "<subnet router>"
+		if link, err := netlink.LinkByName(egressPath.Interface); err == nil {
+			if ip, err := egressPathGateway(egressPath, link); err == nil {
+				gw = ip.String()
+			}
+		}
+		ops = append(ops, fmt.Sprintf("ip -4 route replace default via %s dev %s table %d", gw, egressPath.Interface, egressPath.Table))
+	}
+	if steering != nil {
+		for _, ip := range containerIPs {
+			if ip.To4() == nil {
+				continue
+			}
+			rulespec := egressMarkRulespec(hostRoute(ip), steering.Mark, comment)
+			ops = append(ops, fmt.Sprintf("iptables -t mangle -A PREROUTING %s", strings.Join(rulespec, " ")))
+		}
+		ops = append(ops, fmt.Sprintf("ip -4 rule add fwmark %d lookup %d priority %d", steering.Mark, steering.Table, egressRulePriority))
+	}
+	return ops
+}
+
+// planTable returns the operations adding the routes of the Pod table
+// and the policy rules pointing to it
+func planTable(conf *PluginConf, hostIfName string, containerIPs []net.IP, table int) []string {
+	var ops []string
+	if conf.SharedTablePerENI {
+		gw := eniGateway(conf.PrevResult.IPs)
+		ops = append(ops, fmt.Sprintf("add route %v/32 dev %s scope link table %d, unless the table is shared already", gw, hostIfName, table))
+		for _, route := range conf.PrevResult.Routes {
+			ops = append(ops, fmt.Sprintf("add route %v via %v dev %s metric %d table %d", route.Dst.String(), gw, hostIfName, conf.RouteMetric, table))
+		}
+		for _, ip := range containerIPs {
+			if ip.To4() != nil {
+				ops = append(ops, fmt.Sprintf("ip -4 rule add from %v/32 iif <host veth> lookup %d priority %d", ip, table, conf.PodRulePriority))
+			}
+		}
+		return ops
+	}
+
+	families := make(map[string]bool)
+	for _, route := range conf.PrevResult.Routes {
+		ops = append(ops, fmt.Sprintf("add route %v via %v dev <host veth> metric %d table %d",
+			route.Dst.String(), tableGateway(conf.PrevResult.IPs, conf.tableGateways(), route.Dst.IP), conf.RouteMetric, table))
+		if route.Dst.IP.To4() != nil {
+			families["-4"] = true
+		} else {
+			families["-6"] = true
+		}
+	}
+	for _, family := range []string{"-4", "-6"} {
+		if families[family] {
+			ops = append(ops, fmt.Sprintf("ip %s rule add iif <host veth> lookup %d priority %d", family, table, conf.PodRulePriority))
+		}
+	}
+	return ops
+}
+
+// renameLink renames an up link, taking it down for the rename
+func renameLink(name string, newName string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetName(link, newName); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(link)
+}
+
+func setupContainerVeth(netns ns.NetNS, ifName string, mtu int, routeMetric int, preferredSrc bool, hostAddrs []netlink.Addr, gwRoutes []*net.IPNet, masq, containerIPV4, containerIPV6 bool, k8sIfName string, hostVethName string, announce Announce, extraRoutes []types.Route, pr *current.Result) (*current.Interface, *current.Interface, error) {
+	hostInterface := &current.Interface{}
+	containerInterface := &current.Interface{}
+
+	err := netns.Do(func(hostNS ns.NetNS) error {
+		// a crashed DEL may have left the container side behind, which
+		// would otherwise fail the veth creation with "file exists"
+		if err := removeStaleLink(ifName); err != nil {
+			return err
+		}
+		// or the host side only, whose name is derived from the Pod
+		if err := hostNS.Do(func(_ ns.NetNS) error {
+			if link := namedHostVeth(hostVethName); link != nil {
+				fmt.Fprintf(os.Stderr, "removing stale host veth %q\n", hostVethName)
+				return netlink.LinkDel(link)
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to remove stale host veth %q: %v", hostVethName, err)
+		}
+
+		hostVeth, contVeth0, err := ip.SetupVeth(ifName, mtu, hostNS)
+		if err != nil {
+			return err
+		}
+		// the NodePort restore rule only matches host veths named with
+		// the prefix, and DEL finds the veth by its name when the
+		// container side is gone
+		hostInterface.Name = hostVethName
+		err = hostNS.Do(func(_ ns.NetNS) error {
+			return renameLink(hostVeth.Name, hostVethName)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to rename host veth %q to %q: %v", hostVeth.Name, hostVethName, err)
+		}
+		hostInterface.Mac = hostVeth.HardwareAddr.String()
+		containerInterface.Name = contVeth0.Name
+		// ip.SetupVeth does not retrieve MAC address from peer in veth
+		containerNetlinkIface, _ := netlink.LinkByName(contVeth0.Name)
+		containerInterface.Mac = containerNetlinkIface.Attrs().HardwareAddr.String()
+		containerInterface.Sandbox = netns.Path()
+
+		pr.Interfaces = append(pr.Interfaces, hostInterface, containerInterface)
+
+		contVeth, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to look up %q: %v", ifName, err)
+		}
+
+		h, err := newHandle()
+		if err != nil {
+			return err
+		}
+		defer h.Delete()
+
+		// without chaining the veth is the Pod interface and carries
+		// the Pod IPs, the routes are those of the veth below
+		if ifName == k8sIfName {
+			if err := ipam.ConfigureIface(ifName, podAddrs(pr, ifName)); err != nil {
+				return err
+			}
+		}
+
+		if masq {
+			// enable forwarding and SNATing for traffic rerouted from kube-proxy
+			err := enableForwarding(containerIPV4, containerIPV6)
+			if err != nil {
+				return err
+			}
+
+			err = setupSNAT(k8sIfName, "kube-proxy SNAT", containerIPV4, containerIPV6)
+			if err != nil {
+				return fmt.Errorf("failed to enable SNAT on %q: %v", k8sIfName, err)
+			}
+		}
+
+		// add host routes for each dst hostInterface ip on dev
+		// contVeth, covering the addresses alone unless gwRoutes says
+		// otherwise
+		if gwRoutes == nil {
+			gwRoutes = gatewayRoutes(hostAddrs, false, 0, 0)
+		}
+		for _, dst := range gwRoutes {
+			err := addRoute(h, &netlink.Route{
+				LinkIndex: contVeth.Index,
+				Scope:     netlink.SCOPE_LINK,
+				Dst:       dst,
+			})
+
+			// another interface of a Pod sharing this namespace may
+			// already provide the route
+			if err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to add host route dst %v: %v", dst, err)
+			}
+		}
+
+		// add a default gateway of each Pod family pointed at the first
+		// hostAddr of the family
+		for _, gw := range podGateways(hostAddrs, containerIPV4, containerIPV6) {
+			var src net.IP
+			if preferredSrc && gw.To4() != nil {
+				src = podGateway(pr.IPs, gw)
+			}
+			err = addRoute(h, &netlink.Route{
+				LinkIndex: contVeth.Index,
+				Scope:     netlink.SCOPE_UNIVERSE,
+				Dst:       nil,
+				Gw:        gw,
+				Src:       src,
+				Priority:  routeMetric,
+			})
+			if err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to add default route %v: %v", gw, err)
+			}
+		}
+
+		// add the additional routes, skipping those whose gateway is
+		// not reachable through an on-link route
+		var linkRoutes []netlink.Route
+		if len(extraRoutes) > 0 {
+			linkRoutes, err = h.RouteList(containerNetlinkIface, netlink.FAMILY_ALL)
+			if err != nil {
+				return fmt.Errorf("failed to list routes of %q: %v", ifName, err)
+			}
+		}
+		for _, route := range extraRoutes {
+			dst := route.Dst
+			r := &netlink.Route{
+				LinkIndex: contVeth.Index,
+				Scope:     netlink.SCOPE_LINK,
+				Dst:       &dst,
+				Priority:  routeMetric,
+			}
+			if route.GW != nil {
+				if !onLinkGateway(route.GW, linkRoutes) {
+					fmt.Fprintf(os.Stderr, "skipping additional route %v: gateway %v is not on-link\n", route.String(), route.GW)
+					continue
+				}
+				r.Scope = netlink.SCOPE_UNIVERSE
+				r.Gw = route.GW
+			}
+			if err := addRoute(h, r); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to add additional route %v: %v", route.String(), err)
+			}
+		}
+
+		// Send a gratuitous arp for all borrowed v4 addresses, and an
+		// unsolicited neighbor advertisement for v6 ones
+		for _, ipc := range pr.IPs {
+			announce.send(ipc.Address.IP, *contVeth)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return hostInterface, containerInterface, nil
+}
+
+func setupHostVeth(vethName string, hostAddrs []netlink.Addr, masq bool, alloc TableAlloc, routeMetric int, gateways []net.IP, rulePriority int, announce Announce, result *current.Result) (int, error) {
+	// no IPs to route
+	if len(result.IPs) == 0 {
+		return -1, nil
+	}
+
+	// lookup by name as interface ids might have changed
+	veth, err := net.InterfaceByName(vethName)
+	if err != nil {
+		return -1, fmt.Errorf("failed to lookup %q: %v", vethName, err)
+	}
+
+	h, err := newHandle()
+	if err != nil {
+		return -1, err
+	}
+	defer h.Delete()
+
+	// add destination routes to Pod IPs
+	for _, ipc := range result.IPs {
+		addrBits := 128
+		if ipc.Address.IP.To4() != nil {
+			addrBits = 32
+		}
+
+		err := addRoute(h, &netlink.Route{
+			LinkIndex: veth.Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst: &net.IPNet{
+				IP:   ipc.Address.IP,
+				Mask: net.CIDRMask(addrBits, addrBits),
+			},
+		})
+
+		if err != nil {
+			return -1, fmt.Errorf("failed to add host route dst %v: %v", ipc.Address.IP, err)
+		}
+	}
+
+	// add policy rules for traffic coming in from Pods and destined for the VPC
+	table, err := addPolicyRules(h, veth, result.IPs, result.Routes, alloc, routeMetric, gateways, rulePriority)
+	if e, ok := err.(*types.Error); ok {
+		// keep the error code for the runtime
+		e.Msg = fmt.Sprintf("failed to add policy rules: %v", e.Msg)
+		return -1, e
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to add policy rules: %v", err)
+	}
+
+	// Send a gratuitous arp for all borrowed v4 addresses, and an
+	// unsolicited neighbor advertisement for v6 ones
+	for _, ipc := range hostAddrs {
+		announce.send(ipc.IP, *veth)
+	}
+
+	return table, nil
+}
+
+// localPodRule routes the traffic to a local Pod IP through the main
+// table, ahead of the per-Pod tables which send it back out of the
+// source Pod and its ENI
+func localPodRule(ip net.IP, priority int) *netlink.Rule {
+	rule := netlink.NewRule()
+	bits := 128
+	rule.Family = netlink.FAMILY_V6
+	if ip.To4() != nil {
+		bits = 32
+		rule.Family = netlink.FAMILY_V4
+	}
+	rule.Dst = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	rule.Table = syscall.RT_TABLE_MAIN
+	rule.Priority = priority
+	return rule
+}
+
+// addLocalPod keeps the traffic from other local Pods to the Pod IPs
+// ips on the host: a policy rule at priority, ahead of the per-Pod
+// tables, looks each IP up in the main table, where its /32 (or /128)
+// route leads to the host veth vethName. The rules added are removed
+// again on failure.
+func addLocalPod(vethName string, ips []net.IP, priority int) (err error) {
+	link, err := netlink.LinkByName(vethName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", vethName, err)
+	}
+	h, err := newHandle()
+	if err != nil {
+		return err
+	}
+	defer h.Delete()
+
+	var added []*netlink.Rule
+	defer func() {
+		if err != nil {
+			for _, rule := range added {
+				logRule("rule delete", rule, h.RuleDel(rule))
+			}
+		}
+	}()
+
+	for _, ip := range ips {
+		route := localPodRoute(link, ip)
+		if err := h.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add local Pod route to %v: %v", ip, err)
+		}
+
+		rule := localPodRule(ip, priority)
+		exists, err := podRuleExists(h, rule)
+		if err != nil {
+			return fmt.Errorf("failed to check the local Pod rule for %v: %v", ip, err)
+		}
+		if exists {
+			continue
+		}
+		err = ruleAdd(h, rule)
+		logRule("rule add", rule, err)
+		if err != nil {
+			return fmt.Errorf("failed to add local Pod rule for %v: %v", ip, err)
+		}
+		added = append(added, rule)
+	}
+	return nil
+}
+
+// removeLocalPod removes the local Pod rules of the Pod IPs ips. Their
+// routes go with the host veth.
+func removeLocalPod(ips []net.IP, priority int) {
+	for _, ip := range ips {
+		rule := localPodRule(ip, priority)
+		logRule("rule delete", rule, netlink.RuleDel(rule))
+	}
+}
+
+// localPodRoute is the main table route to the local Pod IP dst over
+// its host veth link
+func localPodRoute(link netlink.Link, dst net.IP) *netlink.Route {
+	bits := 128
+	if dst.To4() != nil {
+		bits = 32
+	}
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       &net.IPNet{IP: dst, Mask: net.CIDRMask(bits, bits)},
+	}
+}
+
+// ipamResult runs the IPAM plugin of conf when the plugin is not
+// chained, attributing the IPs it returns to the container veth
+func ipamResult(conf *PluginConf, args *skel.CmdArgs) (*current.Result, error) {
+	stdin, err := lib.DelegateConf(args.StdinData)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ipam.ExecAdd(conf.IPAM.Type, stdin)
+	if err != nil {
+		return nil, err
+	}
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert IPAM result to current version: %v", err)
+	}
+	if len(result.IPs) == 0 {
+		return nil, fmt.Errorf("IPAM plugin returned missing IP config")
+	}
+
+	// the IPs belong to the container veth, which the veth setup adds
+	// to the interfaces after the host veth
+	result.Interfaces = nil
+	for _, ipc := range result.IPs {
+		ipc.Interface = current.Int(1)
+	}
+	return result, nil
+}
+
+// podAddrs returns the IPs of result as host addresses of the Pod
+// interface ifName, without the gateways and routes of the IPAM plugin
+func podAddrs(result *current.Result, ifName string) *current.Result {
+	addrs := &current.Result{Interfaces: []*current.Interface{{Name: ifName}}}
+	for _, ipc := range result.IPs {
+		addrBits := 128
+		if ipc.Address.IP.To4() != nil {
+			addrBits = 32
+		}
+		addrs.IPs = append(addrs.IPs, &current.IPConfig{
+			Version:   ipc.Version,
+			Interface: current.Int(0),
+			Address:   net.IPNet{IP: ipc.Address.IP, Mask: net.CIDRMask(addrBits, addrBits)},
+		})
+	}
+	return addrs
+}
+
+// cmdAdd is called for ADD requests
+func cmdAdd(args *skel.CmdArgs) (err error) {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return lib.InvalidConfig(err)
+	}
+	openLogger(conf, args, "ADD")
+	defer logger.Close()
+	openMetrics(conf, "ADD")
+	defer flushMetrics()
+	routeProtocol = conf.RouteProtocol
+	iptablesPath = conf.IptablesPath
+	// the stale link cleanup would otherwise remove the Pod interface
+	if !conf.Unchained && conf.containerVethName(args.IfName) == args.IfName {
+		return lib.InvalidConfig(fmt.Errorf("container veth name %q is the Pod interface name", args.IfName))
+	}
+
+	if conf.PrevResult == nil {
+		if conf.IPAM.Type == "" {
+			return fmt.Errorf("must be called as chained plugin")
+		}
+		conf.PrevResult, err = ipamResult(conf, args)
+		if err != nil {
+			return err
+		}
+		// the runtime may not call DEL after a failed ADD either. The
+		// IPAM plugin is run with the CNI_COMMAND of this process.
+		defer func() {
+			if err != nil {
+				os.Setenv("CNI_COMMAND", "DEL")
+				stdin, err := lib.DelegateConf(args.StdinData)
+				if err == nil {
+					err = ipam.ExecDel(conf.IPAM.Type, stdin)
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "failed to release the IPAM addresses of the failed ADD: %v\n", err)
+				}
+				os.Setenv("CNI_COMMAND", "ADD")
+			}
+		}()
+	}
+	// the dns block of the config is stamped on the result
+	mergeDNS(&conf.PrevResult.DNS, conf.DNS)
+
+	containerIPs := resultContainerIPs(conf, args.IfName)
+	if len(containerIPs) == 0 {
+		return fmt.Errorf("got no container IPs")
+	}
+
+	hostIfName := conf.hostInterfaceFor(containerIPs, args.Netns, args.IfName)
+
+	iface, err := netlink.LinkByName(hostIfName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostIfName, err)
+	}
+
+	hostAddrs, err := podGatewayAddrs(iface, conf.HostInterface)
 	if err != nil || len(hostAddrs) == 0 {
 		return fmt.Errorf("failed to get host IP addresses for %q: %v", iface, err)
 	}
 
-	netns, err := ns.GetNS(args.Netns)
+	// a Pod MTU requested by the runtime overrides conf.MTU for this
+	// call only
+	podMTU, err := runtimeMTU(conf, args.Args)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+		return err
+	}
+	if podMTU > iface.Attrs().MTU {
+		return fmt.Errorf("requested mtu %d exceeds the MTU %d of %q", podMTU, iface.Attrs().MTU, hostIfName)
 	}
-	defer netns.Close()
 
 	containerIPV4 := false
 	containerIPV6 := false
@@ -490,117 +2527,638 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 	}
 
-	hostInterface, _, err := setupContainerVeth(netns, conf.ContainerInterface, conf.MTU,
-		hostAddrs, conf.IPMasq, containerIPV4, containerIPV6, args.IfName, conf.PrevResult)
+	// Resolve everything that can fail before touching any namespace so
+	// that a failure leaves nothing to roll back
+	hostAddrs = usableHostAddrs(hostAddrs)
+	if len(hostAddrs) == 0 {
+		return fmt.Errorf("no global scope host IP addresses on %q to use as a gateway", hostIfName)
+	}
+	// the first hostAddr of each Pod family becomes a Pod default gateway
+	sortHostAddrs(hostAddrs, containerIPV4)
+	gateways := podGateways(hostAddrs, containerIPV4, containerIPV6)
+	if len(gateways) == 0 {
+		return fmt.Errorf("no host IP addresses of the Pod address families on %q to use as a gateway", hostIfName)
+	}
+	if containerIPV4 && containerIPV6 && len(gateways) == 1 {
+		fmt.Fprintf(os.Stderr, "%q only has addresses of one Pod family, the Pod gets a single default route via %v\n", hostIfName, gateways[0])
+	}
+	// an IPv6-only Pod gets no IPv4 host routes or announcements
+	hostAddrs = podFamilyAddrs(hostAddrs, containerIPV4, containerIPV6)
+
+	steering, egressPath, err := podEgress(conf, args.Args)
+	if err != nil {
+		return err
+	}
+	if egressPath != nil {
+		link, err := netlink.LinkByName(egressPath.Interface)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q of egress path %q: %v", egressPath.Interface, egressPath.Name, err)
+		}
+		if err := checkEgressPath(egressPath, link, containerIPs, podMAC(args.Netns, args.IfName)); err != nil {
+			return err
+		}
+	}
+
+	if conf.ValidatePodSubnet {
+		if outside := ipsOutsideSubnets(containerIPs, hostAddrs); len(outside) > 0 {
+			var subnets []string
+			for _, addr := range hostAddrs {
+				subnets = append(subnets, addr.IPNet.String())
+			}
+			return fmt.Errorf("Pod IPs %v are not in any subnet of %q (%v)", outside, hostIfName, strings.Join(subnets, ", "))
+		}
+	}
+
+	// the kube-proxy SNAT of the Pod namespace uses ip6tables for IPv6
+	if err = checkIptables(true, (conf.IPMasq || conf.ClampMSS) && containerIPV6); err != nil {
+		return err
+	}
+
+	netns, err := lib.GetNSWithRetry(args.Netns, conf.NetnsOpenRetries,
+		time.Duration(conf.NetnsOpenBackoff)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	mtu := conf.MTU
+	if conf.EnforceMTU {
+		mtu = iface.Attrs().MTU
+	}
+	if podMTU > 0 {
+		mtu = podMTU
+	}
+	if mtu == 0 {
+		mtu = conf.PrevResultMTUs[args.IfName]
+	}
+	if mtu == 0 {
+		// follow the MTU of the Pod interface, which may be lower than
+		// the MTU of the ENI
+		_ = netns.Do(func(_ ns.NetNS) error {
+			if link, err := netlink.LinkByName(args.IfName); err == nil {
+				mtu = link.Attrs().MTU
+			}
+			return nil
+		})
+	}
+
+	alloc := conf.tableAlloc()
+	if conf.SharedTablePerENI {
+		if alloc.ENI, err = eniTable(iface, conf.PrevResult.IPs); err != nil {
+			return err
+		}
+	}
+
+	if conf.DryRun {
+		h, err := newHandle()
+		if err != nil {
+			return err
+		}
+		defer h.Delete()
+		table := -1
+		if alloc.ENI != nil {
+			routes, err := h.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 0}, netlink.RT_FILTER_TABLE)
+			if err != nil {
+				return err
+			}
+			table = findENITable(routes, *alloc.ENI, alloc.Start)
+		}
+		if table == -1 {
+			if table, _, err = findFreeTable(h, alloc.slot(containerIPs[0], 0), alloc); err != nil {
+				return err
+			}
+		}
+		ops := planAdd(conf, args, hostIfName, hostAddrs, containerIPs, mtu, table)
+		var nodePortIfNames []string
+		if conf.EnableNodePort {
+			nodePortIfNames = conf.nodePortInterfaces(hostIfName)
+		}
+		for _, ifName := range nodePortIfNames {
+			nodePortOps, err := nl.PlanNodePortRule(ifName, conf.NodePorts, conf.NodePortMark, conf.NodePortMarkMask, conf.MainTableRulePriority, conf.NodePortSCTP, conf.HostVethPrefix)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, nodePortOps...)
+		}
+		for _, op := range ops {
+			fmt.Fprintf(os.Stderr, "dry-run: %s\n", op)
+			logger.Log("dry-run", lib.LogFields{"op": op})
+		}
+		return lib.PrintResult(conf.PrevResult, conf.CNIVersion, conf.PrevResultMTUs)
+	}
+
+	// the runtime may not call DEL after a failed ADD, and the datapath
+	// of a half-finished one is torn down by the same code as DEL
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "removing the datapath of the failed ADD: %v\n", err)
+			logger.Log("rollback", lib.LogFields{"error": err.Error()})
+			teardownPod(conf, args)
+		}
+	}()
+
+	span := tracer.StartSpan("veth-setup")
+	start := time.Now()
+	hostInterface, _, err := setupContainerVeth(netns, conf.containerVethName(args.IfName), mtu, conf.containerRouteMetric(), conf.PreferredSrc,
+		hostAddrs, conf.gatewayRoutes(hostAddrs), conf.IPMasq, containerIPV4, containerIPV6, args.IfName, hostVethName(conf.HostVethPrefix, args.ContainerID, args.IfName), conf.announce(), conf.AdditionalContainerRoutes, conf.PrevResult)
+	span.Finish(err)
+	logPhase("setupContainerVeth", start)
 	if err != nil {
+		metrics.Inc("cni_ptp_veth_setup_failures_total")
 		return err
 	}
 
-	if err = setupHostVeth(hostInterface.Name, hostAddrs, conf.IPMasq, conf.TableStart, conf.PrevResult); err != nil {
+	start = time.Now()
+	table, err := setupHostVeth(hostInterface.Name, hostAddrs, conf.IPMasq, alloc, conf.RouteMetric,
+		conf.tableGateways(), conf.PodRulePriority, conf.announce(), conf.PrevResult)
+	logPhase("setupHostVeth", start)
+	if err != nil {
 		return err
 	}
 
+	if bw := conf.Bandwidth(); bw.Shaped() {
+		if err = setupBandwidth(netns, hostInterface.Name, conf.containerVethName(args.IfName), bw); err != nil {
+			return err
+		}
+	}
+
+	if conf.LocalPodRoutes {
+		if err = addLocalPod(hostInterface.Name, containerIPs, conf.PodRulePriority-1); err != nil {
+			return fmt.Errorf("failed to set up local Pod routes: %v", err)
+		}
+	}
+
 	if conf.IPMasq {
 		err := enableForwarding(containerIPV4, containerIPV6)
 		if err != nil {
 			return err
 		}
 
-		chain := utils.FormatChainName(conf.Name, args.ContainerID)
-		comment := utils.FormatComment(conf.Name, args.ContainerID)
+		chain := utils.FormatChainName(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
+		comment := utils.FormatComment(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
 		for _, ipc := range containerIPs {
+			if !conf.masquerade(ipc) {
+				continue
+			}
 			addrBits := 128
 			if ipc.To4() != nil {
 				addrBits = 32
 			}
 
-			if err = ip.SetupIPMasq(&net.IPNet{IP: ipc, Mask: net.CIDRMask(addrBits, addrBits)}, chain, comment); err != nil {
+			// nl.SetupIPMasq uses ip6tables for IPv6 addresses
+			if err = setupIPMasq(iptablesPath, &net.IPNet{IP: ipc, Mask: net.CIDRMask(addrBits, addrBits)}, chain, comment); err != nil {
 				return err
 			}
 		}
 	}
 
-	if err = setupNodePortRule(conf.HostInterface, conf.NodePorts, conf.NodePortMark); err != nil {
-		return err
+	if conf.ClampMSS {
+		vethMTU := 0
+		if conf.ClampMSSToMTU {
+			link, err := netlink.LinkByName(hostInterface.Name)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", hostInterface.Name, err)
+			}
+			vethMTU = link.Attrs().MTU
+		}
+
+		comment := utils.FormatComment(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
+		for _, ipc := range containerIPs {
+			addrBits := 128
+			if ipc.To4() != nil {
+				addrBits = 32
+			}
+
+			if err = setupMSSClamp(&net.IPNet{IP: ipc, Mask: net.CIDRMask(addrBits, addrBits)}, hostIfName, mssForMTU(ipc, vethMTU), comment); err != nil {
+				return fmt.Errorf("failed to set up MSS clamping: %v", err)
+			}
+		}
+	}
+
+	if egressPath != nil {
+		if err = addEgressPathTable(egressPath); err != nil {
+			return err
+		}
+	}
+	if steering != nil {
+		comment := utils.FormatComment(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
+		for _, ipc := range containerIPs {
+			if ipc.To4() == nil {
+				continue
+			}
+			if err = setupEgressSteering(&net.IPNet{IP: ipc, Mask: net.CIDRMask(32, 32)}, steering, comment); err != nil {
+				return fmt.Errorf("failed to set up egress steering: %v", err)
+			}
+		}
+	}
+
+	if conf.EnableNodePort {
+		start = time.Now()
+		for _, ifName := range conf.nodePortInterfaces(hostIfName) {
+			if err = setupNodePortRule(iptablesPath, ifName, conf.NodePorts, conf.NodePortMark, conf.NodePortMarkMask, conf.MainTableRulePriority, conf.NodePortSCTP, conf.HostVethPrefix); err != nil {
+				return err
+			}
+		}
+		logPhase("nodePortSetup", start)
+	}
+
+	// the CNI result has no room for the table, so it is reported for
+	// debugging with "ip route show table"
+	if table != -1 {
+		fmt.Fprintf(os.Stderr, "Pod %v on %q is routed by table %d\n", containerIPs, hostInterface.Name, table)
 	}
 
 	// Pass through the result for the next plugin
-	return types.PrintResult(conf.PrevResult, conf.CNIVersion)
+	logger.Log("result", lib.LogFields{"result": conf.PrevResult, "table": table, "mtu": mtu})
+	mtus := map[string]int{hostInterface.Name: mtu, conf.containerVethName(args.IfName): mtu}
+	for name, prevMTU := range conf.PrevResultMTUs {
+		mtus[name] = prevMTU
+	}
+	return lib.PrintResult(conf.PrevResult, conf.CNIVersion, mtus)
 }
 
 // cmdDel is called for DELETE requests
 func cmdDel(args *skel.CmdArgs) error {
-	conf, err := parseConfig(args.StdinData)
+	conf, err := loadConfig(args.StdinData)
 	if err != nil {
-		return err
+		return lib.InvalidConfig(err)
+	}
+	openLogger(conf, args, "DEL")
+	defer logger.Close()
+	// DEL is best effort, the host interface only scopes the cleanup of
+	// the MSS clamping rules
+	if err := conf.detectHostInterface(); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+		logger.Log("host interface detection failed", lib.LogFields{"error": err.Error()})
+	}
+	openMetrics(conf, "DEL")
+	defer flushMetrics()
+	routeProtocol = conf.RouteProtocol
+	iptablesPath = conf.IptablesPath
+
+	// On chained invocation, IPAM block is empty
+	if conf.IPAM.Type != "" {
+		stdin, err := lib.DelegateConf(args.StdinData)
+		if err != nil {
+			return err
+		}
+		if err := ipam.ExecDel(conf.IPAM.Type, stdin); err != nil {
+			return err
+		}
 	}
 
 	if args.Netns == "" {
 		return nil
 	}
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	// If the device isn't there then don't try to clean up IP masq either.
+	teardownPod(conf, args)
+	return nil
+}
+
+// teardownPod removes the datapath of the Pod interface of args, as far
+// as it exists. Delete can be called multiple times so no error is
+// returned if the device is already removed, and if the device isn't
+// there IP masq is not cleaned up either.
+func teardownPod(conf *PluginConf, args *skel.CmdArgs) {
 	var ipnets []netlink.Addr
 	vethPeerIndex := -1
+	contVethIndex := -1
+	vethMTU := 0
 	_ = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		var err error
-
-		// lookup pod IPs from the args.IfName device (usually eth0)
-		if conf.IPMasq {
-			iface, err := netlink.LinkByName(args.IfName)
-			if err != nil {
-				if err.Error() == "Link not found" {
-					return ip.ErrLinkNotFound
-				}
-				return fmt.Errorf("failed to lookup %q: %v", args.IfName, err)
-			}
-
-			ipnets, err = netlink.AddrList(iface, netlink.FAMILY_ALL)
-			if err != nil || len(ipnets) == 0 {
-				return fmt.Errorf("failed to get IP addresses for %q: %v", args.IfName, err)
-			}
+		// lookup pod IPs from the args.IfName device (usually eth0). A
+		// half-finished ADD may have left it missing or without
+		// addresses, which only leaves nothing container-side to clean.
+		if iface, err := netlink.LinkByName(args.IfName); err == nil {
+			ipnets, _ = netlink.AddrList(iface, netlink.FAMILY_ALL)
 		}
 
-		vethIface, err := netlink.LinkByName(conf.ContainerInterface)
-		if err != nil && err != ip.ErrLinkNotFound {
+		vethIface, err := netlink.LinkByName(conf.containerVethName(args.IfName))
+		if err != nil {
 			return err
 		}
-		vethPeerIndex, _ = netlink.VethPeerIndex(&netlink.Veth{LinkAttrs: *vethIface.Attrs()})
+		contVethIndex = vethIface.Attrs().Index
+		if vethPeerIndex, err = netlink.VethPeerIndex(&netlink.Veth{LinkAttrs: *vethIface.Attrs()}); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to resolve the host peer of %q: %v\n", vethIface.Attrs().Name, err)
+			vethPeerIndex = -1
+		}
+		if conf.ClampMSSToMTU {
+			vethMTU = vethIface.Attrs().MTU
+		}
+		if conf.Bandwidth().EgressRate > 0 {
+			removeTbf(vethIface)
+		}
 		return nil
 	})
 
+	if conf.ClampMSS {
+		var podIPs []net.IP
+		for _, ipn := range ipnets {
+			podIPs = append(podIPs, ipn.IP)
+		}
+		hostIfName := conf.hostInterfaceFor(podIPs, args.Netns, args.IfName)
+
+		comment := utils.FormatComment(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
+		for _, ipn := range ipnets {
+			addrBits := 128
+			if ipn.IP.To4() != nil {
+				addrBits = 32
+			}
+
+			_ = teardownMSSClamp(&net.IPNet{IP: ipn.IP, Mask: net.CIDRMask(addrBits, addrBits)}, hostIfName, mssForMTU(ipn.IP, vethMTU), comment)
+		}
+	}
+
+	if steering, egressPath, _ := podEgress(conf, args.Args); steering != nil {
+		comment := utils.FormatComment(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
+		for _, ipn := range ipnets {
+			if ipn.IP.To4() == nil {
+				continue
+			}
+			_ = teardownEgressSteering(&net.IPNet{IP: ipn.IP, Mask: net.CIDRMask(32, 32)}, steering, comment)
+		}
+		if egressPath != nil {
+			_ = removeEgressPathTable(egressPath)
+		}
+	}
+
 	if conf.IPMasq {
-		chain := utils.FormatChainName(conf.Name, args.ContainerID)
-		comment := utils.FormatComment(conf.Name, args.ContainerID)
+		chain := utils.FormatChainName(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
+		comment := utils.FormatComment(ruleName(conf), ipMasqID(args.ContainerID, args.IfName))
 		for _, ipn := range ipnets {
 			addrBits := 128
 			if ipn.IP.To4() != nil {
 				addrBits = 32
 			}
 
-			_ = ip.TeardownIPMasq(&net.IPNet{IP: ipn.IP, Mask: net.CIDRMask(addrBits, addrBits)}, chain, comment)
+			_ = nl.TeardownIPMasq(iptablesPath, &net.IPNet{IP: ipn.IP, Mask: net.CIDRMask(addrBits, addrBits)}, chain, comment)
 		}
+	}
 
-		if vethPeerIndex != -1 {
-			link, err := netlink.LinkByIndex(vethPeerIndex)
-			if err != nil {
-				return nil
+	// only remove the veth of args.IfName, the namespace may be shared
+	// with other interfaces of the Pod
+	var link netlink.Link
+	if vethPeerIndex != -1 {
+		link = hostVethPeer(vethPeerIndex, contVethIndex)
+	}
+	vethName := hostVethName(conf.HostVethPrefix, args.ContainerID, args.IfName)
+	if link == nil {
+		// the container side is gone, or the peer could not be
+		// resolved: fall back to the name ADD gave the host veth
+		link = namedHostVeth(vethName)
+	}
+
+	// find the tables of the Pod by its routes rather than its policy
+	// rules, which a failed ADD may not have added
+	var podIPs []net.IP
+	for _, ipn := range ipnets {
+		podIPs = append(podIPs, ipn.IP)
+	}
+	if conf.PrevResult != nil {
+		podIPs = append(podIPs, resultContainerIPs(conf, args.IfName)...)
+	}
+	vethIndex := -1
+	if link != nil {
+		vethIndex = link.Attrs().Index
+	}
+	removePodTableRoutes(vethIndex, podIPs, conf.TableStart)
+	if conf.LocalPodRoutes {
+		removeLocalPod(podIPs, conf.PodRulePriority-1)
+	}
+
+	if link != nil {
+		vethName = link.Attrs().Name
+	}
+	// the rules match the veth by name, so they can be removed even
+	// when the veth is gone. Ignore errors as we might be called
+	// multiple times.
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.IifName = vethName
+		err := netlink.RuleDel(rule)
+		logRule("rule delete", rule, err)
+		// a shared table is pointed to by a rule per Pod IP
+		for err == nil && conf.SharedTablePerENI {
+			err = netlink.RuleDel(rule)
+		}
+	}
+	if conf.SharedTablePerENI {
+		if err := releaseENITables(conf.TableStart, conf.TableLockPath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to release the shared route tables: %v\n", err)
+		}
+	}
+	if link != nil {
+		if conf.Bandwidth().IngressRate > 0 {
+			removeTbf(link)
+		}
+		_ = netlink.LinkDel(link)
+	}
+}
+
+// namedHostVeth returns the host veth named name, nil when there is
+// none or the link is not a veth
+func namedHostVeth(name string) netlink.Link {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil
+	}
+	if link.Type() != "veth" {
+		fmt.Fprintf(os.Stderr, "host link %q is not a veth, not removing it\n", name)
+		return nil
+	}
+	return link
+}
+
+// hostVethPeer returns the host link at index when it is a veth whose
+// peer is the container veth at peerIndex, so DEL never removes an
+// unrelated link, nil otherwise
+func hostVethPeer(index int, peerIndex int) netlink.Link {
+	link, err := netlink.LinkByIndex(index)
+	if err != nil {
+		return nil
+	}
+	if link.Type() != "veth" {
+		fmt.Fprintf(os.Stderr, "host link %q at index %d is not a veth, not removing it\n", link.Attrs().Name, index)
+		return nil
+	}
+	if index, err := netlink.VethPeerIndex(&netlink.Veth{LinkAttrs: *link.Attrs()}); err != nil || index != peerIndex {
+		fmt.Fprintf(os.Stderr, "host veth %q is not the peer of the container veth, not removing it\n", link.Attrs().Name)
+		return nil
+	}
+	return link
+}
+
+// cmdCheck is called for CHECK requests. It verifies that the datapath
+// set up by ADD is still in place.
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return lib.InvalidConfig(err)
+	}
+	iptablesPath = conf.IptablesPath
+
+	if conf.PrevResult == nil {
+		return fmt.Errorf("must be called as chained plugin")
+	}
+
+	netns, err := lib.GetNSWithRetry(args.Netns, conf.NetnsOpenRetries,
+		time.Duration(conf.NetnsOpenBackoff)*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+
+	podIPs := resultContainerIPs(conf, args.IfName)
+	checkConf := nl.PodCheckConf{
+		IfName:          args.IfName,
+		VethName:        conf.containerVethName(args.IfName),
+		PodIPs:          podIPs,
+		PodRulePriority: conf.PodRulePriority,
+	}
+	// the NodePort rule is legitimately absent when it is disabled
+	if conf.EnableNodePort {
+		checkConf.NodePortMark = conf.NodePortMark
+		checkConf.NodePortMarkMask = conf.NodePortMarkMask
+		checkConf.MainTableRulePriority = conf.MainTableRulePriority
+	}
+	if conf.EnforceMTU || conf.SharedTablePerENI {
+		hostIfName := conf.hostInterfaceFor(podIPs, args.Netns, args.IfName)
+		iface, err := netlink.LinkByName(hostIfName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", hostIfName, err)
+		}
+		if conf.SharedTablePerENI {
+			checkConf.TableLinkIndex = iface.Attrs().Index
+		}
+		if conf.EnforceMTU {
+			checkConf.MTU = iface.Attrs().MTU
+			if podMTU, err := runtimeMTU(conf, args.Args); err == nil && podMTU > 0 {
+				checkConf.MTU = podMTU
 			}
+		}
+	}
+
+	// checks depending on a failed one fail as well, so the first
+	// failure is the cause
+	for _, check := range nl.CheckPod(netns, checkConf) {
+		if check.Err != nil {
+			return check.Err
+		}
+	}
+	return nil
+}
+
+// cmdStatus is called for STATUS requests. The plugin is available when
+// its host interfaces exist and, when it runs the IPAM plugin of this
+// repository itself, that plugin can hand out an IP. Chained after the
+// IPAM plugin, the IPAM plugin reports its capacity to the runtime.
+func cmdStatus(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	for _, ifName := range conf.nodePortInterfaces(conf.HostInterface) {
+		if _, err := netlink.LinkByName(ifName); err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+	}
+
+	if conf.IPAM.Type != netconf.IPAMPluginType {
+		return nil
+	}
+	// the IPAM plugin is passed the configuration of this plugin
+	ipamConf, err := netconf.LoadIPAMConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	return checkIPCapacity(ipamConf.IfaceIndex)
+}
+
+// checkIPCapacity is the capacity check of the IPAM plugin, replaced in
+// tests
+var checkIPCapacity = aws.CheckIPCapacity
+
+// cmdGC is called for GC requests
+func cmdGC(args *skel.CmdArgs) error {
+	conf, err := parseConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
 
-			rule := netlink.NewRule()
-			rule.IifName = link.Attrs().Name
-			// ignore errors as we might be called multiple times
-			_ = netlink.RuleDel(rule)
-			_ = netlink.LinkDel(link)
+	routeProtocol = conf.RouteProtocol
+	iptablesPath = conf.IptablesPath
+
+	attachments, err := lib.ValidAttachments(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err := gcPolicyRules(conf.PodRulePriority); err != nil {
+		return err
+	}
+	if conf.SharedTablePerENI {
+		if err := releaseENITables(conf.TableStart, conf.TableLockPath); err != nil {
+			return err
+		}
+	}
+
+	if conf.IPMasq {
+		return gcIPMasq(ruleName(conf), attachments)
+	}
+	return nil
+}
+
+// gcPolicyRules removes Pod policy rules (and their route tables) whose
+// host veth no longer exists
+func gcPolicyRules(priority int) error {
+	rules, err := nl.StalePodRules(priority, routeProtocol)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		fmt.Fprintf(os.Stderr, "removing stale policy rule for %q and table %d\n", rule.IifName, rule.Table)
+		if err := nl.RemovePodRule(rule); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// gcIPMasq tears down the IP masquerade chains of this network which
+// belong to containers that are not valid attachments
+func gcIPMasq(name string, attachments []lib.GCAttachment) error {
+	valid := make(map[string]bool)
+	for _, attachment := range attachments {
+		valid[ipMasqID(attachment.ContainerID, attachment.IfName)] = true
+	}
 
+	rules, err := nl.ListIPMasqRules(iptablesPath, name)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if valid[rule.ID] {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "removing stale IP masquerade chain %v for container %v\n", rule.Chain, rule.ID)
+		chain := utils.FormatChainName(name, rule.ID)
+		if err := nl.TeardownIPMasq(iptablesPath, rule.Source, chain, utils.FormatComment(name, rule.ID)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func main() {
-	rand.Seed(time.Now().UnixNano())
-	skel.PluginMain(cmdAdd, cmdDel, version.All)
+	tableRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	traceStderr = os.Getenv(traceEnv) == "1"
+	lib.PluginMain(lib.PluginFuncs{
+		Add:    lib.TraceVerb("cmdAdd", setTracer, cmdAdd),
+		Del:    lib.TraceVerb("cmdDel", setTracer, cmdDel),
+		Check:  cmdCheck,
+		Status: cmdStatus,
+		GC:     cmdGC,
+	}, lib.AllVersions)
 }
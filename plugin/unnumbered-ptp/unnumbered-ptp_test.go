@@ -0,0 +1,3377 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/vishvananda/netlink"
+
+	"github.com/lyft/cni-ipvlan-vpc-k8s/aws"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/lib"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/netconf"
+	"github.com/lyft/cni-ipvlan-vpc-k8s/nl"
+)
+
+func createTestNS(t *testing.T) ns.NetNS {
+	netns, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create netns: %v", err)
+	}
+	return netns
+}
+
+// pkgHandle opens a socket per request in the current namespace, like
+// the package level netlink functions
+var pkgHandle = &netlink.Handle{}
+
+// TestMain seeds the route table jitter, so collisions replay the same
+// way on every run
+func TestMain(m *testing.M) {
+	tableRand = rand.New(rand.NewSource(1))
+	os.Exit(m.Run())
+}
+
+// testTableAlloc allocates route tables from 256 with the default
+// options and at most maxTables tables
+func testTableAlloc(maxTables int) TableAlloc {
+	return TableAlloc{
+		Start:       256,
+		End:         defaultTableEnd,
+		Max:         maxTables,
+		Mode:        tableAllocRandom,
+		Range:       defaultTableRange,
+		Retries:     tableAllocRetries,
+		BaseSleepMs: baseSleep,
+		MaxSleepMs:  maxSleep,
+		Rand:        rand.New(rand.NewSource(1)),
+	}
+}
+
+func TestSetupContainerVethRemovesStaleLink(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	// leave a stale interface behind as a crashed DEL would
+	err := contNS.Do(func(_ ns.NetNS) error {
+		return netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}})
+	})
+	if err != nil {
+		t.Fatalf("Failed to create stale link: %v", err)
+	}
+
+	hostAddrs := []netlink.Addr{{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(32, 32)}}}
+	err = hostNS.Do(func(_ ns.NetNS) error {
+		_, _, err := setupContainerVeth(contNS, "veth0", 1500, 0, false, hostAddrs, nil, false, true, false, "eth0", hostVethName(nl.DefaultHostVethPrefix, "test", "eth0"), Announce{}, nil, &current.Result{})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up veth over a stale link: %v", err)
+	}
+
+	err = contNS.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName("veth0")
+		if err != nil {
+			return err
+		}
+		if link.Type() != "veth" {
+			t.Errorf("Stale link was not replaced, got type %v", link.Type())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to lookup veth0: %v", err)
+	}
+}
+
+func TestSetupContainerVethHostVethPrefix(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	hostAddrs := []netlink.Addr{{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(32, 32)}}}
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		hostVeth, _, err := setupContainerVeth(contNS, "veth0", 1500, 0, false, hostAddrs, nil, false, true, false, "eth0", hostVethName("lyft", "test", "eth0"), Announce{}, nil, &current.Result{})
+		if err != nil {
+			return err
+		}
+		// the NodePort restore rule matches "-i lyft+", a prefix match
+		if !strings.HasPrefix(hostVeth.Name, "lyft") {
+			t.Errorf("Host veth %q is not matched by the restore rule of prefix lyft", hostVeth.Name)
+		}
+		link, err := netlink.LinkByName(hostVeth.Name)
+		if err != nil {
+			return err
+		}
+		if link.Type() != "veth" || link.Attrs().Flags&net.FlagUp == 0 {
+			t.Errorf("Renamed host veth %q is not an up veth", hostVeth.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up veth with a host veth prefix: %v", err)
+	}
+}
+
+func TestMSSClamp(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	for _, ipn := range []*net.IPNet{
+		{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(32, 32)},
+		{IP: net.ParseIP("2001:db8::10"), Mask: net.CIDRMask(128, 128)},
+	} {
+		err := testNS.Do(func(_ ns.NetNS) error {
+			ipt, err := iptablesForIP(ipn.IP)
+			if err != nil {
+				return err
+			}
+			rulespec := mssClampRulespec(ipn, "eth0", 0, "lyft-test")
+
+			if err := setupMSSClamp(ipn, "eth0", 0, "lyft-test"); err != nil {
+				return err
+			}
+			if exists, err := ipt.Exists("mangle", "FORWARD", rulespec...); !exists || err != nil {
+				t.Errorf("MSS clamp rule for %v was not created: %v", ipn, err)
+			}
+
+			if err := teardownMSSClamp(ipn, "eth0", 0, "lyft-test"); err != nil {
+				return err
+			}
+			if exists, err := ipt.Exists("mangle", "FORWARD", rulespec...); exists || err != nil {
+				t.Errorf("MSS clamp rule for %v was not removed: %v", ipn, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to clamp MSS for %v: %v", ipn, err)
+		}
+	}
+}
+
+func TestSelectHostInterface(t *testing.T) {
+	excludes, err := netconf.CompileExcludes([]string{"tun0", "docker.*"})
+	if err != nil {
+		t.Fatalf("Failed to compile excludes: %v", err)
+	}
+
+	cases := []struct {
+		Candidates []string
+		Expected   string
+		Error      bool
+	}{
+		{Candidates: []string{"eth0", "eth1"}, Expected: "eth0"},
+		{Candidates: []string{"tun0", "eth1"}, Expected: "eth1"},
+		{Candidates: []string{"docker0", "tun0", "ens5"}, Expected: "ens5"},
+		// names are matched in full, not as a prefix
+		{Candidates: []string{"tun01"}, Expected: "tun01"},
+		{Candidates: []string{"tun0", "docker0"}, Error: true},
+		{Candidates: []string{}, Error: true},
+	}
+
+	for i, c := range cases {
+		res, err := selectHostInterface(c.Candidates, excludes)
+		if c.Error {
+			if err == nil {
+				t.Errorf("%d expected an error, got %v", i, res)
+			}
+			continue
+		}
+		if err != nil || res != c.Expected {
+			t.Errorf("%d expected %v, got %v (%v)", i, c.Expected, res, err)
+		}
+	}
+}
+
+func TestCompileExcludesInvalid(t *testing.T) {
+	if _, err := netconf.CompileExcludes([]string{"eth("}); err == nil {
+		t.Errorf("Invalid pattern was accepted")
+	}
+}
+
+func TestCmdDelWithoutHostInterface(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	// a namespace without a default route to detect the host interface by
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	stdin := []byte(`{"name": "test", "type": "cni-ipvlan-vpc-k8s-unnumbered-ptp", "containerInterface": "veth0"}`)
+	_ = testNS.Do(func(_ ns.NetNS) error {
+		if _, err := parseConfig(stdin); err == nil {
+			t.Errorf("Undetectable host interface was accepted")
+		}
+		if err := cmdDel(&skel.CmdArgs{ContainerID: "dummy", IfName: "eth0", StdinData: stdin}); err != nil {
+			t.Errorf("DEL failed without a host interface: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestGCPolicyRules(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-live"}}); err != nil {
+			return err
+		}
+		for _, iif := range []string{"lyft-live", "lyft-gone"} {
+			rule := netlink.NewRule()
+			rule.IifName = iif
+			rule.Table = 300
+			rule.Priority = podRulePriority
+			if err := netlink.RuleAdd(rule); err != nil {
+				return err
+			}
+		}
+
+		if err := gcPolicyRules(podRulePriority); err != nil {
+			return err
+		}
+
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		found := map[string]bool{}
+		for _, rule := range rules {
+			found[rule.IifName] = true
+		}
+		if !found["lyft-live"] {
+			t.Errorf("Rule for an existing veth was removed")
+		}
+		if found["lyft-gone"] {
+			t.Errorf("Rule for a missing veth was not removed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to garbage collect rules: %v", err)
+	}
+}
+
+func TestUsableHostAddrs(t *testing.T) {
+	addrs := []netlink.Addr{
+		{IPNet: &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}, Scope: int(netlink.SCOPE_LINK)},
+		{IPNet: &net.IPNet{IP: net.ParseIP("169.254.0.1"), Mask: net.CIDRMask(16, 32)}},
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}},
+	}
+
+	usable := usableHostAddrs(addrs)
+	if len(usable) != 1 || !usable[0].IP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Unexpected usable addresses %v", usable)
+	}
+}
+
+func TestCmdAddNoGatewayCreatesNoVeth(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	// a host interface with only a link-local address can't act as gateway
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-host"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("lyft-host")
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr("fe80::1/64")
+		return netlink.AddrAdd(link, addr)
+	})
+	if err != nil {
+		t.Fatalf("Failed to create host interface: %v", err)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		Netns:       contNS.Path(),
+		IfName:      "eth0",
+		StdinData: []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "test",
+			"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+			"hostInterface": "lyft-host",
+			"containerInterface": "veth0",
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{"name": "eth0"}],
+				"ips": [{"version": "4", "address": "10.0.0.5/24", "interface": 0}]
+			}
+		}`),
+	}
+	err = hostNS.Do(func(_ ns.NetNS) error {
+		return cmdAdd(args)
+	})
+	if err == nil {
+		t.Fatalf("cmdAdd succeeded without a usable gateway")
+	}
+
+	_ = contNS.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName("veth0"); err == nil {
+			t.Errorf("veth was created even though gateway resolution failed")
+		}
+		return nil
+	})
+}
+
+func TestSetupContainerVethRouteMetric(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	hostAddrs := []netlink.Addr{{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(32, 32)}}}
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		_, _, err := setupContainerVeth(contNS, "veth0", 1500, 300, false, hostAddrs, nil, false, true, false, "eth0", hostVethName(nl.DefaultHostVethPrefix, "test", "eth0"), Announce{}, nil, &current.Result{})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up veth: %v", err)
+	}
+
+	err = contNS.Do(func(_ ns.NetNS) error {
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes {
+			if route.Dst == nil {
+				if route.Priority != 300 {
+					t.Errorf("Default route has metric %d, expected 300", route.Priority)
+				}
+				return nil
+			}
+		}
+		t.Errorf("No default route found in %v", routes)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list routes: %v", err)
+	}
+}
+
+func TestGatewayRoutes(t *testing.T) {
+	addr := func(cidr string) netlink.Addr {
+		a, _ := netlink.ParseAddr(cidr)
+		return *a
+	}
+	// a /31 gateway shares its prefix with the address next to it
+	addrs := []netlink.Addr{addr("10.0.0.1/31"), addr("10.0.0.0/31"), addr("2001:db8::1/64")}
+
+	cases := []struct {
+		FromInterface bool
+		PrefixLenV4   int
+		PrefixLenV6   int
+		Expected      []string
+	}{
+		{Expected: []string{"10.0.0.1/32", "10.0.0.0/32", "2001:db8::1/128"}},
+		{FromInterface: true, Expected: []string{"10.0.0.0/31", "2001:db8::/64"}},
+		{PrefixLenV4: 31, Expected: []string{"10.0.0.0/31", "2001:db8::1/128"}},
+		{FromInterface: true, PrefixLenV6: 127, Expected: []string{"10.0.0.0/31", "2001:db8::/127"}},
+	}
+	for _, c := range cases {
+		routes := gatewayRoutes(addrs, c.FromInterface, c.PrefixLenV4, c.PrefixLenV6)
+		var dsts []string
+		for _, dst := range routes {
+			dsts = append(dsts, dst.String())
+		}
+		if strings.Join(dsts, ",") != strings.Join(c.Expected, ",") {
+			t.Errorf("With %+v expected gateway routes %v, got %v", c, c.Expected, dsts)
+		}
+	}
+
+	if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "gatewayPrefixLenV4": 33}`)); err == nil {
+		t.Errorf("gatewayPrefixLenV4 above 32 was accepted")
+	}
+}
+
+func TestSetupContainerVethGatewayPrefix(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	hostAddrs := []netlink.Addr{{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(31, 32)}}}
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		_, _, err := setupContainerVeth(contNS, "veth0", 1500, 0, false, hostAddrs, gatewayRoutes(hostAddrs, true, 0, 0),
+			false, true, false, "eth0", hostVethName(nl.DefaultHostVethPrefix, "test", "eth0"), Announce{}, nil, &current.Result{})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up veth: %v", err)
+	}
+
+	err = contNS.Do(func(_ ns.NetNS) error {
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		onLink, defaultRoute := false, false
+		for _, route := range routes {
+			if route.Dst == nil {
+				defaultRoute = route.Gw.Equal(net.ParseIP("192.168.1.1"))
+			} else if route.Dst.String() == "192.168.1.0/31" && route.Scope == netlink.SCOPE_LINK {
+				onLink = true
+			} else if route.Dst.String() == "192.168.1.1/32" {
+				t.Errorf("Full-width gateway route %v was added", route)
+			}
+		}
+		if !onLink || !defaultRoute {
+			t.Errorf("Expected an on-link /31 route and a default route via the gateway, got %v", routes)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list routes: %v", err)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "ingressRateBps": 100000000}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if bw := conf.Bandwidth(); bw.IngressRate != 100000000 || bw.IngressBurst != 10000000 || bw.EgressRate != 0 {
+		t.Errorf("Unexpected bandwidth %+v, expected a 100ms ingress burst", bw)
+	}
+
+	// the runtime config of the Pod overrides the plugin config
+	conf, err = parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "ingressRateBps": 100000000,
+		"runtimeConfig": {"bandwidth": {"egressRate": 1000000}}}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if bw := conf.Bandwidth(); bw.IngressRate != 0 || bw.EgressRate != 1000000 || bw.EgressBurst != minTbfBurst {
+		t.Errorf("Unexpected bandwidth %+v, expected the runtime egress rate with the minimum burst", bw)
+	}
+
+	for _, config := range []string{
+		`{"hostInterface": "eth0", "containerInterface": "veth0", "egressRateBps": -1}`,
+		`{"hostInterface": "eth0", "containerInterface": "veth0", "egressRateBps": 4}`,
+		`{"hostInterface": "eth0", "containerInterface": "veth0", "runtimeConfig": {"bandwidth": {"ingressRate": 1000, "ingressBurst": 68719476736}}}`,
+	} {
+		if _, err := parseConfig([]byte(config)); err == nil {
+			t.Errorf("Invalid bandwidth was accepted: %v", config)
+		}
+	}
+}
+
+func TestSetupBandwidth(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	tbfRate := func(name string) uint64 {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			t.Fatalf("Failed to find %v: %v", name, err)
+		}
+		qdiscs, err := netlink.QdiscList(link)
+		if err != nil {
+			t.Fatalf("Failed to list qdiscs of %v: %v", name, err)
+		}
+		for _, qdisc := range qdiscs {
+			if tbf, ok := qdisc.(*netlink.Tbf); ok && tbf.Parent == netlink.HANDLE_ROOT {
+				return tbf.Rate
+			}
+		}
+		return 0
+	}
+
+	hostAddrs := []netlink.Addr{{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(32, 32)}}}
+	bw := Bandwidth{IngressRate: 8000000, IngressBurst: minTbfBurst, EgressRate: 800000, EgressBurst: minTbfBurst}
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		hostVeth, _, err := setupContainerVeth(contNS, "veth0", 1500, 0, false, hostAddrs, nil, false, true, false, "eth0", hostVethName(nl.DefaultHostVethPrefix, "test", "eth0"), Announce{}, nil, &current.Result{})
+		if err != nil {
+			t.Fatalf("Failed to set up veth: %v", err)
+		}
+		if err := setupBandwidth(contNS, hostVeth.Name, "veth0", bw); err != nil {
+			t.Fatalf("Failed to set up bandwidth: %v", err)
+		}
+		if rate := tbfRate(hostVeth.Name); rate != 1000000 {
+			t.Errorf("Host veth is shaped to %d bytes/s, expected 1000000", rate)
+		}
+
+		link, _ := netlink.LinkByName(hostVeth.Name)
+		removeTbf(link)
+		if rate := tbfRate(hostVeth.Name); rate != 0 {
+			t.Errorf("Token bucket filter of the host veth was not removed")
+		}
+		return nil
+	})
+	_ = contNS.Do(func(_ ns.NetNS) error {
+		if rate := tbfRate("veth0"); rate != 100000 {
+			t.Errorf("Container veth is shaped to %d bytes/s, expected 100000", rate)
+		}
+		return nil
+	})
+}
+
+func TestPodGateways(t *testing.T) {
+	addr := func(cidr string) netlink.Addr {
+		a, _ := netlink.ParseAddr(cidr)
+		return *a
+	}
+	v4, v6 := addr("10.0.0.10/24"), addr("2001:db8::1/64")
+
+	cases := []struct {
+		Addrs    []netlink.Addr
+		V4       bool
+		V6       bool
+		Expected []string
+	}{
+		{Addrs: []netlink.Addr{v6, v4}, V4: true, Expected: []string{"10.0.0.10"}},
+		{Addrs: []netlink.Addr{v4, v6}, V6: true, Expected: []string{"2001:db8::1"}},
+		{Addrs: []netlink.Addr{v6, v4}, V4: true, V6: true, Expected: []string{"10.0.0.10", "2001:db8::1"}},
+		{Addrs: []netlink.Addr{v4, v6}, V4: true, V6: true, Expected: []string{"10.0.0.10", "2001:db8::1"}},
+		{Addrs: []netlink.Addr{v6}, V4: true},
+		{Addrs: []netlink.Addr{v6}, V4: true, V6: true, Expected: []string{"2001:db8::1"}},
+	}
+	for _, c := range cases {
+		gateways := podGateways(c.Addrs, c.V4, c.V6)
+		if len(gateways) != len(c.Expected) {
+			t.Errorf("From %v expected gateways %v, got %v", c.Addrs, c.Expected, gateways)
+			continue
+		}
+		for i, gw := range gateways {
+			if !gw.Equal(net.ParseIP(c.Expected[i])) {
+				t.Errorf("From %v expected gateways %v, got %v", c.Addrs, c.Expected, gateways)
+			}
+		}
+	}
+}
+
+func TestSetupContainerVethDualStackGateways(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	// the IPv6 host address is listed first
+	hostAddrs := []netlink.Addr{
+		{IPNet: &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(128, 128)}},
+		{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(32, 32)}},
+	}
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		_, _, err := setupContainerVeth(contNS, "veth0", 1500, 0, false, hostAddrs, nil, false, true, true, "eth0", hostVethName(nl.DefaultHostVethPrefix, "test", "eth0"), Announce{}, nil, &current.Result{})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up veth: %v", err)
+	}
+
+	err = contNS.Do(func(_ ns.NetNS) error {
+		for family, gw := range map[int]string{netlink.FAMILY_V4: "192.168.1.1", netlink.FAMILY_V6: "2001:db8::1"} {
+			routes, err := netlink.RouteList(nil, family)
+			if err != nil {
+				return err
+			}
+			found := false
+			for _, route := range routes {
+				if route.Dst == nil && route.Gw.Equal(net.ParseIP(gw)) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("No default route via %v found in %v", gw, routes)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list routes: %v", err)
+	}
+}
+
+func TestCmdAddIPv6Only(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	addLink := func(name string, cidrs ...string) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		for _, cidr := range cidrs {
+			addr, _ := netlink.ParseAddr(cidr)
+			addr.Flags = syscall.IFA_F_NODAD
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return err
+			}
+		}
+		return netlink.LinkSetUp(link)
+	}
+	// the host has both families, the Pod only IPv6
+	if err := hostNS.Do(func(_ ns.NetNS) error { return addLink("lyft-host", "192.168.1.1/24", "2001:db8::1/64") }); err != nil {
+		t.Fatalf("Failed to create host interface: %v", err)
+	}
+	if err := contNS.Do(func(_ ns.NetNS) error { return addLink("eth0", "2001:db8::5/64") }); err != nil {
+		t.Fatalf("Failed to create pod interface: %v", err)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		Netns:       contNS.Path(),
+		IfName:      "eth0",
+		StdinData: []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "test",
+			"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+			"hostInterface": "lyft-host",
+			"containerInterface": "veth0",
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{"name": "eth0"}],
+				"ips": [{"version": "6", "address": "2001:db8::5/64", "interface": 0}],
+				"routes": [{"dst": "2001:db8:1::/48"}]
+			}
+		}`),
+	}
+
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		if err := cmdAdd(args); err != nil {
+			return err
+		}
+
+		// the Pod table and its policy rule are IPv6 only
+		for family, expected := range map[int]int{netlink.FAMILY_V4: 0, netlink.FAMILY_V6: 1} {
+			rules, err := netlink.RuleList(family)
+			if err != nil {
+				return err
+			}
+			found := 0
+			for _, rule := range rules {
+				if rule.Priority == podRulePriority {
+					found++
+				}
+			}
+			if found != expected {
+				t.Errorf("Expected %d Pod policy rules of family %d, got %d", expected, family, found)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to add an IPv6-only Pod: %v", err)
+	}
+
+	err = contNS.Do(func(_ ns.NetNS) error {
+		veth, err := netlink.LinkByName("veth0")
+		if err != nil {
+			return err
+		}
+		if routes, err := netlink.RouteList(veth, netlink.FAMILY_V4); err != nil || len(routes) != 0 {
+			t.Errorf("Unexpected IPv4 routes in an IPv6-only Pod: %v %v", routes, err)
+		}
+		routes, err := netlink.RouteList(veth, netlink.FAMILY_V6)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, route := range routes {
+			if route.Dst == nil && route.Gw.Equal(net.ParseIP("2001:db8::1")) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("No IPv6 default route via the host address in %v", routes)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list routes: %v", err)
+	}
+}
+
+func TestPodFamilyAddrs(t *testing.T) {
+	hostAddrs := []netlink.Addr{
+		{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(24, 32)}},
+		{IPNet: &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)}},
+	}
+	if addrs := podFamilyAddrs(hostAddrs, false, true); len(addrs) != 1 || addrs[0].IP.To4() != nil {
+		t.Errorf("Expected only the IPv6 address for an IPv6-only Pod, got %v", addrs)
+	}
+	if addrs := podFamilyAddrs(hostAddrs, true, false); len(addrs) != 1 || addrs[0].IP.To4() == nil {
+		t.Errorf("Expected only the IPv4 address for an IPv4-only Pod, got %v", addrs)
+	}
+	if addrs := podFamilyAddrs(hostAddrs, true, true); len(addrs) != 2 {
+		t.Errorf("Expected both addresses for a dual-stack Pod, got %v", addrs)
+	}
+}
+
+func TestSetupContainerVethPreferredSrc(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	// the Pod IPs are configured on the Pod interface before ptp runs
+	podIP := net.ParseIP("10.0.1.20")
+	err := contNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("eth0")
+		if err != nil {
+			return err
+		}
+		for _, cidr := range []string{"10.0.1.20/32", "10.0.1.21/32"} {
+			addr, _ := netlink.ParseAddr(cidr)
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return err
+			}
+		}
+		return netlink.LinkSetUp(link)
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up Pod interface: %v", err)
+	}
+
+	pr := &current.Result{IPs: []*current.IPConfig{
+		{Version: "4", Address: net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}},
+		{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.1.21"), Mask: net.CIDRMask(32, 32)}},
+	}}
+	hostAddrs := []netlink.Addr{{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(32, 32)}}}
+	err = hostNS.Do(func(_ ns.NetNS) error {
+		_, _, err := setupContainerVeth(contNS, "veth0", 1500, 0, true, hostAddrs, nil, false, true, false, "eth0", hostVethName(nl.DefaultHostVethPrefix, "test", "eth0"), Announce{}, nil, pr)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up veth: %v", err)
+	}
+
+	err = contNS.Do(func(_ ns.NetNS) error {
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes {
+			if route.Dst == nil {
+				if !route.Src.Equal(podIP) {
+					t.Errorf("Default route has source %v, expected %v", route.Src, podIP)
+				}
+				return nil
+			}
+		}
+		t.Errorf("No default route found in %v", routes)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to list routes: %v", err)
+	}
+}
+
+func TestAddPolicyRulesCleansUpOnRuleFailure(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	oldRuleAdd := ruleAdd
+	defer func() { ruleAdd = oldRuleAdd }()
+	ruleAdd = func(*netlink.Handle, *netlink.Rule) error { return fmt.Errorf("injected failure") }
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-veth"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("lyft-veth")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+		veth, err := net.InterfaceByName("lyft-veth")
+		if err != nil {
+			return err
+		}
+
+		ipc := &current.IPConfig{Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}}
+		route := &netlink.Route{LinkIndex: veth.Index, Dst: &ipc.Address, Scope: netlink.SCOPE_LINK}
+		if err := netlink.RouteAdd(route); err != nil {
+			return err
+		}
+		_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+		if _, err := addPolicyRules(pkgHandle, veth, []*current.IPConfig{ipc}, []*types.Route{{Dst: *dst}}, testTableAlloc(0), 0, nil, podRulePriority); err == nil {
+			t.Errorf("addPolicyRules succeeded despite a rule failure")
+		}
+
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 0}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+		for _, r := range routes {
+			if r.Table >= 256 {
+				t.Errorf("Route %v was left in table %d", r.Dst, r.Table)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to add policy rules: %v", err)
+	}
+}
+
+func TestContainerVethName(t *testing.T) {
+	cases := []struct {
+		IfName   string
+		Expected string
+	}{
+		{IfName: "", Expected: "veth0"},
+		{IfName: "eth0", Expected: "veth0"},
+		{IfName: "eth1", Expected: "veth0-eth1"},
+	}
+	for _, c := range cases {
+		if name := containerVethName("veth0", c.IfName); name != c.Expected {
+			t.Errorf("%q expected %v, got %v", c.IfName, c.Expected, name)
+		}
+	}
+
+	long := containerVethName("veth0", "longifname01")
+	if len(long) > 15 || long == containerVethName("veth0", "longifname02") {
+		t.Errorf("Long interface names produced %q", long)
+	}
+}
+
+func TestPrevResultMTUs(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "cniVersion": "0.3.1",
+		"prevResult": {"cniVersion": "0.3.1", "interfaces": [{"name": "eth0", "sandbox": "/var/run/netns/pod", "mtu": 1400}],
+			"ips": [{"version": "4", "address": "10.0.0.5/24", "interface": 0}]}}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if mtu := conf.PrevResultMTUs["eth0"]; mtu != 1400 {
+		t.Errorf("Expected the MTU 1400 of eth0, got %d", mtu)
+	}
+}
+
+func TestContainerIfName(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "containerIfName": "sidecar0"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	for ifName, expected := range map[string]string{"eth0": "sidecar0", "eth1": "sidecar0-eth1"} {
+		if name := conf.containerVethName(ifName); name != expected {
+			t.Errorf("%q expected %v, got %v", ifName, expected, name)
+		}
+	}
+
+	for _, name := range []string{"averylonginterface", "a/b", "a b"} {
+		if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "containerIfName": "` + name + `"}`)); err == nil {
+			t.Errorf("containerIfName %q was accepted", name)
+		}
+	}
+}
+
+func TestCmdAddSharedNamespace(t *testing.T) {
+	testCmdAddSharedNamespace(t, "", "veth0", "veth0-eth1")
+}
+
+func TestCmdAddSharedNamespaceContainerIfName(t *testing.T) {
+	testCmdAddSharedNamespace(t, "sidecar0", "sidecar0", "sidecar0-eth1")
+}
+
+// testCmdAddSharedNamespace runs ADDs of eth0 and eth1 in one network
+// namespace and the DEL of eth1, which must leave the veth named
+// remaining of eth0 alone and remove the veth named deleted of eth1
+func testCmdAddSharedNamespace(t *testing.T, containerIfName string, remaining string, deleted string) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-host"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("lyft-host")
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr("192.168.1.1/24")
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	})
+	if err != nil {
+		t.Fatalf("Failed to create host interface: %v", err)
+	}
+
+	argsFor := func(ifName string, podIP string) *skel.CmdArgs {
+		return &skel.CmdArgs{
+			ContainerID: "lyft-test",
+			Netns:       contNS.Path(),
+			IfName:      ifName,
+			StdinData: []byte(fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "test",
+				"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+				"hostInterface": "lyft-host",
+				"containerInterface": "veth0",
+				"containerIfName": %q,
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [{"name": %q}],
+					"ips": [{"version": "4", "address": %q, "interface": 0}]
+				}
+			}`, containerIfName, ifName, podIP)),
+		}
+	}
+
+	err = hostNS.Do(func(_ ns.NetNS) error {
+		if err := cmdAdd(argsFor("eth0", "10.0.0.5/24")); err != nil {
+			return err
+		}
+		if err := cmdAdd(argsFor("eth1", "10.0.0.6/24")); err != nil {
+			return err
+		}
+		return cmdDel(argsFor("eth1", "10.0.0.6/24"))
+	})
+	if err != nil {
+		t.Fatalf("Failed to run ADD and DEL for two interfaces: %v", err)
+	}
+
+	var peerIndex int
+	err = contNS.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(deleted); err == nil {
+			t.Errorf("veth of the deleted interface was not removed")
+		}
+		link, err := netlink.LinkByName(remaining)
+		if err != nil {
+			return err
+		}
+		peerIndex, err = netlink.VethPeerIndex(link.(*netlink.Veth))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("veth of the remaining interface is gone: %v", err)
+	}
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		peer, err := netlink.LinkByIndex(peerIndex)
+		if err != nil {
+			t.Errorf("Host veth of the remaining interface is gone: %v", err)
+			return nil
+		}
+		rules, _ := netlink.RuleList(netlink.FAMILY_V4)
+		found := false
+		for _, rule := range rules {
+			if rule.IifName == peer.Attrs().Name {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Policy rule of the remaining interface was removed")
+		}
+		return nil
+	})
+}
+
+func TestPodTablesInUse(t *testing.T) {
+	rules := []netlink.Rule{
+		{Priority: podRulePriority, Table: 256},
+		{Priority: podRulePriority, Table: 257},
+		// the same table listed for another family
+		{Priority: podRulePriority, Table: 257},
+		// below the plugin's range
+		{Priority: podRulePriority, Table: 100},
+		// not a Pod rule
+		{Priority: nodePortRulePriority, Table: 258},
+	}
+	if inUse := podTablesInUse(rules, 256, podRulePriority); inUse != 2 {
+		t.Errorf("Expected 2 tables in use, got %d", inUse)
+	}
+}
+
+func TestAddPolicyRulesTableCeiling(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		for i, iif := range []string{"lyft-a", "lyft-b"} {
+			rule := netlink.NewRule()
+			rule.IifName = iif
+			rule.Table = 256 + i
+			rule.Priority = podRulePriority
+			if err := netlink.RuleAdd(rule); err != nil {
+				return err
+			}
+		}
+
+		ipc := &current.IPConfig{Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}}
+		_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+		_, err := addPolicyRules(pkgHandle, &net.Interface{Name: "lyft-c"}, []*current.IPConfig{ipc}, []*types.Route{{Dst: *dst}}, testTableAlloc(2), 0, nil, podRulePriority)
+		if err == nil || !strings.Contains(err.Error(), "route table ceiling reached") {
+			t.Errorf("Allocation at the ceiling was not refused: %v", err)
+		}
+
+		// the lock is released when the allocation fails
+		alloc := testTableAlloc(2)
+		alloc.LockPath = filepath.Join(os.TempDir(), fmt.Sprintf("lyft-tables-%d.lock", os.Getpid()))
+		_, err = addPolicyRules(pkgHandle, &net.Interface{Name: "lyft-c"}, []*current.IPConfig{ipc}, []*types.Route{{Dst: *dst}}, alloc, 0, nil, podRulePriority)
+		if err == nil || !strings.Contains(err.Error(), "route table ceiling reached") {
+			t.Errorf("Allocation at the ceiling was not refused under the lock: %v", err)
+		}
+		if _, err := os.Stat(alloc.LockPath); !os.IsNotExist(err) {
+			t.Errorf("Table lock was not released: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to set up rules: %v", err)
+	}
+}
+
+func TestTableBackoffReleasesLock(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(lo); err != nil {
+			return err
+		}
+
+		ipc := &current.IPConfig{Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}}
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: lo.Attrs().Index, Dst: &ipc.Address, Scope: netlink.SCOPE_LINK}); err != nil {
+			return err
+		}
+
+		// a route of another table user makes the first attempt collide
+		_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+		taken := &netlink.Route{LinkIndex: lo.Attrs().Index, Dst: dst, Table: 256}
+		if err := netlink.RouteAdd(taken); err != nil {
+			return err
+		}
+
+		alloc := testTableAlloc(0)
+		alloc.Range = 1
+		alloc.LockPath = filepath.Join(os.TempDir(), fmt.Sprintf("lyft-tables-%d.lock", os.Getpid()))
+		defer func(f func(time.Duration)) { tableBackoff = f }(tableBackoff)
+		backoffs := 0
+		tableBackoff = func(time.Duration) {
+			backoffs++
+			if _, err := os.Stat(alloc.LockPath); !os.IsNotExist(err) {
+				t.Errorf("Table lock is held while backing off: %v", err)
+			}
+			_ = netlink.RouteDel(taken)
+		}
+
+		veth := &net.Interface{Name: "lo", Index: lo.Attrs().Index}
+		table, err := addPolicyRules(pkgHandle, veth, []*current.IPConfig{ipc}, []*types.Route{{Dst: *dst}}, alloc, 0, nil, podRulePriority)
+		if err != nil {
+			return err
+		}
+		if table != 256 || backoffs != 1 {
+			t.Errorf("Expected table 256 after one backoff, got %d after %d", table, backoffs)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to allocate a table: %v", err)
+	}
+}
+
+func TestRuleNameClusterScope(t *testing.T) {
+	containerID := strings.Repeat("a", 64)
+	cases := []struct {
+		Conf     PluginConf
+		Expected string
+	}{
+		{Conf: PluginConf{netconf.PtpConf{NetConf: types.NetConf{Name: "net"}}}, Expected: "net"},
+		{Conf: PluginConf{netconf.PtpConf{NetConf: types.NetConf{Name: "net"}, ClusterID: "prod-1"}}, Expected: "prod-1/net"},
+		// very long scopes are hashed to fit the comment limit
+		{Conf: PluginConf{netconf.PtpConf{NetConf: types.NetConf{Name: "net"}, ClusterID: strings.Repeat("c", 300)}}},
+	}
+
+	chains := map[string]bool{}
+	for i, c := range cases {
+		name := ruleName(&c.Conf)
+		if c.Expected != "" && name != c.Expected {
+			t.Errorf("%d expected %v, got %v", i, c.Expected, name)
+		}
+
+		comment := utils.FormatComment(name, ipMasqID(containerID, "eth1"))
+		if c.Conf.ClusterID != "" && len(c.Conf.ClusterID) < maxRuleNameLen && !strings.Contains(comment, c.Conf.ClusterID) {
+			t.Errorf("%d comment %q lacks the cluster scope", i, comment)
+		}
+		if len(comment) > 256 {
+			t.Errorf("%d comment is %d characters long", i, len(comment))
+		}
+
+		chain := utils.FormatChainName(name, containerID)
+		if len(chain) > 28 {
+			t.Errorf("%d chain %q exceeds the iptables limit", i, chain)
+		}
+		chains[chain] = true
+	}
+	if len(chains) != len(cases) {
+		t.Errorf("Cluster scopes share chains: %v", chains)
+	}
+}
+
+func TestENIMACForIPs(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("10.0.2.16/28")
+	interfaces := []aws.Interface{
+		{Mac: "02:00:00:00:00:01", IPv4s: []net.IP{net.ParseIP("10.0.1.10"), net.ParseIP("10.0.1.20")}},
+		{Mac: "02:00:00:00:00:02", IPv4s: []net.IP{net.ParseIP("10.0.1.11")}, IPv4Prefixes: []*net.IPNet{prefix}},
+	}
+
+	cases := []struct {
+		IP       string
+		Expected string
+	}{
+		{IP: "10.0.1.20", Expected: "02:00:00:00:00:01"},
+		// ENIs of the same subnet are told apart
+		{IP: "10.0.1.11", Expected: "02:00:00:00:00:02"},
+		{IP: "10.0.2.20", Expected: "02:00:00:00:00:02"},
+		{IP: "10.0.1.30", Expected: ""},
+	}
+	for _, c := range cases {
+		if mac := eniMACForIPs([]net.IP{net.ParseIP(c.IP)}, interfaces); mac != c.Expected {
+			t.Errorf("%v expected %q, got %q", c.IP, c.Expected, mac)
+		}
+	}
+}
+
+func TestIPsOutsideSubnets(t *testing.T) {
+	addr := func(cidr string) netlink.Addr {
+		a, _ := netlink.ParseAddr(cidr)
+		return *a
+	}
+	addrs := []netlink.Addr{addr("10.0.1.10/24"), addr("2600:1f14::10/64")}
+
+	ips := []net.IP{net.ParseIP("10.0.1.20"), net.ParseIP("10.0.2.20"), net.ParseIP("2600:1f14::20"), net.ParseIP("2600:1f15::20")}
+	outside := ipsOutsideSubnets(ips, addrs)
+	if len(outside) != 2 || !outside[0].Equal(ips[1]) || !outside[1].Equal(ips[3]) {
+		t.Errorf("Expected %v and %v outside, got %v", ips[1], ips[3], outside)
+	}
+	if outside := ipsOutsideSubnets(ips[:1], addrs); len(outside) != 0 {
+		t.Errorf("Expected no IP outside, got %v", outside)
+	}
+}
+
+func TestPodHostInterfaceMultiENI(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	podIP := net.ParseIP("10.0.1.11")
+	defer func(f func() ([]aws.Interface, error)) { getInterfaces = f }(getInterfaces)
+	getInterfaces = func() ([]aws.Interface, error) {
+		return []aws.Interface{{Mac: "02:00:00:00:00:02", IPv4s: []net.IP{podIP}}}, nil
+	}
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		// both ENIs are in the same subnet, and only the first carries
+		// an address
+		for i, name := range []string{"lyft-eni1", "lyft-eni2"} {
+			mac, _ := net.ParseMAC(fmt.Sprintf("02:00:00:00:00:0%d", i+1))
+			if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, HardwareAddr: mac}}); err != nil {
+				return err
+			}
+		}
+		eni1, err := netlink.LinkByName("lyft-eni1")
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr("10.0.1.10/24")
+		if err := netlink.AddrAdd(eni1, addr); err != nil {
+			return err
+		}
+
+		// the MAC of the Pod interface resolves its ENI
+		hostIfName := podHostInterface([]net.IP{podIP}, "02:00:00:00:00:02", nil, "lyft-eni1")
+		if hostIfName != "lyft-eni2" {
+			t.Errorf("Expected the Pod ENI lyft-eni2, got %q", hostIfName)
+		}
+		// and so does the metadata service once the Pod interface is gone
+		if name := podHostInterface([]net.IP{podIP}, "", nil, "lyft-eni1"); name != "lyft-eni2" {
+			t.Errorf("Expected the Pod ENI lyft-eni2 from the metadata, got %q", name)
+		}
+		if name := podHostInterface([]net.IP{net.ParseIP("10.0.1.12")}, "", nil, "lyft-eni1"); name != "lyft-eni1" {
+			t.Errorf("Expected the fallback interface, got %q", name)
+		}
+		// only the listed hostInterfaces are candidates
+		if name := podHostInterface([]net.IP{podIP}, "02:00:00:00:00:02", []string{"lyft-eni1"}, "eth0"); name != "eth0" {
+			t.Errorf("Expected the fallback interface for an unlisted ENI, got %q", name)
+		}
+
+		// the ENI without an address uses the gateways of hostInterface
+		eni2, err := netlink.LinkByName(hostIfName)
+		if err != nil {
+			return err
+		}
+		hostAddrs, err := podGatewayAddrs(eni2, "lyft-eni1")
+		if err != nil {
+			return err
+		}
+		if hostAddrs = usableHostAddrs(hostAddrs); len(hostAddrs) != 1 || !hostAddrs[0].IP.Equal(addr.IP) {
+			t.Errorf("Expected the gateway %v of lyft-eni1, got %v", addr.IP, hostAddrs)
+		}
+
+		// egress rules of the Pod target its own ENI
+		ipn := &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}
+		if err := setupMSSClamp(ipn, hostIfName, 0, "lyft-test"); err != nil {
+			return err
+		}
+		ipt, err := iptablesForIP(podIP)
+		if err != nil {
+			return err
+		}
+		if exists, err := ipt.Exists("mangle", "FORWARD", mssClampRulespec(ipn, "lyft-eni2", 0, "lyft-test")...); !exists || err != nil {
+			t.Errorf("MSS clamp rule does not target the Pod ENI: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve the Pod ENI: %v", err)
+	}
+}
+
+func TestSelectEgressSteering(t *testing.T) {
+	steering := []EgressSteering{
+		{Namespace: "payments", PodName: "proxy-.*", Mark: 0x10, Table: 100},
+		{Namespace: "payments", Mark: 0x20, Table: 200},
+	}
+
+	cases := []struct {
+		Namespace string
+		PodName   string
+		Table     int
+	}{
+		{Namespace: "payments", PodName: "proxy-abc", Table: 100},
+		{Namespace: "payments", PodName: "web-abc", Table: 200},
+		{Namespace: "default", PodName: "proxy-abc", Table: 0},
+	}
+	for _, c := range cases {
+		selected := selectEgressSteering(steering, c.Namespace, c.PodName)
+		if c.Table == 0 {
+			if selected != nil {
+				t.Errorf("%v/%v should not be steered, got %+v", c.Namespace, c.PodName, selected)
+			}
+			continue
+		}
+		if selected == nil || selected.Table != c.Table {
+			t.Errorf("%v/%v expected table %d, got %+v", c.Namespace, c.PodName, c.Table, selected)
+		}
+	}
+}
+
+func TestEgressSteering(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	steering := &EgressSteering{Mark: 0x10, Table: 100}
+	ipn := &net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}
+	err := testNS.Do(func(_ ns.NetNS) error {
+		ipt, err := iptablesForIP(ipn.IP)
+		if err != nil {
+			return err
+		}
+		rulespec := egressMarkRulespec(ipn, steering.Mark, "lyft-test")
+
+		if err := setupEgressSteering(ipn, steering, "lyft-test"); err != nil {
+			return err
+		}
+		if exists, err := ipt.Exists("mangle", "PREROUTING", rulespec...); !exists || err != nil {
+			t.Errorf("Pod traffic is not marked: %v", err)
+		}
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, rule := range rules {
+			if rule.Mark == steering.Mark && rule.Table == steering.Table && rule.Priority == egressRulePriority {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Marked traffic is not routed to table %d", steering.Table)
+		}
+
+		if err := teardownEgressSteering(ipn, steering, "lyft-test"); err != nil {
+			return err
+		}
+		if exists, err := ipt.Exists("mangle", "PREROUTING", rulespec...); exists || err != nil {
+			t.Errorf("Mark rule was not removed: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to steer egress: %v", err)
+	}
+}
+
+func TestSortHostAddrs(t *testing.T) {
+	addr := func(cidr string, flags int) netlink.Addr {
+		a, _ := netlink.ParseAddr(cidr)
+		a.Flags = flags
+		return *a
+	}
+	addrs := []netlink.Addr{
+		addr("10.0.0.20/24", syscall.IFA_F_SECONDARY),
+		addr("2001:db8::1/64", 0),
+		addr("10.0.0.30/24", 0),
+		addr("10.0.0.10/24", 0),
+	}
+
+	for i := 0; i < 20; i++ {
+		shuffled := make([]netlink.Addr, len(addrs))
+		for j, k := range rand.Perm(len(addrs)) {
+			shuffled[j] = addrs[k]
+		}
+
+		sortHostAddrs(shuffled, true)
+		if !shuffled[0].IP.Equal(net.ParseIP("10.0.0.10")) {
+			t.Fatalf("Expected gateway 10.0.0.10, got %v from %v", shuffled[0].IP, shuffled)
+		}
+		if !shuffled[2].IP.Equal(net.ParseIP("10.0.0.20")) {
+			t.Errorf("Secondary address was not sorted after primaries: %v", shuffled)
+		}
+
+		sortHostAddrs(shuffled, false)
+		if !shuffled[0].IP.Equal(net.ParseIP("2001:db8::1")) {
+			t.Errorf("Expected IPv6 gateway for IPv6 Pods, got %v", shuffled[0].IP)
+		}
+	}
+}
+
+func TestCmdCheck(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	addLink := func(name string, cidr string) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr(cidr)
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	}
+	if err := hostNS.Do(func(_ ns.NetNS) error { return addLink("lyft-host", "192.168.1.1/24") }); err != nil {
+		t.Fatalf("Failed to create host interface: %v", err)
+	}
+	if err := contNS.Do(func(_ ns.NetNS) error { return addLink("eth0", "10.0.0.5/24") }); err != nil {
+		t.Fatalf("Failed to create pod interface: %v", err)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		Netns:       contNS.Path(),
+		IfName:      "eth0",
+		StdinData: []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "test",
+			"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+			"hostInterface": "lyft-host",
+			"containerInterface": "veth0",
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{"name": "eth0"}],
+				"ips": [{"version": "4", "address": "10.0.0.5/24", "interface": 0}]
+			}
+		}`),
+	}
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		if err := cmdAdd(args); err != nil {
+			t.Fatalf("Failed to add: %v", err)
+		}
+		if err := cmdCheck(args); err != nil {
+			t.Errorf("Check failed on an intact datapath: %v", err)
+		}
+
+		rules, _ := netlink.RuleList(netlink.FAMILY_V4)
+		for _, rule := range rules {
+			if rule.Priority == podRulePriority {
+				r := rule
+				_ = netlink.RuleDel(&r)
+			}
+		}
+		err := cmdCheck(args)
+		if err == nil || !strings.Contains(err.Error(), "policy rule") {
+			t.Errorf("Check did not detect the missing policy rule: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestCmdAddNodePortDisabled(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if !conf.EnableNodePort {
+		t.Errorf("NodePort setup is not enabled by default")
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	addLink := func(name string, cidr string) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr(cidr)
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	}
+	if err := hostNS.Do(func(_ ns.NetNS) error { return addLink("lyft-host", "192.168.1.1/24") }); err != nil {
+		t.Fatalf("Failed to create host interface: %v", err)
+	}
+	if err := contNS.Do(func(_ ns.NetNS) error { return addLink("eth0", "10.0.0.5/24") }); err != nil {
+		t.Fatalf("Failed to create pod interface: %v", err)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		Netns:       contNS.Path(),
+		IfName:      "eth0",
+		StdinData: []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "test",
+			"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+			"hostInterface": "lyft-host",
+			"containerInterface": "veth0",
+			"enableNodePort": false,
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{"name": "eth0"}],
+				"ips": [{"version": "4", "address": "10.0.0.5/24", "interface": 0}]
+			}
+		}`),
+	}
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		if err := cmdAdd(args); err != nil {
+			t.Fatalf("Failed to add: %v", err)
+		}
+		rules, _ := netlink.RuleList(netlink.FAMILY_V4)
+		for _, rule := range rules {
+			if rule.Priority == nodePortRulePriority {
+				t.Errorf("NodePort policy rule %v was added while disabled", rule)
+			}
+		}
+		if err := cmdCheck(args); err != nil {
+			t.Errorf("Check failed without the disabled NodePort rule: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestCmdAddDefaultRouteMetric(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "routeMetric": 50}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if metric := conf.containerRouteMetric(); metric != 50 {
+		t.Errorf("Pod route metric is %d without defaultRouteMetric, expected routeMetric 50", metric)
+	}
+	if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "defaultRouteMetric": -1}`)); err == nil {
+		t.Errorf("Negative defaultRouteMetric was accepted")
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	addLink := func(name string, cidr string) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr(cidr)
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	}
+	if err := hostNS.Do(func(_ ns.NetNS) error { return addLink("lyft-host", "192.168.1.1/24") }); err != nil {
+		t.Fatalf("Failed to create host interface: %v", err)
+	}
+	if err := contNS.Do(func(_ ns.NetNS) error { return addLink("eth0", "10.0.0.5/24") }); err != nil {
+		t.Fatalf("Failed to create pod interface: %v", err)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		Netns:       contNS.Path(),
+		IfName:      "eth0",
+		StdinData: []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "test",
+			"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+			"hostInterface": "lyft-host",
+			"containerInterface": "veth0",
+			"routeMetric": 50,
+			"defaultRouteMetric": 200,
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{"name": "eth0"}],
+				"ips": [{"version": "4", "address": "10.0.0.5/24", "interface": 0}]
+			}
+		}`),
+	}
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		if err := cmdAdd(args); err != nil {
+			t.Fatalf("Failed to add: %v", err)
+		}
+		return nil
+	})
+	_ = contNS.Do(func(_ ns.NetNS) error {
+		veth, err := netlink.LinkByName("veth0")
+		if err != nil {
+			t.Fatalf("Failed to find container veth: %v", err)
+		}
+		routes, err := netlink.RouteList(veth, netlink.FAMILY_V4)
+		if err != nil {
+			t.Fatalf("Failed to list routes: %v", err)
+		}
+		found := false
+		for _, route := range routes {
+			if route.Dst != nil {
+				continue
+			}
+			found = true
+			if route.Priority != 200 {
+				t.Errorf("Pod default route %v has metric %d, expected 200", route, route.Priority)
+			}
+		}
+		if !found {
+			t.Errorf("Pod default route is missing: %v", routes)
+		}
+		return nil
+	})
+}
+
+func TestCmdAddRollback(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	oldRuleAdd, oldSetupIPMasq, oldSetupNodePortRule := ruleAdd, setupIPMasq, setupNodePortRule
+	defer func() {
+		ruleAdd, setupIPMasq, setupNodePortRule = oldRuleAdd, oldSetupIPMasq, oldSetupNodePortRule
+	}()
+	injected := fmt.Errorf("injected failure")
+
+	stages := map[string]func(){
+		"setupHostVeth": func() {
+			ruleAdd = func(*netlink.Handle, *netlink.Rule) error { return injected }
+		},
+		"ipMasq": func() {
+			setupIPMasq = func(string, *net.IPNet, string, string) error { return injected }
+		},
+		"nodePort": func() {
+			setupNodePortRule = func(string, string, string, int, int, int, bool, string) error { return injected }
+		},
+	}
+	for stage, inject := range stages {
+		ruleAdd, setupIPMasq, setupNodePortRule = oldRuleAdd, oldSetupIPMasq, oldSetupNodePortRule
+		inject()
+
+		hostNS := createTestNS(t)
+		contNS := createTestNS(t)
+		addLink := func(name string, cidr string) error {
+			if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+				return err
+			}
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			addr, _ := netlink.ParseAddr(cidr)
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return err
+			}
+			return netlink.LinkSetUp(link)
+		}
+		if err := hostNS.Do(func(_ ns.NetNS) error { return addLink("lyft-host", "192.168.1.1/24") }); err != nil {
+			t.Fatalf("Failed to create host interface: %v", err)
+		}
+		if err := contNS.Do(func(_ ns.NetNS) error { return addLink("eth0", "10.0.0.5/24") }); err != nil {
+			t.Fatalf("Failed to create pod interface: %v", err)
+		}
+
+		args := &skel.CmdArgs{
+			ContainerID: "lyft-test",
+			Netns:       contNS.Path(),
+			IfName:      "eth0",
+			StdinData: []byte(`{
+				"cniVersion": "0.3.1",
+				"name": "test",
+				"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+				"hostInterface": "lyft-host",
+				"containerInterface": "veth0",
+				"ipMasq": true,
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [{"name": "eth0"}],
+					"ips": [{"version": "4", "address": "10.0.0.5/24", "interface": 0}],
+					"routes": [{"dst": "10.0.0.0/16"}]
+				}
+			}`),
+		}
+
+		_ = hostNS.Do(func(_ ns.NetNS) error {
+			if err := cmdAdd(args); err == nil || !strings.Contains(err.Error(), "injected failure") {
+				t.Errorf("%s: expected the injected failure, got %v", stage, err)
+			}
+
+			// the host is back to its baseline
+			links, _ := netlink.LinkList()
+			for _, link := range links {
+				if link.Type() == "veth" {
+					t.Errorf("%s: host veth %q was left behind", stage, link.Attrs().Name)
+				}
+			}
+			rules, _ := netlink.RuleList(netlink.FAMILY_V4)
+			for _, rule := range rules {
+				if rule.Priority == podRulePriority {
+					t.Errorf("%s: policy rule %v was left behind", stage, rule)
+				}
+			}
+			routes, _ := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: 0}, netlink.RT_FILTER_TABLE)
+			for _, route := range routes {
+				if route.Table >= 256 {
+					t.Errorf("%s: route %v of table %d was left behind", stage, route.Dst, route.Table)
+				}
+			}
+			ipt, err := iptablesForIP(net.ParseIP("10.0.0.5"))
+			if err != nil {
+				return err
+			}
+			chains, _ := ipt.ListChains("nat")
+			chain := utils.FormatChainName("test", ipMasqID(args.ContainerID, args.IfName))
+			for _, c := range chains {
+				if c == chain {
+					t.Errorf("%s: IP masquerade chain %q was left behind", stage, chain)
+				}
+			}
+			return nil
+		})
+		_ = contNS.Do(func(_ ns.NetNS) error {
+			if _, err := netlink.LinkByName("veth0"); err == nil {
+				t.Errorf("%s: container veth was left behind", stage)
+			}
+			return nil
+		})
+
+		contNS.Close()
+		hostNS.Close()
+	}
+}
+
+func TestLocalPodRoutes(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+
+	// veths stand in for the host interface and the Pod interfaces
+	addLink := func(name string, cidr string) error {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "-peer"}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr(cidr)
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	}
+	if err := hostNS.Do(func(_ ns.NetNS) error { return addLink("lyft-host", "192.168.1.1/24") }); err != nil {
+		t.Fatalf("Failed to create host interface: %v", err)
+	}
+
+	// two Pods in the same ENI subnet, whose per-Pod tables would
+	// hairpin the traffic between them through the ENI
+	podArgs := func(id string, netns ns.NetNS, cidr string) *skel.CmdArgs {
+		return &skel.CmdArgs{
+			ContainerID: id,
+			Netns:       netns.Path(),
+			IfName:      "eth0",
+			StdinData: []byte(`{
+				"cniVersion": "0.3.1",
+				"name": "test",
+				"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+				"hostInterface": "lyft-host",
+				"containerInterface": "veth0",
+				"localPodRoutes": true,
+				"prevResult": {
+					"cniVersion": "0.3.1",
+					"interfaces": [{"name": "eth0"}],
+					"ips": [{"version": "4", "address": "` + cidr + `", "interface": 0}],
+					"routes": [{"dst": "10.0.0.0/16"}]
+				}
+			}`),
+		}
+	}
+	var pods []*skel.CmdArgs
+	for i, cidr := range []string{"10.0.0.5/24", "10.0.0.6/24"} {
+		contNS := createTestNS(t)
+		defer contNS.Close()
+		if err := contNS.Do(func(_ ns.NetNS) error { return addLink("eth0", cidr) }); err != nil {
+			t.Fatalf("Failed to create pod interface: %v", err)
+		}
+		args := podArgs(fmt.Sprintf("lyft-test-%d", i), contNS, cidr)
+		if err := hostNS.Do(func(_ ns.NetNS) error { return cmdAdd(args) }); err != nil {
+			t.Fatalf("Failed to add Pod %d: %v", i, err)
+		}
+		pods = append(pods, args)
+	}
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		// the traffic from the host veth of one Pod to the other is
+		// looked up in the main table ahead of the per-Pod table, and
+		// delivered to the host veth of the other Pod
+		for i, ip := range []string{"10.0.0.5", "10.0.0.6"} {
+			rule := localPodRule(net.ParseIP(ip), podRulePriority-1)
+			if exists, err := podRuleExists(pkgHandle, rule); err != nil || !exists {
+				t.Errorf("Local Pod rule for %v is missing: %v", ip, err)
+			}
+			routes, err := netlink.RouteGet(net.ParseIP(ip))
+			if err != nil || len(routes) == 0 {
+				t.Fatalf("Failed to get the route to %v: %v", ip, err)
+			}
+			link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+			if err != nil {
+				t.Fatalf("Failed to lookup the link of %v: %v", routes[0], err)
+			}
+			if veth := hostVethName(nl.DefaultHostVethPrefix, pods[i].ContainerID, "eth0"); link.Attrs().Name != veth {
+				t.Errorf("Main table routes %v via %q, not the host veth %q", ip, link.Attrs().Name, veth)
+			}
+		}
+
+		if err := cmdDel(pods[1]); err != nil {
+			t.Errorf("Failed to delete the second Pod: %v", err)
+		}
+		if exists, _ := podRuleExists(pkgHandle, localPodRule(net.ParseIP("10.0.0.6"), podRulePriority-1)); exists {
+			t.Errorf("Local Pod rule of the deleted Pod was left behind")
+		}
+		if exists, _ := podRuleExists(pkgHandle, localPodRule(net.ParseIP("10.0.0.5"), podRulePriority-1)); !exists {
+			t.Errorf("Local Pod rule of the remaining Pod was removed")
+		}
+		return nil
+	})
+}
+
+func TestAddLocalPodRollback(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	_ = testNS.Do(func(_ ns.NetNS) error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			t.Fatalf("Failed to lookup lo: %v", err)
+		}
+		if err := netlink.LinkSetUp(lo); err != nil {
+			t.Fatalf("Failed to set lo up: %v", err)
+		}
+
+		// the rule of the second IP fails, the first is removed again
+		oldRuleAdd := ruleAdd
+		defer func() { ruleAdd = oldRuleAdd }()
+		calls := 0
+		ruleAdd = func(h *netlink.Handle, rule *netlink.Rule) error {
+			if calls++; calls > 1 {
+				return fmt.Errorf("injected failure")
+			}
+			return oldRuleAdd(h, rule)
+		}
+		ips := []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("10.0.0.6")}
+		if err := addLocalPod("lo", ips, podRulePriority-1); err == nil || !strings.Contains(err.Error(), "injected failure") {
+			t.Errorf("Unexpected error %v", err)
+		}
+		for _, ip := range ips {
+			if exists, _ := podRuleExists(pkgHandle, localPodRule(ip, podRulePriority-1)); exists {
+				t.Errorf("Local Pod rule for %v was left behind", ip)
+			}
+		}
+		return nil
+	})
+}
+
+func TestCmdCheckEnforceMTU(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	addLink := func(name string, cidr string, mtu int) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr(cidr)
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	}
+	if err := hostNS.Do(func(_ ns.NetNS) error { return addLink("lyft-host", "192.168.1.1/24", 9001) }); err != nil {
+		t.Fatalf("Failed to create host interface: %v", err)
+	}
+	// the Pod interface reports a stale MTU
+	if err := contNS.Do(func(_ ns.NetNS) error { return addLink("eth0", "10.0.0.5/24", 1500) }); err != nil {
+		t.Fatalf("Failed to create pod interface: %v", err)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		Netns:       contNS.Path(),
+		IfName:      "eth0",
+		StdinData: []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "test",
+			"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+			"hostInterface": "lyft-host",
+			"containerInterface": "veth0",
+			"enforceMTU": true,
+			"prevResult": {
+				"cniVersion": "0.3.1",
+				"interfaces": [{"name": "eth0"}],
+				"ips": [{"version": "4", "address": "10.0.0.5/24", "interface": 0}]
+			}
+		}`),
+	}
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		if err := cmdAdd(args); err != nil {
+			t.Fatalf("Failed to add: %v", err)
+		}
+		if err := cmdCheck(args); err != nil {
+			t.Errorf("Check failed with the veth following the ENI MTU: %v", err)
+		}
+
+		// jumbo frames toggled on the ENI
+		link, _ := netlink.LinkByName("lyft-host")
+		if err := netlink.LinkSetMTU(link, 1500); err != nil {
+			t.Fatalf("Failed to change the host MTU: %v", err)
+		}
+		err := cmdCheck(args)
+		if err == nil || !strings.Contains(err.Error(), "MTU") {
+			t.Errorf("Check did not detect the MTU mismatch: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestAddPolicyRulesNoRoutes(t *testing.T) {
+	ipc := &current.IPConfig{Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}}
+	_, err := addPolicyRules(pkgHandle, &net.Interface{Name: "lyft-c"}, []*current.IPConfig{ipc}, nil, testTableAlloc(0), 0, nil, podRulePriority)
+	if err == nil || !strings.Contains(err.Error(), "no routes") {
+		t.Errorf("Empty routes were not refused: %v", err)
+	}
+
+	_, dst, _ := net.ParseCIDR("::/0")
+	_, err = addPolicyRules(pkgHandle, &net.Interface{Name: "lyft-c"}, []*current.IPConfig{ipc}, []*types.Route{{Dst: *dst}}, testTableAlloc(0), 0, nil, podRulePriority)
+	if err == nil {
+		t.Errorf("IPv6 route without an IPv6 Pod IP was not refused")
+	}
+}
+
+func TestAddPolicyRulesDualStack(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-veth"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("lyft-veth")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+		veth, err := net.InterfaceByName("lyft-veth")
+		if err != nil {
+			return err
+		}
+
+		ips := []*current.IPConfig{
+			{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}},
+			{Version: "6", Address: net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(128, 128)}},
+		}
+		for _, ipc := range ips {
+			dst := ipc.Address
+			if err := netlink.RouteAdd(&netlink.Route{LinkIndex: veth.Index, Dst: &dst, Scope: netlink.SCOPE_LINK}); err != nil {
+				return err
+			}
+		}
+
+		// prevResult carrying a default route per family
+		_, v4, _ := net.ParseCIDR("0.0.0.0/0")
+		_, v6, _ := net.ParseCIDR("::/0")
+		routes := []*types.Route{{Dst: *v4}, {Dst: *v6}}
+		chosen, err := addPolicyRules(pkgHandle, veth, ips, routes, testTableAlloc(0), 0, nil, podRulePriority)
+		if err != nil {
+			return err
+		}
+
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			rules, err := netlink.RuleList(family)
+			if err != nil {
+				return err
+			}
+			table := 0
+			for _, rule := range rules {
+				if rule.IifName == "lyft-veth" && rule.Priority == podRulePriority {
+					table = rule.Table
+				}
+			}
+			if table == 0 {
+				t.Errorf("No policy rule for family %d", family)
+				continue
+			}
+			if table != chosen {
+				t.Errorf("Rule of family %d points to table %d, not the returned table %d", family, table, chosen)
+			}
+			tableRoutes, err := netlink.RouteListFiltered(family, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+			if err != nil {
+				return err
+			}
+			if len(tableRoutes) != 1 || tableRoutes[0].Dst != nil {
+				t.Errorf("Expected a default route in table %d for family %d, got %v", table, family, tableRoutes)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to add dual-stack policy rules: %v", err)
+	}
+}
+
+func TestAddPolicyRulesGatewayOverride(t *testing.T) {
+	if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "gatewayV4": "2001:db8::1"}`)); err == nil {
+		t.Errorf("IPv6 gatewayV4 was accepted")
+	}
+	if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "gatewayV6": "10.0.0.1"}`)); err == nil {
+		t.Errorf("IPv4 gatewayV6 was accepted")
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-veth"}}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("lyft-veth")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+		veth, err := net.InterfaceByName("lyft-veth")
+		if err != nil {
+			return err
+		}
+		_, onLink, _ := net.ParseCIDR("10.0.0.0/24")
+		if err := netlink.RouteAdd(&netlink.Route{LinkIndex: veth.Index, Dst: onLink, Scope: netlink.SCOPE_LINK}); err != nil {
+			return err
+		}
+
+		ips := []*current.IPConfig{{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}}}
+		_, v4, _ := net.ParseCIDR("0.0.0.0/0")
+		routes := []*types.Route{{Dst: *v4}}
+
+		if _, err := addPolicyRules(pkgHandle, veth, ips, routes, testTableAlloc(0), 0, []net.IP{net.ParseIP("192.168.9.1")}, podRulePriority); err == nil {
+			t.Errorf("Gateway override not on-link via the veth was accepted")
+		}
+
+		gw := net.ParseIP("10.0.0.254")
+		table, err := addPolicyRules(pkgHandle, veth, ips, routes, testTableAlloc(0), 0, []net.IP{gw}, podRulePriority)
+		if err != nil {
+			return err
+		}
+		tableRoutes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+		if len(tableRoutes) != 1 || !tableRoutes[0].Gw.Equal(gw) {
+			t.Errorf("Expected the default route of table %d via %v, got %v", table, gw, tableRoutes)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to add policy rules with a gateway override: %v", err)
+	}
+}
+
+func TestAddPolicyRulesSharedTablePerENI(t *testing.T) {
+	if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "sharedTablePerENI": true, "gatewayV4": "10.0.0.1"}`)); err == nil {
+		t.Errorf("sharedTablePerENI with a gateway override was accepted")
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		var ifaces []*net.Interface
+		for _, name := range []string{"lyft-eni", "lyft-veth1", "lyft-veth2"} {
+			if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}); err != nil {
+				return err
+			}
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				return err
+			}
+			if err := netlink.LinkSetUp(link); err != nil {
+				return err
+			}
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				return err
+			}
+			ifaces = append(ifaces, iface)
+		}
+
+		alloc := testTableAlloc(0)
+		alloc.ENI = &ENITable{LinkIndex: ifaces[0].Index, Gateway: net.ParseIP("10.0.1.1")}
+		_, vpc, _ := net.ParseCIDR("10.0.0.0/16")
+		routes := []*types.Route{{Dst: *vpc}}
+
+		_, v6, _ := net.ParseCIDR("::/0")
+		v6IPs := []*current.IPConfig{{Version: "6", Address: net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(64, 128)}}}
+		if _, err := addPolicyRules(pkgHandle, ifaces[1], v6IPs, []*types.Route{{Dst: *v6}}, alloc, 0, nil, podRulePriority); err == nil {
+			t.Errorf("IPv6 route was added to a shared table")
+		}
+
+		var tables []int
+		for i, podIP := range []string{"10.0.1.5", "10.0.1.6"} {
+			ips := []*current.IPConfig{{Version: "4", Address: net.IPNet{IP: net.ParseIP(podIP), Mask: net.CIDRMask(24, 32)}}}
+			table, err := addPolicyRules(pkgHandle, ifaces[i+1], ips, routes, alloc, 0, nil, podRulePriority)
+			if err != nil {
+				return err
+			}
+			tables = append(tables, table)
+		}
+		if tables[0] != tables[1] {
+			t.Fatalf("Pods behind the same ENI got tables %v", tables)
+		}
+		table := tables[0]
+
+		tableRoutes := func() []netlink.Route {
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+			if err != nil {
+				t.Fatalf("Failed to list routes: %v", err)
+			}
+			return routes
+		}
+		if routes := tableRoutes(); len(routes) != 2 {
+			t.Errorf("Expected the gateway and VPC routes in table %d, got %v", table, routes)
+		}
+		rules, err := netlink.RuleList(netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		refs := 0
+		for _, rule := range rules {
+			if rule.Table == table {
+				refs++
+			}
+		}
+		if refs != 2 {
+			t.Errorf("Expected a rule per Pod pointing to table %d, got %d", table, refs)
+		}
+
+		// the table stays until the rule of the last Pod is removed
+		for i, veth := range ifaces[1:] {
+			rule := netlink.NewRule()
+			rule.IifName = veth.Name
+			if err := netlink.RuleDel(rule); err != nil {
+				return err
+			}
+			if err := releaseENITables(alloc.Start, ""); err != nil {
+				return err
+			}
+			routes := tableRoutes()
+			if last := i == len(ifaces)-2; last && len(routes) != 0 {
+				t.Errorf("Table %d was kept after the last Pod: %v", table, routes)
+			} else if !last && len(routes) != 2 {
+				t.Errorf("Table %d was released while in use: %v", table, routes)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to share a table per ENI: %v", err)
+	}
+}
+
+func TestENITables(t *testing.T) {
+	_, vpc, _ := net.ParseCIDR("10.0.0.0/16")
+	_, gw1, _ := net.ParseCIDR("10.0.1.1/32")
+	_, gw2, _ := net.ParseCIDR("10.0.2.1/32")
+	routes := []netlink.Route{
+		{Table: 300, LinkIndex: 3, Dst: gw1, Scope: netlink.SCOPE_LINK},
+		{Table: 300, LinkIndex: 3, Dst: vpc, Gw: gw1.IP},
+		{Table: 301, LinkIndex: 4, Dst: gw2, Scope: netlink.SCOPE_LINK},
+		// a per-Pod table and a table below tableStart are not shared
+		{Table: 302, LinkIndex: 5, Dst: vpc, Gw: net.ParseIP("10.0.1.5")},
+		{Table: 100, LinkIndex: 3, Dst: gw1, Scope: netlink.SCOPE_LINK},
+	}
+
+	tables := eniTables(routes, 256)
+	if len(tables) != 2 || tables[300].LinkIndex != 3 || !tables[301].Gateway.Equal(gw2.IP) {
+		t.Errorf("Unexpected shared tables %v", tables)
+	}
+	if table := findENITable(routes, ENITable{LinkIndex: 3, Gateway: gw1.IP}, 256); table != 300 {
+		t.Errorf("Expected table 300 for the first ENI, got %d", table)
+	}
+	if table := findENITable(routes, ENITable{LinkIndex: 4, Gateway: gw1.IP}, 256); table != -1 {
+		t.Errorf("Expected no table for another gateway, got %d", table)
+	}
+
+	rules := []netlink.Rule{{Table: 300}, {Table: 300}, {Table: 302}}
+	if unreferenced := unreferencedTables(tables, rules); len(unreferenced) != 1 || unreferenced[0] != 301 {
+		t.Errorf("Expected table 301 to be unreferenced, got %v", unreferenced)
+	}
+}
+
+func TestENIGateway(t *testing.T) {
+	ips := []*current.IPConfig{
+		{Version: "6", Address: net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(64, 128)}},
+		{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.1.5"), Mask: net.CIDRMask(24, 32)}},
+	}
+	if gw := eniGateway(ips); !gw.Equal(net.ParseIP("10.0.1.1")) {
+		t.Errorf("Expected the VPC router of the subnet, got %v", gw)
+	}
+	ips[1].Gateway = net.ParseIP("10.0.1.254")
+	if gw := eniGateway(ips); !gw.Equal(ips[1].Gateway) {
+		t.Errorf("Expected the gateway of the result, got %v", gw)
+	}
+	host := []*current.IPConfig{{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.1.5"), Mask: net.CIDRMask(32, 32)}}}
+	if gw := eniGateway(host); gw != nil {
+		t.Errorf("Expected no gateway for a host address, got %v", gw)
+	}
+}
+
+func TestTableSlot(t *testing.T) {
+	podIP := net.ParseIP("10.0.0.5")
+	alloc := TableAlloc{Start: 256, Range: 100, Mode: tableAllocHash}
+	first := alloc.slot(podIP, 0)
+	if first < 256 || first >= 356 {
+		t.Fatalf("Slot %d is outside of the table range", first)
+	}
+	if again := alloc.slot(podIP, 0); again != first {
+		t.Errorf("Hashed slot is not deterministic: %d != %d", again, first)
+	}
+
+	// collisions probe the next slot, wrapping around the range
+	for attempt := 1; attempt < 200; attempt++ {
+		slot := alloc.slot(podIP, attempt)
+		if expected := 256 + (first-256+attempt)%100; slot != expected {
+			t.Errorf("Attempt %d got slot %d, expected %d", attempt, slot, expected)
+		}
+	}
+
+	alloc = TableAlloc{Start: 256, Range: 10, Mode: tableAllocRandom, Rand: rand.New(rand.NewSource(1))}
+	for i := 0; i < 100; i++ {
+		if slot := alloc.slot(podIP, i); slot < 256 || slot >= 266 {
+			t.Errorf("Random slot %d is outside of the table range", slot)
+		}
+	}
+}
+
+func TestTableAllocSeed(t *testing.T) {
+	podIP := net.ParseIP("10.0.0.5")
+	seeded := func() TableAlloc {
+		alloc := testTableAlloc(0)
+		alloc.Rand = rand.New(rand.NewSource(42))
+		return alloc
+	}
+	a, b := seeded(), seeded()
+	for attempt := 0; attempt < 20; attempt++ {
+		if slotA, slotB := a.slot(podIP, attempt), b.slot(podIP, attempt); slotA != slotB {
+			t.Errorf("Attempt %d got slots %d and %d with the same seed", attempt, slotA, slotB)
+		}
+		if waitA, waitB := a.backoff(attempt), b.backoff(attempt); waitA != waitB {
+			t.Errorf("Attempt %d got waits %v and %v with the same seed", attempt, waitA, waitB)
+		}
+	}
+}
+
+func TestOpenLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lyft-ptp-log")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ptp.log")
+	conf := &PluginConf{netconf.PtpConf{ContainerInterface: "veth0", LogFile: path}}
+	openLogger(conf, &skel.CmdArgs{ContainerID: "lyft-test", IfName: "eth0"}, "ADD")
+	logRule("rule add", &netlink.Rule{IifName: "veth0", Table: 256, Priority: podRulePriority}, nil)
+	logPhase("setupHostVeth", time.Now())
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Failed to close log: %v", err)
+	}
+	logger = nil
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 log lines, got %q", data)
+	}
+	if !strings.Contains(lines[0], `"containerID":"lyft-test"`) || !strings.Contains(lines[1], `"table":256`) ||
+		!strings.Contains(lines[2], `"phase":"setupHostVeth"`) {
+		t.Errorf("Unexpected log lines %q", lines)
+	}
+}
+
+func TestOpenLoggerTrace(t *testing.T) {
+	stderr, err := ioutil.TempFile("", "lyft-ptp-stderr")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+	defer func(orig *os.File) { os.Stderr = orig }(os.Stderr)
+	defer func(orig bool) { traceStderr = orig }(traceStderr)
+
+	conf := &PluginConf{netconf.PtpConf{ContainerInterface: "veth0"}}
+	os.Stderr = stderr
+	openLogger(conf, &skel.CmdArgs{ContainerID: "lyft-test", IfName: "eth0"}, "ADD")
+	if logger != nil {
+		t.Errorf("Logger enabled without logFile or tracing")
+	}
+
+	traceStderr = true
+	openLogger(conf, &skel.CmdArgs{ContainerID: "lyft-test", IfName: "eth0"}, "ADD")
+	logRule("rule add", &netlink.Rule{IifName: "veth0", Table: 256, Priority: podRulePriority}, nil)
+	logger = nil
+
+	data, err := ioutil.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatalf("Failed to read stderr: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"containerID":"lyft-test"`) || !strings.Contains(lines[1], `"table":256`) {
+		t.Errorf("Unexpected trace %q", data)
+	}
+}
+
+func TestMSSClampRulespecMTU(t *testing.T) {
+	v4 := &net.IPNet{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(32, 32)}
+	v6 := &net.IPNet{IP: net.ParseIP("2001:db8::10"), Mask: net.CIDRMask(128, 128)}
+
+	if mss := mssForMTU(v4.IP, 9001); mss != 8961 {
+		t.Errorf("Expected IPv4 MSS 8961, got %d", mss)
+	}
+	if mss := mssForMTU(v6.IP, 9001); mss != 8941 {
+		t.Errorf("Expected IPv6 MSS 8941, got %d", mss)
+	}
+	if mss := mssForMTU(v4.IP, 0); mss != 0 {
+		t.Errorf("Unknown MTU should clamp to the path MTU, got %d", mss)
+	}
+
+	rulespec := strings.Join(mssClampRulespec(v4, "eth0", 8961, "lyft-test"), " ")
+	if !strings.Contains(rulespec, "-j TCPMSS --set-mss 8961 -m comment") {
+		t.Errorf("Unexpected rulespec %q", rulespec)
+	}
+	rulespec = strings.Join(mssClampRulespec(v4, "eth0", 0, "lyft-test"), " ")
+	if !strings.Contains(rulespec, "-j TCPMSS --clamp-mss-to-pmtu -m comment") {
+		t.Errorf("Unexpected rulespec %q", rulespec)
+	}
+}
+
+func TestCmdDelPartialAdd(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	result := &current.Result{
+		IPs: []*current.IPConfig{{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}}},
+	}
+	_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+	result.Routes = []*types.Route{{Dst: *dst}}
+	hostAddrs := []netlink.Addr{{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(32, 32)}}}
+
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		Netns:       contNS.Path(),
+		IfName:      "eth0",
+		StdinData:   []byte(`{"cniVersion": "0.3.1", "name": "test", "hostInterface": "lyft-host", "containerInterface": "veth0", "clampMSS": true}`),
+	}
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		// an ADD that programmed the Pod table and then failed, before
+		// the Pod interface got its addresses
+		hostVeth, _, err := setupContainerVeth(contNS, "veth0", 1500, 0, false, hostAddrs, nil, false, true, false, "eth0", hostVethName(nl.DefaultHostVethPrefix, args.ContainerID, "eth0"), Announce{}, nil, &current.Result{})
+		if err != nil {
+			t.Fatalf("Failed to set up veth: %v", err)
+		}
+		if _, err := setupHostVeth(hostVeth.Name, hostAddrs, false, testTableAlloc(0), 0, nil, podRulePriority, Announce{}, result); err != nil {
+			t.Fatalf("Failed to set up host veth: %v", err)
+		}
+		// and the rule of another Pod, which DEL leaves to gc
+		stale := netlink.NewRule()
+		stale.IifName = "lyft-gone"
+		stale.Table = 300
+		stale.Priority = podRulePriority
+		if err := netlink.RuleAdd(stale); err != nil {
+			t.Fatalf("Failed to add stale rule: %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := cmdDel(args); err != nil {
+				t.Errorf("DEL %d of a partial ADD failed: %v", i, err)
+			}
+		}
+
+		if _, err := netlink.LinkByName(hostVeth.Name); err == nil {
+			t.Errorf("Host veth %v was not removed", hostVeth.Name)
+		}
+		rules, _ := netlink.RuleList(netlink.FAMILY_V4)
+		for _, rule := range rules {
+			if rule.Priority == podRulePriority && rule.IifName != stale.IifName {
+				t.Errorf("Policy rule %v was leaked", rule)
+			}
+		}
+		if !hasRule(rules, stale.IifName) {
+			t.Errorf("Policy rule of another Pod was removed")
+		}
+		return nil
+	})
+}
+
+func TestCmdDelHostVethName(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+
+	result := &current.Result{
+		IPs: []*current.IPConfig{{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(32, 32)}}},
+	}
+	_, dst, _ := net.ParseCIDR("10.1.0.0/16")
+	result.Routes = []*types.Route{{Dst: *dst}}
+	hostAddrs := []netlink.Addr{{IPNet: &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(32, 32)}}}
+
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		Netns:       contNS.Path(),
+		IfName:      "eth0",
+		StdinData:   []byte(`{"cniVersion": "0.3.1", "name": "test", "hostInterface": "lyft-host", "containerInterface": "veth0"}`),
+	}
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		name := hostVethName(nl.DefaultHostVethPrefix, args.ContainerID, args.IfName)
+		if _, _, err := setupContainerVeth(contNS, "veth0", 1500, 0, false, hostAddrs, nil, false, true, false, "eth0", name, Announce{}, nil, &current.Result{}); err != nil {
+			t.Fatalf("Failed to set up veth: %v", err)
+		}
+		if _, err := setupHostVeth(name, hostAddrs, false, testTableAlloc(0), 0, nil, podRulePriority, Announce{}, result); err != nil {
+			t.Fatalf("Failed to set up host veth: %v", err)
+		}
+		// DEL can't resolve the host veth from a container side it
+		// doesn't find
+		if err := contNS.Do(func(_ ns.NetNS) error {
+			return renameLink("veth0", "moved0")
+		}); err != nil {
+			t.Fatalf("Failed to rename the container veth: %v", err)
+		}
+
+		if err := cmdDel(args); err != nil {
+			t.Errorf("DEL failed: %v", err)
+		}
+		if _, err := netlink.LinkByName(name); err == nil {
+			t.Errorf("Host veth %v was not removed", name)
+		}
+		rules, _ := netlink.RuleList(netlink.FAMILY_V4)
+		if hasRule(rules, name) {
+			t.Errorf("Policy rule of %v was leaked", name)
+		}
+		return nil
+	})
+}
+
+// hasRule reports whether a rule matches the veth iifName
+func hasRule(rules []netlink.Rule, iifName string) bool {
+	for _, rule := range rules {
+		if rule.IifName == iifName {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHostVethName(t *testing.T) {
+	name := hostVethName("lyft", "lyft-test", "eth0")
+	if len(name) != 15 || !strings.HasPrefix(name, "lyft") {
+		t.Errorf("Unexpected host veth name %q", name)
+	}
+	if name != hostVethName("lyft", "lyft-test", "eth0") {
+		t.Errorf("Host veth name is not stable")
+	}
+	if name == hostVethName("lyft", "lyft-test", "net1") || name == hostVethName("lyft", "lyft-other", "eth0") {
+		t.Errorf("Host veth names of distinct Pod interfaces collide")
+	}
+}
+
+func TestPodTableRoutes(t *testing.T) {
+	podIP := net.ParseIP("10.0.0.5")
+	routes := []netlink.Route{
+		{Table: 256, LinkIndex: 7, Gw: podIP},
+		{Table: 257, LinkIndex: 9, Gw: podIP},
+		{Table: 258, LinkIndex: 7},
+		{Table: 259, LinkIndex: 9, Gw: net.ParseIP("10.0.0.6")},
+		{Table: 254, LinkIndex: 7, Gw: podIP},
+	}
+
+	owned := podTableRoutes(routes, 7, []net.IP{podIP}, 256)
+	if len(owned) != 3 || owned[0].Table != 256 || owned[1].Table != 257 || owned[2].Table != 258 {
+		t.Errorf("Unexpected Pod routes %v", owned)
+	}
+
+	// the veth is gone, only the Pod IP identifies the table
+	owned = podTableRoutes(routes, -1, []net.IP{podIP}, 256)
+	if len(owned) != 2 {
+		t.Errorf("Unexpected Pod routes without a veth %v", owned)
+	}
+
+	// only tagged routes belong to Pods when a routeProtocol is set
+	routeProtocol = 99
+	defer func() { routeProtocol = 0 }()
+	routes[1].Protocol = 99
+	owned = podTableRoutes(routes, 7, []net.IP{podIP}, 256)
+	if len(owned) != 1 || owned[0].Table != 257 {
+		t.Errorf("Unexpected tagged Pod routes %v", owned)
+	}
+	for _, bad := range []string{`"routeProtocol": 4`, `"routeProtocol": 256`} {
+		if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", ` + bad + `}`)); err == nil {
+			t.Errorf("Config with %s was accepted", bad)
+		}
+	}
+}
+
+func TestTableAllocBackoff(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "routeTableAllocMaxSleepMs": 50}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	alloc := conf.tableAlloc()
+	if alloc.Retries != tableAllocRetries || alloc.BaseSleepMs != baseSleep || alloc.MaxSleepMs != 50 {
+		t.Errorf("Unexpected backoff options %+v", alloc)
+	}
+	for attempt := 0; attempt < 10; attempt++ {
+		if wait := alloc.backoff(attempt); wait < 0 || wait >= 50*time.Millisecond {
+			t.Errorf("Wait %v of attempt %d exceeds the maximum sleep", wait, attempt)
+		}
+	}
+
+	alloc.BaseSleepMs = 0
+	if wait := alloc.backoff(3); wait != 0 {
+		t.Errorf("Expected no wait without a base sleep, got %v", wait)
+	}
+
+	for _, bad := range []string{`"routeTableAllocRetries": 0`, `"routeTableAllocBaseSleepMs": -1`} {
+		if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", ` + bad + `}`)); err == nil {
+			t.Errorf("Config with %s was accepted", bad)
+		}
+	}
+}
+
+func TestParseConfigNodePorts(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if conf.NodePorts != nl.DefaultNodePorts {
+		t.Errorf("Expected the default nodePorts, got %q", conf.NodePorts)
+	}
+
+	for _, bad := range []string{`"nodePorts": "30000-32767"`, `"nodePorts": "32767:30000"`, `"nodePorts": "0:100"`} {
+		if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", ` + bad + `}`)); err == nil {
+			t.Errorf("Config with %s was accepted", bad)
+		}
+	}
+}
+
+func TestRuntimeMTU(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "mtu": 9001, "runtimeConfig": {"mtu": 1420}}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if mtu, err := runtimeMTU(conf, "IgnoreUnknown=1;MTU=1380"); err != nil || mtu != 1420 {
+		t.Errorf("Runtime config should take precedence, got %d %v", mtu, err)
+	}
+
+	conf.RuntimeConfig.MTU = 0
+	if mtu, err := runtimeMTU(conf, "IgnoreUnknown=1;K8S_POD_NAME=web;MTU=1380"); err != nil || mtu != 1380 {
+		t.Errorf("Expected the MTU CNI_ARG, got %d %v", mtu, err)
+	}
+	if mtu, err := runtimeMTU(conf, "K8S_POD_NAME=web"); err != nil || mtu != 0 {
+		t.Errorf("Expected no override, got %d %v", mtu, err)
+	}
+	if _, err := runtimeMTU(conf, "MTU=jumbo"); err == nil {
+		t.Errorf("Invalid MTU CNI_ARG was accepted")
+	}
+}
+
+func TestPlanAdd(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "0.3.1", "name": "test", "hostInterface": "eth0", "containerInterface": "veth0",
+		"ipMasq": true, "clampMSS": true, "dryRun": true,
+		"prevResult": {"cniVersion": "0.3.1", "ips": [{"version": "4", "address": "10.0.1.20/24"}],
+			"routes": [{"dst": "0.0.0.0/0"}]}}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	hostAddr, _ := netlink.ParseAddr("10.0.0.10/24")
+	args := &skel.CmdArgs{ContainerID: "abc", Netns: "/var/run/netns/test", IfName: "eth0"}
+
+	ops := planAdd(conf, args, "eth0", []netlink.Addr{*hostAddr}, []net.IP{net.ParseIP("10.0.1.20")}, 1500, 300)
+	expected := []string{
+		`create veth "veth0" with mtu 1500`,
+		"add route 10.0.0.10/32 dev veth0 scope link in the container",
+		"add default route via 10.0.0.10 dev veth0",
+		"add route 10.0.1.20/32 dev <host veth> scope link",
+		"add route 0.0.0.0/0 via 10.0.1.20 dev <host veth> metric 0 table 300",
+		fmt.Sprintf("ip -4 rule add iif <host veth> lookup 300 priority %d", podRulePriority),
+		"add IP masquerade chain",
+		"iptables -t mangle -A FORWARD -s 10.0.1.20/32 -o eth0",
+	}
+	plan := strings.Join(ops, "\n")
+	for _, op := range expected {
+		if !strings.Contains(plan, op) {
+			t.Errorf("Plan is missing %q:\n%s", op, plan)
+		}
+	}
+}
+
+func TestPlanAddSharedTablePerENI(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "0.3.1", "name": "test", "hostInterface": "eth1", "containerInterface": "veth0",
+		"sharedTablePerENI": true, "dryRun": true,
+		"prevResult": {"cniVersion": "0.3.1", "ips": [{"version": "4", "address": "10.0.1.20/24", "gateway": "10.0.1.1"}],
+			"routes": [{"dst": "10.0.0.0/16"}]}}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	hostAddr, _ := netlink.ParseAddr("10.0.0.10/24")
+	args := &skel.CmdArgs{ContainerID: "abc", Netns: "/var/run/netns/test", IfName: "eth0"}
+
+	plan := strings.Join(planAdd(conf, args, "eth1", []netlink.Addr{*hostAddr}, []net.IP{net.ParseIP("10.0.1.20")}, 1500, 300), "\n")
+	expected := []string{
+		"add route 10.0.1.1/32 dev eth1 scope link table 300",
+		"add route 10.0.0.0/16 via 10.0.1.1 dev eth1 metric 0 table 300",
+		fmt.Sprintf("ip -4 rule add from 10.0.1.20/32 iif <host veth> lookup 300 priority %d", podRulePriority),
+	}
+	for _, op := range expected {
+		if !strings.Contains(plan, op) {
+			t.Errorf("Plan is missing %q:\n%s", op, plan)
+		}
+	}
+	if strings.Contains(plan, "via 10.0.1.20") {
+		t.Errorf("Plan routes through the Pod IP:\n%s", plan)
+	}
+}
+
+func TestWarnTableUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { metrics = nil }()
+	path := filepath.Join(dir, "cni.prom")
+	metrics = lib.NewMetrics(path)
+
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "routeTableWarnThreshold": 2}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	alloc := conf.tableAlloc()
+	// tables outside of the allocation window are not counted
+	allocated := map[int]bool{254: true, 256: true, 257: true}
+	if inUse := tablesInUse(allocated, alloc); inUse != 2 {
+		t.Errorf("Expected 2 tables in use, got %d", inUse)
+	}
+	warnTableUsage(tablesInUse(allocated, alloc), alloc)
+	allocated[258] = true
+	warnTableUsage(tablesInUse(allocated, alloc), alloc)
+	if err := metrics.Flush(); err != nil {
+		t.Fatalf("Failed to flush metrics: %v", err)
+	}
+	content, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(content), "cni_ptp_route_table_threshold_warnings_total 1") {
+		t.Errorf("Expected a single threshold warning, got %q", content)
+	}
+
+	if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "routeTableWarnThreshold": -1}`)); err == nil {
+		t.Errorf("Negative routeTableWarnThreshold was accepted")
+	}
+}
+
+func TestFreeTable(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0",
+		"routeTableStart": 250, "routeTableEnd": 262, "reservedRouteTables": [256, 257]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	alloc := conf.tableAlloc()
+	if alloc.Range != 12 {
+		t.Errorf("Expected the table range to be clamped to the window, got %d", alloc.Range)
+	}
+
+	allocated := map[int]bool{250: true, 251: true, 252: true, 258: true}
+	cases := []struct {
+		Start    int
+		Expected int
+	}{
+		{Start: 250, Expected: 259},
+		{Start: 252, Expected: 259},
+		{Start: 261, Expected: 261},
+	}
+	// 253-255 are reserved by the kernel and 256-257 by the config
+	for _, c := range cases {
+		if table, err := freeTable(allocated, c.Start, alloc); err != nil || table != c.Expected {
+			t.Errorf("From %d expected table %d, got %d %v", c.Start, c.Expected, table, err)
+		}
+	}
+
+	allocated[259], allocated[260], allocated[261] = true, true, true
+	if table, err := freeTable(allocated, 261, alloc); err == nil {
+		t.Errorf("Expected the table space to be exhausted, got %d", table)
+	} else if !strings.Contains(err.Error(), "exhausted: 7 tables allocated in [250, 262)") {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	allocated[261] = false
+	if table, err := freeTable(allocated, 259, alloc); err != nil || table != 261 {
+		t.Errorf("Expected table 261, got %d %v", table, err)
+	}
+	allocated[261], allocated[250] = true, false
+	if table, err := freeTable(allocated, 259, alloc); err != nil || table != 250 {
+		t.Errorf("Expected the search to wrap around to 250, got %d %v", table, err)
+	}
+
+	if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "routeTableEnd": 256}`)); err == nil {
+		t.Errorf("routeTableEnd at routeTableStart was accepted")
+	}
+}
+
+func TestMasquerade(t *testing.T) {
+	v4, v6 := net.ParseIP("10.0.1.20"), net.ParseIP("2600:1f14::20")
+	cases := []struct {
+		Conf       PluginConf
+		V4Expected bool
+		V6Expected bool
+	}{
+		{Conf: PluginConf{}},
+		{Conf: PluginConf{netconf.PtpConf{IPMasq: true}}, V4Expected: true, V6Expected: true},
+		{Conf: PluginConf{netconf.PtpConf{IPMasq: true, DisableIPMasqV6: true}}, V4Expected: true},
+		{Conf: PluginConf{netconf.PtpConf{DisableIPMasqV6: true}}},
+	}
+	for _, c := range cases {
+		if c.Conf.masquerade(v4) != c.V4Expected || c.Conf.masquerade(v6) != c.V6Expected {
+			t.Errorf("ipMasq %v disableIPMasqV6 %v expected v4 %v v6 %v",
+				c.Conf.IPMasq, c.Conf.DisableIPMasqV6, c.V4Expected, c.V6Expected)
+		}
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if announce := conf.announce(); announce.Count != 1 || announce.IntervalMs != 0 {
+		t.Errorf("Unexpected default announce options %+v", announce)
+	}
+
+	conf, err = parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "gratuitousArpCount": 3, "gratuitousArpIntervalMs": 200}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if announce := conf.announce(); announce.Count != 3 || announce.IntervalMs != 200 {
+		t.Errorf("Unexpected announce options %+v", announce)
+	}
+
+	for _, bad := range []string{`"gratuitousArpCount": -1`, `"gratuitousArpIntervalMs": -1`} {
+		if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", ` + bad + `}`)); err == nil {
+			t.Errorf("Config with %s was accepted", bad)
+		}
+	}
+}
+
+func TestOnLinkGateway(t *testing.T) {
+	routes := []netlink.Route{
+		{Dst: &net.IPNet{IP: net.ParseIP("10.0.1.10"), Mask: net.CIDRMask(32, 32)}, Scope: netlink.SCOPE_LINK},
+		{Dst: &net.IPNet{IP: net.ParseIP("10.0.2.0"), Mask: net.CIDRMask(24, 32)}, Scope: netlink.SCOPE_UNIVERSE},
+		{Scope: netlink.SCOPE_UNIVERSE, Gw: net.ParseIP("10.0.1.10")},
+	}
+	if !onLinkGateway(net.ParseIP("10.0.1.10"), routes) {
+		t.Errorf("Gateway of an on-link route was rejected")
+	}
+	if onLinkGateway(net.ParseIP("10.0.2.1"), routes) {
+		t.Errorf("Gateway of a routed subnet was accepted")
+	}
+
+	if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0",
+		"additionalContainerRoutes": [{"dst": "169.254.170.2/32", "gw": "2600:1f14::1"}]}`)); err == nil {
+		t.Errorf("Additional route with a gateway of another family was accepted")
+	}
+}
+
+func TestResultContainerIPs(t *testing.T) {
+	pr := &current.Result{
+		Interfaces: []*current.Interface{{Name: "eth0"}, {Name: "eth1"}},
+		IPs: []*current.IPConfig{
+			{Interface: current.Int(0), Address: net.IPNet{IP: net.ParseIP("10.0.1.20"), Mask: net.CIDRMask(24, 32)}},
+			{Interface: current.Int(1), Address: net.IPNet{IP: net.ParseIP("10.0.2.20"), Mask: net.CIDRMask(24, 32)}},
+			{Interface: current.Int(0), Address: net.IPNet{IP: net.ParseIP("2600:1f14::20"), Mask: net.CIDRMask(64, 128)}},
+		},
+	}
+	for _, cniVersion := range []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"} {
+		conf := &PluginConf{netconf.PtpConf{PrevResult: pr}}
+		conf.CNIVersion = cniVersion
+		ips := resultContainerIPs(conf, "eth0")
+		if len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.1.20")) || !ips[1].Equal(net.ParseIP("2600:1f14::20")) {
+			t.Errorf("Unexpected container IPs %v of a %s result", ips, cniVersion)
+		}
+	}
+
+	conf := &PluginConf{netconf.PtpConf{PrevResult: pr}}
+	conf.CNIVersion = "0.2.0"
+	if ips := resultContainerIPs(conf, "eth0"); len(ips) != 3 {
+		t.Errorf("Unexpected container IPs %v of a 0.2.0 result", ips)
+	}
+}
+
+func TestParseConfigResult100(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"cniVersion": "1.0.0",
+		"name": "test",
+		"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+		"hostInterface": "eth0",
+		"containerInterface": "veth0",
+		"prevResult": {
+			"cniVersion": "1.0.0",
+			"interfaces": [{"name": "eth0", "sandbox": "/var/run/netns/pod"}, {"name": "eth1", "sandbox": "/var/run/netns/pod"}],
+			"ips": [
+				{"interface": 0, "address": "10.0.1.20/24"},
+				{"interface": 1, "address": "10.0.2.20/24"},
+				{"interface": 0, "address": "2600:1f14::20/64"}
+			]
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse a 1.0.0 config: %v", err)
+	}
+	ips := resultContainerIPs(conf, "eth0")
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.1.20")) || !ips[1].Equal(net.ParseIP("2600:1f14::20")) {
+		t.Errorf("Unexpected container IPs %v of a 1.0.0 result", ips)
+	}
+	if v := conf.PrevResult.IPs[2].Version; v != "6" {
+		t.Errorf("Unexpected version %q of an IPv6 address", v)
+	}
+}
+
+func TestPodRuleExists(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		rule := netlink.NewRule()
+		rule.Family = netlink.FAMILY_V4
+		rule.IifName = "lyft-veth"
+		rule.Table = 300
+		rule.Priority = podRulePriority
+
+		if exists, err := podRuleExists(pkgHandle, rule); err != nil || exists {
+			t.Errorf("Missing rule reported as existing: %v", err)
+		}
+		if err := netlink.RuleAdd(rule); err != nil {
+			return err
+		}
+		if exists, err := podRuleExists(pkgHandle, rule); err != nil || !exists {
+			t.Errorf("Existing rule not detected: %v", err)
+		}
+
+		other := *rule
+		other.Table = 301
+		if exists, err := podRuleExists(pkgHandle, &other); err != nil || exists {
+			t.Errorf("Rule to another table reported as existing: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to check policy rules: %v", err)
+	}
+}
+
+func TestCmdAddWithoutPrevResult(t *testing.T) {
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		IfName:      "eth0",
+		StdinData: []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "test",
+			"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+			"hostInterface": "lyft-host",
+			"containerInterface": "veth0"
+		}`),
+	}
+	if err := cmdAdd(args); err == nil || !strings.Contains(err.Error(), "must be called as chained plugin") {
+		t.Errorf("Unexpected error without prevResult and ipam: %v", err)
+	}
+
+	// the IPAM plugin is run instead of failing the call
+	args.StdinData = []byte(`{
+		"cniVersion": "0.3.1",
+		"name": "test",
+		"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+		"hostInterface": "lyft-host",
+		"containerInterface": "veth0",
+		"ipam": {"type": "lyft-missing-ipam"}
+	}`)
+	if err := cmdAdd(args); err == nil || strings.Contains(err.Error(), "must be called as chained plugin") {
+		t.Errorf("Unexpected error of a missing IPAM plugin: %v", err)
+	}
+}
+
+// fakeIPAM installs an IPAM plugin named lyft-ipam in a temporary
+// CNI_PATH, which logs its commands to the returned file and hands out
+// 10.0.0.5
+func fakeIPAM(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	log := filepath.Join(dir, "commands")
+	script := fmt.Sprintf(`#!/bin/sh
+cat >/dev/null
+echo $CNI_COMMAND >>%s
+if [ "$CNI_COMMAND" = ADD ]; then
+	echo '{"cniVersion": "0.3.1", "ips": [{"version": "4", "address": "10.0.0.5/24", "gateway": "10.0.0.1"}], "routes": [{"dst": "10.0.0.0/16"}]}'
+fi
+`, log)
+	if err := ioutil.WriteFile(filepath.Join(dir, "lyft-ipam"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write IPAM plugin: %v", err)
+	}
+	for k, v := range map[string]string{"CNI_PATH": dir, "CNI_COMMAND": "ADD", "CNI_CONTAINERID": "lyft-test", "CNI_IFNAME": "eth0", "CNI_NETNS": "/dev/null"} {
+		os.Setenv(k, v)
+	}
+	return log, func() {
+		for _, k := range []string{"CNI_PATH", "CNI_COMMAND", "CNI_CONTAINERID", "CNI_IFNAME", "CNI_NETNS"} {
+			os.Unsetenv(k)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCmdAddUnchained(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	hostNS := createTestNS(t)
+	defer hostNS.Close()
+	contNS := createTestNS(t)
+	defer contNS.Close()
+	log, cleanup := fakeIPAM(t)
+	defer cleanup()
+
+	err := hostNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "lyft-host"}, PeerName: "lyft-peer"}); err != nil {
+			return err
+		}
+		link, err := netlink.LinkByName("lyft-host")
+		if err != nil {
+			return err
+		}
+		addr, _ := netlink.ParseAddr("192.168.1.1/24")
+		if err := netlink.AddrAdd(link, addr); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	})
+	if err != nil {
+		t.Fatalf("Failed to create host interface: %v", err)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: "lyft-test",
+		Netns:       contNS.Path(),
+		IfName:      "eth0",
+		StdinData: []byte(`{
+			"cniVersion": "0.3.1",
+			"name": "test",
+			"type": "cni-ipvlan-vpc-k8s-unnumbered-ptp",
+			"hostInterface": "lyft-missing",
+			"containerInterface": "veth0",
+			"ipam": {"type": "lyft-ipam"}
+		}`),
+	}
+
+	_ = hostNS.Do(func(_ ns.NetNS) error {
+		// a failed ADD releases the IPs of the IPAM plugin
+		if err := cmdAdd(args); err == nil {
+			t.Fatalf("ADD without a host interface succeeded")
+		}
+		if data, _ := ioutil.ReadFile(log); string(data) != "ADD\nDEL\n" {
+			t.Errorf("Expected the IPAM plugin to be run for ADD and DEL, got %q", data)
+		}
+
+		args.StdinData = []byte(strings.Replace(string(args.StdinData), "lyft-missing", "lyft-host", 1))
+		if err := cmdAdd(args); err != nil {
+			t.Fatalf("Failed to add: %v", err)
+		}
+		return contNS.Do(func(_ ns.NetNS) error {
+			// the veth is the Pod interface and carries the Pod IP
+			link, err := netlink.LinkByName("eth0")
+			if err != nil {
+				t.Fatalf("Pod interface is missing: %v", err)
+			}
+			if link.Type() != "veth" {
+				t.Errorf("Pod interface is a %s, not the veth", link.Type())
+			}
+			addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4)
+			if len(addrs) != 1 || addrs[0].IPNet.String() != "10.0.0.5/32" {
+				t.Errorf("Unexpected Pod addresses %v", addrs)
+			}
+			routes, _ := netlink.RouteList(link, netlink.FAMILY_V4)
+			var gw net.IP
+			for _, route := range routes {
+				if route.Dst == nil {
+					gw = route.Gw
+				}
+			}
+			if !gw.Equal(net.ParseIP("192.168.1.1")) {
+				t.Errorf("Expected the default route via the host, got %v", routes)
+			}
+			return nil
+		})
+	})
+}
+
+func TestHostInterfaces(t *testing.T) {
+	conf, err := parseConfig([]byte(`{"hostInterfaces": ["eth0", "eth1"], "containerInterface": "veth0"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if conf.HostInterface != "eth0" {
+		t.Errorf("Expected the first hostInterfaces entry as hostInterface, got %q", conf.HostInterface)
+	}
+	if ifNames := conf.nodePortInterfaces("eth1"); len(ifNames) != 2 {
+		t.Errorf("Unexpected NodePort interfaces %v", ifNames)
+	}
+	if ifNames := conf.nodePortInterfaces("eth2"); len(ifNames) != 3 || ifNames[0] != "eth2" {
+		t.Errorf("Unexpected NodePort interfaces %v", ifNames)
+	}
+
+	conf.HostInterfaces = nil
+	if ifNames := conf.nodePortInterfaces("eth0"); len(ifNames) != 1 || ifNames[0] != "eth0" {
+		t.Errorf("Unexpected NodePort interfaces without hostInterfaces %v", ifNames)
+	}
+}
+
+func TestHostVethPeer(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root or network capabilities - skipped")
+		return
+	}
+
+	testNS := createTestNS(t)
+	defer testNS.Close()
+
+	err := testNS.Do(func(_ ns.NetNS) error {
+		if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "lyft-host"}, PeerName: "lyft-cont"}); err != nil {
+			return err
+		}
+		if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "lyft-other"}}); err != nil {
+			return err
+		}
+		index := func(name string) int {
+			link, err := netlink.LinkByName(name)
+			if err != nil {
+				t.Fatalf("Failed to lookup %q: %v", name, err)
+			}
+			return link.Attrs().Index
+		}
+
+		if link := hostVethPeer(index("lyft-host"), index("lyft-cont")); link == nil || link.Attrs().Name != "lyft-host" {
+			t.Errorf("Expected the host veth, got %v", link)
+		}
+		if link := hostVethPeer(index("lyft-other"), index("lyft-cont")); link != nil {
+			t.Errorf("Non-veth link %q was accepted", link.Attrs().Name)
+		}
+		if link := hostVethPeer(index("lyft-host"), index("lyft-other")); link != nil {
+			t.Errorf("Veth with another peer was accepted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve the host veth: %v", err)
+	}
+}
+
+func TestMergeDNS(t *testing.T) {
+	result := types.DNS{
+		Nameservers: []string{"10.0.0.2", "10.0.0.3"},
+		Domain:      "ec2.internal",
+		Search:      []string{"ec2.internal"},
+	}
+	mergeDNS(&result, types.DNS{
+		Nameservers: []string{"169.254.20.10", "10.0.0.3"},
+		Domain:      "cluster.local",
+		Search:      []string{"svc.cluster.local"},
+		Options:     []string{"ndots:5"},
+	})
+
+	expected := types.DNS{
+		Nameservers: []string{"169.254.20.10", "10.0.0.3", "10.0.0.2"},
+		Domain:      "cluster.local",
+		Search:      []string{"svc.cluster.local", "ec2.internal"},
+		Options:     []string{"ndots:5"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected merged DNS %+v", result)
+	}
+
+	// the result is kept without a dns block in the config
+	mergeDNS(&result, types.DNS{})
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("DNS changed without a dns block %+v", result)
+	}
+}
+
+func TestPodEgress(t *testing.T) {
+	conf, err := parseConfig([]byte(`{
+		"hostInterface": "eth0",
+		"containerInterface": "veth0",
+		"egressSteering": [{"namespace": "payments", "mark": 16, "table": 100}],
+		"egressPaths": [{"name": "compliance-nat", "mark": 32, "table": 200, "interface": "eth2"}]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	steering, path, err := podEgress(conf, "IgnoreUnknown=1;K8S_POD_NAMESPACE=payments;K8S_POD_NAME=web;EgressMark=32")
+	if err != nil || path == nil || path.Name != "compliance-nat" || steering.Table != 200 {
+		t.Errorf("Expected the egress path of the mark, got %+v %+v %v", steering, path, err)
+	}
+	steering, path, err = podEgress(conf, "IgnoreUnknown=1;K8S_POD_NAMESPACE=payments;K8S_POD_NAME=web")
+	if err != nil || path != nil || steering == nil || steering.Table != 100 {
+		t.Errorf("Expected the egressSteering entry without a mark, got %+v %+v %v", steering, path, err)
+	}
+	if _, _, err := podEgress(conf, "EgressMark=48"); err == nil {
+		t.Errorf("Unknown egressMark was accepted")
+	}
+
+	conf.RuntimeConfig.EgressMark = 32
+	if _, path, err := podEgress(conf, "EgressMark=48"); err != nil || path == nil {
+		t.Errorf("Runtime config should take precedence, got %+v %v", path, err)
+	}
+
+	for _, bad := range []string{
+		`[{"name": "nat", "mark": 32, "table": 200}]`,
+		`[{"name": "nat", "mark": 32, "table": 200, "interface": "eth2", "gateway": "nat"}]`,
+		`[{"name": "a", "mark": 32, "table": 200, "interface": "eth2"}, {"name": "b", "mark": 32, "table": 201, "interface": "eth3"}]`,
+	} {
+		if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "egressPaths": ` + bad + `}`)); err == nil {
+			t.Errorf("Invalid egressPaths %v were accepted", bad)
+		}
+	}
+
+	// the egress rules sort before the per-Pod rules
+	for _, priorities := range []string{`"podRulePriority": 700, "mainTableRulePriority": 600`, `"mainTableRulePriority": 768`} {
+		if _, err := parseConfig([]byte(`{"hostInterface": "eth0", "containerInterface": "veth0", "egressSteering": [{"mark": 16, "table": 100}], ` + priorities + `}`)); err == nil {
+			t.Errorf("Rule priorities %v clashing with the egress rules were accepted", priorities)
+		}
+	}
+}
+
+func TestCheckEgressPath(t *testing.T) {
+	podIPs := []net.IP{net.ParseIP("10.0.2.11")}
+	eniMAC := "02:00:00:00:00:02"
+	defer func(f func() ([]aws.Interface, error)) { getInterfaces = f }(getInterfaces)
+	getInterfaces = func() ([]aws.Interface, error) {
+		return []aws.Interface{{Mac: eniMAC, IPv4s: podIPs}}, nil
+	}
+
+	mac, _ := net.ParseMAC("02:00:00:00:00:03")
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth2", HardwareAddr: mac}}
+	path := &EgressPath{Name: "compliance-nat", Mark: 32, Table: 200, Interface: "eth2"}
+
+	if err := checkEgressPath(path, link, podIPs, mac.String()); err != nil {
+		t.Errorf("Path through the ENI of the Pod MAC was rejected: %v", err)
+	}
+	if err := checkEgressPath(path, link, podIPs, eniMAC); err == nil {
+		t.Errorf("Path through another ENI than the one of the Pod MAC was accepted")
+	}
+	// without the Pod interface the metadata service tells the ENI
+	if err := checkEgressPath(path, link, podIPs, ""); err == nil {
+		t.Errorf("Path through an ENI not owning the Pod IPs was accepted")
+	}
+	eniMAC = mac.String()
+	if err := checkEgressPath(path, link, podIPs, ""); err != nil {
+		t.Errorf("Path through the ENI owning the Pod IPs was rejected: %v", err)
+	}
+}
+
+func TestSubnetRouter(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.12.0/22")
+	if gw := subnetRouter(&net.IPNet{IP: net.ParseIP("10.0.13.7"), Mask: subnet.Mask}); !gw.Equal(net.ParseIP("10.0.12.1")) {
+		t.Errorf("Expected the VPC router 10.0.12.1, got %v", gw)
+	}
+}
+
+func TestEgressMarkInUse(t *testing.T) {
+	rules := []string{
+		"-P PREROUTING ACCEPT",
+		`-A PREROUTING -s 10.0.0.5/32 -m comment --comment "name: \"test\" id: \"lyft\"" -j MARK --set-xmark 0x20/0xffffffff`,
+	}
+	if !egressMarkInUse(rules, 32) {
+		t.Errorf("Mark 32 should be in use")
+	}
+	if egressMarkInUse(rules, 2) {
+		t.Errorf("Mark 2 should not be in use")
+	}
+}
+
+func TestCmdStatus(t *testing.T) {
+	defer func(old func(int) error) { checkIPCapacity = old }(checkIPCapacity)
+	checked := -1
+	checkIPCapacity = func(index int) error {
+		checked = index
+		return fmt.Errorf("no IP capacity available at interface index %d", index)
+	}
+
+	args := &skel.CmdArgs{StdinData: []byte(`{"cniVersion": "1.1.0", "hostInterface": "lo", "containerInterface": "veth0"}`)}
+	if err := cmdStatus(args); err != nil {
+		t.Errorf("Chained plugin was not available: %v", err)
+	}
+	if checked != -1 {
+		t.Errorf("Chained plugin checked the IP capacity of the IPAM plugin")
+	}
+
+	args.StdinData = []byte(`{"cniVersion": "1.1.0", "hostInterface": "missing0", "containerInterface": "veth0"}`)
+	if err := cmdStatus(args); err == nil {
+		t.Errorf("Missing host interface was reported available")
+	}
+
+	args.StdinData = []byte(`{"cniVersion": "1.1.0", "hostInterface": "lo", "containerInterface": "veth0",
+		"interfaceIndex": 2, "ipam": {"type": "cni-ipvlan-vpc-k8s-ipam"}}`)
+	if err := cmdStatus(args); err == nil {
+		t.Errorf("IP capacity failure was not reported")
+	}
+	if checked != 2 {
+		t.Errorf("Expected the IP capacity of interface index 2 to be checked, got %d", checked)
+	}
+}